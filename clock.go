@@ -0,0 +1,22 @@
+package scuttlebutt
+
+import (
+	"time"
+
+	"github.com/andydunstall/scuttlebutt/internal"
+)
+
+// Clock is used by the node to read the time and schedule gossip rounds, so
+// time can be controlled in tests and simulations.
+type Clock = internal.Clock
+
+// Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker = internal.Ticker
+
+// ManualClock is a Clock whose time only moves when Advance is called.
+type ManualClock = internal.ManualClock
+
+// NewManualClock returns a ManualClock starting at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return internal.NewManualClock(now)
+}
@@ -15,24 +15,24 @@ type Node struct {
 }
 
 func (n *Node) KnownPeers() int {
-	return len(n.Gossiper.Addrs())
+	return len(n.Gossiper.IDs())
 }
 
-func (n *Node) DiscoveredNode(nodeAddr string) bool {
-	if nodeAddr == n.Gossiper.BindAddr() {
+func (n *Node) DiscoveredNode(nodeID string) bool {
+	if nodeID == n.Gossiper.ID() {
 		return true
 	}
 
-	for _, addr := range n.Gossiper.Addrs() {
-		if nodeAddr == addr {
+	for _, id := range n.Gossiper.IDs() {
+		if nodeID == id {
 			return true
 		}
 	}
 	return false
 }
 
-func (n *Node) ReceivedUpdate(nodeAddr string, key string, value string) bool {
-	val, ok := n.Gossiper.Lookup(nodeAddr, key)
+func (n *Node) ReceivedUpdate(nodeID string, key string, value string) bool {
+	val, ok := n.Gossiper.Lookup(nodeID, key)
 	if ok && val == value {
 		return true
 	}
@@ -106,8 +106,8 @@ func (c *Cluster) WaitForHealthy(ctx context.Context) error {
 }
 
 // WaitToDiscover waits for all nodes to be notified about the node with the
-// given addr joining the cluster.
-func (c *Cluster) WaitToDiscover(ctx context.Context, nodeAddr string) error {
+// given ID joining the cluster.
+func (c *Cluster) WaitToDiscover(ctx context.Context, nodeID string) error {
 	// TODO(AD) for now just poll - later subscribe to each gossip - and
 	// add another subscriber to fire once discovered the given node
 	ticker := time.NewTicker(10 * time.Millisecond)
@@ -119,7 +119,7 @@ func (c *Cluster) WaitToDiscover(ctx context.Context, nodeAddr string) error {
 		case <-ticker.C:
 			healthyNodes := 0
 			for _, node := range c.nodes {
-				if node.DiscoveredNode(nodeAddr) {
+				if node.DiscoveredNode(nodeID) {
 					healthyNodes += 1
 				}
 			}
@@ -132,7 +132,7 @@ func (c *Cluster) WaitToDiscover(ctx context.Context, nodeAddr string) error {
 }
 
 // WaitToUpdate waits for all nodes to be notified about the given update.
-func (c *Cluster) WaitToUpdate(ctx context.Context, nodeAddr string, key string, value string) error {
+func (c *Cluster) WaitToUpdate(ctx context.Context, nodeID string, key string, value string) error {
 	// TODO(AD) for now just poll - later subscribe to each gossip - and
 	// add another subscriber to fire once discovered the given node
 	ticker := time.NewTicker(10 * time.Millisecond)
@@ -144,7 +144,7 @@ func (c *Cluster) WaitToUpdate(ctx context.Context, nodeAddr string, key string,
 		case <-ticker.C:
 			healthyNodes := 0
 			for _, node := range c.nodes {
-				if node.ReceivedUpdate(nodeAddr, key, value) {
+				if node.ReceivedUpdate(nodeID, key, value) {
 					healthyNodes += 1
 				}
 			}
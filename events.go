@@ -0,0 +1,100 @@
+package scuttlebutt
+
+import (
+	"github.com/andydunstall/scuttlebutt/internal"
+)
+
+// Event describes a change to the cluster as known by the local node.
+type Event = internal.Event
+
+// EventType is the type of change to the cluster an event describes.
+type EventType = internal.EventType
+
+const (
+	// EventJoin indicates a peer joined the cluster, or came back up after
+	// being considered down.
+	EventJoin = internal.EventJoin
+	// EventLeave indicates a peer left the cluster or was considered down.
+	// Event.LeaveReason contains why the peer left.
+	EventLeave = internal.EventLeave
+	// EventUpdate indicates a key in a peers state was updated.
+	EventUpdate = internal.EventUpdate
+	// EventDelete indicates a key in a peers state was deleted.
+	EventDelete = internal.EventDelete
+	// EventRejoin indicates a peer restarted with a new generation so its old
+	// state was discarded.
+	EventRejoin = internal.EventRejoin
+	// EventStatusChange indicates the status of a peer changed, such as from
+	// alive to suspect. Event.Status and Event.PrevStatus contain the new and
+	// previous status.
+	EventStatusChange = internal.EventStatusChange
+	// EventFlapping indicates a peer is repeatedly failing and recovering, so
+	// its join and leave events are suppressed until it stabilizes. See
+	// FlapDamping.
+	EventFlapping = internal.EventFlapping
+)
+
+// SlowConsumerPolicy describes what to do when a subscriber's buffer is full.
+type SlowConsumerPolicy = internal.SlowConsumerPolicy
+
+const (
+	// SlowConsumerDropOldest discards the oldest buffered event to make room
+	// for the new event.
+	SlowConsumerDropOldest = internal.SlowConsumerDropOldest
+	// SlowConsumerDropNewest discards the new event.
+	SlowConsumerDropNewest = internal.SlowConsumerDropNewest
+	// SlowConsumerBlock waits for the subscriber to read the event. This only
+	// blocks dispatching events to other subscribers, never gossip.
+	SlowConsumerBlock = internal.SlowConsumerBlock
+	// SlowConsumerUnsubscribe cancels the subscription and closes its channel.
+	SlowConsumerUnsubscribe = internal.SlowConsumerUnsubscribe
+)
+
+// EventFilter returns true if the event should be sent to the subscriber.
+type EventFilter func(e Event) bool
+
+// EventTypes returns a filter that only accepts events of the given types.
+func EventTypes(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// handleEvent invokes the callbacks in options for the event.
+func (opts *Options) handleEvent(e Event) {
+	switch e.Type {
+	case EventJoin:
+		if opts.OnJoin != nil {
+			opts.OnJoin(e.ID)
+		}
+	case EventLeave:
+		if opts.OnLeave != nil {
+			opts.OnLeave(e.ID, e.LeaveReason)
+		}
+	case EventUpdate:
+		if opts.OnUpdate != nil {
+			opts.OnUpdate(e.ID, e.Key, e.Value)
+		}
+	case EventDelete:
+		if opts.OnDelete != nil {
+			opts.OnDelete(e.ID, e.Key)
+		}
+	case EventRejoin:
+		if opts.OnRejoin != nil {
+			opts.OnRejoin(e.ID)
+		}
+	case EventStatusChange:
+		if opts.OnStatusChange != nil {
+			opts.OnStatusChange(e.ID, e.PrevStatus, e.Status)
+		}
+	case EventFlapping:
+		if opts.OnFlapping != nil {
+			opts.OnFlapping(e.ID)
+		}
+	}
+}
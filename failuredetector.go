@@ -0,0 +1,74 @@
+package scuttlebutt
+
+import (
+	"time"
+
+	"github.com/andydunstall/scuttlebutt/internal"
+)
+
+// FailureDetector detects whether peers are down based on the heartbeats
+// received from them. A custom failure detector can be configured with
+// WithFailureDetector.
+//
+// If no heartbeats have been received from a peer, the first call to
+// Suspicion or Available should be treated as a heartbeat, so a peer that is
+// never heard from is eventually considered down.
+//
+// Note implementations must be thread safe.
+type FailureDetector = internal.FailureDetector
+
+// PhiAccrualDetector is a phi accrual failure detector that assumes the
+// intervals between heartbeats follow a normal distribution, as described in
+// "The Phi Accrual Failure Detector" and implemented by Akka.
+type PhiAccrualDetector = internal.PhiAccrualDetector
+
+// ExponentialDetector is a phi accrual failure detector that assumes the
+// intervals between heartbeats follow an exponential distribution, as used by
+// Cassandra.
+type ExponentialDetector = internal.ExponentialDetector
+
+// TimeoutDetector is a failure detector that considers a peer down if no
+// heartbeats have been received within a fixed timeout.
+type TimeoutDetector = internal.TimeoutDetector
+
+// NewPhiAccrualDetector returns a phi accrual failure detector.
+//
+// threshold is the value of phi at which a peer is considered down.
+// maxSampleSize is the number of intervals between heartbeats used to
+// calculate the mean and standard deviation. minStdDeviation is the minimum
+// standard deviation used, since a very low standard deviation would make the
+// detector too sensitive. acceptableHeartbeatPause is the duration of missing
+// heartbeats that is tolerated, such as due to garbage collection pauses.
+// firstHeartbeatEstimate is the expected interval before any heartbeats are
+// received.
+func NewPhiAccrualDetector(
+	threshold float64,
+	maxSampleSize int,
+	minStdDeviation time.Duration,
+	acceptableHeartbeatPause time.Duration,
+	firstHeartbeatEstimate time.Duration,
+) *PhiAccrualDetector {
+	return internal.NewPhiAccrualDetector(
+		threshold,
+		maxSampleSize,
+		minStdDeviation,
+		acceptableHeartbeatPause,
+		firstHeartbeatEstimate,
+	)
+}
+
+// NewExponentialDetector returns an exponential failure detector.
+//
+// threshold is the value of phi at which a peer is considered down.
+// maxSampleSize is the number of intervals between heartbeats used to
+// calculate the mean. firstHeartbeatEstimate is used as the interval before
+// any heartbeats are received.
+func NewExponentialDetector(threshold float64, maxSampleSize int, firstHeartbeatEstimate time.Duration) *ExponentialDetector {
+	return internal.NewExponentialDetector(threshold, maxSampleSize, firstHeartbeatEstimate)
+}
+
+// NewTimeoutDetector returns a failure detector that considers a peer down if
+// no heartbeats have been received within the timeout.
+func NewTimeoutDetector(timeout time.Duration) *TimeoutDetector {
+	return internal.NewTimeoutDetector(timeout)
+}
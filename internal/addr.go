@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ValidateAdvertiseAddr returns an error if the given address can't be used
+// by other nodes to reach the local node, such as missing a host or port.
+func ValidateAdvertiseAddr(addr string) error {
+	if err := validateAddr(addr); err != nil {
+		return fmt.Errorf("invalid advertise addr: %w", err)
+	}
+	return nil
+}
+
+// validateAddr returns an error if the given address can't be used to reach a
+// node, such as missing a host or port.
+func validateAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("%s: missing host", addr)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return fmt.Errorf("%s: invalid port", addr)
+	}
+	return nil
+}
+
+// IsUnspecifiedAddr returns whether the host of the given address is missing
+// or is an unspecified IP (0.0.0.0 or ::), which other nodes can't reach.
+func IsUnspecifiedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// isLoopbackAddr returns whether the host of the given address is a loopback
+// IP or localhost.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isRemoteAddr returns whether the host of the given address is an IP that
+// isn't loopback. Hostnames aren't considered remote as they may resolve to a
+// loopback address.
+func isRemoteAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsLoopback() && !ip.IsUnspecified()
+}
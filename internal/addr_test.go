@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAdvertiseAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"10.26.104.52:8229", true},
+		{"[fd00::1]:8229", true},
+		{"node-1.cluster.local:8229", true},
+		{"10.26.104.52", false},
+		{":8229", false},
+		{"10.26.104.52:0", false},
+		{"10.26.104.52:http", false},
+		{"10.26.104.52:70000", false},
+		{"fd00::1:8229", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := ValidateAdvertiseAddr(tt.addr)
+			if tt.valid {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestIsUnspecifiedAddr(t *testing.T) {
+	assert.True(t, IsUnspecifiedAddr("0.0.0.0:8229"))
+	assert.True(t, IsUnspecifiedAddr("[::]:8229"))
+	assert.True(t, IsUnspecifiedAddr(":8229"))
+	assert.False(t, IsUnspecifiedAddr("10.26.104.52:8229"))
+	assert.False(t, IsUnspecifiedAddr("node-1.cluster.local:8229"))
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	assert.True(t, isLoopbackAddr("127.0.0.1:8229"))
+	assert.True(t, isLoopbackAddr("[::1]:8229"))
+	assert.True(t, isLoopbackAddr("localhost:8229"))
+	assert.False(t, isLoopbackAddr("10.26.104.52:8229"))
+
+	assert.True(t, isRemoteAddr("10.26.104.52:8229"))
+	assert.False(t, isRemoteAddr("127.0.0.1:8229"))
+	assert.False(t, isRemoteAddr("node-1.cluster.local:8229"))
+}
@@ -5,7 +5,9 @@ import (
 )
 
 var (
-	phiFactor = float64(1.0 / math.Log10(10.0))
+	// phiFactor converts from the natural logarithm used by the exponential
+	// distribution to the base 10 logarithm used by phi.
+	phiFactor = float64(1.0 / math.Log(10.0))
 )
 
 type ArrivalWindow struct {
@@ -14,11 +16,14 @@ type ArrivalWindow struct {
 	bootstrapInterval uint64
 }
 
-func NewArrivalWindow(gossipInterval uint64, sampleSize int) *ArrivalWindow {
+// NewArrivalWindow returns a window of the last sampleSize intervals, where
+// bootstrapInterval is used as the first interval before any have been
+// received.
+func NewArrivalWindow(bootstrapInterval uint64, sampleSize int) *ArrivalWindow {
 	return &ArrivalWindow{
 		lastTimestampNano: 0,
 		intervals:         NewArrivalIntervals(sampleSize),
-		bootstrapInterval: gossipInterval * 2,
+		bootstrapInterval: bootstrapInterval,
 	}
 }
 
@@ -27,12 +32,23 @@ func (w *ArrivalWindow) Phi(timestampNano uint64) float64 {
 		panic("cannot sample phi before any samples arrived")
 	}
 
+	// The timestamp may be before the last heartbeat if the heartbeat was
+	// reported concurrently after the timestamp was read.
+	if timestampNano <= w.lastTimestampNano {
+		return 0
+	}
 	deltaSinceLast := timestampNano - w.lastTimestampNano
 	return (float64(deltaSinceLast) / w.intervals.Mean()) * phiFactor
 }
 
+// Add adds the interval since the last heartbeat. Heartbeats that are not
+// after the last heartbeat, such as when reported concurrently out of order,
+// are ignored.
 func (w *ArrivalWindow) Add(timestampNano uint64) {
 	if w.lastTimestampNano > 0 {
+		if timestampNano <= w.lastTimestampNano {
+			return
+		}
 		w.intervals.Add(timestampNano - w.lastTimestampNano)
 	} else {
 		// If this is the first interval, use a high interval to avoid false
@@ -67,6 +83,21 @@ func (ai *ArrivalIntervals) Mean() float64 {
 	return ai.mean
 }
 
+// StdDeviation returns the standard deviation of the intervals.
+func (ai *ArrivalIntervals) StdDeviation() float64 {
+	size := ai.size()
+	if size == 0 {
+		return 0
+	}
+
+	var sum float64
+	for i := 0; i != size; i++ {
+		d := float64(ai.intervals[i]) - ai.mean
+		sum += d * d
+	}
+	return math.Sqrt(sum / float64(size))
+}
+
 func (ai *ArrivalIntervals) Add(interval uint64) {
 	// If the index is at the end of the buffer wrap around.
 	if ai.index == len(ai.intervals) {
@@ -16,29 +16,36 @@ func TestArrivalWindow(t *testing.T) {
 	}{
 		{
 			Name:        "bootstrap phi",
-			ExpectedPhi: 0.05,
+			ExpectedPhi: 0.0217,
 			Timestamps:  []uint64{100},
 			Now:         200,
 			SampleSize:  10,
 		},
 		{
 			Name:        "low phi",
-			ExpectedPhi: 1.0,
+			ExpectedPhi: 0.434,
 			Timestamps:  []uint64{100, 200, 300, 400, 500, 600},
 			Now:         700,
 			SampleSize:  5,
 		},
 		{
 			Name:        "high phi",
-			ExpectedPhi: 14.0,
+			ExpectedPhi: 6.08,
 			Timestamps:  []uint64{100, 200, 300, 400, 500, 600},
 			Now:         2000,
 			SampleSize:  5,
 		},
+		{
+			Name:        "out of order timestamps ignored",
+			ExpectedPhi: 0.434,
+			Timestamps:  []uint64{100, 200, 300, 400, 500, 600, 550, 600},
+			Now:         700,
+			SampleSize:  5,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			window := NewArrivalWindow(1000, test.SampleSize)
+			window := NewArrivalWindow(2000, test.SampleSize)
 			for _, ts := range test.Timestamps {
 				window.Add(ts)
 			}
@@ -47,3 +54,15 @@ func TestArrivalWindow(t *testing.T) {
 		})
 	}
 }
+
+func TestArrivalIntervals_StdDeviation(t *testing.T) {
+	intervals := NewArrivalIntervals(4)
+	assert.Equal(t, 0.0, intervals.StdDeviation())
+
+	for _, interval := range []uint64{2, 4, 4, 4, 5, 5, 7, 9} {
+		intervals.Add(interval)
+	}
+	// Only the last 4 intervals are kept.
+	assert.Equal(t, 6.5, intervals.Mean())
+	assert.InEpsilon(t, 1.658, intervals.StdDeviation(), 0.01)
+}
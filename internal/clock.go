@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is used to read the current time and schedule timers, so time can be
+// controlled in tests and simulations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a ticker that sends the time on its channel every
+	// period d.
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc calls f in its own goroutine once d has elapsed.
+	AfterFunc(d time.Duration, f func())
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. After Stop no more ticks are sent.
+	Stop()
+}
+
+// RealClock is a Clock using the system time.
+type RealClock struct{}
+
+func NewRealClock() *RealClock {
+	return &RealClock{}
+}
+
+func (c *RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *RealClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (c *RealClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+type manualTimer struct {
+	when time.Time
+	// period is the period of a ticker, or 0 if the timer fires once.
+	period time.Duration
+	// ch is the tickers channel.
+	ch chan time.Time
+	// f is the function called when a timer created with AfterFunc fires.
+	f func()
+}
+
+// ManualClock is a Clock whose time only moves when Advance is called, which
+// is used to make tests and simulations deterministic.
+//
+// Unlike RealClock, functions scheduled with AfterFunc are called by
+// Advance rather than in their own goroutine.
+//
+// Note this is thread safe.
+type ManualClock struct {
+	now time.Time
+	// timers contains the pending timers and tickers in the order they were
+	// scheduled.
+	timers []*manualTimer
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+// NewManualClock returns a clock starting at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ticker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &manualTimer{
+		when:   c.now.Add(d),
+		period: d,
+		// Like time.Ticker, buffer a single tick and drop ticks for slow
+		// receivers.
+		ch: make(chan time.Time, 1),
+	}
+	c.timers = append(c.timers, timer)
+	return &manualTicker{clock: c, timer: timer}
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timers = append(c.timers, &manualTimer{
+		when: c.now.Add(d),
+		f:    f,
+	})
+}
+
+// Advance moves the clock forward by d, firing any timers and tickers that
+// are due in the order of when they are due. Functions scheduled with
+// AfterFunc are called from Advance.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		timer, ok := c.nextTimer(target)
+		if !ok {
+			break
+		}
+		if timer.when.After(c.now) {
+			c.now = timer.when
+		}
+
+		if timer.period > 0 {
+			timer.when = timer.when.Add(timer.period)
+			select {
+			case timer.ch <- c.now:
+			default:
+			}
+			continue
+		}
+
+		c.removeTimer(timer)
+		// Call without holding mu as the function may use the clock.
+		c.mu.Unlock()
+		timer.f()
+		c.mu.Lock()
+	}
+	if target.After(c.now) {
+		c.now = target
+	}
+}
+
+// nextTimer returns the earliest timer due at or before target. If multiple
+// timers are due at the same time, the first scheduled is returned.
+//
+// Note must hold mu.
+func (c *ManualClock) nextTimer(target time.Time) (*manualTimer, bool) {
+	var next *manualTimer
+	for _, timer := range c.timers {
+		if timer.when.After(target) {
+			continue
+		}
+		if next == nil || timer.when.Before(next.when) {
+			next = timer
+		}
+	}
+	return next, next != nil
+}
+
+// removeTimer removes the timer from the pending timers.
+//
+// Note must hold mu.
+func (c *ManualClock) removeTimer(timer *manualTimer) {
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type manualTicker struct {
+	clock *ManualClock
+	timer *manualTimer
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.timer.ch
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.clock.removeTimer(t.timer)
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClock_Ticker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Millisecond * 500)
+	assert.Equal(t, 0, len(ticker.C()))
+
+	clock.Advance(time.Millisecond * 500)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+
+	// Like time.Ticker, ticks are dropped if the receiver is slow.
+	clock.Advance(time.Second * 5)
+	assert.Equal(t, start.Add(time.Second*2), <-ticker.C())
+	assert.Equal(t, 0, len(ticker.C()))
+
+	ticker.Stop()
+	clock.Advance(time.Second * 5)
+	assert.Equal(t, 0, len(ticker.C()))
+
+	assert.Equal(t, start.Add(time.Second*11), clock.Now())
+}
+
+// Tests functions scheduled with AfterFunc are called in the order they are
+// due, and see the time they were due.
+func TestManualClock_AfterFunc(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+
+	var calls []time.Time
+	clock.AfterFunc(time.Second*2, func() {
+		calls = append(calls, clock.Now())
+	})
+	clock.AfterFunc(time.Second, func() {
+		calls = append(calls, clock.Now())
+		// Schedule another function from within a function.
+		clock.AfterFunc(time.Millisecond*500, func() {
+			calls = append(calls, clock.Now())
+		})
+	})
+
+	clock.Advance(time.Second * 10)
+	assert.Equal(t, []time.Time{
+		start.Add(time.Second),
+		start.Add(time.Millisecond * 1500),
+		start.Add(time.Second * 2),
+	}, calls)
+	assert.Equal(t, start.Add(time.Second*10), clock.Now())
+}
@@ -2,19 +2,210 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 )
 
+var (
+	// ErrTruncated indicates a message ended before a field could be
+	// decoded.
+	ErrTruncated = errors.New("message truncated")
+	// ErrStringTooLarge indicates a string is too large to be encoded with
+	// the protocol version.
+	ErrStringTooLarge = errors.New("string too large")
+)
+
+// DecodeError is returned when a received message is malformed and can't be
+// decoded.
+type DecodeError struct {
+	// Field is the type of field that couldn't be decoded.
+	Field string
+	// Offset is the offset in the message of the field.
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownMessageTypeError is returned when a received message has a type that
+// isn't supported.
+type UnknownMessageTypeError struct {
+	Type uint8
+}
+
+func (e *UnknownMessageTypeError) Error() string {
+	return fmt.Sprintf("unknown message type: %d", e.Type)
+}
+
+// UnsupportedVersionError is returned when a received message is encoded with
+// a protocol version that isn't supported.
+type UnsupportedVersionError struct {
+	Version uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version: %d", e.Version)
+}
+
 type messageType uint8
 
 const (
 	typeDigestRequest  messageType = 1
 	typeDigestResponse messageType = 2
 	typeDelta          messageType = 3
+	// typeDeltaFragment contains a fragment of a delta that is too large to
+	// fit in a single message. Only supported by protocol version 2 onwards.
+	typeDeltaFragment messageType = 4
+	// typePushPullRequest and typePushPullResponse contain the full state of
+	// the sender, and are sent over a stream rather than as packets.
+	typePushPullRequest  messageType = 5
+	typePushPullResponse messageType = 6
+	// typePing, typePingReq and typeAck are used to probe whether a suspected
+	// peer is alive, either directly or indirectly through other peers. Only
+	// supported by protocol version 3 onwards.
+	typePing    messageType = 7
+	typePingReq messageType = 8
+	typeAck     messageType = 9
 
 	uint8Len  = 1
+	uint16Len = 2
+	uint32Len = 4
 	uint64Len = 8
+
+	// maxFrameSize is the maximum size of a message sent over a stream, which
+	// must fit the full known cluster state in a push-pull exchange.
+	maxFrameSize = 16 * 1024 * 1024
+
+	// fragmentHeaderLen is the size of the header of a delta fragment,
+	// containing the fragment ID, index and count.
+	fragmentHeaderLen = uint64Len + uint16Len + uint16Len
 )
 
+const (
+	// protocolVersion1 encodes strings with a uint8 length prefix, so
+	// strings cannot exceed 255 bytes.
+	protocolVersion1 = 1
+	// protocolVersion2 encodes strings with a varint length prefix, and
+	// supports fragmenting deltas that don't fit in a single message.
+	protocolVersion2 = 2
+	// protocolVersion3 supports probing suspected peers with ping, ping-req
+	// and ack messages.
+	protocolVersion3 = 3
+	// protocolVersion4 includes the senders advertised address in the
+	// message header.
+	protocolVersion4 = 4
+	// protocolVersion5 identifies nodes by ID rather than address, and
+	// includes the senders ID in the message header.
+	protocolVersion5 = 5
+
+	// ProtocolVersionMin is the oldest protocol version this node can encode
+	// and decode.
+	ProtocolVersionMin = protocolVersion1
+	// ProtocolVersionMax is the newest protocol version this node can encode
+	// and decode.
+	ProtocolVersionMax = protocolVersion5
+)
+
+// messageHeader is the header included at the start of every message.
+//
+// Note the version, type and cluster name are encoded the same in all protocol
+// versions, so receivers can always check them before rejecting a message.
+type messageHeader struct {
+	// Version is the protocol version the message is encoded with. This must
+	// always be the first byte of the message so receivers can check it
+	// before decoding anything else.
+	Version uint8
+	Type    messageType
+	// ClusterName is the name of the cluster the sender belongs to. Messages
+	// from other clusters are dropped.
+	ClusterName string
+	// Sender is the advertised address of the sender, which is used to reach
+	// the sender instead of the packets source address (which may differ when
+	// the sender is behind NAT or binds to an unspecified address). Only
+	// included in protocol version 4 onwards.
+	Sender string
+	// SenderID is the ID of the sender. Only included in protocol version 5
+	// onwards.
+	SenderID string
+}
+
+// deltaFragment is a fragment of an encoded delta. Deltas are fragmented when
+// they are too large to fit in a single message, and reassembled by the
+// receiver once all fragments are received.
+type deltaFragment struct {
+	// ID identifies the delta the fragment belongs to. This is unique per
+	// sender.
+	ID uint64
+	// Index is the index of the fragment in the delta.
+	Index uint16
+	// Count is the total number of fragments in the delta.
+	Count uint16
+	// Data is the fragment of the encoded delta.
+	Data []byte
+}
+
+// ping probes whether the receiver is alive, who responds with an ack with the
+// same sequence number.
+type ping struct {
+	Seq uint64
+}
+
+// pingReq asks the receiver to ping the target on behalf of the sender, and
+// relay the targets ack back to the sender with the same sequence number.
+type pingReq struct {
+	Seq    uint64
+	Target string
+}
+
+// ack acknowledges a ping with the given sequence number.
+type ack struct {
+	Seq uint64
+}
+
+// peerState contains the full known state of a peer.
+type peerState struct {
+	Digest Digest
+	// Deltas contains the peers entries sorted by version.
+	Deltas []Delta
+}
+
+// pushPullState contains the full known state of the cluster, which is
+// exchanged in push-pull messages.
+type pushPullState struct {
+	// ID is the ID of the sender. This is needed since the source address of
+	// a stream doesn't identify the sender.
+	ID    string
+	Peers []peerState
+}
+
+func encodeHeader(h messageHeader) []byte {
+	size := uint8Len + uint8Len + uint8Len + len(h.ClusterName)
+	if h.Version >= protocolVersion4 {
+		size += stringLen(h.Sender, h.Version)
+	}
+	if h.Version >= protocolVersion5 {
+		size += stringLen(h.SenderID, h.Version)
+	}
+	b := make([]byte, size)
+	offset := encodeUint8(b, 0, h.Version)
+	offset = encodeUint8(b, offset, uint8(h.Type))
+	offset = encodeString(b, offset, h.ClusterName, protocolVersion1)
+	if h.Version >= protocolVersion4 {
+		offset = encodeString(b, offset, h.Sender, h.Version)
+	}
+	if h.Version >= protocolVersion5 {
+		encodeString(b, offset, h.SenderID, h.Version)
+	}
+	return b
+}
+
 func encodeUint8(buf []byte, offset int, n uint8) int {
 	if len(buf) < offset+uint8Len {
 		panic("buf too small; cannot encode uint8")
@@ -24,6 +215,15 @@ func encodeUint8(buf []byte, offset int, n uint8) int {
 	return offset + uint8Len
 }
 
+func encodeUint16(buf []byte, offset int, n uint16) int {
+	if len(buf) < offset+uint16Len {
+		panic("buf too small; cannot encode uint16")
+	}
+
+	binary.BigEndian.PutUint16(buf[offset:offset+uint16Len], n)
+	return offset + uint16Len
+}
+
 func encodeUint64(buf []byte, offset int, n uint64) int {
 	if len(buf) < offset+uint64Len {
 		panic("buf too small; cannot encode uint64")
@@ -33,110 +233,469 @@ func encodeUint64(buf []byte, offset int, n uint64) int {
 	return offset + uint64Len
 }
 
-func encodeString(buf []byte, offset int, s string) int {
-	if len(buf) < offset+len(s) {
+func encodeBool(buf []byte, offset int, b bool) int {
+	if b {
+		return encodeUint8(buf, offset, 1)
+	}
+	return encodeUint8(buf, offset, 0)
+}
+
+// stringLen returns the size of the encoded string with the given protocol
+// version.
+func stringLen(s string, version uint8) int {
+	if version == protocolVersion1 {
+		return uint8Len + len(s)
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(lenBuf[:], uint64(len(s))) + len(s)
+}
+
+// stringEncodable returns whether the string can be encoded with the given
+// protocol version.
+func stringEncodable(s string, version uint8) bool {
+	return version != protocolVersion1 || len(s) <= 0xff
+}
+
+func encodeString(buf []byte, offset int, s string, version uint8) int {
+	if len(buf) < offset+stringLen(s, version) {
 		panic("buf too small; cannot encode bytes")
 	}
-	if len(s) > 0xff {
+	if !stringEncodable(s, version) {
 		panic("string too large; cannot exceed 256 bytes")
 	}
 
-	offset = encodeUint8(buf, offset, uint8(len(s)))
-	for i := 0; i != len(s); i++ {
-		buf[offset+i] = s[i]
+	if version == protocolVersion1 {
+		offset = encodeUint8(buf, offset, uint8(len(s)))
+	} else {
+		offset += binary.PutUvarint(buf[offset:], uint64(len(s)))
 	}
-	offset += len(s)
+	offset += copy(buf[offset:], s)
 	return offset
 }
 
-func encodeDigest(d Digest) []byte {
-	payloadLen := uint8Len + len(d.Addr) + uint64Len
+func encodeDigest(d Digest, version uint8) []byte {
+	payloadLen := stringLen(d.ID, version) + uint64Len + uint64Len
+	if version >= protocolVersion5 {
+		payloadLen += stringLen(d.Addr, version)
+	}
 
 	b := make([]byte, payloadLen)
-	offset := encodeString(b, 0, d.Addr)
-	encodeUint64(b, offset, d.Version)
+	offset := encodeString(b, 0, d.ID, version)
+	offset = encodeUint64(b, offset, d.Generation)
+	offset = encodeUint64(b, offset, d.Version)
+	if version >= protocolVersion5 {
+		encodeString(b, offset, d.Addr, version)
+	}
 
 	return b
 }
 
-func encodeDelta(d Delta) []byte {
-	payloadLen := uint8Len + len(d.Addr) + uint8Len + len(d.Key) + uint8Len + len(d.Value) + uint64Len
+// deltaEncodable returns whether the delta can be encoded with the given
+// protocol version.
+func deltaEncodable(d Delta, version uint8) bool {
+	return stringEncodable(d.ID, version) && stringEncodable(d.Key, version) && stringEncodable(d.Value, version)
+}
+
+// encodeDelta encodes the delta with the given protocol version. Returns
+// ErrStringTooLarge if the delta contains a string that can't be encoded with
+// the version.
+func encodeDelta(d Delta, version uint8) ([]byte, error) {
+	if !deltaEncodable(d, version) {
+		return nil, ErrStringTooLarge
+	}
+
+	payloadLen := stringLen(d.ID, version) + uint64Len + stringLen(d.Key, version) + stringLen(d.Value, version) + uint64Len + uint8Len
 
 	b := make([]byte, payloadLen)
-	offset := encodeString(b, 0, d.Addr)
-	offset = encodeString(b, offset, d.Key)
-	offset = encodeString(b, offset, d.Value)
-	encodeUint64(b, offset, d.Version)
+	offset := encodeString(b, 0, d.ID, version)
+	offset = encodeUint64(b, offset, d.Generation)
+	offset = encodeString(b, offset, d.Key, version)
+	offset = encodeString(b, offset, d.Value, version)
+	offset = encodeUint64(b, offset, d.Version)
+	encodeBool(b, offset, d.Deleted)
+
+	return b, nil
+}
+
+func encodeDeltaFragment(f deltaFragment) []byte {
+	b := make([]byte, fragmentHeaderLen+len(f.Data))
+	offset := encodeUint64(b, 0, f.ID)
+	offset = encodeUint16(b, offset, f.Index)
+	offset = encodeUint16(b, offset, f.Count)
+	copy(b[offset:], f.Data)
+	return b
+}
+
+func encodePing(p ping) []byte {
+	b := make([]byte, uint64Len)
+	encodeUint64(b, 0, p.Seq)
+	return b
+}
+
+func encodePingReq(p pingReq, version uint8) []byte {
+	b := make([]byte, uint64Len+stringLen(p.Target, version))
+	offset := encodeUint64(b, 0, p.Seq)
+	encodeString(b, offset, p.Target, version)
+	return b
+}
 
+func encodeAck(a ack) []byte {
+	b := make([]byte, uint64Len)
+	encodeUint64(b, 0, a.Seq)
 	return b
 }
 
-func decodeUint8(buf []byte, offset int) (uint8, int) {
+// encodePushPullState encodes the state with the given protocol version.
+// Returns ErrStringTooLarge if the state contains a string that can't be
+// encoded with the version.
+func encodePushPullState(state pushPullState, version uint8) ([]byte, error) {
+	if !stringEncodable(state.ID, version) {
+		return nil, ErrStringTooLarge
+	}
+
+	b := make([]byte, stringLen(state.ID, version))
+	encodeString(b, 0, state.ID, version)
+
+	for _, peer := range state.Peers {
+		if !stringEncodable(peer.Digest.ID, version) {
+			return nil, ErrStringTooLarge
+		}
+		b = append(b, encodeDigest(peer.Digest, version)...)
+
+		count := make([]byte, uint64Len)
+		encodeUint64(count, 0, uint64(len(peer.Deltas)))
+		b = append(b, count...)
+
+		for _, delta := range peer.Deltas {
+			deltaEnc, err := encodeDelta(delta, version)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, deltaEnc...)
+		}
+	}
+	return b, nil
+}
+
+// writeFrame writes the message to the stream prefixed with its uint32
+// length.
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(b))
+	}
+
+	buf := make([]byte, uint32Len+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[uint32Len:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+func decodeUint8(buf []byte, offset int) (uint8, int, error) {
 	if len(buf) < offset+uint8Len {
-		panic("buf too small; cannot decode uint8")
+		return 0, offset, &DecodeError{Field: "uint8", Offset: offset, Err: ErrTruncated}
 	}
 
 	n := uint8(buf[offset])
-	return n, offset + uint8Len
+	return n, offset + uint8Len, nil
 }
 
-func decodeUint64(buf []byte, offset int) (uint64, int) {
+func decodeUint16(buf []byte, offset int) (uint16, int, error) {
+	if len(buf) < offset+uint16Len {
+		return 0, offset, &DecodeError{Field: "uint16", Offset: offset, Err: ErrTruncated}
+	}
+
+	n := binary.BigEndian.Uint16(buf[offset : offset+uint16Len])
+	return n, offset + uint16Len, nil
+}
+
+func decodeUint64(buf []byte, offset int) (uint64, int, error) {
 	if len(buf) < offset+uint64Len {
-		panic("buf too small; cannot decode uint64")
+		return 0, offset, &DecodeError{Field: "uint64", Offset: offset, Err: ErrTruncated}
 	}
 
 	n := binary.BigEndian.Uint64(buf[offset : offset+uint64Len])
-	return n, offset + uint64Len
+	return n, offset + uint64Len, nil
+}
+
+func decodeBool(buf []byte, offset int) (bool, int, error) {
+	n, offset, err := decodeUint8(buf, offset)
+	if err != nil {
+		return false, offset, err
+	}
+	return n != 0, offset, nil
 }
 
-func decodeString(buf []byte, offset int) (string, int) {
-	n, offset := decodeUint8(buf, offset)
-	if len(buf) < offset+int(n) {
-		panic("buf too small; cannot decode string")
+func decodeString(buf []byte, offset int, version uint8) (string, int, error) {
+	var n uint64
+	if version == protocolVersion1 {
+		var n8 uint8
+		var err error
+		n8, offset, err = decodeUint8(buf, offset)
+		if err != nil {
+			return "", offset, err
+		}
+		n = uint64(n8)
+	} else {
+		var read int
+		n, read = binary.Uvarint(buf[offset:])
+		if read == 0 {
+			return "", offset, &DecodeError{Field: "string", Offset: offset, Err: ErrTruncated}
+		}
+		if read < 0 {
+			return "", offset, &DecodeError{Field: "string", Offset: offset, Err: ErrStringTooLarge}
+		}
+		offset += read
+	}
+
+	if uint64(len(buf)-offset) < n {
+		return "", offset, &DecodeError{Field: "string", Offset: offset, Err: ErrTruncated}
+	}
+	return string(buf[offset : offset+int(n)]), offset + int(n), nil
+}
+
+func decodeHeader(b []byte) (messageHeader, int, error) {
+	version, offset, err := decodeUint8(b, 0)
+	if err != nil {
+		return messageHeader{}, offset, err
+	}
+	t, offset, err := decodeUint8(b, offset)
+	if err != nil {
+		return messageHeader{}, offset, err
+	}
+	clusterName, offset, err := decodeString(b, offset, protocolVersion1)
+	if err != nil {
+		return messageHeader{}, offset, err
 	}
-	return string(buf[offset : offset+int(n)]), offset + int(n)
+	var sender string
+	if version >= protocolVersion4 {
+		sender, offset, err = decodeString(b, offset, version)
+		if err != nil {
+			return messageHeader{}, offset, err
+		}
+	}
+	var senderID string
+	if version >= protocolVersion5 {
+		senderID, offset, err = decodeString(b, offset, version)
+		if err != nil {
+			return messageHeader{}, offset, err
+		}
+	}
+	return messageHeader{
+		Version:     version,
+		Type:        messageType(t),
+		ClusterName: clusterName,
+		Sender:      sender,
+		SenderID:    senderID,
+	}, offset, nil
 }
 
-func decodeDigest(b []byte, offset int) (Digest, int) {
-	addr, offset := decodeString(b, offset)
-	version, offset := decodeUint64(b, offset)
+func decodeDigest(b []byte, offset int, version uint8) (Digest, int, error) {
+	id, offset, err := decodeString(b, offset, version)
+	if err != nil {
+		return Digest{}, offset, err
+	}
+	generation, offset, err := decodeUint64(b, offset)
+	if err != nil {
+		return Digest{}, offset, err
+	}
+	digestVersion, offset, err := decodeUint64(b, offset)
+	if err != nil {
+		return Digest{}, offset, err
+	}
+	var addr string
+	if version >= protocolVersion5 {
+		addr, offset, err = decodeString(b, offset, version)
+		if err != nil {
+			return Digest{}, offset, err
+		}
+	}
 	return Digest{
-		Addr:    addr,
-		Version: version,
-	}, offset
+		ID:         id,
+		Generation: generation,
+		Version:    digestVersion,
+		Addr:       addr,
+	}, offset, nil
 }
 
-func decodeDigestSync(b []byte) []Digest {
+func decodeDigestSync(b []byte, version uint8) ([]Digest, error) {
 	sync := []Digest{}
 	offset := 0
 	for offset < len(b) {
 		var digest Digest
-		digest, offset = decodeDigest(b, offset)
+		var err error
+		digest, offset, err = decodeDigest(b, offset, version)
+		if err != nil {
+			return nil, err
+		}
 		sync = append(sync, digest)
 	}
-	return sync
+	return sync, nil
 }
 
-func decodeDelta(b []byte, offset int) (Delta, int) {
-	addr, offset := decodeString(b, offset)
-	key, offset := decodeString(b, offset)
-	value, offset := decodeString(b, offset)
-	version, offset := decodeUint64(b, offset)
+func decodeDelta(b []byte, offset int, version uint8) (Delta, int, error) {
+	id, offset, err := decodeString(b, offset, version)
+	if err != nil {
+		return Delta{}, offset, err
+	}
+	generation, offset, err := decodeUint64(b, offset)
+	if err != nil {
+		return Delta{}, offset, err
+	}
+	key, offset, err := decodeString(b, offset, version)
+	if err != nil {
+		return Delta{}, offset, err
+	}
+	value, offset, err := decodeString(b, offset, version)
+	if err != nil {
+		return Delta{}, offset, err
+	}
+	deltaVersion, offset, err := decodeUint64(b, offset)
+	if err != nil {
+		return Delta{}, offset, err
+	}
+	deleted, offset, err := decodeBool(b, offset)
+	if err != nil {
+		return Delta{}, offset, err
+	}
 	return Delta{
-		Addr:    addr,
-		Key:     key,
-		Value:   value,
-		Version: version,
-	}, offset
+		ID:         id,
+		Generation: generation,
+		Key:        key,
+		Value:      value,
+		Version:    deltaVersion,
+		Deleted:    deleted,
+	}, offset, nil
 }
 
-func decodeDeltaSync(b []byte) []Delta {
+func decodeDeltaSync(b []byte, version uint8) ([]Delta, error) {
 	sync := []Delta{}
 	offset := 0
 	for offset < len(b) {
 		var delta Delta
-		delta, offset = decodeDelta(b, offset)
+		var err error
+		delta, offset, err = decodeDelta(b, offset, version)
+		if err != nil {
+			return nil, err
+		}
 		sync = append(sync, delta)
 	}
-	return sync
+	return sync, nil
+}
+
+func decodeDeltaFragment(b []byte) (deltaFragment, error) {
+	id, offset, err := decodeUint64(b, 0)
+	if err != nil {
+		return deltaFragment{}, err
+	}
+	index, offset, err := decodeUint16(b, offset)
+	if err != nil {
+		return deltaFragment{}, err
+	}
+	count, offset, err := decodeUint16(b, offset)
+	if err != nil {
+		return deltaFragment{}, err
+	}
+	return deltaFragment{
+		ID:    id,
+		Index: index,
+		Count: count,
+		Data:  b[offset:],
+	}, nil
+}
+
+func decodePing(b []byte) (ping, error) {
+	seq, _, err := decodeUint64(b, 0)
+	if err != nil {
+		return ping{}, err
+	}
+	return ping{Seq: seq}, nil
+}
+
+func decodePingReq(b []byte, version uint8) (pingReq, error) {
+	seq, offset, err := decodeUint64(b, 0)
+	if err != nil {
+		return pingReq{}, err
+	}
+	target, _, err := decodeString(b, offset, version)
+	if err != nil {
+		return pingReq{}, err
+	}
+	return pingReq{Seq: seq, Target: target}, nil
+}
+
+func decodeAck(b []byte) (ack, error) {
+	seq, _, err := decodeUint64(b, 0)
+	if err != nil {
+		return ack{}, err
+	}
+	return ack{Seq: seq}, nil
+}
+
+func decodePushPullState(b []byte, version uint8) (pushPullState, error) {
+	id, offset, err := decodeString(b, 0, version)
+	if err != nil {
+		return pushPullState{}, err
+	}
+
+	state := pushPullState{
+		ID:    id,
+		Peers: []peerState{},
+	}
+	for offset < len(b) {
+		var digest Digest
+		digest, offset, err = decodeDigest(b, offset, version)
+		if err != nil {
+			return pushPullState{}, err
+		}
+
+		var count uint64
+		count, offset, err = decodeUint64(b, offset)
+		if err != nil {
+			return pushPullState{}, err
+		}
+
+		peer := peerState{
+			Digest: digest,
+			Deltas: []Delta{},
+		}
+		// Note don't preallocate the deltas using the count since it
+		// isn't trusted.
+		for i := uint64(0); i != count; i++ {
+			var delta Delta
+			delta, offset, err = decodeDelta(b, offset, version)
+			if err != nil {
+				return pushPullState{}, err
+			}
+			peer.Deltas = append(peer.Deltas, delta)
+		}
+		state.Peers = append(state.Peers, peer)
+	}
+	return state, nil
+}
+
+// readFrame reads a message prefixed with its uint32 length from the stream.
+func readFrame(r io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, uint32Len)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(lenBuf)
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+
+	// Read the frame incrementally rather than allocating the claimed
+	// length up front, so a sender can't make us allocate memory for data it
+	// never sends.
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != int(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
 }
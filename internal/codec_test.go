@@ -1,89 +1,558 @@
 package internal
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func TestCodec_EncodeHeader(t *testing.T) {
+	header := messageHeader{
+		Version:     0x2,
+		Type:        typeDelta,
+		ClusterName: "my-cluster",
+	}
+	b := encodeHeader(header)
+	assert.Equal(t, []byte{
+		0x2,                                                             // Version
+		0x3,                                                             // Type
+		0xa, 0x6d, 0x79, 0x2d, 0x63, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, // Cluster name
+	}, b)
+
+	decoded, offset, err := decodeHeader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decoded)
+	assert.Equal(t, len(b), offset)
+}
+
+func TestCodec_EncodeHeaderSender(t *testing.T) {
+	header := messageHeader{
+		Version:     protocolVersion4,
+		Type:        typeDelta,
+		ClusterName: "c",
+		Sender:      "10.26.104.56:8123",
+	}
+	b := encodeHeader(header)
+	assert.Equal(t, []byte{
+		0x4,       // Version
+		0x3,       // Type
+		0x1, 0x63, // Cluster name
+		0x11, 0x31, 0x30, 0x2e, 0x32, 0x36, 0x2e, 0x31, 0x30, 0x34, 0x2e, 0x35, 0x36, 0x3a, 0x38, 0x31, 0x32, 0x33, // Sender
+	}, b)
+
+	decoded, offset, err := decodeHeader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decoded)
+	assert.Equal(t, len(b), offset)
+
+	// The sender isn't included in older protocol versions.
+	header.Version = protocolVersion3
+	decoded, _, err = decodeHeader(encodeHeader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, "", decoded.Sender)
+}
+
+func TestCodec_EncodeHeaderSenderID(t *testing.T) {
+	header := messageHeader{
+		Version:     protocolVersion5,
+		Type:        typeDelta,
+		ClusterName: "c",
+		Sender:      "10.26.104.56:8123",
+		SenderID:    "node-1",
+	}
+	b := encodeHeader(header)
+	assert.Equal(t, []byte{
+		0x5,       // Version
+		0x3,       // Type
+		0x1, 0x63, // Cluster name
+		0x11, 0x31, 0x30, 0x2e, 0x32, 0x36, 0x2e, 0x31, 0x30, 0x34, 0x2e, 0x35, 0x36, 0x3a, 0x38, 0x31, 0x32, 0x33, // Sender
+		0x6, 0x6e, 0x6f, 0x64, 0x65, 0x2d, 0x31, // Sender ID
+	}, b)
+
+	decoded, offset, err := decodeHeader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decoded)
+	assert.Equal(t, len(b), offset)
+
+	// The sender ID isn't included in older protocol versions.
+	header.Version = protocolVersion4
+	decoded, _, err = decodeHeader(encodeHeader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, "10.26.104.56:8123", decoded.Sender)
+	assert.Equal(t, "", decoded.SenderID)
+}
+
 func TestCodec_EncodeDigest(t *testing.T) {
 	digest := Digest{
-		Addr:    "10.26.104.56:8123",
-		Version: 0xaabbccddeeff,
+		ID:         "10.26.104.56:8123",
+		Generation: 0x1122334455,
+		Version:    0xaabbccddeeff,
 	}
-	b := encodeDigest(digest)
+	b := encodeDigest(digest, protocolVersion1)
 	assert.Equal(t, []byte{
 		0x11, 0x31, 0x30, 0x2e, 0x32, 0x36, 0x2e, 0x31, 0x30, 0x34, 0x2e, 0x35, 0x36, 0x3a, 0x38, 0x31, 0x32, 0x33, // Addr
+		0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55, // Generation
 		0x0, 0x0, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, // Version
 	}, b)
 }
 
+// Tests protocol version 5 includes the peers address in digests.
+func TestCodec_EncodeDigestAddr(t *testing.T) {
+	digest := Digest{
+		ID:         "node-1",
+		Generation: 0x1122334455,
+		Version:    0xaabbccddeeff,
+		Addr:       "10.26.104.56:8123",
+	}
+	b := encodeDigest(digest, protocolVersion5)
+	decoded, offset, err := decodeDigest(b, 0, protocolVersion5)
+	assert.Nil(t, err)
+	assert.Equal(t, len(b), offset)
+	assert.Equal(t, digest, decoded)
+
+	// The address isn't included in older protocol versions.
+	b = encodeDigest(digest, protocolVersion4)
+	decoded, _, err = decodeDigest(b, 0, protocolVersion4)
+	assert.Nil(t, err)
+	assert.Equal(t, "", decoded.Addr)
+}
+
 func TestCodec_EncodeDelta(t *testing.T) {
-	digest := Delta{
-		Addr:    "10.26.104.56:8123",
-		Key:     "key-123",
-		Value:   "value-123",
-		Version: 0xaabbccddeeff,
+	delta := Delta{
+		ID:         "10.26.104.56:8123",
+		Generation: 0x1122334455,
+		Key:        "key-123",
+		Value:      "value-123",
+		Version:    0xaabbccddeeff,
 	}
-	b := encodeDelta(digest)
+	b, err := encodeDelta(delta, protocolVersion1)
+	assert.Nil(t, err)
 	assert.Equal(t, []byte{
 		0x11, 0x31, 0x30, 0x2e, 0x32, 0x36, 0x2e, 0x31, 0x30, 0x34, 0x2e, 0x35, 0x36, 0x3a, 0x38, 0x31, 0x32, 0x33, // Addr
+		0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55, // Generation
 		0x7, 0x6b, 0x65, 0x79, 0x2d, 0x31, 0x32, 0x33, // Key
 		0x9, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x2d, 0x31, 0x32, 0x33, // Value
 		0x0, 0x0, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, // Version
+		0x0, // Deleted
 	}, b)
 }
 
+// Tests protocol version 2 encodes strings with a varint length prefix.
+func TestCodec_EncodeDeltaV2(t *testing.T) {
+	delta := Delta{
+		ID:         "10.26.104.56:8123",
+		Generation: 0x1122334455,
+		Key:        "key-123",
+		Value:      strings.Repeat("a", 300),
+		Version:    0xaabbccddeeff,
+	}
+	b, err := encodeDelta(delta, protocolVersion2)
+	assert.Nil(t, err)
+
+	expected := []byte{
+		0x11, 0x31, 0x30, 0x2e, 0x32, 0x36, 0x2e, 0x31, 0x30, 0x34, 0x2e, 0x35, 0x36, 0x3a, 0x38, 0x31, 0x32, 0x33, // Addr
+		0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55, // Generation
+		0x7, 0x6b, 0x65, 0x79, 0x2d, 0x31, 0x32, 0x33, // Key
+		0xac, 0x02, // Value length (300 as a varint)
+	}
+	expected = append(expected, []byte(strings.Repeat("a", 300))...)
+	expected = append(expected,
+		0x0, 0x0, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, // Version
+		0x0, // Deleted
+	)
+	assert.Equal(t, expected, b)
+
+	// Protocol version 1 can't encode strings larger than 255 bytes.
+	_, err = encodeDelta(delta, protocolVersion1)
+	assert.ErrorIs(t, err, ErrStringTooLarge)
+}
+
 func TestCodec_DecodeDigestSync(t *testing.T) {
 	sync := []Digest{
 		{
-			Addr:    "10.26.104.56:8123",
+			ID:      "10.26.104.56:8123",
 			Version: 0x10,
 		},
 		{
-			Addr:    "10.26.104.82:9833",
-			Version: 0x20,
+			ID:         "10.26.104.82:9833",
+			Generation: 0x1234,
+			Version:    0x20,
 		},
 		{
-			Addr:    "10.26.104.11:1211",
+			ID:      "10.26.104.11:1211",
 			Version: 0x30,
 		},
 	}
 
-	syncEnc := []byte{}
-	for _, digest := range sync {
-		syncEnc = append(syncEnc, encodeDigest(digest)...)
-	}
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			syncEnc := []byte{}
+			for _, digest := range sync {
+				syncEnc = append(syncEnc, encodeDigest(digest, version)...)
+			}
 
-	assert.Equal(t, decodeDigestSync(syncEnc), sync)
+			decoded, err := decodeDigestSync(syncEnc, version)
+			assert.Nil(t, err)
+			assert.Equal(t, sync, decoded)
+		})
+	}
 }
 
 func TestCodec_DecodeDeltaSync(t *testing.T) {
 	sync := []Delta{
 		{
-			Addr:    "10.26.104.56:8123",
+			ID:      "10.26.104.56:8123",
 			Key:     "key-1",
 			Value:   "value-1",
 			Version: 0x10,
 		},
 		{
-			Addr:    "10.26.104.73:1223",
-			Key:     "key-2",
-			Value:   "value-2",
-			Version: 0x20,
+			ID:         "10.26.104.73:1223",
+			Generation: 0x1234,
+			Key:        "key-2",
+			Value:      "value-2",
+			Version:    0x20,
 		},
 		{
-			Addr:    "10.26.104.12:2389",
+			ID:      "10.26.104.12:2389",
 			Key:     "key-3",
 			Value:   "value-3",
 			Version: 0x30,
 		},
+		{
+			ID:      "10.26.104.12:2389",
+			Key:     "key-4",
+			Version: 0x40,
+			Deleted: true,
+		},
+	}
+
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			syncEnc := []byte{}
+			for _, delta := range sync {
+				syncEnc = append(syncEnc, mustEncodeDelta(delta, version)...)
+			}
+
+			decoded, err := decodeDeltaSync(syncEnc, version)
+			assert.Nil(t, err)
+			assert.Equal(t, sync, decoded)
+		})
+	}
+}
+
+func TestCodec_DecodeDeltaFragment(t *testing.T) {
+	fragment := deltaFragment{
+		ID:    0x1122334455,
+		Index: 3,
+		Count: 5,
+		Data:  []byte{1, 2, 3},
+	}
+	b := encodeDeltaFragment(fragment)
+	assert.Equal(t, []byte{
+		0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55, // ID
+		0x0, 0x3, // Index
+		0x0, 0x5, // Count
+		0x1, 0x2, 0x3, // Data
+	}, b)
+
+	decoded, err := decodeDeltaFragment(b)
+	assert.Nil(t, err)
+	assert.Equal(t, fragment, decoded)
+
+	_, err = decodeDeltaFragment(b[:fragmentHeaderLen-1])
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestCodec_DecodePing(t *testing.T) {
+	b := encodePing(ping{Seq: 0x1122334455})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55}, b)
+
+	decoded, err := decodePing(b)
+	assert.Nil(t, err)
+	assert.Equal(t, ping{Seq: 0x1122334455}, decoded)
+
+	_, err = decodePing(b[:len(b)-1])
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestCodec_DecodePingReq(t *testing.T) {
+	req := pingReq{Seq: 0x1122334455, Target: "10.26.104.56:8123"}
+	b := encodePingReq(req, protocolVersion3)
+
+	decoded, err := decodePingReq(b, protocolVersion3)
+	assert.Nil(t, err)
+	assert.Equal(t, req, decoded)
+
+	for i := 0; i != len(b); i++ {
+		_, err = decodePingReq(b[:i], protocolVersion3)
+		assert.ErrorIs(t, err, ErrTruncated)
+	}
+}
+
+func TestCodec_DecodeAck(t *testing.T) {
+	b := encodeAck(ack{Seq: 0x1122334455})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x11, 0x22, 0x33, 0x44, 0x55}, b)
+
+	decoded, err := decodeAck(b)
+	assert.Nil(t, err)
+	assert.Equal(t, ack{Seq: 0x1122334455}, decoded)
+
+	_, err = decodeAck(b[:len(b)-1])
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+// Tests decoding a truncated message returns an error rather than panicking.
+func TestCodec_DecodeTruncated(t *testing.T) {
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			digestEnc := encodeDigest(Digest{
+				ID:      "node-1",
+				Version: 0x10,
+				Addr:    "10.26.104.56:8123",
+			}, version)
+			for i := 1; i != len(digestEnc); i++ {
+				_, err := decodeDigestSync(digestEnc[:i], version)
+				assert.ErrorIs(t, err, ErrTruncated)
+			}
+
+			deltaEnc := mustEncodeDelta(Delta{
+				ID:      "10.26.104.56:8123",
+				Key:     "key-1",
+				Value:   "value-1",
+				Version: 0x10,
+			}, version)
+			for i := 1; i != len(deltaEnc); i++ {
+				_, err := decodeDeltaSync(deltaEnc[:i], version)
+				assert.ErrorIs(t, err, ErrTruncated)
+			}
+		})
+	}
+
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		headerEnc := encodeHeader(messageHeader{
+			Version:     version,
+			Type:        typeDigestRequest,
+			ClusterName: "my-cluster",
+			Sender:      "10.26.104.56:8123",
+			SenderID:    "node-1",
+		})
+		for i := 0; i != len(headerEnc); i++ {
+			_, _, err := decodeHeader(headerEnc[:i])
+			assert.ErrorIs(t, err, ErrTruncated)
+		}
+	}
+}
+
+func FuzzCodec_DecodeDigestSync(f *testing.F) {
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		f.Add([]byte{}, version)
+		f.Add(encodeDigest(Digest{
+			ID:         "10.26.104.56:8123",
+			Generation: 0x1234,
+			Version:    0x10,
+		}, version), version)
+		f.Add(append(
+			encodeDigest(Digest{ID: "10.26.104.56:8123", Version: 0x10}, version),
+			encodeDigest(Digest{ID: "10.26.104.82:9833", Version: 0x20}, version)...,
+		), version)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte, version uint8) {
+		if version < ProtocolVersionMin || version > ProtocolVersionMax {
+			return
+		}
+
+		sync, err := decodeDigestSync(b, version)
+		if err != nil {
+			return
+		}
+
+		// Re-encoding the digests must decode to the same digests. Note
+		// the encoding isn't canonical since varints may contain redundant
+		// bytes.
+		encoded := []byte{}
+		for _, digest := range sync {
+			encoded = append(encoded, encodeDigest(digest, version)...)
+		}
+		decoded, err := decodeDigestSync(encoded, version)
+		assert.Nil(t, err)
+		assert.Equal(t, sync, decoded)
+	})
+}
+
+func FuzzCodec_DecodeDeltaSync(f *testing.F) {
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		f.Add([]byte{}, version)
+		f.Add(mustEncodeDelta(Delta{
+			ID:         "10.26.104.56:8123",
+			Generation: 0x1234,
+			Key:        "key-1",
+			Value:      "value-1",
+			Version:    0x10,
+		}, version), version)
+		f.Add(append(
+			mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Key: "key-1", Value: "value-1", Version: 0x10}, version),
+			mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Key: "key-2", Version: 0x11, Deleted: true}, version)...,
+		), version)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte, version uint8) {
+		if version < ProtocolVersionMin || version > ProtocolVersionMax {
+			return
+		}
+
+		sync, err := decodeDeltaSync(b, version)
+		if err != nil {
+			return
+		}
+
+		encoded := []byte{}
+		for _, delta := range sync {
+			encoded = append(encoded, mustEncodeDelta(delta, version)...)
+		}
+		decoded, err := decodeDeltaSync(encoded, version)
+		assert.Nil(t, err)
+		assert.Equal(t, sync, decoded)
+	})
+}
+
+func FuzzCodec_DecodeDeltaFragment(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(encodeDeltaFragment(deltaFragment{ID: 1, Index: 0, Count: 2, Data: []byte{1, 2, 3}}))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fragment, err := decodeDeltaFragment(b)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, b, encodeDeltaFragment(fragment))
+	})
+}
+
+func FuzzCodec_DecodePingReq(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(encodePingReq(pingReq{Seq: 1, Target: "10.26.104.56:8123"}, protocolVersion3))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := decodePingReq(b, protocolVersion3)
+		if err != nil {
+			return
+		}
+		decoded, err := decodePingReq(encodePingReq(req, protocolVersion3), protocolVersion3)
+		assert.Nil(t, err)
+		assert.Equal(t, req, decoded)
+	})
+}
+
+func mustEncodeDelta(d Delta, version uint8) []byte {
+	b, err := encodeDelta(d, version)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCodec_DecodePushPullState(t *testing.T) {
+	state := pushPullState{
+		ID: "10.26.104.56:8123",
+		Peers: []peerState{
+			{
+				Digest: Digest{ID: "10.26.104.56:8123", Generation: 0x1234, Version: 0x11},
+				Deltas: []Delta{
+					{ID: "10.26.104.56:8123", Generation: 0x1234, Key: "key-1", Value: "value-1", Version: 0x10},
+					{ID: "10.26.104.56:8123", Generation: 0x1234, Key: "key-2", Version: 0x11, Deleted: true},
+				},
+			},
+			{
+				Digest: Digest{ID: "10.26.104.73:1223"},
+				Deltas: []Delta{},
+			},
+		},
 	}
 
-	syncEnc := []byte{}
-	for _, delta := range sync {
-		syncEnc = append(syncEnc, encodeDelta(delta)...)
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			b, err := encodePushPullState(state, version)
+			assert.Nil(t, err)
+
+			decoded, err := decodePushPullState(b, version)
+			assert.Nil(t, err)
+			assert.Equal(t, state, decoded)
+
+			// Note truncating at a peer boundary is a valid state, since the
+			// frame includes the length of the state.
+			for i := 0; i != len(b); i++ {
+				if _, err := decodePushPullState(b[:i], version); err != nil {
+					assert.ErrorIs(t, err, ErrTruncated)
+				}
+			}
+		})
 	}
+}
+
+func TestCodec_Frame(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, writeFrame(&buf, []byte{1, 2, 3}))
+	assert.Nil(t, writeFrame(&buf, []byte{}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x3, 0x1, 0x2, 0x3, 0x0, 0x0, 0x0, 0x0}, buf.Bytes())
+
+	b, err := readFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, b)
+	b, err = readFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, b)
+
+	// Frames larger than the maximum size are rejected before reading the
+	// frame.
+	_, err = readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.NotNil(t, err)
+	_, err = readFrame(bytes.NewReader([]byte{0x0, 0x0, 0x0, 0x3, 0x1}))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Frames claiming the maximum size that are never sent are truncated.
+	_, err = readFrame(bytes.NewReader([]byte{0x1, 0x0, 0x0, 0x0, 0x1}))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func FuzzCodec_DecodePushPullState(f *testing.F) {
+	for version := uint8(ProtocolVersionMin); version <= ProtocolVersionMax; version++ {
+		b, err := encodePushPullState(pushPullState{
+			ID: "10.26.104.56:8123",
+			Peers: []peerState{
+				{
+					Digest: Digest{ID: "10.26.104.56:8123", Generation: 0x1234, Version: 0x10},
+					Deltas: []Delta{
+						{ID: "10.26.104.56:8123", Generation: 0x1234, Key: "key-1", Value: "value-1", Version: 0x10},
+					},
+				},
+			},
+		}, version)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b, version)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte, version uint8) {
+		if version < ProtocolVersionMin || version > ProtocolVersionMax {
+			return
+		}
+
+		state, err := decodePushPullState(b, version)
+		if err != nil {
+			return
+		}
 
-	assert.Equal(t, decodeDeltaSync(syncEnc), sync)
+		encoded, err := encodePushPullState(state, version)
+		assert.Nil(t, err)
+		decoded, err := decodePushPullState(encoded, version)
+		assert.Nil(t, err)
+		assert.Equal(t, state, decoded)
+	})
 }
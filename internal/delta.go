@@ -5,16 +5,22 @@ import (
 )
 
 type Delta struct {
-	Addr    string
-	Key     string
-	Value   string
-	Version uint64
+	// ID is the ID of the peer the delta updates.
+	ID         string
+	Generation uint64
+	Key        string
+	Value      string
+	Version    uint64
+	// Deleted indicates the delta is a tombstone for a deleted key.
+	Deleted bool
 }
 
 func (e Delta) MarshalLogObject(enc zapcore.ObjectEncoder) error {
-	enc.AddString("addr", e.Addr)
+	enc.AddString("id", e.ID)
+	enc.AddUint64("generation", e.Generation)
 	enc.AddString("key", e.Key)
 	enc.AddString("value", e.Value)
 	enc.AddUint64("version", e.Version)
+	enc.AddBool("deleted", e.Deleted)
 	return nil
 }
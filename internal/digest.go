@@ -5,12 +5,22 @@ import (
 )
 
 type Digest struct {
-	Addr    string
-	Version uint64
+	// ID is the ID of the peer the digest describes.
+	ID         string
+	Generation uint64
+	Version    uint64
+	// Addr is the address of the peer, which is used to reach the peer before
+	// its state has been received. Only included in protocol version 5 and
+	// later, and empty if the address isn't known.
+	Addr string
 }
 
 func (p Digest) MarshalLogObject(enc zapcore.ObjectEncoder) error {
-	enc.AddString("addr", p.Addr)
+	enc.AddString("id", p.ID)
+	enc.AddUint64("generation", p.Generation)
 	enc.AddUint64("version", p.Version)
+	if p.Addr != "" {
+		enc.AddString("addr", p.Addr)
+	}
 	return nil
 }
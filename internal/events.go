@@ -0,0 +1,419 @@
+package internal
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// EventType is the type of change to the cluster an event describes.
+type EventType int
+
+const (
+	// EventJoin indicates a peer joined the cluster, or came back up after
+	// being considered down.
+	EventJoin = EventType(1)
+	// EventLeave indicates a peer left the cluster or was considered down.
+	EventLeave = EventType(2)
+	// EventUpdate indicates a key in a peers state was updated.
+	EventUpdate = EventType(3)
+	// EventDelete indicates a key in a peers state was deleted.
+	EventDelete = EventType(4)
+	// EventRejoin indicates a peer restarted with a new generation so its old
+	// state was discarded.
+	EventRejoin = EventType(5)
+	// EventStatusChange indicates the status of a peer changed, such as from
+	// alive to suspect.
+	EventStatusChange = EventType(6)
+	// EventFlapping indicates a peer is repeatedly failing and recovering, so
+	// its join and leave events are suppressed until it stabilizes.
+	EventFlapping = EventType(7)
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	case EventRejoin:
+		return "rejoin"
+	case EventStatusChange:
+		return "status-change"
+	case EventFlapping:
+		return "flapping"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change to the cluster as known by the local node.
+type Event struct {
+	Type EventType
+	// ID is the ID of the peer the event is about.
+	ID string
+	// Addr is the address of the peer when the event was emitted, or empty if
+	// the peers address isn't known yet (such as when a peer first joins,
+	// since its address is received with the rest of its state).
+	Addr string
+	// Key is the key that was updated or deleted for EventUpdate and
+	// EventDelete.
+	Key string
+	// Value is the updated value for EventUpdate.
+	Value string
+	// LeaveReason is the reason the peer left for EventLeave.
+	LeaveReason LeaveReason
+	// Status is the new status of the peer for EventStatusChange.
+	Status PeerStatus
+	// PrevStatus is the previous status of the peer for EventStatusChange.
+	PrevStatus PeerStatus
+}
+
+func (e Event) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("type", e.Type.String())
+	enc.AddString("id", e.ID)
+	enc.AddString("addr", e.Addr)
+	if e.Type == EventUpdate || e.Type == EventDelete {
+		enc.AddString("key", e.Key)
+	}
+	if e.Type == EventUpdate {
+		enc.AddString("value", e.Value)
+	}
+	if e.Type == EventLeave {
+		enc.AddString("reason", e.LeaveReason.String())
+	}
+	if e.Type == EventStatusChange {
+		enc.AddString("status", e.Status.String())
+		enc.AddString("prev-status", e.PrevStatus.String())
+	}
+	return nil
+}
+
+// SlowConsumerPolicy describes what to do when a subscriber's buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDropOldest discards the oldest buffered event to make room
+	// for the new event.
+	SlowConsumerDropOldest = SlowConsumerPolicy(1)
+	// SlowConsumerDropNewest discards the new event.
+	SlowConsumerDropNewest = SlowConsumerPolicy(2)
+	// SlowConsumerBlock waits for the subscriber to read the event. This only
+	// blocks dispatching to other subscribers, never gossip.
+	SlowConsumerBlock = SlowConsumerPolicy(3)
+	// SlowConsumerUnsubscribe removes the subscriber and closes its channel.
+	SlowConsumerUnsubscribe = SlowConsumerPolicy(4)
+)
+
+type subscriber struct {
+	ch     chan Event
+	filter func(e Event) bool
+	// done is closed when the subscriber is cancelled.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// closed is true once ch is closed.
+	closed bool
+	// mu protects closed and is held while sending to ch, so ch can't be
+	// closed concurrently.
+	mu sync.Mutex
+}
+
+func (s *subscriber) cancel() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// close cancels the subscriber and closes its channel. Cancelling first
+// unblocks any pending send so the channel can be closed.
+func (s *subscriber) close() {
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+}
+
+// EventDispatcher dispatches events to subscribers from its own goroutine, so
+// emitting an event never blocks, and subscribers can't stall gossip or
+// deadlock by calling back into the node.
+//
+// Note this is thread safe.
+type EventDispatcher struct {
+	// queue contains events waiting to be dispatched. This is unbounded so
+	// Emit never blocks.
+	queue  []Event
+	closed bool
+	// emitted and dispatched are the number of events emitted and
+	// dispatched, used to wait for queued events to be dispatched.
+	emitted    uint64
+	dispatched uint64
+	// queueMu protects the above fields.
+	queueMu sync.Mutex
+	// dispatchedCond is signalled when events are dispatched or the
+	// dispatcher is closed.
+	dispatchedCond *sync.Cond
+
+	// subscribers contains the active subscribers.
+	subscribers map[*subscriber]struct{}
+	// subscribersMu protects subscribers. This isn't held while sending to
+	// subscribers, so a blocked subscriber can't block Subscribe or cancel.
+	subscribersMu sync.Mutex
+
+	// notifyCh is signalled when an event is added to the queue.
+	notifyCh chan struct{}
+
+	// handler is an optional handler invoked for every event after the
+	// subscribers.
+	handler func(e Event)
+
+	bufferSize int
+	policy     SlowConsumerPolicy
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	logger *zap.Logger
+}
+
+// NewEventDispatcher creates a dispatcher and starts its dispatch goroutine.
+// Each subscriber has a buffer of bufferSize events, and when the buffer is
+// full events are handled according to policy.
+func NewEventDispatcher(
+	handler func(e Event),
+	bufferSize int,
+	policy SlowConsumerPolicy,
+	logger *zap.Logger,
+) *EventDispatcher {
+	d := &EventDispatcher{
+		queue:       []Event{},
+		subscribers: make(map[*subscriber]struct{}),
+		notifyCh:    make(chan struct{}, 1),
+		handler:     handler,
+		bufferSize:  bufferSize,
+		policy:      policy,
+		done:        make(chan struct{}),
+		logger:      logger,
+	}
+	d.dispatchedCond = sync.NewCond(&d.queueMu)
+
+	d.wg.Add(1)
+	go d.dispatchLoop()
+
+	return d
+}
+
+// Emit queues the event to be dispatched. This never blocks.
+func (d *EventDispatcher) Emit(e Event) {
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	d.queue = append(d.queue, e)
+	d.emitted++
+
+	select {
+	case d.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Flush blocks until all events emitted before the call have been dispatched,
+// or the dispatcher is closed. Note with SlowConsumerBlock this waits for
+// subscribers to read the events.
+func (d *EventDispatcher) Flush() {
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	emitted := d.emitted
+	for d.dispatched < emitted && !d.closed {
+		d.dispatchedCond.Wait()
+	}
+}
+
+// Subscribe returns a channel that receives all events matching the filter
+// (or all events if the filter is nil), and a function to cancel the
+// subscription, which closes the channel.
+func (d *EventDispatcher) Subscribe(filter func(e Event) bool) (<-chan Event, func()) {
+	sub := &subscriber{
+		ch:     make(chan Event, d.bufferSize),
+		filter: filter,
+		done:   make(chan struct{}),
+	}
+
+	d.queueMu.Lock()
+	closed := d.closed
+	d.queueMu.Unlock()
+	if closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+
+	d.subscribers[sub] = struct{}{}
+	return sub.ch, func() {
+		d.unsubscribe(sub)
+	}
+}
+
+// Close stops dispatching events and closes all subscriber channels.
+func (d *EventDispatcher) Close() {
+	d.queueMu.Lock()
+	if d.closed {
+		d.queueMu.Unlock()
+		return
+	}
+	d.closed = true
+	d.dispatchedCond.Broadcast()
+	d.queueMu.Unlock()
+
+	close(d.done)
+	d.wg.Wait()
+
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+
+	for sub := range d.subscribers {
+		d.removeSubscriber(sub)
+	}
+}
+
+func (d *EventDispatcher) unsubscribe(sub *subscriber) {
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+
+	if _, ok := d.subscribers[sub]; !ok {
+		return
+	}
+	d.removeSubscriber(sub)
+}
+
+// removeSubscriber removes the subscriber and closes its channel.
+//
+// Note must hold subscribersMu.
+func (d *EventDispatcher) removeSubscriber(sub *subscriber) {
+	delete(d.subscribers, sub)
+	sub.close()
+}
+
+func (d *EventDispatcher) dispatchLoop() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.notifyCh:
+		case <-d.done:
+			return
+		}
+
+		for {
+			d.queueMu.Lock()
+			if len(d.queue) == 0 {
+				d.queueMu.Unlock()
+				break
+			}
+			events := d.queue
+			d.queue = []Event{}
+			d.queueMu.Unlock()
+
+			for _, e := range events {
+				d.dispatch(e)
+			}
+
+			d.queueMu.Lock()
+			d.dispatched += uint64(len(events))
+			d.dispatchedCond.Broadcast()
+			d.queueMu.Unlock()
+		}
+	}
+}
+
+func (d *EventDispatcher) dispatch(e Event) {
+	d.dispatchSubscribers(e)
+
+	if d.handler != nil {
+		d.handler(e)
+	}
+}
+
+func (d *EventDispatcher) dispatchSubscribers(e Event) {
+	// Copy the subscribers so the lock isn't held while sending.
+	d.subscribersMu.Lock()
+	subscribers := make([]*subscriber, 0, len(d.subscribers))
+	for sub := range d.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	d.subscribersMu.Unlock()
+
+	for _, sub := range subscribers {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+
+		if !d.send(sub, e) {
+			d.logger.Warn("subscriber buffer full; unsubscribing")
+			d.unsubscribe(sub)
+		}
+	}
+}
+
+// send sends the event to the subscriber, handling a full buffer according
+// to the slow consumer policy. Returns false if the subscriber should be
+// unsubscribed.
+func (d *EventDispatcher) send(sub *subscriber, e Event) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	// The subscriber may have been cancelled since the subscribers were
+	// copied.
+	if sub.closed {
+		return true
+	}
+
+	select {
+	case sub.ch <- e:
+		return true
+	default:
+	}
+
+	switch d.policy {
+	case SlowConsumerDropOldest:
+		// Discard the oldest event then retry. Since the subscriber may
+		// read concurrently don't block if the buffer changed.
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	case SlowConsumerDropNewest:
+		d.logger.Debug("subscriber buffer full; dropping event", zap.Object("event", e))
+	case SlowConsumerBlock:
+		select {
+		case sub.ch <- e:
+		case <-sub.done:
+		case <-d.done:
+		}
+	case SlowConsumerUnsubscribe:
+		return false
+	}
+	return true
+}
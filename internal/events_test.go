@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestEventDispatcher_Subscribe(t *testing.T) {
+	d := NewEventDispatcher(nil, 16, SlowConsumerDropOldest, zap.NewNop())
+	defer d.Close()
+
+	allCh, cancelAll := d.Subscribe(nil)
+	defer cancelAll()
+	joinCh, cancelJoin := d.Subscribe(func(e Event) bool {
+		return e.Type == EventJoin
+	})
+	defer cancelJoin()
+
+	d.Emit(Event{Type: EventJoin, ID: "10.26.104.11:8119"})
+	d.Emit(Event{Type: EventUpdate, ID: "10.26.104.11:8119", Key: "foo", Value: "bar"})
+
+	assert.Equal(t, Event{Type: EventJoin, ID: "10.26.104.11:8119"}, waitEvent(t, allCh))
+	assert.Equal(t, Event{Type: EventUpdate, ID: "10.26.104.11:8119", Key: "foo", Value: "bar"}, waitEvent(t, allCh))
+	assert.Equal(t, Event{Type: EventJoin, ID: "10.26.104.11:8119"}, waitEvent(t, joinCh))
+}
+
+func TestEventDispatcher_Cancel(t *testing.T) {
+	d := NewEventDispatcher(nil, 16, SlowConsumerDropOldest, zap.NewNop())
+	defer d.Close()
+
+	ch, cancel := d.Subscribe(nil)
+	cancel()
+	// Cancelling twice should do nothing.
+	cancel()
+
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestEventDispatcher_CloseClosesSubscribers(t *testing.T) {
+	d := NewEventDispatcher(nil, 16, SlowConsumerDropOldest, zap.NewNop())
+
+	ch, cancel := d.Subscribe(nil)
+	d.Close()
+	// Cancelling after closing should do nothing.
+	cancel()
+
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestEventDispatcher_SlowConsumer(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Policy   SlowConsumerPolicy
+		Expected []string
+		Closed   bool
+	}{
+		{
+			Name:     "drop oldest",
+			Policy:   SlowConsumerDropOldest,
+			Expected: []string{"3", "4"},
+		},
+		{
+			Name:     "drop newest",
+			Policy:   SlowConsumerDropNewest,
+			Expected: []string{"1", "2"},
+		},
+		{
+			Name:     "unsubscribe",
+			Policy:   SlowConsumerUnsubscribe,
+			Expected: []string{"1", "2"},
+			Closed:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			// Use a handler to wait for all events to be dispatched, which
+			// is called after dispatching to subscribers.
+			dispatched := make(chan struct{}, 16)
+			d := NewEventDispatcher(func(e Event) {
+				dispatched <- struct{}{}
+			}, 2, test.Policy, zap.NewNop())
+			defer d.Close()
+
+			ch, cancel := d.Subscribe(nil)
+			defer cancel()
+
+			for _, key := range []string{"1", "2", "3", "4"} {
+				d.Emit(Event{Type: EventUpdate, Key: key})
+			}
+			for i := 0; i != 4; i++ {
+				<-dispatched
+			}
+
+			keys := []string{}
+			for len(keys) != len(test.Expected) {
+				e := waitEvent(t, ch)
+				keys = append(keys, e.Key)
+			}
+			assert.Equal(t, test.Expected, keys)
+
+			if test.Closed {
+				_, ok := <-ch
+				assert.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestEventDispatcher_SlowConsumerBlock(t *testing.T) {
+	d := NewEventDispatcher(nil, 1, SlowConsumerBlock, zap.NewNop())
+	defer d.Close()
+
+	ch, cancel := d.Subscribe(nil)
+	defer cancel()
+
+	// Emitting must never block even though the subscriber is blocked.
+	for i := 0; i != 100; i++ {
+		d.Emit(Event{Type: EventUpdate, Value: "v"})
+	}
+
+	for i := 0; i != 100; i++ {
+		waitEvent(t, ch)
+	}
+}
+
+// Tests a blocked subscriber doesn't block subscribing or cancelling other
+// subscribers.
+func TestEventDispatcher_SlowConsumerBlockSubscribe(t *testing.T) {
+	d := NewEventDispatcher(nil, 1, SlowConsumerBlock, zap.NewNop())
+	defer d.Close()
+
+	blockedCh, cancelBlocked := d.Subscribe(nil)
+
+	// Fill the blocked subscribers buffer and block dispatching on the next
+	// event.
+	d.Emit(Event{Type: EventUpdate, Value: "1"})
+	d.Emit(Event{Type: EventUpdate, Value: "2"})
+	assert.Eventually(t, func() bool {
+		return len(blockedCh) == 1
+	}, time.Second, time.Millisecond)
+
+	subscribed := make(chan struct{})
+	go func() {
+		_, cancel := d.Subscribe(nil)
+		cancel()
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out subscribing")
+	}
+
+	// Cancelling the blocked subscriber unblocks dispatching and closes its
+	// channel.
+	cancelBlocked()
+	e := waitEvent(t, blockedCh)
+	assert.Equal(t, "1", e.Value)
+	_, ok := <-blockedCh
+	assert.False(t, ok)
+}
+
+func TestEventDispatcher_Flush(t *testing.T) {
+	var events []Event
+	d := NewEventDispatcher(func(e Event) {
+		events = append(events, e)
+	}, 16, SlowConsumerDropOldest, zap.NewNop())
+	defer d.Close()
+
+	for i := 0; i != 100; i++ {
+		d.Emit(Event{Type: EventJoin, ID: fmt.Sprintf("peer-%d", i)})
+		d.Flush()
+		assert.Equal(t, i+1, len(events))
+		assert.Equal(t, fmt.Sprintf("peer-%d", i), events[i].ID)
+	}
+
+	// Flushing with no events or once closed must not block.
+	d.Flush()
+	d.Close()
+	d.Emit(Event{Type: EventJoin, ID: "peer-100"})
+	d.Flush()
+}
+
+func waitEvent(t *testing.T, ch <-chan Event) Event {
+	select {
+	case e, ok := <-ch:
+		assert.True(t, ok)
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
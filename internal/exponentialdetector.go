@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// ExponentialDetector is a phi accrual failure detector that assumes the
+// intervals between heartbeats follow an exponential distribution, as used by
+// Cassandra. This only depends on the mean interval so is cheap to compute.
+type ExponentialDetector struct {
+	threshold              float64
+	maxSampleSize          int
+	firstHeartbeatEstimate time.Duration
+
+	windows map[string]*ArrivalWindow
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+// NewExponentialDetector returns an exponential failure detector.
+//
+// threshold is the value of phi at which a peer is considered down.
+// maxSampleSize is the number of intervals between heartbeats used to
+// calculate the mean. firstHeartbeatEstimate is used as the interval before
+// any heartbeats are received, which should be a high estimate to avoid false
+// positives before there are enough samples.
+func NewExponentialDetector(threshold float64, maxSampleSize int, firstHeartbeatEstimate time.Duration) *ExponentialDetector {
+	return &ExponentialDetector{
+		threshold:              threshold,
+		maxSampleSize:          maxSampleSize,
+		firstHeartbeatEstimate: firstHeartbeatEstimate,
+		windows:                make(map[string]*ArrivalWindow),
+	}
+}
+
+func (d *ExponentialDetector) Report(id string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	window, ok := d.windows[id]
+	if !ok {
+		window = NewArrivalWindow(uint64(d.firstHeartbeatEstimate), d.maxSampleSize)
+		d.windows[id] = window
+	}
+	window.Add(uint64(now.UnixNano()))
+}
+
+// Suspicion returns the phi of the peer.
+func (d *ExponentialDetector) Suspicion(id string, now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	window, ok := d.windows[id]
+	if !ok {
+		// If we have never received any heartbeats from the node, start by
+		// assuming it is alive, though add an initial bootstrap interval so we
+		// can eventually detect the node as down if we never receive any
+		// heartbeats.
+		window = NewArrivalWindow(uint64(d.firstHeartbeatEstimate), d.maxSampleSize)
+		window.Add(uint64(now.UnixNano()))
+		d.windows[id] = window
+	}
+	return window.Phi(uint64(now.UnixNano()))
+}
+
+func (d *ExponentialDetector) Available(id string, now time.Time) bool {
+	return d.Suspicion(id, now) <= d.threshold
+}
+
+func (d *ExponentialDetector) Remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.windows, id)
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialDetector(t *testing.T) {
+	tests := []struct {
+		Name       string
+		Available  bool
+		Timestamps []int64
+		Now        int64
+		SampleSize int
+	}{
+		{
+			Name:       "bootstrap status",
+			Available:  true,
+			Timestamps: []int64{100},
+			Now:        200,
+			SampleSize: 10,
+		},
+		{
+			Name:       "peer up",
+			Available:  true,
+			Timestamps: []int64{100, 200, 300, 400, 500, 600},
+			Now:        700,
+			SampleSize: 5,
+		},
+		{
+			Name:       "peer down",
+			Available:  false,
+			Timestamps: []int64{100, 200, 300, 400, 500, 600},
+			Now:        3000,
+			SampleSize: 5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			fd := NewExponentialDetector(8.0, test.SampleSize, 2000)
+			for _, ts := range test.Timestamps {
+				fd.Report("my-endpoint", time.Unix(0, ts))
+			}
+
+			assert.Equal(
+				t,
+				test.Available,
+				fd.Available("my-endpoint", time.Unix(0, test.Now)),
+			)
+		})
+	}
+}
+
+func TestExponentialDetector_BootstrapUnknownPeer(t *testing.T) {
+	fd := NewExponentialDetector(8.0, 10, 2000)
+
+	// The first query is treated as a heartbeat.
+	assert.True(t, fd.Available("my-endpoint", time.Unix(0, 1000)))
+	assert.Equal(t, 0.0, fd.Suspicion("my-endpoint", time.Unix(0, 1000)))
+	assert.False(t, fd.Available("my-endpoint", time.Unix(0, 100000)))
+
+	fd.Remove("my-endpoint")
+	assert.True(t, fd.Available("my-endpoint", time.Unix(0, 100000)))
+}
+
+// Tests heartbeats reported out of order don't corrupt the mean interval.
+func TestExponentialDetector_OutOfOrderReport(t *testing.T) {
+	fd := NewExponentialDetector(8.0, 5, 2000)
+	for _, ts := range []int64{100, 200, 300, 400, 500, 600} {
+		fd.Report("my-endpoint", time.Unix(0, ts))
+	}
+	// Reports before or at the last heartbeat are ignored.
+	fd.Report("my-endpoint", time.Unix(0, 550))
+	fd.Report("my-endpoint", time.Unix(0, 600))
+
+	assert.True(t, fd.Available("my-endpoint", time.Unix(0, 700)))
+	assert.False(t, fd.Available("my-endpoint", time.Unix(0, 3000)))
+}
+
+// Tests checking suspicion with a time before the last heartbeat doesn't
+// suspect the peer.
+func TestExponentialDetector_SuspicionBeforeLastReport(t *testing.T) {
+	fd := NewExponentialDetector(8.0, 5, 2000)
+	for _, ts := range []int64{100, 200, 300, 400, 500, 600} {
+		fd.Report("my-endpoint", time.Unix(0, ts))
+	}
+
+	assert.Equal(t, 0.0, fd.Suspicion("my-endpoint", time.Unix(0, 550)))
+	assert.True(t, fd.Available("my-endpoint", time.Unix(0, 550)))
+}
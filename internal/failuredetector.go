@@ -1,88 +1,30 @@
 package internal
 
 import (
-	"sync"
 	"time"
 )
 
-type PeerStatus int
-
-const (
-	PeerStatusUp   = PeerStatus(1)
-	PeerStatusDown = PeerStatus(2)
-)
-
-// FailureDetector is a failure detector that detects down nodes based on
-// incoming heartbeats.
+// FailureDetector detects whether peers are down based on the heartbeats
+// received from them.
 //
-// This implements the paper "The Phi Accrual Failure Detector".
-type FailureDetector struct {
-	// mu is a mutex protecting the below fields
-	mu sync.Mutex
-
-	windows map[string]*ArrivalWindow
-
-	sampleSize     int
-	gossipInterval uint64
-
-	convictThreshold float64
-}
-
-func NewFailureDetector(gossipInterval uint64, sampleSize int, convictThreshold float64) *FailureDetector {
-	return &FailureDetector{
-		windows:          make(map[string]*ArrivalWindow),
-		sampleSize:       sampleSize,
-		gossipInterval:   gossipInterval,
-		convictThreshold: convictThreshold,
-	}
-}
-
-func (fd *FailureDetector) PeerStatus(endpoint string) PeerStatus {
-	return fd.PeerStatusAtTimestamp(endpoint, uint64(time.Now().UnixNano()))
-}
-
-func (fd *FailureDetector) PeerStatusAtTimestamp(endpoint string, timestampNano uint64) PeerStatus {
-	fd.mu.Lock()
-	defer fd.mu.Unlock()
-
-	window, ok := fd.windows[endpoint]
-	if !ok {
-		// If we have never received any heartbeats from the node, start by
-		// assuming it is alive, though add an initial bootstrap interval so we
-		// can eventually detect the node as down if we never receive any
-		// heartbeats.
-		window = NewArrivalWindow(fd.gossipInterval, fd.sampleSize)
-		window.Add(timestampNano)
-		fd.windows[endpoint] = window
-	}
-
-	phi := window.Phi(timestampNano)
-	if phi > fd.convictThreshold {
-		return PeerStatusDown
-	}
-	return PeerStatusUp
-}
-
-func (fd *FailureDetector) Report(endpoint string) {
-	fd.ReportWithTimestamp(endpoint, uint64(time.Now().UnixNano()))
-}
-
-func (fd *FailureDetector) ReportWithTimestamp(endpoint string, timestampNano uint64) {
-	fd.mu.Lock()
-	defer fd.mu.Unlock()
-
-	window, ok := fd.windows[endpoint]
-	if !ok {
-		window = NewArrivalWindow(fd.gossipInterval, fd.sampleSize)
-		fd.windows[endpoint] = window
-	}
-
-	window.Add(timestampNano)
-}
-
-func (fd *FailureDetector) RemovePeer(endpoint string) {
-	fd.mu.Lock()
-	defer fd.mu.Unlock()
-
-	delete(fd.windows, endpoint)
+// If no heartbeats have been received from a peer, the first call to
+// Suspicion or Available should be treated as a heartbeat, so a peer that is
+// never heard from is eventually considered down.
+//
+// Note implementations must be thread safe.
+type FailureDetector interface {
+	// Report records a heartbeat from the peer with the given ID received
+	// at the given time.
+	Report(id string, now time.Time)
+
+	// Suspicion returns the suspicion level of the peer at the given time,
+	// where a higher value means the peer is more likely to be down. The
+	// scale of the suspicion level depends on the implementation.
+	Suspicion(id string, now time.Time) float64
+
+	// Available returns whether the peer is considered up at the given time.
+	Available(id string, now time.Time) bool
+
+	// Remove discards the heartbeats received from the peer.
+	Remove(id string)
 }
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FileSeeds is a SeedProvider that reads seed addresses from a file.
+//
+// The file either contains one address per line, where empty lines and lines
+// starting with # are ignored, or a JSON array of addresses.
+//
+// If the reload interval is non-zero, the file is watched for changes by
+// re-reading it every interval, otherwise the file is re-read each time seeds
+// are requested. If the file can't be read or contains an invalid address, the
+// error is logged and passed to the error callback, and the seeds from the
+// last valid version of the file are kept.
+//
+// Note this is thread safe.
+type FileSeeds struct {
+	path string
+
+	// content is the content of the file when it was last loaded, used to
+	// detect when the file changes.
+	content []byte
+	// seeds contains the seeds from the last valid version of the file.
+	seeds []string
+	// err is the error loading the file, or nil if the last load succeeded.
+	err error
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	reloadInterval time.Duration
+	onError        func(err error)
+	clock          Clock
+	done           chan struct{}
+	wg             sync.WaitGroup
+	logger         *zap.Logger
+}
+
+// NewFileSeeds returns a provider that reads seed addresses from the file at
+// the given path, which is loaded before returning.
+//
+// If reloadInterval is non-zero the file is watched for changes until the
+// provider is closed. onError is called with the error each time the file
+// fails to load with a new error, or may be nil.
+func NewFileSeeds(
+	path string,
+	reloadInterval time.Duration,
+	onError func(err error),
+	clock Clock,
+	logger *zap.Logger,
+) *FileSeeds {
+	s := &FileSeeds{
+		path:           path,
+		reloadInterval: reloadInterval,
+		onError:        onError,
+		clock:          clock,
+		done:           make(chan struct{}),
+		logger:         logger,
+	}
+	// Errors are reported through the logger and callback.
+	_ = s.Reload()
+
+	if reloadInterval > 0 {
+		s.wg.Add(1)
+		go s.watchLoop()
+	}
+	return s
+}
+
+// Seeds returns the seeds from the last valid version of the file. If the
+// file currently fails to load the error is also returned.
+func (s *FileSeeds) Seeds(ctx context.Context) ([]string, error) {
+	if s.reloadInterval == 0 {
+		// Errors are returned below.
+		_ = s.Reload()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seeds := make([]string, len(s.seeds))
+	copy(seeds, s.seeds)
+	return seeds, s.err
+}
+
+// Reload reads the file, updating the seeds if the file has changed. If the
+// file can't be read or is invalid, the previous seeds are kept and the error
+// is returned.
+func (s *FileSeeds) Reload() error {
+	reported, err := s.load()
+	// Call without holding mu as the callback may use the provider.
+	if reported && s.onError != nil {
+		s.onError(err)
+	}
+	return err
+}
+
+// load reads the file, updating the seeds if the file has changed. Returns
+// whether the error loading the file is new so should be reported, and the
+// error.
+func (s *FileSeeds) load() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return s.setErr(fmt.Errorf("seeds file: %w", err))
+	}
+	if s.err == nil && s.content != nil && bytes.Equal(b, s.content) {
+		return false, nil
+	}
+
+	seeds, err := parseSeeds(b)
+	if err != nil {
+		return s.setErr(fmt.Errorf("seeds file: %s: %w", s.path, err))
+	}
+
+	s.logger.Info(
+		"loaded seeds file",
+		zap.String("path", s.path),
+		zap.Strings("seeds", seeds),
+	)
+
+	s.content = b
+	s.seeds = seeds
+	s.err = nil
+	return false, nil
+}
+
+// Close stops watching the file.
+func (s *FileSeeds) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+// setErr records the error loading the file. If the error differs from the
+// last error it is logged and should be reported, so a file that stays
+// invalid isn't reported on every reload. Returns whether the error should be
+// reported, and the error.
+//
+// Note must hold mu.
+func (s *FileSeeds) setErr(err error) (bool, error) {
+	if s.err != nil && s.err.Error() == err.Error() {
+		return false, s.err
+	}
+	s.err = err
+
+	s.logger.Warn(
+		"failed to load seeds file; keeping previous seeds",
+		zap.String("path", s.path),
+		zap.Error(err),
+	)
+	return true, err
+}
+
+func (s *FileSeeds) watchLoop() {
+	defer s.wg.Done()
+
+	ticker := s.clock.NewTicker(s.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			// Errors are reported through the logger and callback.
+			_ = s.Reload()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// parseSeeds parses the seed addresses from the content of a seeds file,
+// either a JSON array of addresses or one address per line. Returns an error
+// if any address is invalid.
+func parseSeeds(b []byte) ([]string, error) {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(b, &addrs); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		seeds := []string{}
+		for i, addr := range addrs {
+			addr = strings.TrimSpace(addr)
+			if err := validateAddr(addr); err != nil {
+				return nil, fmt.Errorf("entry %d: invalid address: %w", i, err)
+			}
+			seeds = append(seeds, addr)
+		}
+		return seeds, nil
+	}
+
+	seeds := []string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validateAddr(line); err != nil {
+			return nil, fmt.Errorf("line %d: invalid address: %w", i+1, err)
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, nil
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// errorRecorder records the errors passed to an error callback.
+type errorRecorder struct {
+	errs []error
+	mu   sync.Mutex
+}
+
+func (r *errorRecorder) OnError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error{}, r.errs...)
+}
+
+func writeSeedsFile(t *testing.T, path string, content string) {
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestFileSeeds_Lines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	writeSeedsFile(t, path, `# seeds
+10.26.104.52:8229
+
+  [fd00::1]:8229
+`)
+
+	provider := NewFileSeeds(path, 0, nil, NewRealClock(), zap.NewNop())
+	defer provider.Close()
+
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "[fd00::1]:8229"}, seeds)
+
+	// Without a reload interval, updates to the file are used on the next
+	// call.
+	writeSeedsFile(t, path, "10.26.104.53:8229\n")
+	seeds, err = provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.53:8229"}, seeds)
+}
+
+func TestFileSeeds_JSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.json")
+	writeSeedsFile(t, path, `
+["10.26.104.52:8229", "[fd00::1]:8229"]
+`)
+
+	provider := NewFileSeeds(path, 0, nil, NewRealClock(), zap.NewNop())
+	defer provider.Close()
+
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "[fd00::1]:8229"}, seeds)
+}
+
+// Tests if the file becomes invalid the error is reported once and the
+// previous seeds are kept, until the file is fixed.
+func TestFileSeeds_InvalidKeepsPreviousSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	writeSeedsFile(t, path, "10.26.104.52:8229\n")
+
+	var recorder errorRecorder
+	provider := NewFileSeeds(path, 0, recorder.OnError, NewRealClock(), zap.NewNop())
+	defer provider.Close()
+
+	for _, content := range []string{
+		"10.26.104.53:8229\n10.26.104.54\n",
+		"[\"10.26.104.53:8229\"",
+		"[\"10.26.104.53:0\"]",
+	} {
+		writeSeedsFile(t, path, content)
+
+		// Reload twice to check the same error is only reported once.
+		assert.NotNil(t, provider.Reload())
+		assert.NotNil(t, provider.Reload())
+
+		seeds, err := provider.Seeds(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"10.26.104.52:8229"}, seeds)
+	}
+	assert.Equal(t, 3, len(recorder.Errors()))
+
+	writeSeedsFile(t, path, "10.26.104.53:8229\n")
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.53:8229"}, seeds)
+	assert.Equal(t, 3, len(recorder.Errors()))
+}
+
+func TestFileSeeds_NotFound(t *testing.T) {
+	var recorder errorRecorder
+	provider := NewFileSeeds(filepath.Join(t.TempDir(), "seeds"), 0, recorder.OnError, NewRealClock(), zap.NewNop())
+	defer provider.Close()
+
+	seeds, err := provider.Seeds(context.Background())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, []string{}, seeds)
+
+	errs := recorder.Errors()
+	assert.Equal(t, 1, len(errs))
+	assert.ErrorIs(t, errs[0], os.ErrNotExist)
+}
+
+// Tests the file is watched for changes when a reload interval is
+// configured.
+func TestFileSeeds_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	writeSeedsFile(t, path, "10.26.104.52:8229\n")
+
+	clock := NewManualClock(time.Unix(1000, 0))
+	provider := NewFileSeeds(path, time.Second, nil, clock, zap.NewNop())
+	defer provider.Close()
+
+	writeSeedsFile(t, path, "10.26.104.53:8229\n")
+
+	// The file isn't reloaded until the reload interval.
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229"}, seeds)
+
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		seeds, err := provider.Seeds(context.Background())
+		return err == nil && len(seeds) == 1 && seeds[0] == "10.26.104.53:8229"
+	}, time.Second*5, time.Millisecond*10)
+}
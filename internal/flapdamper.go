@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FlapDampingConfig configures damping of join and leave events for peers
+// that repeatedly fail and recover, like BGP route flap damping.
+type FlapDampingConfig struct {
+	// Penalty is added to the peers penalty each time the peer fails. If 0
+	// flap damping is disabled.
+	Penalty float64
+	// SuppressLimit is the penalty at which the peers join and leave
+	// events are suppressed.
+	SuppressLimit float64
+	// ReuseLimit is the penalty below which a suppressed peers events
+	// are no longer suppressed.
+	ReuseLimit float64
+	// HalfLife is the time for the penalty to decay by half.
+	HalfLife time.Duration
+	// MaxSuppressTime is the maximum time a peer is suppressed after its last
+	// failure, which limits the penalty.
+	MaxSuppressTime time.Duration
+}
+
+type flapState struct {
+	penalty float64
+	// updated is the time penalty was last decayed.
+	updated time.Time
+	// suppressed is whether the peers join and leave events are being
+	// suppressed.
+	suppressed bool
+	// notifiedUp is whether the last join or leave event emitted for the
+	// peer was a join.
+	notifiedUp bool
+	// up is whether the peer is currently up, which may differ from
+	// notifiedUp while the peer is suppressed.
+	up bool
+	// addr is the last known address of the peer, which is included in
+	// events emitted once the peer is reused.
+	addr string
+}
+
+// FlapDamper sits between the peer map and the event dispatcher, suppressing
+// the join and leave events of peers that are flapping between up and down.
+//
+// Each time a peer fails a penalty is added, which decays exponentially. Once
+// the penalty exceeds the suppress limit, an EventFlapping is emitted and
+// the peers join and leave events are suppressed. Once the penalty decays
+// below the reuse limit the peer is no longer suppressed, and if the peers
+// status changed while suppressed a join or leave is emitted so subscribers
+// learn the peers current status.
+//
+// Note this is thread safe.
+type FlapDamper struct {
+	config FlapDampingConfig
+	// maxPenalty is the penalty that takes MaxSuppressTime to decay to the
+	// reuse limit.
+	maxPenalty float64
+
+	peers map[string]*flapState
+	// mu protects the above fields. mu is held while emitting events so
+	// events are emitted in order.
+	mu sync.Mutex
+
+	emit   func(e Event)
+	clock  Clock
+	logger *zap.Logger
+}
+
+// NewFlapDamper returns a damper that passes events on to emit.
+func NewFlapDamper(config FlapDampingConfig, emit func(e Event), clock Clock, logger *zap.Logger) *FlapDamper {
+	maxPenalty := math.Inf(1)
+	if config.HalfLife > 0 && config.MaxSuppressTime > 0 {
+		maxPenalty = config.ReuseLimit * math.Exp2(float64(config.MaxSuppressTime)/float64(config.HalfLife))
+	}
+	return &FlapDamper{
+		config:     config,
+		maxPenalty: maxPenalty,
+		peers:      make(map[string]*flapState),
+		emit:       emit,
+		clock:      clock,
+		logger:     logger,
+	}
+}
+
+// OnEvent handles an event from the peer map, passing it on unless it is
+// suppressed.
+func (d *FlapDamper) OnEvent(e Event) {
+	if d.config.Penalty == 0 {
+		d.emit(e)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case e.Type == EventJoin:
+		state, ok := d.peers[e.ID]
+		if !ok {
+			d.emit(e)
+			return
+		}
+		state.up = true
+		state.setAddr(e.Addr)
+		if state.suppressed {
+			return
+		}
+		state.notifiedUp = true
+		d.emit(e)
+	case e.Type == EventLeave && e.LeaveReason == LeaveReasonFailed:
+		now := d.clock.Now()
+		state, ok := d.peers[e.ID]
+		if !ok {
+			// The peer must have been up to fail, and since the peer
+			// wasn't suppressed subscribers were notified it was up.
+			state = &flapState{updated: now, notifiedUp: true}
+			d.peers[e.ID] = state
+		}
+		state.up = false
+		state.setAddr(e.Addr)
+		state.penalty = d.decay(state, now) + d.config.Penalty
+		if state.penalty > d.maxPenalty {
+			state.penalty = d.maxPenalty
+		}
+		state.updated = now
+
+		if state.suppressed {
+			return
+		}
+		if state.penalty >= d.config.SuppressLimit {
+			d.logger.Warn(
+				"peer flapping; suppressing join and leave events",
+				zap.String("id", e.ID),
+				zap.Float64("penalty", state.penalty),
+			)
+			state.suppressed = true
+			d.emit(Event{
+				Type: EventFlapping,
+				ID:   e.ID,
+				Addr: e.Addr,
+			})
+			return
+		}
+		state.notifiedUp = false
+		d.emit(e)
+	case e.Type == EventLeave:
+		// A peer that gracefully left or was removed won't come back
+		// without restarting, so stop damping the peer. If subscribers were
+		// last notified the peer was down theres no need to notify them
+		// again.
+		state, ok := d.peers[e.ID]
+		if ok {
+			delete(d.peers, e.ID)
+			if !state.notifiedUp {
+				return
+			}
+		}
+		d.emit(e)
+	default:
+		d.emit(e)
+	}
+}
+
+// Reuse decays the penalty of each peer, and stops suppressing peers whose
+// penalty has decayed below the reuse limit. Returns the sorted IDs of the
+// peers that are no longer suppressed.
+func (d *FlapDamper) Reuse() []string {
+	if d.config.Penalty == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+
+	// Sort so events are emitted in a deterministic order.
+	ids := make([]string, 0, len(d.peers))
+	for id := range d.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	reused := []string{}
+	for _, id := range ids {
+		state := d.peers[id]
+		state.penalty = d.decay(state, now)
+		state.updated = now
+
+		if !state.suppressed {
+			// Once the penalty is negligible discard the state.
+			if state.penalty < 1 {
+				delete(d.peers, id)
+			}
+			continue
+		}
+		if state.penalty >= d.config.ReuseLimit {
+			continue
+		}
+
+		d.logger.Info(
+			"peer stopped flapping",
+			zap.String("id", id),
+			zap.Bool("up", state.up),
+		)
+		state.suppressed = false
+		reused = append(reused, id)
+
+		// Notify subscribers if the peers status changed while suppressed.
+		if state.up == state.notifiedUp {
+			continue
+		}
+		state.notifiedUp = state.up
+		if state.up {
+			d.emit(Event{
+				Type: EventJoin,
+				ID:   id,
+				Addr: state.addr,
+			})
+		} else {
+			d.emit(Event{
+				Type:        EventLeave,
+				ID:          id,
+				Addr:        state.addr,
+				LeaveReason: LeaveReasonFailed,
+			})
+		}
+	}
+	return reused
+}
+
+// Suppressed returns whether the join and leave events of the peer with the
+// given ID are being suppressed.
+func (d *FlapDamper) Suppressed(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.peers[id]
+	return ok && state.suppressed
+}
+
+// setAddr records the peers address from an event, unless the event doesn't
+// include the address.
+func (s *flapState) setAddr(addr string) {
+	if addr != "" {
+		s.addr = addr
+	}
+}
+
+// decay returns the peers penalty decayed to the given time.
+//
+// Note must hold mu.
+func (d *FlapDamper) decay(state *flapState, now time.Time) float64 {
+	if d.config.HalfLife <= 0 {
+		return state.penalty
+	}
+	elapsed := now.Sub(state.updated)
+	if elapsed <= 0 {
+		return state.penalty
+	}
+	return state.penalty * math.Exp2(-float64(elapsed)/float64(d.config.HalfLife))
+}
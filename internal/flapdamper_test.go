@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var testFlapDampingConfig = FlapDampingConfig{
+	Penalty:         1000,
+	SuppressLimit:   2000,
+	ReuseLimit:      750,
+	HalfLife:        time.Minute,
+	MaxSuppressTime: time.Minute * 5,
+}
+
+func joinEvent(id string) Event {
+	return Event{Type: EventJoin, ID: id}
+}
+
+func failedEvent(id string) Event {
+	return Event{Type: EventLeave, ID: id, LeaveReason: LeaveReasonFailed}
+}
+
+// Tests a peer that fails and recovers occasionally isn't suppressed.
+func TestFlapDamper_NotFlapping(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	for i := 0; i != 5; i++ {
+		d.OnEvent(failedEvent("node-a"))
+		d.OnEvent(joinEvent("node-a"))
+		clock.Advance(time.Minute * 5)
+		d.Reuse()
+	}
+
+	assert.Equal(t, 10, len(events))
+	assert.False(t, d.Suppressed("node-a"))
+}
+
+// Tests a flapping peers join and leave events are suppressed, and once the
+// peer stabilizes subscribers are notified of its current status.
+func TestFlapDamper_Flapping(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	for i := 0; i != 5; i++ {
+		d.OnEvent(failedEvent("node-a"))
+		d.OnEvent(joinEvent("node-a"))
+		clock.Advance(time.Second)
+		d.Reuse()
+	}
+	// Other peers are unaffected.
+	d.OnEvent(failedEvent("node-b"))
+	// The peer ends down.
+	d.OnEvent(failedEvent("node-a"))
+
+	assert.Equal(t, []Event{
+		failedEvent("node-a"),
+		joinEvent("node-a"),
+		failedEvent("node-a"),
+		joinEvent("node-a"),
+		{Type: EventFlapping, ID: "node-a"},
+		failedEvent("node-b"),
+	}, events)
+	assert.True(t, d.Suppressed("node-a"))
+
+	events = nil
+	clock.Advance(time.Minute * 5)
+	assert.Equal(t, []string{"node-a"}, d.Reuse())
+	assert.False(t, d.Suppressed("node-a"))
+	assert.Equal(t, []Event{failedEvent("node-a")}, events)
+}
+
+// Tests if a flapping peers status is unchanged once it stabilizes, no event
+// is emitted.
+func TestFlapDamper_ReuseUnchanged(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	for i := 0; i != 3; i++ {
+		d.OnEvent(failedEvent("node-a"))
+		d.OnEvent(joinEvent("node-a"))
+	}
+	assert.True(t, d.Suppressed("node-a"))
+
+	events = nil
+	clock.Advance(time.Hour)
+	assert.Equal(t, []string{"node-a"}, d.Reuse())
+	assert.Nil(t, events)
+}
+
+// Tests a peer that gracefully leaves while suppressed is only notified as
+// leaving if subscribers think it is up.
+func TestFlapDamper_LeftWhileSuppressed(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	d.OnEvent(failedEvent("node-a"))
+	d.OnEvent(joinEvent("node-a"))
+	d.OnEvent(failedEvent("node-a"))
+	d.OnEvent(joinEvent("node-a"))
+	d.OnEvent(failedEvent("node-a"))
+	assert.True(t, d.Suppressed("node-a"))
+
+	events = nil
+	left := Event{Type: EventLeave, ID: "node-a", LeaveReason: LeaveReasonLeft}
+	d.OnEvent(left)
+	assert.Equal(t, []Event{left}, events)
+	assert.False(t, d.Suppressed("node-a"))
+}
+
+// Tests the penalty is limited so a peer is suppressed for at most
+// MaxSuppressTime after it last failed.
+func TestFlapDamper_MaxSuppressTime(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {}, clock, zap.NewNop())
+
+	for i := 0; i != 100; i++ {
+		d.OnEvent(failedEvent("node-a"))
+		d.OnEvent(joinEvent("node-a"))
+	}
+
+	clock.Advance(time.Minute*5 - time.Second)
+	assert.Equal(t, []string{}, d.Reuse())
+	assert.True(t, d.Suppressed("node-a"))
+
+	clock.Advance(time.Second * 2)
+	assert.Equal(t, []string{"node-a"}, d.Reuse())
+}
+
+// Tests events emitted once a peer is reused include the peers last known
+// address, as the join event that recovered the peer may not.
+func TestFlapDamper_ReuseAddr(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(testFlapDampingConfig, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	for i := 0; i != 3; i++ {
+		d.OnEvent(Event{
+			Type:        EventLeave,
+			ID:          "node-a",
+			Addr:        "10.26.104.52:8119",
+			LeaveReason: LeaveReasonFailed,
+		})
+		d.OnEvent(joinEvent("node-a"))
+	}
+	d.OnEvent(Event{
+		Type:        EventLeave,
+		ID:          "node-a",
+		Addr:        "10.26.104.52:8119",
+		LeaveReason: LeaveReasonFailed,
+	})
+	assert.True(t, d.Suppressed("node-a"))
+
+	events = nil
+	clock.Advance(time.Hour)
+	assert.Equal(t, []string{"node-a"}, d.Reuse())
+	assert.Equal(t, []Event{{
+		Type:        EventLeave,
+		ID:          "node-a",
+		Addr:        "10.26.104.52:8119",
+		LeaveReason: LeaveReasonFailed,
+	}}, events)
+}
+
+func TestFlapDamper_Disabled(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var events []Event
+	d := NewFlapDamper(FlapDampingConfig{}, func(e Event) {
+		events = append(events, e)
+	}, clock, zap.NewNop())
+
+	for i := 0; i != 10; i++ {
+		d.OnEvent(failedEvent("node-a"))
+		d.OnEvent(joinEvent("node-a"))
+	}
+	assert.Equal(t, 20, len(events))
+	assert.False(t, d.Suppressed("node-a"))
+}
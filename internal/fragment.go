@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// reassemblyTimeout is how long to wait for all fragments of a delta
+	// before discarding the received fragments. Since the sender will
+	// resend the delta in a later round if it isn't received, there is no
+	// point waiting long.
+	reassemblyTimeout = time.Second * 10
+	// maxSenderReassemblies is the maximum number of deltas being
+	// reassembled at once from each sender, so a sender sending fragments
+	// that are never completed can't block deltas from other senders. If the
+	// limit is reached the senders oldest reassembly is discarded.
+	maxSenderReassemblies = 8
+	// maxReassemblies is the maximum number of deltas being reassembled at
+	// once from all senders. This bounds the memory used by senders that
+	// never complete their deltas. If the limit is reached the oldest
+	// reassembly is discarded.
+	maxReassemblies = 256
+	// maxReassemblySize is the maximum size of a reassembled delta. Larger
+	// deltas are still synced by push-pull.
+	maxReassemblySize = 4 * 1024 * 1024
+	// minFragmentDataSize is the minimum size of the data in each fragment
+	// (except the last) expected from senders, used to bound the number of
+	// fragments in a delta.
+	minFragmentDataSize = 256
+	// maxFragmentCount is the maximum number of fragments in a delta.
+	maxFragmentCount = maxReassemblySize / minFragmentDataSize
+)
+
+type reassemblyKey struct {
+	FromID string
+	ID     uint64
+}
+
+type reassembly struct {
+	// fragments contains the received fragments indexed by fragment index.
+	// Fragments are only stored once received so a bogus fragment count
+	// doesn't allocate memory up front.
+	fragments map[uint16][]byte
+	count     uint16
+	size      int
+	expiry    time.Time
+	// seq orders reassemblies by when they started, used to discard the
+	// oldest reassembly when the limit is reached.
+	seq uint64
+}
+
+// reassembler reassembles deltas that were fragmented across multiple
+// messages.
+//
+// Note this is thread safe.
+type reassembler struct {
+	reassemblies map[reassemblyKey]*reassembly
+	// senderReassemblies contains the number of reassemblies from each
+	// sender.
+	senderReassemblies map[string]int
+	nextSeq            uint64
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		reassemblies:       make(map[reassemblyKey]*reassembly),
+		senderReassemblies: make(map[string]int),
+	}
+}
+
+// Add adds a fragment received from fromID. If the fragment completes the
+// delta, returns the reassembled encoded delta and true.
+func (r *reassembler) Add(f deltaFragment, fromID string, now time.Time) ([]byte, bool, error) {
+	if f.Count == 0 || f.Index >= f.Count {
+		return nil, false, fmt.Errorf("invalid fragment; index %d of %d", f.Index, f.Count)
+	}
+	if f.Count > maxFragmentCount {
+		return nil, false, fmt.Errorf("invalid fragment; count %d exceeds limit %d", f.Count, maxFragmentCount)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.removeExpired(now)
+
+	key := reassemblyKey{FromID: fromID, ID: f.ID}
+	ra, ok := r.reassemblies[key]
+	if !ok {
+		if r.senderReassemblies[fromID] >= maxSenderReassemblies {
+			r.removeOldest(func(key reassemblyKey) bool {
+				return key.FromID == fromID
+			})
+		}
+		if len(r.reassemblies) >= maxReassemblies {
+			r.removeOldest(func(key reassemblyKey) bool {
+				return true
+			})
+		}
+		ra = &reassembly{
+			fragments: make(map[uint16][]byte),
+			count:     f.Count,
+			expiry:    now.Add(reassemblyTimeout),
+			seq:       r.nextSeq,
+		}
+		r.nextSeq++
+		r.add(key, ra)
+	}
+
+	if ra.count != f.Count {
+		r.remove(key)
+		return nil, false, fmt.Errorf("invalid fragment; fragment count mismatch")
+	}
+	// Ignore duplicate fragments.
+	if _, ok := ra.fragments[f.Index]; ok {
+		return nil, false, nil
+	}
+	if ra.size+len(f.Data) > maxReassemblySize {
+		r.remove(key)
+		return nil, false, fmt.Errorf("fragmented delta too large")
+	}
+
+	// Copy the data as the message buffer may be reused.
+	ra.fragments[f.Index] = append([]byte{}, f.Data...)
+	ra.size += len(f.Data)
+
+	if len(ra.fragments) < int(ra.count) {
+		return nil, false, nil
+	}
+
+	r.remove(key)
+
+	b := make([]byte, 0, ra.size)
+	for i := 0; i != int(ra.count); i++ {
+		b = append(b, ra.fragments[uint16(i)]...)
+	}
+	return b, true, nil
+}
+
+// removeExpired discards any incomplete deltas that have expired.
+//
+// Note must hold mu.
+func (r *reassembler) removeExpired(now time.Time) {
+	for key, ra := range r.reassemblies {
+		if now.After(ra.expiry) {
+			r.remove(key)
+		}
+	}
+}
+
+// removeOldest discards the oldest incomplete delta whose key matches.
+//
+// Note must hold mu.
+func (r *reassembler) removeOldest(match func(key reassemblyKey) bool) {
+	var oldest *reassemblyKey
+	var oldestSeq uint64
+	for key, ra := range r.reassemblies {
+		if !match(key) {
+			continue
+		}
+		if oldest == nil || ra.seq < oldestSeq {
+			k := key
+			oldest = &k
+			oldestSeq = ra.seq
+		}
+	}
+	if oldest != nil {
+		r.remove(*oldest)
+	}
+}
+
+// Note must hold mu.
+func (r *reassembler) add(key reassemblyKey, ra *reassembly) {
+	r.reassemblies[key] = ra
+	r.senderReassemblies[key.FromID]++
+}
+
+// Note must hold mu.
+func (r *reassembler) remove(key reassemblyKey) {
+	if _, ok := r.reassemblies[key]; !ok {
+		return
+	}
+	delete(r.reassemblies, key)
+	r.senderReassemblies[key.FromID]--
+	if r.senderReassemblies[key.FromID] == 0 {
+		delete(r.senderReassemblies, key.FromID)
+	}
+}
+
+// fragmentDelta splits the encoded delta into fragments where each fragment
+// contains at most maxDataSize bytes of the delta.
+func fragmentDelta(b []byte, id uint64, maxDataSize int) ([]deltaFragment, error) {
+	if maxDataSize <= 0 {
+		return nil, fmt.Errorf("max message size too small to fragment delta")
+	}
+
+	count := (len(b) + maxDataSize - 1) / maxDataSize
+	if count > 0xffff {
+		return nil, fmt.Errorf("delta too large to fragment; %d bytes", len(b))
+	}
+
+	fragments := make([]deltaFragment, 0, count)
+	for i := 0; i != count; i++ {
+		end := (i + 1) * maxDataSize
+		if end > len(b) {
+			end = len(b)
+		}
+		fragments = append(fragments, deltaFragment{
+			ID:    id,
+			Index: uint16(i),
+			Count: uint16(count),
+			Data:  b[i*maxDataSize : end],
+		})
+	}
+	return fragments, nil
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReassembler_Reassemble(t *testing.T) {
+	b := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 100)
+	fragments, err := fragmentDelta(b, 12, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(fragments))
+
+	r := newReassembler()
+	now := time.Now()
+
+	// Add the fragments out of order, including a duplicate.
+	for i := len(fragments) - 1; i != 0; i-- {
+		_, complete, err := r.Add(fragments[i], "10.26.104.11:8119", now)
+		assert.Nil(t, err)
+		assert.False(t, complete)
+	}
+	_, complete, err := r.Add(fragments[1], "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	assert.False(t, complete)
+
+	reassembled, complete, err := r.Add(fragments[0], "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, b, reassembled)
+}
+
+// Tests fragments with the same ID from different senders are reassembled
+// separately.
+func TestReassembler_MultipleSenders(t *testing.T) {
+	fragments1, err := fragmentDelta([]byte{1, 2, 3, 4}, 1, 2)
+	assert.Nil(t, err)
+	fragments2, err := fragmentDelta([]byte{5, 6, 7, 8}, 1, 2)
+	assert.Nil(t, err)
+
+	r := newReassembler()
+	now := time.Now()
+
+	_, _, err = r.Add(fragments1[0], "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	_, _, err = r.Add(fragments2[0], "10.26.104.12:8119", now)
+	assert.Nil(t, err)
+
+	b, complete, err := r.Add(fragments2[1], "10.26.104.12:8119", now)
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []byte{5, 6, 7, 8}, b)
+}
+
+// Tests incomplete deltas are discarded after the reassembly timeout.
+func TestReassembler_Expiry(t *testing.T) {
+	fragments, err := fragmentDelta([]byte{1, 2, 3, 4}, 1, 2)
+	assert.Nil(t, err)
+
+	r := newReassembler()
+	now := time.Now()
+
+	_, _, err = r.Add(fragments[0], "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+
+	// Once expired the earlier fragment is discarded so the delta is never
+	// completed.
+	_, complete, err := r.Add(fragments[1], "10.26.104.11:8119", now.Add(reassemblyTimeout+time.Second))
+	assert.Nil(t, err)
+	assert.False(t, complete)
+}
+
+func TestReassembler_Invalid(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+
+	_, _, err := r.Add(deltaFragment{ID: 1, Index: 2, Count: 2}, "10.26.104.11:8119", now)
+	assert.NotNil(t, err)
+	_, _, err = r.Add(deltaFragment{ID: 1, Index: 0, Count: 0}, "10.26.104.11:8119", now)
+	assert.NotNil(t, err)
+
+	// Fragments of the same delta must have the same count.
+	_, _, err = r.Add(deltaFragment{ID: 2, Index: 0, Count: 2}, "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	_, _, err = r.Add(deltaFragment{ID: 2, Index: 1, Count: 3}, "10.26.104.11:8119", now)
+	assert.NotNil(t, err)
+}
+
+// Tests fragments with a count that exceeds the maximum delta size are
+// rejected.
+func TestReassembler_MaxFragmentCount(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+
+	_, _, err := r.Add(deltaFragment{ID: 1, Index: 0, Count: maxFragmentCount + 1}, "10.26.104.11:8119", now)
+	assert.NotNil(t, err)
+	_, _, err = r.Add(deltaFragment{ID: 1, Index: 0, Count: maxFragmentCount}, "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+}
+
+// Tests when a sender reaches the reassembly limit its oldest reassembly is
+// discarded, without affecting other senders.
+func TestReassembler_MaxSenderReassemblies(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+
+	fragments, err := fragmentDelta([]byte{1, 2, 3, 4}, 1, 2)
+	assert.Nil(t, err)
+	_, _, err = r.Add(fragments[0], "10.26.104.12:8119", now)
+	assert.Nil(t, err)
+
+	for i := 0; i != maxSenderReassemblies+1; i++ {
+		_, _, err := r.Add(deltaFragment{ID: uint64(i), Index: 0, Count: 2, Data: []byte{1}}, "10.26.104.11:8119", now)
+		assert.Nil(t, err)
+	}
+
+	b, complete, err := r.Add(deltaFragment{ID: 1, Index: 1, Count: 2, Data: []byte{2}}, "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []byte{1, 2}, b)
+	// The oldest reassembly from the sender was discarded.
+	_, complete, err = r.Add(deltaFragment{ID: 0, Index: 1, Count: 2, Data: []byte{2}}, "10.26.104.11:8119", now)
+	assert.Nil(t, err)
+	assert.False(t, complete)
+
+	// The other senders reassembly is unaffected.
+	b, complete, err = r.Add(fragments[1], "10.26.104.12:8119", now)
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []byte{1, 2, 3, 4}, b)
+}
+
+// Tests when the total reassembly limit is reached the oldest reassembly is
+// discarded rather than rejecting new deltas.
+func TestReassembler_MaxReassemblies(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+
+	for i := 0; i != maxReassemblies; i++ {
+		_, _, err := r.Add(deltaFragment{ID: 1, Index: 0, Count: 2, Data: []byte{1}}, fmt.Sprintf("node-%d", i), now)
+		assert.Nil(t, err)
+	}
+	_, _, err := r.Add(deltaFragment{ID: 1, Index: 0, Count: 2, Data: []byte{1}}, "node-new", now)
+	assert.Nil(t, err)
+	assert.Equal(t, maxReassemblies, len(r.reassemblies))
+
+	// The oldest reassembly was discarded.
+	_, complete, err := r.Add(deltaFragment{ID: 1, Index: 1, Count: 2, Data: []byte{2}}, "node-0", now)
+	assert.Nil(t, err)
+	assert.False(t, complete)
+	_, complete, err = r.Add(deltaFragment{ID: 1, Index: 1, Count: 2, Data: []byte{2}}, "node-new", now)
+	assert.Nil(t, err)
+	assert.True(t, complete)
+}
@@ -1,190 +1,671 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 type peerVersionDelta struct {
-	PeerAddr string
-	Delta    uint64
-	Version  uint64
+	PeerID  string
+	Delta   uint64
+	Version uint64
+}
+
+const (
+	// pushPullTimeout is the maximum time to wait for a push-pull exchange
+	// to complete.
+	pushPullTimeout = time.Second * 10
+)
+
+var (
+	// ErrKeyTooLarge indicates a key exceeds the configured maximum key size.
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge indicates a value exceeds the configured maximum value
+	// size.
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrStateTooLarge indicates an update would make the local nodes state
+	// exceed the configured maximum state size.
+	ErrStateTooLarge = errors.New("state too large")
+	// ErrUnknownPeer indicates the peer isn't known by the local node.
+	ErrUnknownPeer = errors.New("unknown peer")
+)
+
+// StateLimits limits the size of the local nodes state. A limit of 0 means
+// unlimited.
+type StateLimits struct {
+	// MaxKeySize is the maximum size of a key in bytes.
+	MaxKeySize int
+	// MaxValueSize is the maximum size of a value in bytes.
+	MaxValueSize int
+	// MaxStateSize is the maximum total size of the nodes keys and values in
+	// bytes.
+	MaxStateSize int
+}
+
+// ProbeConfig configures probing peers the failure detector suspects are down
+// before convicting them.
+type ProbeConfig struct {
+	// IndirectProbes is the number of other peers asked to probe a suspected
+	// peer. If 0 suspected peers are convicted without probing.
+	IndirectProbes int
+	// Timeout is how long to wait for an ack from a suspected peer before
+	// convicting it.
+	Timeout time.Duration
 }
 
 type Gossiper struct {
 	peerMap         *PeerMap
 	transport       Transport
-	failureDetector *FailureDetector
-	maxMessageSize  int
-	logger          *zap.Logger
+	failureDetector FailureDetector
+	// keyring contains the keys used to encrypt packets. If nil packets are
+	// not encrypted.
+	keyring *Keyring
+	// clusterName is included in the header of all messages, and messages
+	// with a different cluster name are dropped.
+	clusterName string
+	// protocolVersionMin and protocolVersionMax are the range of protocol
+	// versions the gossiper supports, which are advertised to other nodes in
+	// the local peers state.
+	protocolVersionMin uint8
+	protocolVersionMax uint8
+	maxMessageSize     int
+	limits             StateLimits
+	probeConfig        ProbeConfig
+	// updateMu serializes local updates so the state size limit can't be
+	// exceeded by concurrent updates.
+	updateMu sync.Mutex
+	// reassembler reassembles fragmented deltas.
+	reassembler *reassembler
+	// nextFragmentID is used to assign each fragmented delta a unique ID.
+	nextFragmentID atomic.Uint64
+	// prober tracks the outstanding probes of suspected peers.
+	prober *prober
+	// loopbackWarned is whether a warning has been logged that the local
+	// node advertises a loopback address while peers are remote, so the
+	// warning is only logged once.
+	loopbackWarned atomic.Bool
+	stats          stats
+	clock          Clock
+	// rng is used to select peers to gossip with.
+	rng    *rand.Rand
+	logger *zap.Logger
 }
 
-func NewGossiper(peerMap *PeerMap, transport Transport, failureDetector *FailureDetector, maxMessageSize int, logger *zap.Logger) *Gossiper {
-	return &Gossiper{
+func NewGossiper(peerMap *PeerMap, transport Transport, failureDetector FailureDetector, keyring *Keyring, clusterName string, maxMessageSize int, limits StateLimits, probeConfig ProbeConfig, clock Clock, rng *rand.Rand, logger *zap.Logger) *Gossiper {
+	g := &Gossiper{
 		peerMap:         peerMap,
 		transport:       transport,
 		failureDetector: failureDetector,
+		keyring:         keyring,
+		clusterName:     clusterName,
 		maxMessageSize:  maxMessageSize,
+		limits:          limits,
+		reassembler:     newReassembler(),
+		probeConfig:     probeConfig,
+		prober:          newProber(),
+		clock:           clock,
+		rng:             rng,
 		logger:          logger,
 	}
+	g.setProtocolVersions(ProtocolVersionMin, ProtocolVersionMax)
+	return g
 }
 
-func (g *Gossiper) Addrs(includeLocal bool) []string {
-	return g.peerMap.Addrs(includeLocal)
+func (g *Gossiper) IDs(includeLocal bool) []string {
+	return g.peerMap.IDs(includeLocal)
 }
 
-func (g *Gossiper) Lookup(addr string, key string) (string, bool) {
-	e, ok := g.peerMap.Lookup(addr, key)
+// ID returns the ID of the local node.
+func (g *Gossiper) ID() string {
+	return g.peerMap.LocalID()
+}
+
+// Addr returns the address of the peer with the given ID, or false if the
+// peer or its address isn't known.
+func (g *Gossiper) Addr(id string) (string, bool) {
+	return g.peerMap.Addr(id)
+}
+
+func (g *Gossiper) Status(id string) (PeerStatus, bool) {
+	return g.peerMap.Status(id)
+}
+
+// Suspicion returns the failure detectors suspicion level of the peer, or
+// false if the peer is unknown or is the local node.
+func (g *Gossiper) Suspicion(id string) (float64, bool) {
+	if id == g.peerMap.LocalID() {
+		return 0, false
+	}
+	if _, ok := g.peerMap.Status(id); !ok {
+		return 0, false
+	}
+	return g.failureDetector.Suspicion(id, g.clock.Now()), true
+}
+
+func (g *Gossiper) Lookup(id string, key string) (string, bool) {
+	if IsInternalKey(key) {
+		return "", false
+	}
+
+	e, ok := g.peerMap.Lookup(id, key)
 	if !ok {
 		return "", false
 	}
 	return e.Value, true
 }
 
-func (g *Gossiper) UpdateLocal(key string, value string) {
+// UpdateLocal updates the local nodes state. Returns an error if the update
+// exceeds the configured state limits.
+func (g *Gossiper) UpdateLocal(key string, value string) error {
+	if IsInternalKey(key) {
+		return fmt.Errorf("cannot update reserved key: %s", key)
+	}
+	if g.limits.MaxKeySize > 0 && len(key) > g.limits.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d bytes", ErrKeyTooLarge, len(key), g.limits.MaxKeySize)
+	}
+	if g.limits.MaxValueSize > 0 && len(value) > g.limits.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d bytes", ErrValueTooLarge, len(value), g.limits.MaxValueSize)
+	}
+
+	g.updateMu.Lock()
+	defer g.updateMu.Unlock()
+
+	if g.limits.MaxStateSize > 0 {
+		size := g.peerMap.LocalStateSize() + len(key) + len(value)
+		if e, ok := g.peerMap.Lookup(g.peerMap.LocalID(), key); ok {
+			size -= len(key) + len(e.Value)
+		}
+		if size > g.limits.MaxStateSize {
+			return fmt.Errorf("%w: %d bytes exceeds limit of %d bytes", ErrStateTooLarge, size, g.limits.MaxStateSize)
+		}
+	}
+
 	g.peerMap.UpdateLocal(key, value)
+	return nil
+}
+
+func (g *Gossiper) DeleteLocal(key string) error {
+	if IsInternalKey(key) {
+		return fmt.Errorf("cannot delete reserved key: %s", key)
+	}
+	g.updateMu.Lock()
+	defer g.updateMu.Unlock()
+
+	g.peerMap.DeleteLocal(key)
+	return nil
+}
+
+// Leave marks the local node as leaving the cluster. Returns the local
+// version that peers must acknowledge to have received the leave.
+func (g *Gossiper) Leave() uint64 {
+	return g.peerMap.Leave()
+}
+
+// LeaveAcks returns the up peers that have acknowledged the local node
+// leaving at the given version, and those that haven't.
+func (g *Gossiper) LeaveAcks(version uint64) ([]string, []string) {
+	return g.peerMap.LocalVersionAcks(version)
 }
 
 func (g *Gossiper) BindAddr() string {
 	return g.transport.BindAddr()
 }
 
-func (g *Gossiper) SendDigestRequest(addr string) error {
-	g.logger.Debug(
-		"sending digest request",
-		zap.String("addr", addr),
-	)
+// AdvertiseAddr returns the address other nodes use to reach the local node.
+func (g *Gossiper) AdvertiseAddr() string {
+	return g.peerMap.LocalAddr()
+}
 
-	return g.sendDigestSync(addr, true)
+// IsLocalAddr returns whether the given address is the local nodes bind or
+// advertise address.
+func (g *Gossiper) IsLocalAddr(addr string) bool {
+	return addr == g.BindAddr() || addr == g.AdvertiseAddr()
+}
+
+// SendDigestRequest sends a digest request to the peer with the given ID.
+// Returns an error if the peers address isn't known.
+func (g *Gossiper) SendDigestRequest(id string) error {
+	addr, ok := g.peerMap.Addr(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, id)
+	}
+	return g.sendDigestRequest(id, addr)
 }
 
 func (g *Gossiper) OnMessage(b []byte, fromAddr string) error {
-	if len(b) == 0 {
-		return fmt.Errorf("invalid message; message is empty")
+	header, payload, err := g.decodeMessage(b, fromAddr)
+	if err != nil {
+		return err
+	}
+	// From protocol version 4 the sender includes its advertised address,
+	// which is used to reach the sender rather than the packets source
+	// address.
+	if header.Sender != "" {
+		fromAddr = header.Sender
 	}
+	fromID := g.senderID(header, fromAddr)
+	g.checkReachable(fromAddr)
 
-	switch messageType(b[0]) {
+	switch header.Type {
 	case typeDigestRequest:
 		g.logger.Debug(
 			"received digest request",
 			zap.String("addr", fromAddr),
 		)
-		return g.onDigestRequest(decodeDigestSync(b[1:]), fromAddr)
+		sync, err := decodeDigestSync(payload, header.Version)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onDigestRequest(sync, fromID, fromAddr)
 	case typeDigestResponse:
 		g.logger.Debug(
 			"received digest response",
 			zap.String("addr", fromAddr),
 		)
-		return g.onDigestResponse(decodeDigestSync(b[1:]), fromAddr)
+		sync, err := decodeDigestSync(payload, header.Version)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onDigestResponse(sync, fromID, fromAddr)
 	case typeDelta:
 		g.logger.Debug(
 			"received delta",
 			zap.String("addr", fromAddr),
 		)
-		return g.onDelta(decodeDeltaSync(b[1:]), fromAddr)
+		sync, err := decodeDeltaSync(payload, header.Version)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onDelta(sync)
+	case typeDeltaFragment:
+		if header.Version < protocolVersion2 {
+			return g.onUnknownMessageType(header.Type, fromAddr)
+		}
+		fragment, err := decodeDeltaFragment(payload)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onDeltaFragment(fragment, header.Version, fromID, fromAddr)
+	case typePing:
+		if header.Version < protocolVersion3 {
+			return g.onUnknownMessageType(header.Type, fromAddr)
+		}
+		p, err := decodePing(payload)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onPing(p, header.Version, fromID, fromAddr)
+	case typePingReq:
+		if header.Version < protocolVersion3 {
+			return g.onUnknownMessageType(header.Type, fromAddr)
+		}
+		req, err := decodePingReq(payload, header.Version)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onPingReq(req, header.Version, fromID, fromAddr)
+	case typeAck:
+		if header.Version < protocolVersion3 {
+			return g.onUnknownMessageType(header.Type, fromAddr)
+		}
+		a, err := decodeAck(payload)
+		if err != nil {
+			return g.onMalformed(err, fromAddr)
+		}
+		return g.onAck(a, fromID, fromAddr)
+	default:
+		return g.onUnknownMessageType(header.Type, fromAddr)
 	}
+}
 
+// PushPull exchanges the full known state of the cluster with the peer with
+// the given ID over a stream. Unlike digest and delta messages, this isn't
+// limited by the maximum message size, so a joining node converges in a
+// single round trip regardless of the size of the cluster.
+func (g *Gossiper) PushPull(id string) error {
+	addr, ok := g.peerMap.Addr(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, id)
+	}
+	return g.pushPull(id, addr)
+}
+
+// PushPullSeed exchanges the full known state of the cluster with the seed
+// at addr, whose ID isn't known. See PushPull.
+func (g *Gossiper) PushPullSeed(addr string) error {
+	return g.pushPull("", addr)
+}
+
+// pushPull exchanges the full known state of the cluster with the node at
+// addr. The ID of the node may be empty if it isn't known.
+func (g *Gossiper) pushPull(id string, addr string) error {
+	g.logger.Debug(
+		"sending push-pull request",
+		zap.String("id", id),
+		zap.String("addr", addr),
+	)
+
+	conn, err := g.transport.DialTimeout(addr, pushPullTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(pushPullTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+
+	if err := g.writePushPull(conn, typePushPullRequest, id); err != nil {
+		return err
+	}
+
+	b, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read push-pull response from %s: %v", addr, err)
+	}
+	header, payload, err := g.decodeMessage(b, addr)
+	if err != nil {
+		return err
+	}
+	if header.Type != typePushPullResponse {
+		return g.onUnknownMessageType(header.Type, addr)
+	}
+	state, err := decodePushPullState(payload, header.Version)
+	if err != nil {
+		return g.onMalformed(err, addr)
+	}
+
+	g.applyPushPullState(state)
 	return nil
 }
 
+// OnStream handles an incoming stream, which contains a push-pull request
+// from another node. Responds with the full known state of the cluster.
+func (g *Gossiper) OnStream(conn net.Conn) error {
+	defer conn.Close()
+
+	// Note the remote address is the senders ephemeral port so doesn't
+	// identify the sender. The senders address is included in the request.
+	remoteAddr := conn.RemoteAddr().String()
+
+	if err := conn.SetDeadline(time.Now().Add(pushPullTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+
+	b, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read push-pull request from %s: %v", remoteAddr, err)
+	}
+	header, payload, err := g.decodeMessage(b, remoteAddr)
+	if err != nil {
+		return err
+	}
+	if header.Type != typePushPullRequest {
+		return g.onUnknownMessageType(header.Type, remoteAddr)
+	}
+	state, err := decodePushPullState(payload, header.Version)
+	if err != nil {
+		return g.onMalformed(err, remoteAddr)
+	}
+
+	g.logger.Debug("received push-pull request", zap.String("id", state.ID))
+
+	g.applyPushPullState(state)
+
+	return g.writePushPull(conn, typePushPullResponse, state.ID)
+}
+
+// Stats returns counters about the messages received.
+func (g *Gossiper) Stats() Stats {
+	return g.stats.Snapshot()
+}
+
 func (g *Gossiper) Seed(seeds []string) {
 	g.logger.Debug("seeding gossiper", zap.Strings("seeds", seeds))
 
 	for _, addr := range seeds {
 		// Ignore ourselves.
-		if addr == g.BindAddr() {
+		if g.IsLocalAddr(addr) {
 			continue
 		}
-		g.SendDigestRequest(addr)
+		g.checkReachable(addr)
+		// The seeds ID isn't known until its state is received.
+		g.sendDigestRequest("", addr)
 	}
 }
 
+// RandomUpPeer returns the ID of a random up peer whose address is known.
 func (g *Gossiper) RandomUpPeer() (string, bool) {
-	if len(g.peerMap.Addrs(false)) == 0 {
-		return "", false
-	}
-
-	addrs := g.peerMap.Addrs(false)
-	return addrs[rand.Intn(len(addrs))], true
+	return g.randomPeer(g.peerMap.IDs(false))
 }
 
+// RandomDownPeer returns the ID of a random down peer whose address is known.
 func (g *Gossiper) RandomDownPeer() (string, bool) {
-	if len(g.peerMap.DownPeers()) == 0 {
+	return g.randomPeer(g.peerMap.DownPeers())
+}
+
+// randomPeer returns a random peer from ids, excluding peers whose address
+// isn't known yet since they can't be reached.
+func (g *Gossiper) randomPeer(ids []string) (string, bool) {
+	reachable := []string{}
+	for _, id := range ids {
+		if _, ok := g.peerMap.Addr(id); ok {
+			reachable = append(reachable, id)
+		}
+	}
+	if len(reachable) == 0 {
 		return "", false
 	}
+	return reachable[g.rng.Intn(len(reachable))], true
+}
+
+// Heartbeat increments the local nodes heartbeat, which should be called every
+// gossip round.
+func (g *Gossiper) Heartbeat() {
+	g.peerMap.Heartbeat()
+}
 
-	addrs := g.peerMap.DownPeers()
-	return addrs[rand.Intn(len(addrs))], true
+// ForceRemove removes the peer with the given ID from the cluster. See
+// PeerMap.ForceRemove.
+func (g *Gossiper) ForceRemove(id string) error {
+	if err := g.peerMap.ForceRemove(id); err != nil {
+		return err
+	}
+	g.prober.Cancel(id)
+	g.failureDetector.Remove(id)
+	return nil
 }
 
+// CheckLiveness updates the status of each peer using the failure detector.
+//
+// Rather than convicting a peer as soon as the failure detector suspects it,
+// the peer is probed both directly and indirectly through other peers, so a
+// single bad link doesn't cause a reachable peer to be considered down. The
+// peer is only convicted if no ack is received within the probe timeout.
 func (g *Gossiper) CheckLiveness() {
-	for _, addr := range g.peerMap.Addrs(false) {
-		if g.failureDetector.PeerStatus(addr) == PeerStatusDown {
-			g.peerMap.SetStatusDown(addr, time.Now().Add(time.Hour))
+	now := g.clock.Now()
+
+	for _, id := range g.peerMap.IDs(false) {
+		if !g.failureDetector.Available(id, now) {
+			g.suspect(id, now)
 		} else {
-			g.peerMap.SetStatusUp(addr)
+			// If the peer was suspected it has since been heard from.
+			g.prober.Cancel(id)
+			g.peerMap.ClearClaim(id)
+		}
+	}
+	for _, id := range g.prober.Expired(now) {
+		g.logger.Info("suspected peer not acknowledged", zap.String("id", id))
+		g.peerMap.Convict(id)
+	}
+
+	// Withdraw our claim about dead peers that recover. Note the peer stays
+	// dead until any claims from other nodes are also withdrawn or refuted.
+	for _, id := range g.peerMap.DownPeers() {
+		if g.failureDetector.Available(id, now) {
+			g.peerMap.ClearClaim(id)
 		}
 	}
 
 	// Remove any peers that have been dead for long enough to expire.
-	for _, addr := range g.peerMap.RemoveExpiredPeers() {
-		g.failureDetector.RemovePeer(addr)
+	for _, id := range g.peerMap.RemoveExpiredPeers() {
+		g.failureDetector.Remove(id)
+	}
+}
+
+// suspect claims the peer is suspect and probes it, if it isn't already being
+// probed. If probing is disabled, or the peer doesn't support probing, the
+// peer is convicted immediately.
+func (g *Gossiper) suspect(id string, now time.Time) {
+	addr, ok := g.peerMap.Addr(id)
+	if !ok || g.probeConfig.IndirectProbes == 0 || g.protocolVersion(id) < protocolVersion3 {
+		g.peerMap.Convict(id)
+		return
+	}
+
+	seq, ok := g.prober.Start(id, now.Add(g.probeConfig.Timeout))
+	if !ok {
+		return
+	}
+
+	g.logger.Debug("probing suspected peer", zap.String("id", id))
+
+	g.peerMap.Suspect(id)
+
+	g.sendPing(ping{Seq: seq}, id, addr)
+
+	// Ask other peers that support probing to also probe the suspected
+	// peer, so a bad link between the local node and the suspected peer
+	// doesn't cause the peer to be convicted.
+	helpers := []string{}
+	for _, helper := range g.peerMap.IDs(false) {
+		if helper == id || g.protocolVersion(helper) < protocolVersion3 {
+			continue
+		}
+		if _, ok := g.peerMap.Addr(helper); ok {
+			helpers = append(helpers, helper)
+		}
+	}
+	shuffle(g.rng, helpers)
+	for i := 0; i < len(helpers) && i < g.probeConfig.IndirectProbes; i++ {
+		// Note the ping-req target is an address since the helper may not
+		// know the target by ID.
+		g.sendPingReq(pingReq{Seq: seq, Target: addr}, helpers[i])
 	}
 }
 
+// RemoveConvergedTombstones removes any deleted entries that all known peers
+// have received.
+func (g *Gossiper) RemoveConvergedTombstones() {
+	g.peerMap.RemoveConvergedTombstones()
+}
+
 func (g *Gossiper) Close() error {
 	return g.transport.Shutdown()
 }
 
-func (g *Gossiper) sendDigestResponse(addr string) error {
+func (g *Gossiper) sendDigestRequest(id string, addr string) error {
+	g.logger.Debug(
+		"sending digest request",
+		zap.String("id", id),
+		zap.String("addr", addr),
+	)
+
+	return g.sendDigestSync(id, addr, true)
+}
+
+func (g *Gossiper) sendDigestResponse(id string, addr string) error {
 	g.logger.Debug(
 		"sending digest response",
+		zap.String("id", id),
 		zap.String("addr", addr),
 	)
 
-	return g.sendDigestSync(addr, false)
+	return g.sendDigestSync(id, addr, false)
 }
 
-func (g *Gossiper) sendDigestSync(addr string, request bool) error {
-	peerAddrs := g.peerMap.Addrs(true)
-	shuffle(peerAddrs)
+// sendDigestSync sends a digest of the known peers to the node with the given
+// ID at addr. The ID may be empty if it isn't known, such as when seeding.
+func (g *Gossiper) sendDigestSync(id string, addr string, request bool) error {
+	peerIDs := g.peerMap.IDs(true)
+	shuffle(g.rng, peerIDs)
 
 	messageType := typeDigestRequest
 	if !request {
 		messageType = typeDigestResponse
 	}
 
-	req := []byte{byte(messageType)}
-	for _, addr := range peerAddrs {
-		digest := g.peerMap.Digest(addr)
-		digestEnc := encodeDigest(digest)
-		if len(req)+len(digestEnc) > g.maxMessageSize {
+	version := g.protocolVersion(id)
+	req := g.encodeHeader(messageType, version)
+
+	// Always include the receivers own digest first if it is known (even if
+	// it isn't up). This lets the receiver know which of its state we have,
+	// such as to acknowledge it leaving the cluster.
+	if digest := g.peerMap.Digest(id); digest.ID != "" {
+		req = append(req, encodeDigest(digest, version)...)
+	}
+
+	for _, peerID := range peerIDs {
+		if peerID == id {
+			continue
+		}
+
+		digest := g.peerMap.Digest(peerID)
+		digestEnc := encodeDigest(digest, version)
+		if len(req)+len(digestEnc) > g.maxPayloadSize() {
 			break
 		}
 
 		req = append(req, digestEnc...)
 	}
 
-	if err := g.transport.WriteTo(req, addr); err != nil {
-		g.logger.Error("failed to write to transport", zap.Error(err))
-		return fmt.Errorf("failed to write to transport %s: %v", addr, err)
-	}
-
-	return nil
+	return g.write(req, addr)
 }
 
-func (g *Gossiper) sendDelta(sync []Digest, addr string) error {
-	resp := []byte{byte(typeDelta)}
+func (g *Gossiper) sendDelta(sync []Digest, id string, addr string) error {
+	version := g.protocolVersion(id)
+	header := g.encodeHeader(typeDelta, version)
+	resp := header
+	// fragmented contains encoded deltas that are too large to fit in a
+	// single message so must be fragmented.
+	fragmented := [][]byte{}
 	peerVersionDeltas := g.peerVersionDeltas(sync)
 	for _, entry := range peerVersionDeltas {
-		deltas := g.peerMap.Deltas(entry.PeerAddr, entry.Version)
-		for _, delta := range deltas {
-			deltaEnc := encodeDelta(delta)
-			if len(sync)+len(deltaEnc) > g.maxMessageSize {
+		deltas := g.peerMap.Deltas(entry.PeerID, entry.Version)
+		for i, delta := range deltas {
+			deltaEnc, err := encodeDelta(delta, version)
+			if err != nil {
+				// The receiver doesn't support a protocol version that can
+				// encode the delta. Since deltas must be received in version
+				// order we can't send any later deltas for the peer either.
+				g.logger.Debug(
+					"cannot encode delta with protocol version",
+					zap.String("addr", addr),
+					zap.Uint8("version", version),
+					zap.Error(err),
+				)
+				break
+			}
+
+			if len(resp)+len(deltaEnc) > g.maxPayloadSize() {
+				// If the delta can never fit in a message it is fragmented.
+				// This is only done if it is the first delta for the peer,
+				// otherwise the fragments may be received before the earlier
+				// deltas, which would then be ignored. The remaining deltas
+				// for the peer are sent in later rounds.
+				if i == 0 && len(header)+len(deltaEnc) > g.maxPayloadSize() && version >= protocolVersion2 {
+					fragmented = append(fragmented, deltaEnc)
+				}
 				break
 			}
 
@@ -193,67 +674,557 @@ func (g *Gossiper) sendDelta(sync []Digest, addr string) error {
 	}
 
 	// Only send the delta response if it is not empty.
-	if len(resp) > 1 {
+	if len(resp) > len(header) {
 		g.logger.Debug(
 			"sending delta",
 			zap.String("addr", addr),
 		)
 
-		if err := g.transport.WriteTo(resp, addr); err != nil {
-			g.logger.Error("failed to write to transport", zap.Error(err))
-			return fmt.Errorf("failed to write to transport %s: %v", addr, err)
+		if err := g.write(resp, addr); err != nil {
+			return err
+		}
+	}
+
+	for _, deltaEnc := range fragmented {
+		if err := g.sendDeltaFragments(deltaEnc, addr, version); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (g *Gossiper) onDigestRequest(req []Digest, fromAddr string) error {
-	return g.onDigestSync(req, fromAddr, true)
+// sendDeltaFragments splits the encoded delta into fragments that each fit
+// in a message, and sends each fragment to addr.
+func (g *Gossiper) sendDeltaFragments(deltaEnc []byte, addr string, version uint8) error {
+	header := g.encodeHeader(typeDeltaFragment, version)
+	fragments, err := fragmentDelta(
+		deltaEnc,
+		g.nextFragmentID.Add(1),
+		g.maxPayloadSize()-len(header)-fragmentHeaderLen,
+	)
+	if err != nil {
+		g.logger.Warn("failed to fragment delta", zap.Error(err))
+		return fmt.Errorf("failed to fragment delta: %v", err)
+	}
+
+	g.logger.Debug(
+		"sending fragmented delta",
+		zap.String("addr", addr),
+		zap.Int("fragments", len(fragments)),
+	)
+
+	for _, fragment := range fragments {
+		msg := append(append([]byte{}, header...), encodeDeltaFragment(fragment)...)
+		if err := g.write(msg, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeHeader encodes the header of a message with the given protocol
+// version.
+func (g *Gossiper) encodeHeader(messageType messageType, version uint8) []byte {
+	return encodeHeader(messageHeader{
+		Version:     version,
+		Type:        messageType,
+		ClusterName: g.clusterName,
+		Sender:      g.peerMap.LocalAddr(),
+		SenderID:    g.peerMap.LocalID(),
+	})
+}
+
+// senderID returns the ID of the sender of a message. From protocol version 5
+// the sender includes its ID in the header. Otherwise the sender is looked up
+// by address, and if unknown the address is used as the ID since nodes before
+// protocol version 5 are identified by their address.
+func (g *Gossiper) senderID(header messageHeader, fromAddr string) string {
+	if header.SenderID != "" {
+		return header.SenderID
+	}
+	if id, ok := g.peerMap.IDByAddr(fromAddr); ok {
+		return id
+	}
+	return fromAddr
+}
+
+// reportAlive reports the peer with the given ID to the failure detector.
+// Senders that aren't known peers, such as a seed that hasn't sent its state
+// yet, are ignored so the failure detector doesn't track unknown IDs.
+func (g *Gossiper) reportAlive(id string) {
+	if _, ok := g.peerMap.Status(id); !ok {
+		return
+	}
+	g.failureDetector.Report(id, g.clock.Now())
+}
+
+// checkReachable logs a warning if the local node advertises a loopback
+// address while the peer with the given address is remote, since the peer
+// won't be able to reach the local node.
+func (g *Gossiper) checkReachable(addr string) {
+	if !isLoopbackAddr(g.peerMap.LocalAddr()) || !isRemoteAddr(addr) {
+		return
+	}
+	if g.loopbackWarned.Swap(true) {
+		return
+	}
+	g.logger.Warn(
+		"advertise addr is loopback though peers are remote; peers won't be able to reach the local node",
+		zap.String("advertise-addr", g.peerMap.LocalAddr()),
+		zap.String("peer-addr", addr),
+	)
+}
+
+// protocolVersion returns the highest protocol version supported by both the
+// local node and the peer with the given ID.
+//
+// If the peers supported versions aren't known yet, such as when seeding,
+// this uses the minimum supported version which is the most likely to be
+// understood.
+func (g *Gossiper) protocolVersion(id string) uint8 {
+	peerMin, okMin := g.peerProtocolVersion(id, protocolMinKey)
+	peerMax, okMax := g.peerProtocolVersion(id, protocolMaxKey)
+	if !okMin || !okMax {
+		return g.protocolVersionMin
+	}
+
+	version := g.protocolVersionMax
+	if peerMax < version {
+		version = peerMax
+	}
+	if version < g.protocolVersionMin || version < peerMin {
+		g.logger.Warn(
+			"no mutually supported protocol version",
+			zap.String("id", id),
+			zap.Uint8("peer-min", peerMin),
+			zap.Uint8("peer-max", peerMax),
+		)
+		return g.protocolVersionMin
+	}
+	return version
+}
+
+func (g *Gossiper) peerProtocolVersion(id string, key string) (uint8, bool) {
+	e, ok := g.peerMap.Lookup(id, key)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(e.Value, 10, 8)
+	if err != nil {
+		g.logger.Warn(
+			"peer has invalid protocol version",
+			zap.String("id", id),
+			zap.String("key", key),
+			zap.String("value", e.Value),
+		)
+		return 0, false
+	}
+	return uint8(version), true
+}
+
+// setProtocolVersions sets the range of supported protocol versions and
+// advertises them to the other nodes in the cluster.
+func (g *Gossiper) setProtocolVersions(minVersion uint8, maxVersion uint8) {
+	g.protocolVersionMin = minVersion
+	g.protocolVersionMax = maxVersion
+	g.peerMap.UpdateLocal(protocolMinKey, strconv.Itoa(int(minVersion)))
+	g.peerMap.UpdateLocal(protocolMaxKey, strconv.Itoa(int(maxVersion)))
+}
+
+// decodeMessage decrypts the message if a keyring is configured and decodes
+// the header. Returns an error if the message is malformed, has an
+// unsupported protocol version or is from another cluster.
+func (g *Gossiper) decodeMessage(b []byte, fromAddr string) (messageHeader, []byte, error) {
+	if g.keyring != nil {
+		var err error
+		b, err = g.keyring.Decrypt(b)
+		if err != nil {
+			g.stats.decryptFailed.Add(1)
+			g.logger.Warn(
+				"failed to decrypt message",
+				zap.String("addr", fromAddr),
+				zap.Error(err),
+			)
+			return messageHeader{}, nil, fmt.Errorf("failed to decrypt message: %v", err)
+		}
+	}
+
+	header, offset, err := decodeHeader(b)
+	if err != nil {
+		return messageHeader{}, nil, g.onMalformed(err, fromAddr)
+	}
+	if header.Version < g.protocolVersionMin || header.Version > g.protocolVersionMax {
+		g.stats.unsupportedVersion.Add(1)
+		g.logger.Warn(
+			"received message with unsupported protocol version",
+			zap.String("addr", fromAddr),
+			zap.Uint8("version", header.Version),
+		)
+		return messageHeader{}, nil, &UnsupportedVersionError{Version: header.Version}
+	}
+	if header.ClusterName != g.clusterName {
+		g.stats.clusterNameMismatch.Add(1)
+		g.logger.Debug(
+			"dropping message from another cluster",
+			zap.String("addr", fromAddr),
+			zap.String("cluster-name", header.ClusterName),
+		)
+		return messageHeader{}, nil, fmt.Errorf("invalid message; cluster name mismatch: %s", header.ClusterName)
+	}
+	return header, b[offset:], nil
+}
+
+// writePushPull writes a push-pull message containing the full known state
+// of the cluster to the stream, which is connected to the node with the given
+// ID. The ID may be empty if it isn't known.
+func (g *Gossiper) writePushPull(conn net.Conn, messageType messageType, id string) error {
+	version := g.protocolVersion(id)
+	payload, err := encodePushPullState(g.pushPullState(id, version), version)
+	if err != nil {
+		return fmt.Errorf("failed to encode push-pull state: %v", err)
+	}
+
+	b, err := g.encrypt(append(g.encodeHeader(messageType, version), payload...))
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(conn, b); err != nil {
+		return fmt.Errorf("failed to write push-pull to %s: %v", conn.RemoteAddr(), err)
+	}
+	return nil
+}
+
+// pushPullState returns the full known state of the up peers to send to the
+// node with the given ID, excluding that nodes own state.
+//
+// If an entry can't be encoded with the protocol version, that entry and all
+// later entries for the peer are excluded, since entries must be received in
+// version order.
+func (g *Gossiper) pushPullState(id string, version uint8) pushPullState {
+	state := pushPullState{
+		ID:    g.peerMap.LocalID(),
+		Peers: []peerState{},
+	}
+	for _, peerID := range g.peerMap.IDs(true) {
+		if peerID == id {
+			continue
+		}
+
+		peer := peerState{
+			Digest: g.peerMap.Digest(peerID),
+			Deltas: []Delta{},
+		}
+		for _, delta := range g.peerMap.Deltas(peerID, 0) {
+			if !deltaEncodable(delta, version) {
+				break
+			}
+			peer.Deltas = append(peer.Deltas, delta)
+		}
+		state.Peers = append(state.Peers, peer)
+	}
+	return state
+}
+
+func (g *Gossiper) applyPushPullState(state pushPullState) {
+	for _, peer := range state.Peers {
+		// Ignore our own state, which we always know best.
+		if peer.Digest.ID == g.peerMap.LocalID() {
+			continue
+		}
+
+		g.applyDigest(peer.Digest)
+		for _, delta := range peer.Deltas {
+			// Ignore deltas about other peers, which could otherwise be
+			// applied out of order.
+			if delta.ID != peer.Digest.ID {
+				continue
+			}
+			g.applyDelta(delta)
+		}
+	}
+
+	// Record the versions known by the sender once the sender has been
+	// added.
+	for _, peer := range state.Peers {
+		g.peerMap.UpdateKnownVersion(state.ID, peer.Digest)
+	}
+}
+
+// encrypt encrypts the message if a keyring is configured.
+func (g *Gossiper) encrypt(b []byte) ([]byte, error) {
+	if g.keyring == nil {
+		return b, nil
+	}
+
+	b, err := g.keyring.Encrypt(b)
+	if err != nil {
+		g.logger.Error("failed to encrypt message", zap.Error(err))
+		return nil, fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	return b, nil
 }
 
-func (g *Gossiper) onDigestResponse(resp []Digest, fromAddr string) error {
-	return g.onDigestSync(resp, fromAddr, false)
+// write encrypts the message if a keyring is configured and writes it to the
+// transport.
+func (g *Gossiper) write(b []byte, addr string) error {
+	b, err := g.encrypt(b)
+	if err != nil {
+		return err
+	}
+
+	if err := g.transport.WriteTo(b, addr); err != nil {
+		g.logger.Error("failed to write to transport", zap.Error(err))
+		return fmt.Errorf("failed to write to transport %s: %v", addr, err)
+	}
+	return nil
 }
 
-func (g *Gossiper) onDigestSync(sync []Digest, fromAddr string, sendDigestResponse bool) error {
-	g.failureDetector.Report(fromAddr)
+// maxPayloadSize returns the maximum size of a message payload, leaving room
+// for the encryption overhead if encryption is enabled.
+func (g *Gossiper) maxPayloadSize() int {
+	if g.keyring != nil {
+		return g.maxMessageSize - EncryptionOverhead
+	}
+	return g.maxMessageSize
+}
+
+// onMalformed records a message that couldn't be decoded. Nothing from the
+// message is applied.
+func (g *Gossiper) onMalformed(err error, fromAddr string) error {
+	g.stats.malformed.Add(1)
+	g.logger.Warn(
+		"received malformed message",
+		zap.String("addr", fromAddr),
+		zap.Error(err),
+	)
+	return fmt.Errorf("invalid message: %w", err)
+}
+
+func (g *Gossiper) onUnknownMessageType(t messageType, fromAddr string) error {
+	g.stats.unknownMessageType.Add(1)
+	g.logger.Warn(
+		"received unknown message type",
+		zap.String("addr", fromAddr),
+		zap.Uint8("type", uint8(t)),
+	)
+	return &UnknownMessageTypeError{Type: uint8(t)}
+}
+
+func (g *Gossiper) onDigestRequest(req []Digest, fromID string, fromAddr string) error {
+	return g.onDigestSync(req, fromID, fromAddr, true)
+}
+
+func (g *Gossiper) onDigestResponse(resp []Digest, fromID string, fromAddr string) error {
+	return g.onDigestSync(resp, fromID, fromAddr, false)
+}
 
+func (g *Gossiper) onDigestSync(sync []Digest, fromID string, fromAddr string, sendDigestResponse bool) error {
 	for _, digest := range sync {
-		g.peerMap.ApplyDigest(digest)
+		g.applyDigest(digest)
+		g.peerMap.UpdateKnownVersion(fromID, digest)
 	}
 
-	if err := g.sendDelta(sync, fromAddr); err != nil {
+	// Report the sender once its digest has been applied, since the sender
+	// may not have been known before.
+	g.reportAlive(fromID)
+
+	if err := g.sendDelta(sync, fromID, fromAddr); err != nil {
 		return err
 	}
 
 	if sendDigestResponse {
-		return g.sendDigestResponse(fromAddr)
+		return g.sendDigestResponse(fromID, fromAddr)
 	}
 
 	return nil
 }
 
-func (g *Gossiper) onDelta(sync []Delta, fromAddr string) error {
+func (g *Gossiper) onDelta(sync []Delta) error {
 	for _, delta := range sync {
-		g.peerMap.ApplyDelta(delta)
+		g.applyDelta(delta)
+	}
+	return nil
+}
+
+// applyDigest applies the digest to the peer map.
+func (g *Gossiper) applyDigest(digest Digest) {
+	if g.peerMap.ApplyDigest(digest) {
+		g.onRejoin(digest.ID)
+	}
+}
+
+// onRejoin discards the failure detector history and any probe of the old
+// generation of a peer that restarted, so the new generation isn't suspected
+// based on the old generations heartbeats.
+func (g *Gossiper) onRejoin(id string) {
+	g.prober.Cancel(id)
+	g.failureDetector.Remove(id)
+}
+
+// applyDelta applies the delta to the peer map. If the delta contains a newer
+// heartbeat for the peer, the peer is reported to the failure detector, since
+// receiving a newer heartbeat shows the peer is alive even if it was received
+// from another node.
+//
+// If the delta contains a tombstone for a removed peer, the peer may have been
+// removed so is also removed from the failure detector.
+func (g *Gossiper) applyDelta(delta Delta) {
+	applied, rejoined := g.peerMap.ApplyDelta(delta)
+	if rejoined {
+		g.onRejoin(delta.ID)
+	}
+	if !applied || delta.Deleted {
+		return
+	}
+	switch {
+	case delta.Key == heartbeatKey:
+		g.failureDetector.Report(delta.ID, g.clock.Now())
+	case strings.HasPrefix(delta.Key, removedKeyPrefix):
+		id := strings.TrimPrefix(delta.Key, removedKeyPrefix)
+		if _, ok := g.peerMap.Status(id); !ok {
+			g.prober.Cancel(id)
+			g.failureDetector.Remove(id)
+		}
+	}
+}
+
+func (g *Gossiper) onDeltaFragment(fragment deltaFragment, version uint8, fromID string, fromAddr string) error {
+	b, complete, err := g.reassembler.Add(fragment, fromID, g.clock.Now())
+	if err != nil {
+		g.stats.fragmentDropped.Add(1)
+		g.logger.Warn(
+			"dropping delta fragment",
+			zap.String("addr", fromAddr),
+			zap.Error(err),
+		)
+		return fmt.Errorf("failed to reassemble delta: %v", err)
+	}
+	if !complete {
+		return nil
+	}
+
+	g.logger.Debug(
+		"received fragmented delta",
+		zap.String("addr", fromAddr),
+	)
+
+	sync, err := decodeDeltaSync(b, version)
+	if err != nil {
+		return g.onMalformed(err, fromAddr)
 	}
+	return g.onDelta(sync)
+}
+
+func (g *Gossiper) onPing(p ping, version uint8, fromID string, fromAddr string) error {
+	g.logger.Debug("received ping", zap.String("id", fromID))
+
+	g.reportAlive(fromID)
+
+	// Respond with the version of the ping, since the sender may not know
+	// our supported versions yet.
+	return g.sendAck(ack{Seq: p.Seq}, version, fromAddr)
+}
+
+func (g *Gossiper) onPingReq(req pingReq, version uint8, fromID string, fromAddr string) error {
+	g.logger.Debug(
+		"received ping-req",
+		zap.String("id", fromID),
+		zap.String("target", req.Target),
+	)
+
+	g.reportAlive(fromID)
+
+	// The target is identified by address, so look up its ID to find its
+	// supported protocol versions.
+	targetID, ok := g.peerMap.IDByAddr(req.Target)
+	if !ok || g.protocolVersion(targetID) < protocolVersion3 {
+		g.logger.Debug(
+			"ping-req target doesn't support probing",
+			zap.String("target", req.Target),
+		)
+		return nil
+	}
+
+	seq := g.prober.AddRelay(fromID, fromAddr, req.Seq, g.clock.Now().Add(g.probeConfig.Timeout))
+	return g.sendPing(ping{Seq: seq}, targetID, req.Target)
+}
+
+func (g *Gossiper) onAck(a ack, fromID string, fromAddr string) error {
+	g.logger.Debug("received ack", zap.String("id", fromID))
+
+	g.reportAlive(fromID)
+
+	if target, ok := g.prober.AckProbe(a.Seq); ok {
+		g.logger.Debug("suspected peer acknowledged", zap.String("id", target))
+		// The ack may have been relayed by another peer, so the target
+		// itself must be reported as alive.
+		g.failureDetector.Report(target, g.clock.Now())
+		return nil
+	}
+	if r, ok := g.prober.AckRelay(a.Seq); ok {
+		return g.sendAck(ack{Seq: r.Seq}, g.protocolVersion(r.ID), r.Addr)
+	}
+	// Ignore acks for probes that have already completed or expired.
 	return nil
 }
 
+func (g *Gossiper) sendPing(p ping, id string, addr string) error {
+	g.logger.Debug("sending ping", zap.String("id", id))
+
+	msg := append(g.encodeHeader(typePing, g.protocolVersion(id)), encodePing(p)...)
+	return g.write(msg, addr)
+}
+
+// sendPingReq sends a ping-req to the helper peer with the given ID.
+func (g *Gossiper) sendPingReq(req pingReq, id string) error {
+	g.logger.Debug(
+		"sending ping-req",
+		zap.String("id", id),
+		zap.String("target", req.Target),
+	)
+
+	addr, ok := g.peerMap.Addr(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, id)
+	}
+	version := g.protocolVersion(id)
+	msg := append(g.encodeHeader(typePingReq, version), encodePingReq(req, version)...)
+	return g.write(msg, addr)
+}
+
+func (g *Gossiper) sendAck(a ack, version uint8, addr string) error {
+	g.logger.Debug("sending ack", zap.String("addr", addr))
+
+	msg := append(g.encodeHeader(typeAck, version), encodeAck(a)...)
+	return g.write(msg, addr)
+}
+
 // peerVersionDeltas returns the difference between the versions in each digest
 // and the known versions, sorted with the largest delta first. It only includes
 // peers where the digest includes a version greater than the local known
 // version.
+//
+// If the digest contains an older generation of a peer than the local known
+// generation, all known state for the peer is included since the senders state
+// is stale. Digests with a newer generation are ignored.
 func (g *Gossiper) peerVersionDeltas(sync []Digest) []peerVersionDelta {
 	peerVersionDeltas := []peerVersionDelta{}
 	for _, digest := range sync {
-		knownVersion := g.peerMap.Version(digest.Addr)
+		known := g.peerMap.Digest(digest.ID)
+		if digest.Generation > known.Generation {
+			continue
+		}
+
+		knownVersion := known.Version
+		if digest.Generation < known.Generation {
+			digest.Version = 0
+		}
 		if digest.Version < knownVersion {
 			peerVersionDeltas = append(peerVersionDeltas, peerVersionDelta{
-				PeerAddr: digest.Addr,
-				Delta:    knownVersion - digest.Version,
-				Version:  digest.Version,
+				PeerID:  digest.ID,
+				Delta:   knownVersion - digest.Version,
+				Version: digest.Version,
 			})
 		}
 	}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -12,6 +14,8 @@ import (
 
 type fakeTransport struct {
 	target *Gossiper
+	// from is the address the target receives messages from.
+	from string
 }
 
 func newFakeTransport(target *Gossiper) Transport {
@@ -21,7 +25,21 @@ func newFakeTransport(target *Gossiper) Transport {
 }
 
 func (t *fakeTransport) WriteTo(b []byte, addr string) error {
-	t.target.OnMessage(b, "")
+	t.target.OnMessage(b, t.from)
+	return nil
+}
+
+func (t *fakeTransport) PacketCh() <-chan *Packet {
+	return nil
+}
+
+func (t *fakeTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	client, server := net.Pipe()
+	go t.target.OnStream(server)
+	return client, nil
+}
+
+func (t *fakeTransport) StreamCh() <-chan net.Conn {
 	return nil
 }
 
@@ -33,6 +51,33 @@ func (t *fakeTransport) Shutdown() error {
 	return nil
 }
 
+// discardTransport drops all written messages.
+type discardTransport struct{}
+
+func (t *discardTransport) WriteTo(b []byte, addr string) error {
+	return nil
+}
+
+func (t *discardTransport) PacketCh() <-chan *Packet {
+	return nil
+}
+
+func (t *discardTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+
+func (t *discardTransport) StreamCh() <-chan net.Conn {
+	return nil
+}
+
+func (t *discardTransport) BindAddr() string {
+	return ""
+}
+
+func (t *discardTransport) Shutdown() error {
+	return nil
+}
+
 // Tests multiple gossip round between two gossipers end up with the same known
 // state about the cluster.
 func TestGossiper_SyncState(t *testing.T) {
@@ -46,15 +91,27 @@ func TestGossiper_SyncState(t *testing.T) {
 			gossiper1 := NewGossiper(
 				map1,
 				nil,
-				NewFailureDetector(1000000, 1000, 8.0),
+				NewExponentialDetector(8.0, 1000, 2*time.Millisecond),
+				nil,
+				"",
 				maxMessageSize,
+				StateLimits{},
+				ProbeConfig{},
+				NewRealClock(),
+				testRand(),
 				zap.NewNop(),
 			)
 			gossiper2 := NewGossiper(
 				map2,
 				nil,
-				NewFailureDetector(1000000, 1000, 8.0),
+				NewExponentialDetector(8.0, 1000, 2*time.Millisecond),
+				nil,
+				"",
 				maxMessageSize,
+				StateLimits{},
+				ProbeConfig{},
+				NewRealClock(),
+				testRand(),
 				zap.NewNop(),
 			)
 			gossiper1.transport = newFakeTransport(gossiper2)
@@ -63,8 +120,8 @@ func TestGossiper_SyncState(t *testing.T) {
 			// Keep exchanging messages. Note give plenty of rounds, given the digests
 			// can be randomised if they don't fit in the message.
 			for i := 0; i != 50; i++ {
-				assert.Nil(t, gossiper1.SendDigestRequest(""))
-				assert.Nil(t, gossiper2.SendDigestRequest(""))
+				assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+				assert.Nil(t, gossiper2.sendDigestRequest("", ""))
 				if map1.PeersEqual(map2) {
 					return
 				}
@@ -75,7 +132,8 @@ func TestGossiper_SyncState(t *testing.T) {
 }
 
 func randomPeerMap(numPeers int, numValues int) *PeerMap {
-	peerMap := NewPeerMap(randomAddr(), nil, nil, nil, zap.NewNop())
+	addr := randomAddr()
+	peerMap := NewPeerMap(addr, addr, 0, time.Hour, nil, NewRealClock(), zap.NewNop())
 	for j := 0; j != numValues; j++ {
 		peerMap.UpdateLocal(
 			fmt.Sprintf("key-%d", rand.Int()),
@@ -86,21 +144,29 @@ func randomPeerMap(numPeers int, numValues int) *PeerMap {
 	for i := 1; i != numValues+1; i++ {
 		addr := randomAddr()
 		peerMap.ApplyDigest(Digest{
-			Addr:    addr,
+			ID:      addr,
 			Version: 0,
 		})
+		// Each entry must have a unique non-zero version, otherwise it may
+		// never be propagated.
+		var version uint64
 		for j := 0; j != numPeers; j++ {
+			version += uint64(randomUint16()) + 1
 			peerMap.ApplyDelta(Delta{
-				Addr:    addr,
+				ID:      addr,
 				Key:     fmt.Sprintf("key-%d", rand.Int()),
 				Value:   fmt.Sprintf("value-%d", rand.Int()),
-				Version: uint64(randomUint16()),
+				Version: version,
 			})
 		}
 	}
 	return peerMap
 }
 
+func testRand() *rand.Rand {
+	return NewLockedRand(rand.NewSource(time.Now().UnixNano()))
+}
+
 func randomAddr() string {
 	return fmt.Sprintf("%s:%d", net.IPv4(randomByte(), randomByte(), randomByte(), randomByte()).String(), randomUint16())
 }
@@ -112,3 +178,693 @@ func randomUint16() uint16 {
 func randomByte() byte {
 	return byte(rand.Intn(0xff))
 }
+
+// Tests a gossiper with stale state about a restarted peer receives the full
+// state of the new generation, even if it has a higher version.
+func TestGossiper_SyncNewGeneration(t *testing.T) {
+	map1 := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	map2 := NewPeerMap("10.26.104.12:8119", "10.26.104.12:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	map1.ApplyDigest(Digest{ID: "10.26.104.13:8119", Generation: 1})
+	for i := 1; i != 10; i++ {
+		map1.ApplyDelta(Delta{
+			ID:         "10.26.104.13:8119",
+			Generation: 1,
+			Key:        fmt.Sprintf("key-%d", i),
+			Value:      "old",
+			Version:    uint64(i),
+		})
+	}
+
+	map2.ApplyDigest(Digest{ID: "10.26.104.13:8119", Generation: 2})
+	map2.ApplyDelta(Delta{
+		ID:         "10.26.104.13:8119",
+		Generation: 2,
+		Key:        "key-1",
+		Value:      "new",
+		Version:    1,
+	})
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+	assert.Nil(t, gossiper2.sendDigestRequest("", ""))
+
+	assert.True(t, map1.PeersEqual(map2))
+	e, ok := map1.Lookup("10.26.104.13:8119", "key-1")
+	assert.True(t, ok)
+	assert.Equal(t, "new", e.Value)
+}
+
+// Tests gossipers with a shared key can exchange state, and messages
+// encrypted with an unknown key are rejected.
+// Tests a down peer is marked as up again once it recovers.
+func TestGossiper_CheckLivenessRecovered(t *testing.T) {
+	peerMap := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	peerMap.ApplyDigest(Digest{ID: "10.26.104.12:8119", Generation: 1})
+
+	fd := NewExponentialDetector(8.0, 1000, 2*time.Millisecond)
+	gossiper := NewGossiper(peerMap, &discardTransport{}, fd, nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+
+	fd.Report("10.26.104.12:8119", time.Now())
+	time.Sleep(time.Millisecond * 50)
+
+	gossiper.CheckLiveness()
+	assert.Equal(t, []string{"10.26.104.12:8119"}, peerMap.DownPeers())
+
+	fd.Report("10.26.104.12:8119", time.Now())
+
+	gossiper.CheckLiveness()
+	assert.Equal(t, 0, len(peerMap.DownPeers()))
+	assert.Equal(t, []string{"10.26.104.12:8119"}, peerMap.IDs(false))
+}
+
+// testCluster is a cluster of gossipers on a memory network with a manual
+// clock, used to test failure detection.
+type testCluster struct {
+	addrs     []string
+	gossipers []*Gossiper
+	network   *MemoryNetwork
+	clock     *ManualClock
+}
+
+func newTestCluster(t *testing.T, n int, probeConfig ProbeConfig) *testCluster {
+	// Note the failure detector requires a non-zero timestamp.
+	clock := NewManualClock(time.Unix(1000, 0))
+	c := &testCluster{
+		network: NewMemoryNetwork(clock, testRand()),
+		clock:   clock,
+	}
+	for i := 0; i != n; i++ {
+		addr := fmt.Sprintf("10.26.104.%d:8119", 11+i)
+		transport, err := c.network.NewTransport(addr)
+		assert.Nil(t, err)
+		c.addrs = append(c.addrs, addr)
+		c.gossipers = append(c.gossipers, NewGossiper(
+			NewPeerMap(addr, addr, 1, time.Hour, nil, clock, zap.NewNop()),
+			transport,
+			NewExponentialDetector(8.0, 1000, 2*time.Second),
+			nil,
+			"",
+			512,
+			StateLimits{},
+			probeConfig,
+			clock,
+			testRand(),
+			zap.NewNop(),
+		))
+	}
+
+	// Exchange state so each gossiper knows the protocol versions of the
+	// others.
+	for i := range c.gossipers {
+		for j := range c.gossipers {
+			if i != j {
+				assert.Nil(t, c.gossipers[i].sendDigestRequest(c.addrs[j], c.addrs[j]))
+				c.deliver()
+			}
+		}
+	}
+	return c
+}
+
+// deliver delivers all pending packets until there are no more pending
+// packets.
+func (c *testCluster) deliver() {
+	for {
+		delivered := false
+		for _, g := range c.gossipers {
+			select {
+			case p := <-g.transport.PacketCh():
+				g.OnMessage(p.Buf, p.From.String())
+				delivered = true
+			default:
+			}
+		}
+		if !delivered {
+			return
+		}
+	}
+}
+
+// Tests a newer heartbeat received from another node is reported to the
+// failure detector.
+func TestGossiper_HeartbeatReceivedIndirectly(t *testing.T) {
+	c := newTestCluster(t, 3, ProbeConfig{})
+
+	// Drop all packets between the first and third gossiper.
+	c.network.Partition(c.addrs[:1], c.addrs[2:])
+	c.network.Partition(c.addrs[2:], c.addrs[:1])
+
+	c.clock.Advance(time.Minute)
+
+	// Propagate the third gossipers heartbeat to the first gossiper via the
+	// second.
+	c.gossipers[2].Heartbeat()
+	assert.Nil(t, c.gossipers[2].sendDigestRequest(c.addrs[1], c.addrs[1]))
+	c.deliver()
+	assert.Nil(t, c.gossipers[1].sendDigestRequest(c.addrs[0], c.addrs[0]))
+	c.deliver()
+
+	assert.True(t, c.gossipers[0].failureDetector.Available(c.addrs[2], c.clock.Now()))
+	// The heartbeat is only reported once.
+	c.clock.Advance(time.Hour)
+	assert.Nil(t, c.gossipers[1].sendDigestRequest(c.addrs[0], c.addrs[0]))
+	c.deliver()
+	assert.False(t, c.gossipers[0].failureDetector.Available(c.addrs[2], c.clock.Now()))
+}
+
+// Tests a suspected peer that is reachable by another peer isn't considered
+// down.
+func TestGossiper_ProbeSuspectedPeerIndirectAck(t *testing.T) {
+	c := newTestCluster(t, 3, ProbeConfig{IndirectProbes: 1, Timeout: time.Second})
+	assert.Equal(t, uint8(ProtocolVersionMax), c.gossipers[0].protocolVersion(c.addrs[1]))
+
+	// Drop all packets between the first and second gossiper.
+	c.network.Partition(c.addrs[:1], c.addrs[1:2])
+	c.network.Partition(c.addrs[1:2], c.addrs[:1])
+
+	c.clock.Advance(time.Minute)
+	c.gossipers[0].failureDetector.Report(c.addrs[2], c.clock.Now())
+
+	c.gossipers[0].CheckLiveness()
+	c.deliver()
+
+	c.clock.Advance(time.Second * 2)
+	c.gossipers[0].failureDetector.Report(c.addrs[2], c.clock.Now())
+	c.gossipers[0].CheckLiveness()
+	assert.Equal(t, c.addrs[1:], c.gossipers[0].peerMap.IDs(false))
+	assert.Equal(t, 0, len(c.gossipers[0].peerMap.DownPeers()))
+}
+
+// Tests a suspected peer that doesn't acknowledge any probes is considered down
+// once the probe times out.
+func TestGossiper_ProbeSuspectedPeerTimeout(t *testing.T) {
+	c := newTestCluster(t, 3, ProbeConfig{IndirectProbes: 1, Timeout: time.Second})
+
+	// Drop all packets to and from the second gossiper.
+	c.network.Partition(c.addrs[1:2], []string{c.addrs[0], c.addrs[2]})
+	c.network.Partition([]string{c.addrs[0], c.addrs[2]}, c.addrs[1:2])
+
+	c.clock.Advance(time.Minute)
+	c.gossipers[0].failureDetector.Report(c.addrs[2], c.clock.Now())
+
+	c.gossipers[0].CheckLiveness()
+	c.deliver()
+	// The peer is only suspected so not yet down.
+	assert.Equal(t, c.addrs[1:], c.gossipers[0].peerMap.IDs(false))
+
+	c.clock.Advance(time.Second * 2)
+	c.gossipers[0].failureDetector.Report(c.addrs[2], c.clock.Now())
+	c.gossipers[0].CheckLiveness()
+	assert.Equal(t, c.addrs[2:], c.gossipers[0].peerMap.IDs(false))
+	assert.Equal(t, c.addrs[1:2], c.gossipers[0].peerMap.DownPeers())
+}
+
+// Tests a suspected peer is considered down immediately when probing is
+// disabled.
+func TestGossiper_ProbeDisabled(t *testing.T) {
+	c := newTestCluster(t, 3, ProbeConfig{})
+
+	c.network.Partition(c.addrs[:1], c.addrs[1:2])
+	c.network.Partition(c.addrs[1:2], c.addrs[:1])
+
+	c.clock.Advance(time.Minute)
+	c.gossipers[0].failureDetector.Report(c.addrs[2], c.clock.Now())
+
+	c.gossipers[0].CheckLiveness()
+	assert.Equal(t, c.addrs[2:], c.gossipers[0].peerMap.IDs(false))
+	assert.Equal(t, c.addrs[1:2], c.gossipers[0].peerMap.DownPeers())
+}
+
+func TestGossiper_EncryptedSyncState(t *testing.T) {
+	keyring1, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+	keyring2, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	map1 := randomPeerMap(10, 5)
+	map2 := randomPeerMap(10, 5)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), keyring1, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), keyring2, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	for i := 0; i != 50; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+		assert.Nil(t, gossiper2.sendDigestRequest("", ""))
+		if map1.PeersEqual(map2) {
+			break
+		}
+	}
+	assert.True(t, map1.PeersEqual(map2))
+
+	// Messages that can't be decrypted should be rejected.
+	keyring3, err := NewKeyring([][]byte{testKey(2)})
+	assert.Nil(t, err)
+	b, err := keyring3.Encrypt([]byte{byte(typeDigestRequest)})
+	assert.Nil(t, err)
+	assert.NotNil(t, gossiper2.OnMessage(b, ""))
+}
+
+// Tests gossipers in different clusters drop each others messages.
+func TestGossiper_ClusterNameMismatch(t *testing.T) {
+	map1 := randomPeerMap(10, 5)
+	map2 := randomPeerMap(10, 5)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "cluster-1", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "cluster-2", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	numPeers := len(map2.IDs(true))
+
+	// The fake transport ignores errors so check the message was dropped
+	// from the peer map and stats.
+	assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+	assert.Equal(t, numPeers, len(map2.IDs(true)))
+	assert.Equal(t, Stats{ClusterNameMismatch: 1}, gossiper2.Stats())
+}
+
+// Tests malformed messages are rejected and counted without modifying the
+// peer map.
+func TestGossiper_MalformedMessage(t *testing.T) {
+	digestRequest := append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDigestRequest}),
+		encodeDigest(Digest{ID: "10.26.104.56:8123", Version: 0x10}, ProtocolVersionMin)...,
+	)
+	delta := append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDelta}),
+		mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Key: "foo", Value: "bar", Version: 0x10}, ProtocolVersionMin)...,
+	)
+
+	tests := []struct {
+		name  string
+		b     []byte
+		stats Stats
+	}{
+		{"empty", []byte{}, Stats{Malformed: 1}},
+		{"truncated-header", []byte{ProtocolVersionMin, uint8(typeDigestRequest), 0x5, 'a'}, Stats{Malformed: 1}},
+		{"truncated-digest", digestRequest[:len(digestRequest)-1], Stats{Malformed: 1}},
+		{"truncated-delta", delta[:len(delta)-1], Stats{Malformed: 1}},
+		{"unknown-type", encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: 0xff}), Stats{UnknownMessageType: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+			gossiper := NewGossiper(pm, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+
+			assert.NotNil(t, gossiper.OnMessage(tt.b, "10.26.104.56:8123"))
+			assert.Equal(t, tt.stats, gossiper.Stats())
+			assert.Equal(t, []string{"local:123"}, pm.IDs(true))
+		})
+	}
+
+	var unknownErr *UnknownMessageTypeError
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	gossiper := NewGossiper(pm, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	assert.ErrorAs(t, gossiper.OnMessage(encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: 0xff}), ""), &unknownErr)
+	assert.Equal(t, uint8(0xff), unknownErr.Type)
+}
+
+// Tests a gossiper without encryption rejects encrypted messages rather than
+// panicking.
+func TestGossiper_PlaintextReceivesEncrypted(t *testing.T) {
+	keyring, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	map1 := randomPeerMap(10, 5)
+	map2 := randomPeerMap(10, 5)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), keyring, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+
+	numPeers := len(map2.IDs(true))
+	for i := 0; i != 10; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+	}
+	assert.Equal(t, numPeers, len(map2.IDs(true)))
+	stats := gossiper2.Stats()
+	assert.Equal(t, uint64(10), stats.Malformed+stats.UnknownMessageType+stats.ClusterNameMismatch)
+}
+
+func FuzzGossiper_OnMessage(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDigestRequest}),
+		encodeDigest(Digest{ID: "10.26.104.56:8123", Generation: 1, Version: 0x10}, ProtocolVersionMin)...,
+	))
+	f.Add(append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDigestResponse}),
+		encodeDigest(Digest{ID: "10.26.104.56:8123", Generation: 1, Version: 0x10}, ProtocolVersionMin)...,
+	))
+	f.Add(append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDelta}),
+		mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Generation: 1, Key: "foo", Value: "bar", Version: 0x10}, ProtocolVersionMin)...,
+	))
+	f.Add(append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMin, Type: typeDelta}),
+		mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Generation: 1, Key: "foo", Version: 0x11, Deleted: true}, ProtocolVersionMin)...,
+	))
+
+	f.Add(append(
+		encodeHeader(messageHeader{Version: protocolVersion2, Type: typeDelta}),
+		mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Generation: 1, Key: "foo", Value: strings.Repeat("a", 300), Version: 0x10}, protocolVersion2)...,
+	))
+	f.Add(append(
+		encodeHeader(messageHeader{Version: protocolVersion2, Type: typeDeltaFragment}),
+		encodeDeltaFragment(deltaFragment{
+			ID:    1,
+			Index: 0,
+			Count: 1,
+			Data:  mustEncodeDelta(Delta{ID: "10.26.104.56:8123", Generation: 1, Key: "foo", Value: "bar", Version: 0x10}, protocolVersion2),
+		})...,
+	))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+		gossiper := NewGossiper(pm, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+		// Must never panic regardless of the input.
+		gossiper.OnMessage(b, "10.26.104.56:8123")
+	})
+}
+
+// Tests the gossiper encodes messages with the highest protocol version
+// supported by both nodes.
+func TestGossiper_ProtocolVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		localMin uint8
+		localMax uint8
+		peerMin  uint8
+		peerMax  uint8
+		expected uint8
+	}{
+		{"same", 1, 2, 1, 2, 2},
+		{"peer-older", 1, 3, 1, 2, 2},
+		{"peer-newer", 1, 2, 2, 4, 2},
+		{"no-overlap", 1, 2, 3, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localMap := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+			peerMap := NewPeerMap("10.26.104.12:8119", "10.26.104.12:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+			local := NewGossiper(localMap, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+			local.setProtocolVersions(tt.localMin, tt.localMax)
+			peer := NewGossiper(peerMap, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+			peer.setProtocolVersions(tt.peerMin, tt.peerMax)
+
+			// Before the peers state is known the minimum version is used.
+			assert.Equal(t, tt.localMin, local.protocolVersion("10.26.104.12:8119"))
+
+			localMap.ApplyDigest(peerMap.Digest("10.26.104.12:8119"))
+			for _, delta := range peerMap.Deltas("10.26.104.12:8119", 0) {
+				localMap.ApplyDelta(delta)
+			}
+			assert.Equal(t, tt.expected, local.protocolVersion("10.26.104.12:8119"))
+		})
+	}
+}
+
+// Tests nodes supporting different protocol versions can exchange state.
+func TestGossiper_MixedProtocolVersions(t *testing.T) {
+	map1 := randomPeerMap(10, 5)
+	map2 := randomPeerMap(10, 5)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.setProtocolVersions(1, 2)
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2.setProtocolVersions(1, 1)
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	for i := 0; i != 100; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("", ""))
+		assert.Nil(t, gossiper2.sendDigestRequest("", ""))
+	}
+
+	assert.True(t, map1.PeersEqual(map2))
+	assert.Equal(t, Stats{}, gossiper1.Stats())
+	assert.Equal(t, Stats{}, gossiper2.Stats())
+}
+
+// Tests messages with an unsupported protocol version are dropped.
+func TestGossiper_UnsupportedVersion(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	gossiper := NewGossiper(pm, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+
+	b := append(
+		encodeHeader(messageHeader{Version: ProtocolVersionMax + 1, Type: typeDigestRequest}),
+		encodeDigest(Digest{ID: "10.26.104.56:8123", Version: 0x10}, ProtocolVersionMin)...,
+	)
+
+	var versionErr *UnsupportedVersionError
+	assert.ErrorAs(t, gossiper.OnMessage(b, "10.26.104.56:8123"), &versionErr)
+	assert.Equal(t, uint8(ProtocolVersionMax+1), versionErr.Version)
+	assert.Equal(t, Stats{UnsupportedVersion: 1}, gossiper.Stats())
+	assert.Equal(t, []string{"local:123"}, pm.IDs(true))
+}
+
+func TestGossiper_UpdateLocalLimits(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	gossiper := NewGossiper(pm, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{
+		MaxKeySize:   5,
+		MaxValueSize: 10,
+		MaxStateSize: 19,
+	}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+
+	assert.ErrorIs(t, gossiper.UpdateLocal("too-long", "v"), ErrKeyTooLarge)
+	assert.ErrorIs(t, gossiper.UpdateLocal("k", "value-too-long"), ErrValueTooLarge)
+	assert.NotNil(t, gossiper.UpdateLocal(protocolMinKey, "1"))
+	// Reserved keys can't be deleted either.
+	assert.NotNil(t, gossiper.DeleteLocal(protocolMinKey))
+	_, ok := gossiper.peerMap.Lookup("local:123", protocolMinKey)
+	assert.True(t, ok)
+
+	assert.Nil(t, gossiper.UpdateLocal("k1", "12345678"))
+	// Replacing the value of an existing key only counts the new value.
+	assert.Nil(t, gossiper.UpdateLocal("k1", "87654321"))
+	assert.ErrorIs(t, gossiper.UpdateLocal("k2", "12345678"), ErrStateTooLarge)
+	assert.Nil(t, gossiper.UpdateLocal("k2", "1234"))
+
+	// Deleted keys don't count towards the state size.
+	assert.Nil(t, gossiper.DeleteLocal("k1"))
+	assert.Nil(t, gossiper.UpdateLocal("k3", "12345678"))
+
+	v, ok := gossiper.Lookup("local:123", "k3")
+	assert.True(t, ok)
+	assert.Equal(t, "12345678", v)
+	_, ok = gossiper.Lookup("local:123", "k1")
+	assert.False(t, ok)
+}
+
+// Tests values that don't fit in a single message are fragmented and
+// reassembled by peers supporting protocol version 2.
+func TestGossiper_FragmentLargeValue(t *testing.T) {
+	map1 := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	map2 := NewPeerMap("10.26.104.12:8119", "10.26.104.12:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 256, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 256, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = &fakeTransport{target: gossiper2, from: "10.26.104.11:8119"}
+	gossiper2.transport = &fakeTransport{target: gossiper1, from: "10.26.104.12:8119"}
+
+	value := strings.Repeat("a", 5000)
+	assert.Nil(t, gossiper1.UpdateLocal("small", "foo"))
+	assert.Nil(t, gossiper1.UpdateLocal("large", value))
+	assert.Nil(t, gossiper1.UpdateLocal("after", "bar"))
+
+	for i := 0; i != 5; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("10.26.104.12:8119", "10.26.104.12:8119"))
+		assert.Nil(t, gossiper2.sendDigestRequest("10.26.104.11:8119", "10.26.104.11:8119"))
+	}
+
+	assert.Equal(t, uint8(ProtocolVersionMax), gossiper1.protocolVersion("10.26.104.12:8119"))
+	assert.True(t, map1.PeersEqual(map2))
+	v, ok := gossiper2.Lookup("10.26.104.11:8119", "large")
+	assert.True(t, ok)
+	assert.Equal(t, value, v)
+	assert.Equal(t, Stats{}, gossiper2.Stats())
+}
+
+// Tests peers identify a node by its advertised address rather than the
+// packets source address, such as when the node is behind NAT.
+func TestGossiper_AdvertiseAddr(t *testing.T) {
+	map1 := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	map2 := NewPeerMap("10.26.104.12:8119", "10.26.104.12:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	// gossiper1s packets are received from its private address.
+	gossiper1.transport = &fakeTransport{target: gossiper2, from: "172.17.0.2:8119"}
+	gossiper2.transport = &fakeTransport{target: gossiper1, from: "10.26.104.12:8119"}
+
+	assert.Nil(t, gossiper1.UpdateLocal("foo", "bar"))
+	for i := 0; i != 3; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("10.26.104.12:8119", "10.26.104.12:8119"))
+		assert.Nil(t, gossiper2.sendDigestRequest("10.26.104.11:8119", "10.26.104.11:8119"))
+	}
+
+	assert.Equal(t, "10.26.104.11:8119", gossiper1.AdvertiseAddr())
+	assert.Equal(t, uint8(ProtocolVersionMax), gossiper2.protocolVersion("10.26.104.11:8119"))
+	assert.Equal(t, []string{"10.26.104.11:8119"}, gossiper2.IDs(false))
+	v, ok := gossiper2.Lookup("10.26.104.11:8119", "foo")
+	assert.True(t, ok)
+	assert.Equal(t, "bar", v)
+
+	// Once both nodes support protocol version 4, messages are attributed to
+	// the advertised address.
+	acked, _ := gossiper2.LeaveAcks(1)
+	assert.Equal(t, []string{"10.26.104.11:8119"}, acked)
+	assert.True(t, gossiper1.IsLocalAddr("10.26.104.11:8119"))
+	assert.False(t, gossiper1.IsLocalAddr("172.17.0.2:8119"))
+}
+
+// Tests peers are identified by ID rather than address, so a node that
+// restarts with a new address keeps its identity.
+func TestGossiper_NodeID(t *testing.T) {
+	map1 := NewPeerMap("node-1", "10.26.104.11:8119", 1, time.Hour, nil, NewRealClock(), zap.NewNop())
+	map2 := NewPeerMap("node-2", "10.26.104.12:8119", 1, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = &fakeTransport{target: gossiper2, from: "10.26.104.11:8119"}
+	gossiper2.transport = &fakeTransport{target: gossiper1, from: "10.26.104.12:8119"}
+
+	// Seed by address since the IDs aren't known yet.
+	for i := 0; i != 3; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("", "10.26.104.12:8119"))
+		assert.Nil(t, gossiper2.sendDigestRequest("", "10.26.104.11:8119"))
+	}
+
+	assert.Equal(t, []string{"node-1"}, gossiper2.IDs(false))
+	addr, ok := gossiper2.Addr("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.11:8119", addr)
+	acked, _ := gossiper2.LeaveAcks(1)
+	assert.Equal(t, []string{"node-1"}, acked)
+
+	// node-1 restarts with a new address.
+	map1 = NewPeerMap("node-1", "10.26.104.21:8119", 2, time.Hour, nil, NewRealClock(), zap.NewNop())
+	gossiper1 = NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = &fakeTransport{target: gossiper2, from: "10.26.104.21:8119"}
+	gossiper2.transport = &fakeTransport{target: gossiper1, from: "10.26.104.12:8119"}
+
+	for i := 0; i != 3; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("", "10.26.104.12:8119"))
+		assert.Nil(t, gossiper2.SendDigestRequest("node-1"))
+	}
+
+	assert.Equal(t, []string{"node-1"}, gossiper2.IDs(false))
+	addr, ok = gossiper2.Addr("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.21:8119", addr)
+	id, ok := map2.IDByAddr("10.26.104.21:8119")
+	assert.True(t, ok)
+	assert.Equal(t, "node-1", id)
+}
+
+// Tests values that can't be encoded with protocol version 1 are not sent to
+// peers that only support version 1, though the earlier state is.
+func TestGossiper_LargeValueProtocolVersion1(t *testing.T) {
+	map1 := NewPeerMap("10.26.104.11:8119", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	map2 := NewPeerMap("10.26.104.12:8119", "10.26.104.12:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2.setProtocolVersions(protocolVersion1, protocolVersion1)
+	gossiper1.transport = &fakeTransport{target: gossiper2, from: "10.26.104.11:8119"}
+	gossiper2.transport = &fakeTransport{target: gossiper1, from: "10.26.104.12:8119"}
+
+	assert.Nil(t, gossiper1.UpdateLocal("small", "foo"))
+	assert.Nil(t, gossiper1.UpdateLocal("large", strings.Repeat("a", 300)))
+
+	for i := 0; i != 5; i++ {
+		assert.Nil(t, gossiper1.sendDigestRequest("10.26.104.12:8119", "10.26.104.12:8119"))
+		assert.Nil(t, gossiper2.sendDigestRequest("10.26.104.11:8119", "10.26.104.11:8119"))
+	}
+
+	v, ok := gossiper2.Lookup("10.26.104.11:8119", "small")
+	assert.True(t, ok)
+	assert.Equal(t, "foo", v)
+	_, ok = gossiper2.Lookup("10.26.104.11:8119", "large")
+	assert.False(t, ok)
+	assert.Equal(t, Stats{}, gossiper2.Stats())
+}
+
+// Tests a single push-pull exchange syncs the full state of both nodes,
+// regardless of the maximum message size.
+func TestGossiper_PushPull(t *testing.T) {
+	map1 := randomPeerMap(10, 50)
+	map2 := randomPeerMap(10, 50)
+
+	keyring, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), keyring, "", 200, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), keyring, "", 200, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	assert.False(t, map1.PeersEqual(map2))
+	assert.Nil(t, gossiper1.PushPullSeed(map2.LocalAddr()))
+	assert.True(t, map1.PeersEqual(map2))
+}
+
+// Tests a push-pull from a node that missed a delete doesn't re-add the
+// deleted entry once its tombstone has been removed.
+func TestGossiper_PushPullRemovedTombstone(t *testing.T) {
+	pm := NewPeerMap("local", "10.26.104.11:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+	gossiper := NewGossiper(pm, &discardTransport{}, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "node-1", Generation: 1})
+	pm.ApplyDigest(Digest{ID: "node-2", Generation: 1})
+	pm.ApplyDelta(Delta{ID: "node-1", Generation: 1, Key: "foo", Value: "bar", Version: 1})
+	pm.ApplyDelta(Delta{ID: "node-1", Generation: 1, Key: "foo", Deleted: true, Version: 2})
+
+	// Once node-2 has seen the delete the tombstone is removed.
+	pm.UpdateKnownVersion("node-2", Digest{ID: "node-1", Generation: 1, Version: 2})
+	pm.RemoveConvergedTombstones()
+	assert.Equal(t, []Delta{}, pm.Deltas("node-1", 0))
+
+	// A lagging node sends its stale state of node-1 from before the delete.
+	gossiper.applyPushPullState(pushPullState{
+		ID: "node-3",
+		Peers: []peerState{
+			{
+				Digest: Digest{ID: "node-1", Generation: 1, Version: 1},
+				Deltas: []Delta{
+					{ID: "node-1", Generation: 1, Key: "foo", Value: "bar", Version: 1},
+				},
+			},
+		},
+	})
+
+	_, ok := pm.Lookup("node-1", "foo")
+	assert.False(t, ok)
+	assert.Equal(t, []Delta{}, pm.Deltas("node-1", 0))
+}
+
+// Tests push-pull requests from another cluster are rejected.
+func TestGossiper_PushPullClusterNameMismatch(t *testing.T) {
+	map1 := randomPeerMap(10, 5)
+	map2 := randomPeerMap(10, 5)
+
+	gossiper1 := NewGossiper(map1, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "cluster-1", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper2 := NewGossiper(map2, nil, NewExponentialDetector(8.0, 1000, 2*time.Millisecond), nil, "cluster-2", 512, StateLimits{}, ProbeConfig{}, NewRealClock(), testRand(), zap.NewNop())
+	gossiper1.transport = newFakeTransport(gossiper2)
+	gossiper2.transport = newFakeTransport(gossiper1)
+
+	numPeers := len(map2.IDs(true))
+
+	// gossiper2 closes the stream without responding.
+	assert.NotNil(t, gossiper1.PushPullSeed(map2.LocalAddr()))
+	assert.Equal(t, numPeers, len(map2.IDs(true)))
+	assert.Equal(t, Stats{ClusterNameMismatch: 1}, gossiper2.Stats())
+}
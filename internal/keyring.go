@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+const (
+	// encryptionVersion is the version of the encrypted packet format,
+	// prefixed to each encrypted packet.
+	encryptionVersion = 1
+
+	nonceSize = 12
+	tagSize   = 16
+
+	// EncryptionOverhead is the number of bytes added to each packet by
+	// encryption.
+	EncryptionOverhead = uint8Len + nonceSize + tagSize
+)
+
+// Keyring contains the symmetric keys used to encrypt and decrypt packets
+// using AES-GCM.
+//
+// Packets are always encrypted with the primary key, though are decrypted by
+// trying all installed keys. This means keys can be rotated across a live
+// cluster by installing the new key on all nodes, then promoting it to the
+// primary key on all nodes, then removing the old key.
+//
+// Note this is thread safe.
+type Keyring struct {
+	// keys contains the installed keys, where the first key is the primary
+	// key.
+	keys [][]byte
+	// mu protects the above fields.
+	mu sync.RWMutex
+}
+
+// NewKeyring returns a keyring containing the given keys, where the first key
+// is the primary key. At least one key must be given.
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring must contain at least one key")
+	}
+
+	k := &Keyring{
+		keys: [][]byte{},
+	}
+	for _, key := range keys {
+		if err := k.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// AddKey installs the key so it can be used to decrypt packets. If the key is
+// already installed this does nothing.
+func (k *Keyring) AddKey(key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.indexOf(key) != -1 {
+		return nil
+	}
+
+	// Copy the key so it can't be modified by the caller.
+	k.keys = append(k.keys, append([]byte{}, key...))
+	return nil
+}
+
+// UseKey promotes the installed key to the primary key used to encrypt
+// packets.
+func (k *Keyring) UseKey(key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	i := k.indexOf(key)
+	if i == -1 {
+		return fmt.Errorf("key not installed")
+	}
+
+	k.keys[0], k.keys[i] = k.keys[i], k.keys[0]
+	return nil
+}
+
+// RemoveKey removes the installed key. The primary key cannot be removed.
+func (k *Keyring) RemoveKey(key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	i := k.indexOf(key)
+	if i == -1 {
+		return nil
+	}
+	if i == 0 {
+		return fmt.Errorf("cannot remove primary key")
+	}
+
+	k.keys = append(k.keys[:i], k.keys[i+1:]...)
+	return nil
+}
+
+// Keys returns the installed keys, where the first key is the primary key.
+func (k *Keyring) Keys() [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([][]byte, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, append([]byte{}, key...))
+	}
+	return keys
+}
+
+// Encrypt encrypts the packet with the primary key.
+func (k *Keyring) Encrypt(b []byte) ([]byte, error) {
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, uint8Len+nonceSize, len(b)+EncryptionOverhead)
+	buf[0] = encryptionVersion
+	if _, err := rand.Read(buf[uint8Len : uint8Len+nonceSize]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(buf, buf[uint8Len:uint8Len+nonceSize], b, nil), nil
+}
+
+// Decrypt decrypts the packet by trying each installed key.
+func (k *Keyring) Decrypt(b []byte) ([]byte, error) {
+	if len(b) < EncryptionOverhead {
+		return nil, fmt.Errorf("encrypted packet too small")
+	}
+	if b[0] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version: %d", b[0])
+	}
+
+	nonce := b[uint8Len : uint8Len+nonceSize]
+	ciphertext := b[uint8Len+nonceSize:]
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("no installed key can decrypt packet")
+}
+
+// indexOf returns the index of the key in keys, or -1 if not found.
+//
+// Note must hold mu.
+func (k *Keyring) indexOf(key []byte) int {
+	for i, installed := range k.keys {
+		if bytes.Equal(installed, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key size must be 16, 24 or 32 bytes; got %d", len(key))
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %v", err)
+	}
+	return gcm, nil
+}
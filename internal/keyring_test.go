@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring_EncryptThenDecrypt(t *testing.T) {
+	k, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	b, err := k.Encrypt([]byte("my-message"))
+	assert.Nil(t, err)
+	assert.Equal(t, len("my-message")+EncryptionOverhead, len(b))
+	assert.False(t, bytes.Contains(b, []byte("my-message")))
+
+	b, err = k.Decrypt(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("my-message"), b)
+}
+
+func TestKeyring_DecryptWithUnknownKey(t *testing.T) {
+	k1, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+	k2, err := NewKeyring([][]byte{testKey(2)})
+	assert.Nil(t, err)
+
+	b, err := k1.Encrypt([]byte("my-message"))
+	assert.Nil(t, err)
+
+	_, err = k2.Decrypt(b)
+	assert.NotNil(t, err)
+}
+
+func TestKeyring_DecryptInvalidPacket(t *testing.T) {
+	k, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	_, err = k.Decrypt([]byte{})
+	assert.NotNil(t, err)
+	_, err = k.Decrypt(make([]byte, EncryptionOverhead))
+	assert.NotNil(t, err)
+
+	b, err := k.Encrypt([]byte("my-message"))
+	assert.Nil(t, err)
+	b[len(b)-1] ^= 0xff
+	_, err = k.Decrypt(b)
+	assert.NotNil(t, err)
+}
+
+// Tests rotating keys, where a node with the new primary key can still
+// communicate with a node using the old primary key during the rotation.
+func TestKeyring_RotateKeys(t *testing.T) {
+	k1, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+	k2, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	// Install the new key on both nodes and promote on only one.
+	assert.Nil(t, k1.AddKey(testKey(2)))
+	assert.Nil(t, k2.AddKey(testKey(2)))
+	assert.Nil(t, k1.UseKey(testKey(2)))
+
+	assert.Equal(t, [][]byte{testKey(2), testKey(1)}, k1.Keys())
+
+	b, err := k1.Encrypt([]byte("my-message"))
+	assert.Nil(t, err)
+	_, err = k2.Decrypt(b)
+	assert.Nil(t, err)
+
+	b, err = k2.Encrypt([]byte("my-message"))
+	assert.Nil(t, err)
+	_, err = k1.Decrypt(b)
+	assert.Nil(t, err)
+
+	// Once the old key is removed it can no longer decrypt.
+	assert.Nil(t, k1.RemoveKey(testKey(1)))
+	_, err = k1.Decrypt(b)
+	assert.NotNil(t, err)
+}
+
+func TestKeyring_InvalidKeys(t *testing.T) {
+	_, err := NewKeyring([][]byte{})
+	assert.NotNil(t, err)
+
+	_, err = NewKeyring([][]byte{[]byte("too-short")})
+	assert.NotNil(t, err)
+
+	k, err := NewKeyring([][]byte{testKey(1)})
+	assert.Nil(t, err)
+
+	// The primary key can't be removed.
+	assert.NotNil(t, k.RemoveKey(testKey(1)))
+	// Can only use installed keys.
+	assert.NotNil(t, k.UseKey(testKey(2)))
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
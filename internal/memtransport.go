@@ -0,0 +1,431 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// memoryPacketBufSize is the number of packets buffered for each memory
+	// transport. Like a UDP socket buffer, packets that arrive when the
+	// buffer is full are dropped.
+	memoryPacketBufSize = 1024
+
+	// memoryFirstPort is the first port assigned by the memory network when
+	// a transport binds to port 0.
+	memoryFirstPort = 10000
+
+	// defaultReorderDelay is the extra delay added to reordered packets if
+	// the link doesn't configure a ReorderDelay.
+	defaultReorderDelay = time.Millisecond * 10
+)
+
+// LatencyDistribution describes how the jitter of a link is distributed.
+type LatencyDistribution int
+
+const (
+	// LatencyUniform adds a jitter uniformly distributed between 0 and
+	// Jitter to the links latency.
+	LatencyUniform LatencyDistribution = iota
+	// LatencyNormal uses a normal distribution with a mean of the links
+	// latency and a standard deviation of Jitter. Negative delays are
+	// truncated to 0.
+	LatencyNormal
+)
+
+// LinkConfig describes the faults injected into packets sent over a link from
+// one transport to another. The zero value is a perfect link that delivers
+// every packet immediately and in order.
+//
+// Note streams are only affected by partitions, since they model a reliable
+// connection.
+type LinkConfig struct {
+	// Loss is the probability a packet is dropped, between 0 and 1.
+	Loss float64
+
+	// Latency is the delay before a packet is delivered.
+	Latency time.Duration
+
+	// Jitter is the random variation added to Latency, whose meaning
+	// depends on Distribution.
+	Jitter time.Duration
+
+	// Distribution is the distribution of the jitter. Defaults to
+	// LatencyUniform.
+	Distribution LatencyDistribution
+
+	// Reorder is the probability a packet is delayed by an extra
+	// ReorderDelay, so is delivered after packets sent after it.
+	Reorder float64
+
+	// ReorderDelay is the extra delay added to reordered packets. If not
+	// set defaults to 10ms.
+	ReorderDelay time.Duration
+
+	// Duplicate is the probability a packet is delivered twice, where each
+	// copy is delayed independently.
+	Duplicate float64
+}
+
+// delay returns a random delay for a packet sent over the link.
+func (c LinkConfig) delay(rng *rand.Rand) time.Duration {
+	d := c.Latency
+	if c.Jitter > 0 {
+		switch c.Distribution {
+		case LatencyNormal:
+			d += time.Duration(rng.NormFloat64() * float64(c.Jitter))
+		default:
+			d += time.Duration(rng.Int63n(int64(c.Jitter)))
+		}
+	}
+	if c.Reorder > 0 && rng.Float64() < c.Reorder {
+		if c.ReorderDelay > 0 {
+			d += c.ReorderDelay
+		} else {
+			d += defaultReorderDelay
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+type link struct {
+	From string
+	To   string
+}
+
+// memoryAddr is the net.Addr of a memory transport.
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// MemoryNetwork is an in-memory network that MemoryTransports register on,
+// which is used to run many nodes in a single process without real sockets,
+// such as in tests and simulations.
+//
+// Faults such as packet loss, latency and partitions can be injected into the
+// links between transports to test behaviour under realistic network
+// conditions.
+//
+// Note this is thread safe.
+type MemoryNetwork struct {
+	transports map[string]*MemoryTransport
+	nextPort   int
+	// defaultLink is the configuration of links without their own
+	// configuration.
+	defaultLink LinkConfig
+	links       map[link]LinkConfig
+	// partitions contains the links that are partitioned, so drop all
+	// packets and streams.
+	partitions map[link]struct{}
+	rng        *rand.Rand
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	// clock is used to schedule delayed packets.
+	clock Clock
+}
+
+// NewMemoryNetwork returns a new empty network, using the clock to delay
+// packets and rng to inject faults.
+func NewMemoryNetwork(clock Clock, rng *rand.Rand) *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		nextPort:   memoryFirstPort,
+		links:      make(map[link]LinkConfig),
+		partitions: make(map[link]struct{}),
+		rng:        rng,
+		clock:      clock,
+	}
+}
+
+// SetDefaultLink sets the configuration of all links that don't have their
+// own configuration set with SetLink.
+func (n *MemoryNetwork) SetDefaultLink(config LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.defaultLink = config
+}
+
+// SetLink sets the configuration of the link from the transport bound to
+// fromAddr to the transport bound to toAddr. This only affects packets in
+// one direction, so to configure both directions call SetLink for each.
+func (n *MemoryNetwork) SetLink(fromAddr string, toAddr string, config LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links[link{From: fromAddr, To: toAddr}] = config
+}
+
+// ResetLinks removes all link configuration, including the default, so all
+// links are perfect. This doesn't heal partitions.
+func (n *MemoryNetwork) ResetLinks() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.defaultLink = LinkConfig{}
+	n.links = make(map[link]LinkConfig)
+}
+
+// Partition drops all packets sent from the transports in fromAddrs to the
+// transports in toAddrs. Packets in the other direction are unaffected, so
+// a symmetric partition requires partitioning both directions. Streams
+// can't be opened between two transports if either direction is partitioned.
+//
+// The partition remains until Heal is called.
+func (n *MemoryNetwork) Partition(fromAddrs []string, toAddrs []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, from := range fromAddrs {
+		for _, to := range toAddrs {
+			n.partitions[link{From: from, To: to}] = struct{}{}
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *MemoryNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitions = make(map[link]struct{})
+}
+
+// NewTransport registers a new transport bound to the given addr. If the port
+// is 0 the network assigns an unused port, like the system would with a real
+// network.
+//
+// Returns an error if another transport is already bound to the addr.
+func (n *MemoryNetwork) NewTransport(bindAddr string) (*MemoryTransport, error) {
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start memory transport on %s: %v", bindAddr, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == "0" {
+		for {
+			bindAddr = net.JoinHostPort(host, strconv.Itoa(n.nextPort))
+			n.nextPort++
+			if _, ok := n.transports[bindAddr]; !ok {
+				break
+			}
+		}
+	}
+
+	if _, ok := n.transports[bindAddr]; ok {
+		return nil, fmt.Errorf("failed to start memory transport on %s: address already in use", bindAddr)
+	}
+
+	t := &MemoryTransport{
+		addr:       bindAddr,
+		network:    n,
+		packetCh:   make(chan *Packet, memoryPacketBufSize),
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	n.transports[bindAddr] = t
+	return t, nil
+}
+
+// send sends a copy of the packet to the transport bound to toAddr, injecting
+// any faults configured on the link.
+func (n *MemoryNetwork) send(b []byte, fromAddr string, toAddr string) {
+	n.mu.Lock()
+
+	dest, ok := n.transports[toAddr]
+	if !ok || n.isPartitioned(fromAddr, toAddr) {
+		n.mu.Unlock()
+		return
+	}
+
+	config, ok := n.links[link{From: fromAddr, To: toAddr}]
+	if !ok {
+		config = n.defaultLink
+	}
+	if config.Loss > 0 && n.rng.Float64() < config.Loss {
+		n.mu.Unlock()
+		return
+	}
+	delays := []time.Duration{config.delay(n.rng)}
+	if config.Duplicate > 0 && n.rng.Float64() < config.Duplicate {
+		delays = append(delays, config.delay(n.rng))
+	}
+
+	n.mu.Unlock()
+
+	for _, delay := range delays {
+		p := &Packet{
+			// Copy the payload as the caller may reuse the buffer.
+			Buf:  append([]byte{}, b...),
+			From: memoryAddr(fromAddr),
+		}
+		if delay == 0 {
+			dest.deliverPacket(p)
+		} else {
+			n.clock.AfterFunc(delay, func() {
+				dest.deliverPacket(p)
+			})
+		}
+	}
+}
+
+// dial looks up the transport bound to toAddr to open a stream from fromAddr.
+func (n *MemoryNetwork) dial(fromAddr string, toAddr string) (*MemoryTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dest, ok := n.transports[toAddr]
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", toAddr)
+	}
+	if n.isPartitioned(fromAddr, toAddr) || n.isPartitioned(toAddr, fromAddr) {
+		return nil, fmt.Errorf("dial %s: network unreachable", toAddr)
+	}
+	return dest, nil
+}
+
+// isPartitioned returns whether the link from fromAddr to toAddr is
+// partitioned.
+//
+// Note must hold mu.
+func (n *MemoryNetwork) isPartitioned(fromAddr string, toAddr string) bool {
+	_, ok := n.partitions[link{From: fromAddr, To: toAddr}]
+	return ok
+}
+
+func (n *MemoryNetwork) remove(t *MemoryTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transports[t.addr] == t {
+		delete(n.transports, t.addr)
+	}
+}
+
+// MemoryTransport is a Transport implementation that sends packets and streams
+// to other transports on the same MemoryNetwork.
+//
+// Packets to an addr with no transport are silently dropped, like UDP, and
+// dialing an addr with no transport fails. Packets are subject to the faults
+// configured on the network.
+type MemoryTransport struct {
+	addr    string
+	network *MemoryNetwork
+
+	packetCh   chan *Packet
+	streamCh   chan net.Conn
+	shutdownCh chan struct{}
+	// shutdownMu is held for reading while delivering to the transport, so
+	// Shutdown can wait for in-progress deliveries.
+	shutdownMu   sync.RWMutex
+	shutdownOnce sync.Once
+}
+
+func (t *MemoryTransport) WriteTo(b []byte, addr string) error {
+	t.network.send(b, t.addr, addr)
+	return nil
+}
+
+func (t *MemoryTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+func (t *MemoryTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dest, err := t.network.dial(t.addr, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := net.Pipe()
+	if err := dest.deliverStream(server, timeout); err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (t *MemoryTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *MemoryTransport) BindAddr() string {
+	return t.addr
+}
+
+func (t *MemoryTransport) Shutdown() error {
+	t.shutdownOnce.Do(func() {
+		t.network.remove(t)
+		close(t.shutdownCh)
+
+		// Block until any in-progress deliveries have finished.
+		t.shutdownMu.Lock()
+		defer t.shutdownMu.Unlock()
+	})
+	return nil
+}
+
+// deliverPacket adds the packet to the packet channel, or drops the packet if
+// the buffer is full or the transport is shutdown.
+func (t *MemoryTransport) deliverPacket(p *Packet) {
+	t.shutdownMu.RLock()
+	defer t.shutdownMu.RUnlock()
+
+	if t.isShutdown() {
+		return
+	}
+
+	select {
+	case t.packetCh <- p:
+	default:
+	}
+}
+
+// deliverStream hands the connection to the stream channel, waiting up to the
+// timeout for the receiver to accept it.
+func (t *MemoryTransport) deliverStream(conn net.Conn, timeout time.Duration) error {
+	t.shutdownMu.RLock()
+	defer t.shutdownMu.RUnlock()
+
+	if t.isShutdown() {
+		return fmt.Errorf("dial %s: connection refused", t.addr)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case t.streamCh <- conn:
+		return nil
+	case <-t.shutdownCh:
+		return fmt.Errorf("dial %s: connection refused", t.addr)
+	case <-timer.C:
+		return fmt.Errorf("dial %s: timeout", t.addr)
+	}
+}
+
+func (t *MemoryTransport) isShutdown() bool {
+	select {
+	case <-t.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
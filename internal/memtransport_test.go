@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryNetwork() *MemoryNetwork {
+	return NewMemoryNetwork(NewRealClock(), rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+func TestMemoryTransport_WriteTo(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	b := []byte{1, 2, 3}
+	assert.Nil(t, t1.WriteTo(b, t2.BindAddr()))
+	// Modifying the written buffer must not modify the delivered packet.
+	b[0] = 0xff
+
+	p := <-t2.PacketCh()
+	assert.Equal(t, []byte{1, 2, 3}, p.Buf)
+	assert.Equal(t, "10.26.104.11:8119", p.From.String())
+}
+
+// Tests packets to an unknown addr are dropped.
+func TestMemoryTransport_WriteToUnknownAddr(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, "10.26.104.12:8119"))
+}
+
+func TestMemoryTransport_Dial(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	go func() {
+		conn := <-t2.StreamCh()
+		defer conn.Close()
+
+		buf := make([]byte, 3)
+		_, err := conn.Read(buf)
+		assert.Nil(t, err)
+		_, err = conn.Write(buf)
+		assert.Nil(t, err)
+	}()
+
+	conn, err := t1.DialTimeout(t2.BindAddr(), time.Second)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{1, 2, 3})
+	assert.Nil(t, err)
+	buf := make([]byte, 3)
+	_, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, buf)
+
+	_, err = t1.DialTimeout("10.26.104.13:8119", time.Second)
+	assert.NotNil(t, err)
+}
+
+// Tests dialing a transport whose streams aren't being accepted times out.
+func TestMemoryTransport_DialTimeout(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	_, err = t1.DialTimeout(t2.BindAddr(), time.Millisecond*10)
+	assert.NotNil(t, err)
+}
+
+func TestMemoryTransport_AssignPort(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("127.0.0.1:0")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "127.0.0.1:10000", t1.BindAddr())
+	assert.Equal(t, "127.0.0.1:10001", t2.BindAddr())
+
+	_, err = network.NewTransport("127.0.0.1:10000")
+	assert.NotNil(t, err)
+	_, err = network.NewTransport("127.0.0.1")
+	assert.NotNil(t, err)
+}
+
+// Tests once a transport is shutdown it no longer receives packets or
+// streams, and its addr can be reused.
+func TestMemoryTransport_Shutdown(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	assert.Nil(t, t2.Shutdown())
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+	assert.Equal(t, 0, len(t2.PacketCh()))
+
+	_, err = t1.DialTimeout(t2.BindAddr(), time.Second)
+	assert.NotNil(t, err)
+
+	t3, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t3.BindAddr()))
+	assert.Equal(t, 1, len(t3.PacketCh()))
+}
+
+func TestMemoryTransport_Loss(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+	t3, err := network.NewTransport("10.26.104.13:8119")
+	assert.Nil(t, err)
+
+	network.SetDefaultLink(LinkConfig{Loss: 0.5})
+	network.SetLink(t1.BindAddr(), t3.BindAddr(), LinkConfig{Loss: 1.0})
+
+	for i := 0; i != 1000; i++ {
+		assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+		assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t3.BindAddr()))
+	}
+	assert.InDelta(t, 500, len(t2.PacketCh()), 100)
+	assert.Equal(t, 0, len(t3.PacketCh()))
+
+	network.ResetLinks()
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t3.BindAddr()))
+	assert.Equal(t, 1, len(t3.PacketCh()))
+}
+
+func TestMemoryTransport_Latency(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	network.SetLink(t1.BindAddr(), t2.BindAddr(), LinkConfig{
+		Latency: time.Millisecond * 50,
+		Jitter:  time.Millisecond * 10,
+	})
+
+	start := time.Now()
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+	<-t2.PacketCh()
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50)
+}
+
+func TestMemoryTransport_Duplicate(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	network.SetDefaultLink(LinkConfig{Duplicate: 1.0})
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+	assert.Equal(t, 2, len(t2.PacketCh()))
+}
+
+func TestMemoryTransport_Reorder(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	// Reorder the first packet only.
+	network.SetDefaultLink(LinkConfig{Reorder: 1.0})
+	assert.Nil(t, t1.WriteTo([]byte{1}, t2.BindAddr()))
+	network.ResetLinks()
+	assert.Nil(t, t1.WriteTo([]byte{2}, t2.BindAddr()))
+
+	assert.Equal(t, []byte{2}, (<-t2.PacketCh()).Buf)
+	assert.Equal(t, []byte{1}, (<-t2.PacketCh()).Buf)
+}
+
+func TestMemoryTransport_LatencyDistribution(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	uniform := LinkConfig{
+		Latency: time.Millisecond * 10,
+		Jitter:  time.Millisecond * 5,
+	}
+	for i := 0; i != 100; i++ {
+		d := uniform.delay(rng)
+		assert.GreaterOrEqual(t, d, time.Millisecond*10)
+		assert.Less(t, d, time.Millisecond*15)
+	}
+
+	normal := LinkConfig{
+		Latency:      time.Millisecond * 10,
+		Jitter:       time.Millisecond * 20,
+		Distribution: LatencyNormal,
+	}
+	for i := 0; i != 100; i++ {
+		assert.GreaterOrEqual(t, normal.delay(rng), time.Duration(0))
+	}
+}
+
+// Tests an asymmetric partition only drops packets in one direction, and
+// blocks streams in both directions, until healed.
+func TestMemoryTransport_Partition(t *testing.T) {
+	network := newTestMemoryNetwork()
+	t1, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+	t2, err := network.NewTransport("10.26.104.12:8119")
+	assert.Nil(t, err)
+
+	network.Partition([]string{t1.BindAddr()}, []string{t2.BindAddr()})
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+	assert.Equal(t, 0, len(t2.PacketCh()))
+	assert.Nil(t, t2.WriteTo([]byte{1, 2, 3}, t1.BindAddr()))
+	assert.Equal(t, 1, len(t1.PacketCh()))
+
+	_, err = t1.DialTimeout(t2.BindAddr(), time.Second)
+	assert.NotNil(t, err)
+	_, err = t2.DialTimeout(t1.BindAddr(), time.Second)
+	assert.NotNil(t, err)
+
+	network.Heal()
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+	assert.Equal(t, 1, len(t2.PacketCh()))
+}
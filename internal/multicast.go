@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	multicastVersion1 uint8 = 1
+
+	// multicastBufSize is used to buffer incoming multicast messages, which
+	// contain at most 3 strings of 255 bytes.
+	multicastBufSize = 1024
+
+	// multicastExpiryIntervals is the number of announce intervals after which
+	// a discovered node that hasn't been heard from is discarded.
+	multicastExpiryIntervals = 3
+)
+
+type multicastType uint8
+
+const (
+	// multicastAnnounce announces the sender to other nodes.
+	multicastAnnounce multicastType = 1
+	// multicastQuery asks other nodes to announce themselves. Queries also
+	// announce the sender.
+	multicastQuery multicastType = 2
+)
+
+var (
+	ErrNotMulticast = errors.New("not a multicast address")
+)
+
+// MulticastConfig configures discovering nodes on the LAN using multicast.
+type MulticastConfig struct {
+	// Group is the multicast group address, including the port, that nodes
+	// announce themselves to.
+	Group string
+	// Interface is the name of the network interface to use, or empty to
+	// use the system default.
+	Interface string
+	// Interval is the time between announcements.
+	Interval time.Duration
+}
+
+type multicastMessage struct {
+	Type        multicastType
+	ClusterName string
+	ID          string
+	Addr        string
+}
+
+// MulticastDiscovery is a SeedProvider that discovers nodes on the LAN.
+//
+// Each node periodically announces its ID and address to a multicast group,
+// and listens for announcements from other nodes in the same cluster. When
+// seeds are requested, the node also sends a query asking the other nodes to
+// announce themselves, so a joining node discovers nodes quickly rather than
+// waiting for their next announcement.
+//
+// Note this is thread safe.
+type MulticastDiscovery struct {
+	config      MulticastConfig
+	clusterName string
+	localID     string
+	localAddr   string
+
+	group    *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+
+	// discovered contains the time each discovered address expires, indexed
+	// by address.
+	discovered map[string]time.Time
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	clock    Clock
+	shutdown int32
+	done     chan struct{}
+	wg       sync.WaitGroup
+	logger   *zap.Logger
+}
+
+// NewMulticastDiscovery joins the multicast group and starts announcing the
+// local node with the given ID and address.
+func NewMulticastDiscovery(
+	config MulticastConfig,
+	clusterName string,
+	localID string,
+	localAddr string,
+	clock Clock,
+	logger *zap.Logger,
+) (*MulticastDiscovery, error) {
+	if len(localAddr) > 0xff {
+		return nil, fmt.Errorf("multicast discovery: addr cannot exceed 255 bytes")
+	}
+
+	group, err := net.ResolveUDPAddr("udp", config.Group)
+	if err != nil {
+		return nil, fmt.Errorf("multicast discovery: invalid group: %w", err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("multicast discovery: invalid group: %s: %w", config.Group, ErrNotMulticast)
+	}
+
+	var ifi *net.Interface
+	if config.Interface != "" {
+		ifi, err = net.InterfaceByName(config.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("multicast discovery: invalid interface: %w", err)
+		}
+		if group.IP.To4() == nil {
+			// Sending to an IPv6 group uses the zone to select the
+			// interface.
+			group.Zone = ifi.Name
+		}
+	}
+
+	network := "udp6"
+	if group.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	listener, err := net.ListenMulticastUDP(network, ifi, group)
+	if err != nil {
+		return nil, fmt.Errorf("multicast discovery: failed to join group %s: %w", config.Group, err)
+	}
+	sender, err := multicastSender(network, ifi)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("multicast discovery: failed to start sender: %w", err)
+	}
+
+	d := &MulticastDiscovery{
+		config:      config,
+		clusterName: clusterName,
+		localID:     localID,
+		localAddr:   localAddr,
+		group:       group,
+		listener:    listener,
+		sender:      sender,
+		discovered:  make(map[string]time.Time),
+		clock:       clock,
+		done:        make(chan struct{}),
+		logger:      logger,
+	}
+
+	d.wg.Add(2)
+	go d.readLoop()
+	go d.announceLoop()
+
+	return d, nil
+}
+
+// Seeds returns the addresses of the discovered nodes, and queries the other
+// nodes so any nodes that haven't been discovered yet announce themselves.
+// Since responses are received asynchronously, nodes that respond to the
+// query are returned the next time seeds are requested.
+func (d *MulticastDiscovery) Seeds(ctx context.Context) ([]string, error) {
+	err := d.send(multicastQuery)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	addrs := []string{}
+	for addr, expiry := range d.discovered {
+		if now.After(expiry) {
+			delete(d.discovered, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs, err
+}
+
+// Close leaves the multicast group and stops announcing the local node.
+func (d *MulticastDiscovery) Close() error {
+	if !atomic.CompareAndSwapInt32(&d.shutdown, 0, 1) {
+		return nil
+	}
+	close(d.done)
+
+	// Close the listener, which will stop the read loop.
+	d.listener.Close()
+	d.wg.Wait()
+	d.sender.Close()
+	return nil
+}
+
+// readLoop is a long running goroutine that receives announcements and
+// queries from the other nodes.
+func (d *MulticastDiscovery) readLoop() {
+	defer d.wg.Done()
+
+	buf := make([]byte, multicastBufSize)
+	for {
+		n, from, err := d.listener.ReadFrom(buf)
+		if err != nil {
+			if s := atomic.LoadInt32(&d.shutdown); s == 1 {
+				return
+			}
+			d.logger.Error("failed to read from multicast group", zap.Error(err))
+			continue
+		}
+
+		m, err := decodeMulticastMessage(buf[:n])
+		if err != nil {
+			d.logger.Debug(
+				"dropping multicast message",
+				zap.String("from", from.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+		d.onMessage(m)
+	}
+}
+
+// announceLoop is a long running goroutine that announces the local node
+// every interval.
+func (d *MulticastDiscovery) announceLoop() {
+	defer d.wg.Done()
+
+	// Announce as soon as the node starts so other nodes discover it
+	// quickly.
+	if err := d.send(multicastAnnounce); err != nil {
+		d.logger.Warn("failed to announce to multicast group", zap.Error(err))
+	}
+
+	ticker := d.clock.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := d.send(multicastAnnounce); err != nil {
+				d.logger.Warn("failed to announce to multicast group", zap.Error(err))
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *MulticastDiscovery) onMessage(m multicastMessage) {
+	// Ignore our own messages and messages from other clusters.
+	if m.ID == d.localID || m.ClusterName != d.clusterName {
+		return
+	}
+
+	d.mu.Lock()
+	_, known := d.discovered[m.Addr]
+	d.discovered[m.Addr] = d.clock.Now().Add(d.config.Interval * multicastExpiryIntervals)
+	d.mu.Unlock()
+
+	if !known {
+		d.logger.Debug(
+			"discovered node",
+			zap.String("id", m.ID),
+			zap.String("addr", m.Addr),
+		)
+	}
+
+	if m.Type == multicastQuery {
+		if err := d.send(multicastAnnounce); err != nil {
+			d.logger.Warn("failed to announce to multicast group", zap.Error(err))
+		}
+	}
+}
+
+func (d *MulticastDiscovery) send(t multicastType) error {
+	b := encodeMulticastMessage(multicastMessage{
+		Type:        t,
+		ClusterName: d.clusterName,
+		ID:          d.localID,
+		Addr:        d.localAddr,
+	})
+	_, err := d.sender.WriteToUDP(b, d.group)
+	// If we've been shutdown ignore the error.
+	if s := atomic.LoadInt32(&d.shutdown); s == 1 {
+		return nil
+	}
+	return err
+}
+
+// multicastSender returns a socket to send to the multicast group. If the
+// interface is given, IPv4 messages are sent from the interfaces address so
+// the system sends them from that interface.
+func multicastSender(network string, ifi *net.Interface) (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	if ifi != nil && network == "udp4" {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				laddr = &net.UDPAddr{IP: ipNet.IP}
+				break
+			}
+		}
+		if laddr == nil {
+			return nil, fmt.Errorf("interface %s has no ipv4 address", ifi.Name)
+		}
+	}
+	return net.ListenUDP(network, laddr)
+}
+
+func encodeMulticastMessage(m multicastMessage) []byte {
+	size := uint8Len + uint8Len +
+		stringLen(m.ClusterName, protocolVersion1) +
+		stringLen(m.ID, protocolVersion1) +
+		stringLen(m.Addr, protocolVersion1)
+	b := make([]byte, size)
+	offset := encodeUint8(b, 0, multicastVersion1)
+	offset = encodeUint8(b, offset, uint8(m.Type))
+	offset = encodeString(b, offset, m.ClusterName, protocolVersion1)
+	offset = encodeString(b, offset, m.ID, protocolVersion1)
+	encodeString(b, offset, m.Addr, protocolVersion1)
+	return b
+}
+
+func decodeMulticastMessage(b []byte) (multicastMessage, error) {
+	version, offset, err := decodeUint8(b, 0)
+	if err != nil {
+		return multicastMessage{}, err
+	}
+	if version != multicastVersion1 {
+		return multicastMessage{}, fmt.Errorf("unsupported version: %d", version)
+	}
+	t, offset, err := decodeUint8(b, offset)
+	if err != nil {
+		return multicastMessage{}, err
+	}
+	if multicastType(t) != multicastAnnounce && multicastType(t) != multicastQuery {
+		return multicastMessage{}, fmt.Errorf("unknown type: %d", t)
+	}
+	clusterName, offset, err := decodeString(b, offset, protocolVersion1)
+	if err != nil {
+		return multicastMessage{}, err
+	}
+	id, offset, err := decodeString(b, offset, protocolVersion1)
+	if err != nil {
+		return multicastMessage{}, err
+	}
+	addr, _, err := decodeString(b, offset, protocolVersion1)
+	if err != nil {
+		return multicastMessage{}, err
+	}
+	if err := validateAddr(addr); err != nil {
+		return multicastMessage{}, fmt.Errorf("invalid address: %w", err)
+	}
+	return multicastMessage{
+		Type:        multicastType(t),
+		ClusterName: clusterName,
+		ID:          id,
+		Addr:        addr,
+	}, nil
+}
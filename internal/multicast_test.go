@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testMulticastGroup returns a multicast group using a free port, so
+// concurrent tests don't receive each others announcements.
+func testMulticastGroup(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	assert.Nil(t, err)
+	defer conn.Close()
+	return fmt.Sprintf("239.255.82.29:%d", conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func newTestMulticastDiscovery(t *testing.T, group string, clusterName string, id string, addr string) *MulticastDiscovery {
+	d, err := NewMulticastDiscovery(
+		MulticastConfig{
+			Group:    group,
+			Interval: time.Millisecond * 100,
+		},
+		clusterName,
+		id,
+		addr,
+		NewRealClock(),
+		zap.NewNop(),
+	)
+	if err != nil {
+		t.Skipf("multicast not supported: %s", err)
+	}
+	return d
+}
+
+func TestMulticast_EncodeMessage(t *testing.T) {
+	m := multicastMessage{
+		Type:        multicastQuery,
+		ClusterName: "my-cluster",
+		ID:          "node-1",
+		Addr:        "10.26.104.52:8229",
+	}
+	decoded, err := decodeMulticastMessage(encodeMulticastMessage(m))
+	assert.Nil(t, err)
+	assert.Equal(t, m, decoded)
+}
+
+func TestMulticast_DecodeInvalidMessage(t *testing.T) {
+	b := encodeMulticastMessage(multicastMessage{
+		Type:        multicastAnnounce,
+		ClusterName: "my-cluster",
+		ID:          "node-1",
+		Addr:        "10.26.104.52:8229",
+	})
+
+	_, err := decodeMulticastMessage(b[:len(b)-1])
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	unknownType := append([]byte{}, b...)
+	unknownType[1] = 0xff
+	_, err = decodeMulticastMessage(unknownType)
+	assert.NotNil(t, err)
+
+	invalidAddr := encodeMulticastMessage(multicastMessage{
+		Type:        multicastAnnounce,
+		ClusterName: "my-cluster",
+		ID:          "node-1",
+		Addr:        "10.26.104.52",
+	})
+	_, err = decodeMulticastMessage(invalidAddr)
+	assert.NotNil(t, err)
+}
+
+func TestMulticast_InvalidGroup(t *testing.T) {
+	_, err := NewMulticastDiscovery(
+		MulticastConfig{
+			Group:    "10.26.104.52:8229",
+			Interval: time.Second,
+		},
+		"",
+		"node-1",
+		"10.26.104.52:8229",
+		NewRealClock(),
+		zap.NewNop(),
+	)
+	assert.True(t, errors.Is(err, ErrNotMulticast))
+}
+
+// Tests nodes in the same cluster discover each other, and nodes in other
+// clusters are ignored.
+func TestMulticast_Discover(t *testing.T) {
+	group := testMulticastGroup(t)
+
+	d1 := newTestMulticastDiscovery(t, group, "my-cluster", "node-1", "10.26.104.52:8229")
+	defer d1.Close()
+	d2 := newTestMulticastDiscovery(t, group, "my-cluster", "node-2", "10.26.104.53:8229")
+	defer d2.Close()
+	d3 := newTestMulticastDiscovery(t, group, "other-cluster", "node-3", "10.26.104.54:8229")
+	defer d3.Close()
+
+	assert.Eventually(t, func() bool {
+		seeds, err := d1.Seeds(context.Background())
+		return err == nil && assert.ObjectsAreEqual([]string{"10.26.104.53:8229"}, seeds)
+	}, time.Second*5, time.Millisecond*10)
+	assert.Eventually(t, func() bool {
+		seeds, err := d2.Seeds(context.Background())
+		return err == nil && assert.ObjectsAreEqual([]string{"10.26.104.52:8229"}, seeds)
+	}, time.Second*5, time.Millisecond*10)
+
+	seeds, err := d3.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, seeds)
+}
+
+// Tests nodes that stop announcing are no longer returned as seeds.
+func TestMulticast_Expire(t *testing.T) {
+	group := testMulticastGroup(t)
+
+	d1 := newTestMulticastDiscovery(t, group, "", "node-1", "10.26.104.52:8229")
+	defer d1.Close()
+	d2 := newTestMulticastDiscovery(t, group, "", "node-2", "10.26.104.53:8229")
+
+	assert.Eventually(t, func() bool {
+		seeds, _ := d1.Seeds(context.Background())
+		return len(seeds) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	assert.Nil(t, d2.Close())
+
+	assert.Eventually(t, func() bool {
+		seeds, _ := d1.Seeds(context.Background())
+		return len(seeds) == 0
+	}, time.Second*5, time.Millisecond*10)
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// udpPacketBufSize is used to buffer incoming packets during read
+	// operations.
+	udpPacketBufSize = 65536
+
+	// bindAttempts is the number of attempts to bind the UDP and TCP
+	// listeners to the same port when the system assigns the port.
+	bindAttempts = 10
+)
+
+// NetTransport is a Transport implementation using UDP for packets and TCP for
+// streams, where both listen on the same port.
+type NetTransport struct {
+	udpListener *net.UDPConn
+	tcpListener *net.TCPListener
+	packetCh    chan *Packet
+	streamCh    chan net.Conn
+	wg          sync.WaitGroup
+	shutdown    int32
+	shutdownCh  chan struct{}
+	logger      *zap.Logger
+}
+
+// NewNetTransport returns a new transport listening for UDP packets and TCP
+// streams on the given addr.
+func NewNetTransport(bindAddr string, logger *zap.Logger) (*NetTransport, error) {
+	udpListener, tcpListener, err := listen(bindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &NetTransport{
+		udpListener: udpListener,
+		tcpListener: tcpListener,
+		packetCh:    make(chan *Packet),
+		streamCh:    make(chan net.Conn),
+		wg:          sync.WaitGroup{},
+		shutdown:    0,
+		shutdownCh:  make(chan struct{}),
+		logger:      logger,
+	}
+
+	t.wg.Add(2)
+	go t.udpReadLoop(udpListener)
+	go t.tcpAcceptLoop(tcpListener)
+
+	return t, nil
+}
+
+func (t *NetTransport) WriteTo(b []byte, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.udpListener.WriteTo(b, udpAddr)
+	// If we've been shutdown ignore the error.
+	if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+		return nil
+	}
+	return err
+}
+
+func (t *NetTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+func (t *NetTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.Dial("tcp", addr)
+}
+
+func (t *NetTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *NetTransport) BindAddr() string {
+	return t.udpListener.LocalAddr().String()
+}
+
+func (t *NetTransport) Shutdown() error {
+	// This will avoid log spam about errors when we shut down.
+	atomic.StoreInt32(&t.shutdown, 1)
+	close(t.shutdownCh)
+
+	// Close the listeners, which will stop the read and accept loops.
+	t.udpListener.Close()
+	t.tcpListener.Close()
+
+	// Block until all the listener threads have died.
+	t.wg.Wait()
+	return nil
+}
+
+// udpReadLoop is a long running goroutine that accepts incoming UDP packets and
+// hands them off to the packet channel.
+func (t *NetTransport) udpReadLoop(lis *net.UDPConn) {
+	defer t.wg.Done()
+	for {
+		// Do a blocking read into a fresh buffer. Grab a time stamp as
+		// close as possible to the I/O.
+		buf := make([]byte, udpPacketBufSize)
+		n, addr, err := lis.ReadFrom(buf)
+		if err != nil {
+			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+				break
+			}
+
+			t.logger.Error("failed to read from transport", zap.Error(err))
+			continue
+		}
+
+		// Check the length - it needs to have at least one byte to be a
+		// proper message.
+		if n < 1 {
+			t.logger.Error("8eceived packet too small")
+			continue
+		}
+
+		select {
+		case t.packetCh <- &Packet{
+			Buf:  buf[:n],
+			From: addr,
+		}:
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// tcpAcceptLoop is a long running goroutine that accepts incoming TCP
+// connections and hands them off to the stream channel.
+func (t *NetTransport) tcpAcceptLoop(lis *net.TCPListener) {
+	defer t.wg.Done()
+	for {
+		conn, err := lis.AcceptTCP()
+		if err != nil {
+			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+				break
+			}
+
+			t.logger.Error("failed to accept tcp connection", zap.Error(err))
+			continue
+		}
+
+		select {
+		case t.streamCh <- conn:
+		case <-t.shutdownCh:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// listen binds the UDP and TCP listeners to the same port. If the port is 0,
+// the system assigns the UDP port and the TCP listener binds to the same port,
+// retrying if the port is already used for TCP.
+func listen(bindAddr string) (*net.UDPConn, *net.TCPListener, error) {
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start listener on %s: %v", bindAddr, err)
+	}
+	udpNetwork := listenNetwork("udp", host)
+	tcpNetwork := listenNetwork("tcp", host)
+
+	attempts := 1
+	if port == "0" {
+		attempts = bindAttempts
+	}
+
+	for i := 0; ; i++ {
+		udpListener, err := udpListen(udpNetwork, bindAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		udpPort := udpListener.LocalAddr().(*net.UDPAddr).Port
+		tcpListener, err := tcpListen(tcpNetwork, net.JoinHostPort(host, strconv.Itoa(udpPort)))
+		if err == nil {
+			return udpListener, tcpListener, nil
+		}
+
+		udpListener.Close()
+		if i+1 >= attempts {
+			return nil, nil, err
+		}
+	}
+}
+
+// listenNetwork returns the network to listen on for the given bind host,
+// where network is either "udp" or "tcp".
+//
+// An IPv4 host (including 0.0.0.0) listens on IPv4 only, and an IPv6 host
+// listens on IPv6 only. An empty host or :: listens on both IPv4 and IPv6 if
+// the system supports dual-stack sockets. A hostname listens on the family of
+// the address it resolves to.
+func listenNetwork(network string, host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	case ip.IsUnspecified():
+		return network
+	default:
+		return network + "6"
+	}
+}
+
+func udpListen(network string, bindAddr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start UDP listener on %s: %v", bindAddr, err)
+	}
+	listener, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start UDP listener on %s: %v", bindAddr, err)
+	}
+	return listener, nil
+}
+
+func tcpListen(network string, bindAddr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr(network, bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start TCP listener on %s: %v", bindAddr, err)
+	}
+	listener, err := net.ListenTCP(network, tcpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start TCP listener on %s: %v", bindAddr, err)
+	}
+	return listener, nil
+}
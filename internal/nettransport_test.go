@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// skipIfNoIPv6 skips the test if the system doesn't support IPv6 loopback.
+func skipIfNoIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 not supported")
+	}
+	ln.Close()
+}
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		host    string
+		network string
+	}{
+		{"10.26.104.52", "udp4"},
+		{"0.0.0.0", "udp4"},
+		{"fd00::1", "udp6"},
+		{"::1", "udp6"},
+		{"::", "udp"},
+		{"", "udp"},
+		{"localhost", "udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.network, listenNetwork("udp", tt.host))
+		})
+	}
+}
+
+func TestNetTransport_WriteToIPv6(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	t1, err := NewNetTransport("[::1]:0", zap.NewNop())
+	assert.Nil(t, err)
+	defer t1.Shutdown()
+	t2, err := NewNetTransport("[::1]:0", zap.NewNop())
+	assert.Nil(t, err)
+	defer t2.Shutdown()
+
+	host, _, err := net.SplitHostPort(t1.BindAddr())
+	assert.Nil(t, err)
+	assert.Equal(t, "::1", host)
+
+	assert.Nil(t, t1.WriteTo([]byte{1, 2, 3}, t2.BindAddr()))
+
+	p := <-t2.PacketCh()
+	assert.Equal(t, []byte{1, 2, 3}, p.Buf)
+	assert.Equal(t, t1.BindAddr(), p.From.String())
+}
+
+// Tests a transport bound to :: receives packets and streams over both IPv4
+// and IPv6.
+func TestNetTransport_DualStack(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	transport, err := NewNetTransport("[::]:0", zap.NewNop())
+	assert.Nil(t, err)
+	defer transport.Shutdown()
+
+	_, port, err := net.SplitHostPort(transport.BindAddr())
+	assert.Nil(t, err)
+
+	for _, addr := range []string{
+		net.JoinHostPort("127.0.0.1", port),
+		net.JoinHostPort("::1", port),
+	} {
+		conn, err := net.Dial("udp", addr)
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte{1, 2, 3})
+		assert.Nil(t, err)
+
+		p := <-transport.PacketCh()
+		assert.Equal(t, []byte{1, 2, 3}, p.Buf)
+		assert.Equal(t, conn.LocalAddr().String(), p.From.String())
+		conn.Close()
+
+		stream, err := transport.DialTimeout(addr, time.Second)
+		assert.Nil(t, err)
+		accepted := <-transport.StreamCh()
+		accepted.Close()
+		stream.Close()
+	}
+}
+
+// Tests the UDP and TCP listeners bind to the same port when bound to an IPv6
+// address with a system assigned port.
+func TestNetTransport_IPv6SamePort(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	transport, err := NewNetTransport("[::1]:0", zap.NewNop())
+	assert.Nil(t, err)
+	defer transport.Shutdown()
+
+	udpPort := transport.udpListener.LocalAddr().(*net.UDPAddr).Port
+	tcpPort := transport.tcpListener.Addr().(*net.TCPAddr).Port
+	assert.Equal(t, udpPort, tcpPort)
+	assert.Equal(t, net.JoinHostPort("::1", strconv.Itoa(udpPort)), transport.BindAddr())
+}
@@ -1,42 +1,262 @@
 package internal
 
 import (
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// internalKeyPrefix is the prefix of keys used by the library to
+	// propagate its own state. These keys are not exposed to the application.
+	internalKeyPrefix = "__"
+
+	// statusKey is the internal key containing the status of the node when it
+	// has gracefully left the cluster.
+	statusKey = internalKeyPrefix + "status"
+	// statusLeft is the value of statusKey once the node has left.
+	statusLeft = "left"
+
+	// protocolMinKey and protocolMaxKey are the internal keys containing the
+	// minimum and maximum protocol versions the node supports.
+	protocolMinKey = internalKeyPrefix + "protocol_min"
+	protocolMaxKey = internalKeyPrefix + "protocol_max"
+
+	// addrKey is the internal key containing the nodes advertised address,
+	// which other nodes use to reach the node. Since the node is identified by
+	// its ID, the address may change when the node restarts.
+	addrKey = internalKeyPrefix + "addr"
+
+	// heartbeatKey is the internal key containing the nodes heartbeat, which
+	// the node increments every gossip round. Since the heartbeat propagates
+	// like any other state, receiving a newer heartbeat shows the node is
+	// alive even if it was received via another node.
+	heartbeatKey = internalKeyPrefix + "heartbeat"
+
+	// incarnationKey is the internal key containing the incarnation of the
+	// node, which the node increments to refute claims it is suspect or dead.
+	incarnationKey = internalKeyPrefix + "incarnation"
+	// claimKeyPrefix is the prefix of the internal keys containing the nodes
+	// claims that other peers are suspect or dead, where the key is the
+	// prefix followed by the ID of the peer.
+	claimKeyPrefix = internalKeyPrefix + "claim:"
+	// removedKeyPrefix is the prefix of the internal keys containing the
+	// peers the node has removed from the cluster, where the key is the prefix
+	// followed by the ID of the peer and the value is the generation of
+	// the peer that was removed. These act as membership tombstones so other
+	// nodes don't gossip the removed peer back.
+	removedKeyPrefix = internalKeyPrefix + "removed:"
+)
+
+// IsInternalKey returns whether the key is reserved for internal state.
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+// PeerStatus is the status of a peer as known by the local node.
+type PeerStatus int
+
+const (
+	// PeerStatusAlive indicates the peer is considered up.
+	PeerStatusAlive = PeerStatus(1)
+	// PeerStatusDead indicates the peer is considered down.
+	PeerStatusDead = PeerStatus(2)
+	// PeerStatusLeft indicates the peer gracefully left the cluster.
+	PeerStatusLeft = PeerStatus(3)
+	// PeerStatusSuspect indicates a node suspects the peer is down, though it
+	// hasn't been confirmed, so the peer is still considered up.
+	PeerStatusSuspect = PeerStatus(4)
+)
+
+func (s PeerStatus) String() string {
+	switch s {
+	case PeerStatusAlive:
+		return "alive"
+	case PeerStatusDead:
+		return "dead"
+	case PeerStatusLeft:
+		return "left"
+	case PeerStatusSuspect:
+		return "suspect"
+	default:
+		return "unknown"
+	}
+}
+
+// Up returns whether a peer with the status is considered up, meaning it is
+// either alive or suspect.
+func (s PeerStatus) Up() bool {
+	return s == PeerStatusAlive || s == PeerStatusSuspect
+}
+
+// statusClaim is a nodes claim that a peer is suspect or dead. The claim
+// applies to the generation and incarnation of the peer the node observed, so
+// the peer can refute the claim by incrementing its incarnation.
+type statusClaim struct {
+	Status      PeerStatus
+	Generation  uint64
+	Incarnation uint64
+}
+
+// claimKey returns the internal key containing a claim about the peer with the
+// given ID.
+func claimKey(id string) string {
+	return claimKeyPrefix + id
+}
+
+// removedKey returns the internal key containing the tombstone for the removed
+// peer with the given ID.
+func removedKey(id string) string {
+	return removedKeyPrefix + id
+}
+
+// encode encodes the claim as the value of the claim key.
+func (c statusClaim) encode() string {
+	return fmt.Sprintf("%s:%d:%d", c.Status, c.Generation, c.Incarnation)
+}
+
+func decodeStatusClaim(s string) (statusClaim, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return statusClaim{}, fmt.Errorf("invalid claim: %s", s)
+	}
+
+	var status PeerStatus
+	switch parts[0] {
+	case PeerStatusSuspect.String():
+		status = PeerStatusSuspect
+	case PeerStatusDead.String():
+		status = PeerStatusDead
+	default:
+		return statusClaim{}, fmt.Errorf("invalid claim status: %s", parts[0])
+	}
+	generation, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return statusClaim{}, fmt.Errorf("invalid claim generation: %w", err)
+	}
+	incarnation, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return statusClaim{}, fmt.Errorf("invalid claim incarnation: %w", err)
+	}
+	return statusClaim{
+		Status:      status,
+		Generation:  generation,
+		Incarnation: incarnation,
+	}, nil
+}
+
+// LeaveReason indicates why a peer left the cluster.
+type LeaveReason int
+
+const (
+	// LeaveReasonFailed indicates the peer was detected as down by the failure
+	// detector.
+	LeaveReasonFailed = LeaveReason(1)
+	// LeaveReasonLeft indicates the peer gracefully left the cluster.
+	LeaveReasonLeft = LeaveReason(2)
+	// LeaveReasonRemoved indicates the peer was forcibly removed from the
+	// cluster with ForceRemove.
+	LeaveReasonRemoved = LeaveReason(3)
+)
+
+func (r LeaveReason) String() string {
+	switch r {
+	case LeaveReasonFailed:
+		return "failed"
+	case LeaveReasonLeft:
+		return "left"
+	case LeaveReasonRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
 type PeerEntry struct {
 	Version uint64
 	Value   string
+	// Deleted indicates the entry is a tombstone for a deleted key. Tombstones
+	// are kept so the delete is propagated around the cluster, and are removed
+	// once all known peers have seen them.
+	Deleted bool
 }
 
 // Peer represents the state of a peer.
 type Peer struct {
-	addr string
+	// id uniquely identifies the peer. Unlike the peers address this is
+	// stable, so the peer keeps its identity if its address changes.
+	id string
+	// generation identifies the incarnation of the peer, such as the time the
+	// node started. When a node restarts it starts again with a version of 0
+	// so its generation is used to detect the new state replaces the old.
+	generation uint64
 	// version is the highest version of all the peers entries. This is used to
 	// compare versions between nodes to check for missing updates.
 	version uint64
 	// entries contains the peer state to be propagated around the cluster.
 	entries map[string]PeerEntry
-	// status indicates whether the peer is considered up or down.
+	// status indicates whether the peer is considered alive, suspect, dead or
+	// has left.
 	status PeerStatus
 	// expiry is the time the peer should be removed if it is still down.
 	expiry time.Time
+	// digestAddr is the peers address as included in digests from other
+	// nodes, which is used to reach the peer until its own state is received.
+	digestAddr string
+	// knownVersions contains the version of this peer known by each other
+	// node, indexed by node ID, as reported in their digests. This is
+	// used to detect when tombstones have converged.
+	knownVersions map[string]uint64
+	// removedVersion is the highest version tombstones have been removed up
+	// to. Any entry with a version less than or equal to removedVersion that
+	// isn't known must have been deleted and its tombstone removed, so
+	// updates to missing entries at or below this version are discarded.
+	removedVersion uint64
 }
 
-// NewPeer returns a new peer with the given address, with a version of 0 to
-// indicate it has no known state.
-func NewPeer(addr string) *Peer {
+// NewPeer returns a new peer with the given ID and generation, with a version
+// of 0 to indicate it has no known state.
+func NewPeer(id string, generation uint64) *Peer {
 	return &Peer{
-		addr:    addr,
-		version: 0,
-		entries: make(map[string]PeerEntry),
-		status:  PeerStatusUp,
+		id:            id,
+		generation:    generation,
+		version:       0,
+		entries:       make(map[string]PeerEntry),
+		status:        PeerStatusAlive,
+		knownVersions: make(map[string]uint64),
 	}
 }
 
+func (p *Peer) ID() string {
+	return p.id
+}
+
+// Addr returns the address of the peer, or an empty string if it isn't known
+// yet, such as if the peers state hasn't been received and no digest included
+// the address.
+//
+// Peers that only support protocol versions before 5 don't advertise their
+// address, as they are identified by their address, so their ID is used.
 func (p *Peer) Addr() string {
-	return p.addr
+	if entry, ok := p.Lookup(addrKey); ok {
+		return entry.Value
+	}
+	if p.digestAddr != "" {
+		return p.digestAddr
+	}
+	if entry, ok := p.Lookup(protocolMaxKey); ok {
+		version, err := strconv.ParseUint(entry.Value, 10, 8)
+		if err == nil && version < protocolVersion5 {
+			return p.id
+		}
+	}
+	return ""
+}
+
+func (p *Peer) Generation() uint64 {
+	return p.generation
 }
 
 func (p *Peer) Version() uint64 {
@@ -51,32 +271,110 @@ func (p *Peer) Expiry() time.Time {
 	return p.expiry
 }
 
-func (p *Peer) SetStatusUp() {
-	p.status = PeerStatusUp
+func (p *Peer) SetStatusAlive() {
+	p.status = PeerStatusAlive
+	p.expiry = time.Time{}
+}
+
+func (p *Peer) SetStatusSuspect() {
+	p.status = PeerStatusSuspect
 	p.expiry = time.Time{}
 }
 
-// SetStatusDown sets the status to down and sets the expiry of when the
+// SetStatusDead sets the status to dead and sets the expiry of when the
 // peer should be removed if it hasen't come up.
-func (p *Peer) SetStatusDown(expiry time.Time) {
-	// Check if the peer is already down to avoid resetting the expiry.
-	if p.status == PeerStatusDown {
+func (p *Peer) SetStatusDead(expiry time.Time) {
+	// Check if the peer is already dead to avoid resetting the expiry. Peers
+	// that have left can't be marked dead.
+	if p.status == PeerStatusDead || p.status == PeerStatusLeft {
 		return
 	}
 
-	p.status = PeerStatusDown
+	p.status = PeerStatusDead
 	p.expiry = expiry
 }
 
+// SetStatusLeft sets the status to left and sets the expiry of when the peer
+// should be removed.
+func (p *Peer) SetStatusLeft(expiry time.Time) {
+	if p.status == PeerStatusLeft {
+		return
+	}
+
+	p.status = PeerStatusLeft
+	p.expiry = expiry
+}
+
+// Lookup returns the entry with the given key. Deleted entries are not
+// returned.
 func (p *Peer) Lookup(key string) (PeerEntry, bool) {
-	if entry, ok := p.entries[key]; ok {
+	if entry, ok := p.entries[key]; ok && !entry.Deleted {
 		return entry, true
 	}
 	return PeerEntry{}, false
 }
 
+// Incarnation returns the incarnation of the peer, or 0 if the peer has never
+// refuted a claim.
+func (p *Peer) Incarnation() uint64 {
+	entry, ok := p.Lookup(incarnationKey)
+	if !ok {
+		return 0
+	}
+	incarnation, err := strconv.ParseUint(entry.Value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return incarnation
+}
+
+// Claim returns the claim this peer has made about the peer with the given ID,
+// or false if it has made no valid claim.
+func (p *Peer) Claim(id string) (statusClaim, bool) {
+	entry, ok := p.Lookup(claimKey(id))
+	if !ok {
+		return statusClaim{}, false
+	}
+	claim, err := decodeStatusClaim(entry.Value)
+	if err != nil {
+		return statusClaim{}, false
+	}
+	return claim, true
+}
+
+// StateSize returns the total size of the peers application keys and values,
+// excluding deleted entries and internal keys.
+func (p *Peer) StateSize() int {
+	size := 0
+	for key, entry := range p.entries {
+		if entry.Deleted || IsInternalKey(key) {
+			continue
+		}
+		size += len(key) + len(entry.Value)
+	}
+	return size
+}
+
+// KnownVersion returns the version of this peer known by the node with the
+// given ID, or 0 if it is unknown.
+func (p *Peer) KnownVersion(id string) uint64 {
+	return p.knownVersions[id]
+}
+
+// SetKnownVersion records the version of this peer known by the node with
+// the given ID. Since a nodes known version never decreases, smaller versions
+// are ignored.
+func (p *Peer) SetKnownVersion(id string, version uint64) {
+	if version > p.knownVersions[id] {
+		p.knownVersions[id] = version
+	}
+}
+
 func (p *Peer) Equal(o *Peer) bool {
-	if p.addr != o.addr {
+	if p.id != o.id {
+		return false
+	}
+	if p.generation != o.generation {
 		return false
 	}
 	if p.version != o.version {
@@ -97,6 +395,9 @@ func (p *Peer) Equal(o *Peer) bool {
 		if v.Value != w.Value {
 			return false
 		}
+		if v.Deleted != w.Deleted {
+			return false
+		}
 	}
 
 	return true
@@ -108,7 +409,7 @@ func (p *Peer) Equal(o *Peer) bool {
 // redundant data).
 func (p *Peer) UpdateLocal(key string, value string) {
 	if entry, ok := p.entries[key]; ok {
-		if entry.Value == value {
+		if entry.Value == value && !entry.Deleted {
 			return
 		}
 	}
@@ -121,14 +422,18 @@ func (p *Peer) UpdateLocal(key string, value string) {
 }
 
 // UpdateRemote updates the peer from an update from a remote node. If the
-// local version of that entry is greater than the new version, the update is
-// discarded.
-func (p *Peer) UpdateRemote(key string, value string, version uint64) {
+// local version of that entry is greater than or equal to the new version,
+// the update is discarded. Returns true if the update was applied.
+func (p *Peer) UpdateRemote(key string, value string, version uint64) bool {
 	// Ignore updates with a smaller version than the current entry.
-	if entry, ok := p.entries[key]; ok {
-		if version <= entry.Version {
-			return
-		}
+	entry, ok := p.entries[key]
+	if ok && version <= entry.Version {
+		return false
+	}
+	// Ignore stale updates to entries whose tombstones have been removed,
+	// such as from a node that missed the delete.
+	if !ok && version <= p.removedVersion {
+		return false
 	}
 
 	p.entries[key] = PeerEntry{
@@ -138,12 +443,85 @@ func (p *Peer) UpdateRemote(key string, value string, version uint64) {
 	if version > p.version {
 		p.version = version
 	}
+	return true
+}
+
+// DeleteLocal deletes the entry with the given key when the peer is owned by
+// the local node. Rather than removing the entry, it is replaced with a
+// tombstone with an incremented version so the delete is propagated around the
+// cluster. If the key doesn't exist, or is already deleted, this does nothing.
+func (p *Peer) DeleteLocal(key string) {
+	entry, ok := p.entries[key]
+	if !ok || entry.Deleted {
+		return
+	}
+
+	p.version++
+	p.entries[key] = PeerEntry{
+		Version: p.version,
+		Deleted: true,
+	}
+}
+
+// DeleteRemote deletes the entry from a delete from a remote node. If the
+// local version of that entry is greater than the new version, the delete is
+// discarded. Returns true if an existing value was deleted.
+func (p *Peer) DeleteRemote(key string, version uint64) bool {
+	entry, ok := p.entries[key]
+	// Ignore deletes with a smaller version than the current entry.
+	if ok && version <= entry.Version {
+		return false
+	}
+	// Ignore deletes whose tombstones have already been removed.
+	if !ok && version <= p.removedVersion {
+		return false
+	}
+
+	p.entries[key] = PeerEntry{
+		Version: version,
+		Deleted: true,
+	}
+	if version > p.version {
+		p.version = version
+	}
+
+	return ok && !entry.Deleted
+}
+
+// RemoveTombstones removes all tombstones with a version less than or equal
+// to the given version. The version is recorded so updates to the removed
+// entries with an older version, such as in a push-pull from a node that
+// missed the delete, are discarded rather than re-adding the entries.
+func (p *Peer) RemoveTombstones(version uint64) int {
+	if version > p.removedVersion {
+		p.removedVersion = version
+	}
+
+	removed := 0
+	for key, entry := range p.entries {
+		if entry.Deleted && entry.Version <= version {
+			delete(p.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// SetDigestAddr records the peers address from a digest of the same
+// generation. Since a node can't change its address without restarting, the
+// address remains valid for the peers generation.
+func (p *Peer) SetDigestAddr(addr string) {
+	if addr != "" {
+		p.digestAddr = addr
+	}
 }
 
 func (p *Peer) Digest() Digest {
 	return Digest{
-		Addr:    p.addr,
-		Version: p.version,
+		ID:         p.id,
+		Generation: p.generation,
+		Version:    p.version,
+		Addr:       p.Addr(),
 	}
 }
 
@@ -160,10 +538,12 @@ func (p *Peer) Deltas(version uint64) []Delta {
 		}
 
 		deltas = append(deltas, Delta{
-			Addr:    p.addr,
-			Key:     key,
-			Value:   entry.Value,
-			Version: entry.Version,
+			ID:         p.id,
+			Generation: p.generation,
+			Key:        key,
+			Value:      entry.Value,
+			Version:    entry.Version,
+			Deleted:    entry.Deleted,
 		})
 	}
 
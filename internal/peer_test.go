@@ -8,7 +8,7 @@ import (
 )
 
 func TestPeer_UpdateLocalThenLookup(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	p.UpdateLocal("foo", "bar")
 
@@ -18,7 +18,7 @@ func TestPeer_UpdateLocalThenLookup(t *testing.T) {
 }
 
 func TestPeer_LookupNotFound(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 	p.UpdateLocal("foo", "bar")
 
 	_, ok := p.Lookup("car")
@@ -26,7 +26,7 @@ func TestPeer_LookupNotFound(t *testing.T) {
 }
 
 func TestPeer_UpdateLocalIncrementsVersion(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	// Peer version should start at 0.
 	assert.Equal(t, uint64(0), p.Version())
@@ -40,7 +40,7 @@ func TestPeer_UpdateLocalIncrementsVersion(t *testing.T) {
 
 // Tests local updates don't increase the version when the value is unchanged.
 func TestPeer_UpdateLocalDiscardsDuplicateUpdate(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	// Peer version should start at 0.
 	assert.Equal(t, uint64(0), p.Version())
@@ -55,7 +55,7 @@ func TestPeer_UpdateLocalDiscardsDuplicateUpdate(t *testing.T) {
 }
 
 func TestPeer_UpdateRemoteUpdatesValue(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	p.UpdateRemote("foo", "bar", 10)
 	e, ok := p.Lookup("foo")
@@ -69,7 +69,7 @@ func TestPeer_UpdateRemoteUpdatesValue(t *testing.T) {
 }
 
 func TestPeer_UpdateRemoteUpdatesPeerVersion(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	p.UpdateRemote("foo", "bar", 10)
 	assert.Equal(t, uint64(10), p.Version())
@@ -84,7 +84,7 @@ func TestPeer_UpdateRemoteUpdatesPeerVersion(t *testing.T) {
 }
 
 func TestPeer_UpdateRemoteDiscardsOldVersion(t *testing.T) {
-	p := NewPeer("")
+	p := NewPeer("", 0)
 
 	// Update and check value updated.
 	p.UpdateRemote("foo", "bar", 10)
@@ -100,16 +100,16 @@ func TestPeer_UpdateRemoteDiscardsOldVersion(t *testing.T) {
 }
 
 func TestPeer_Digest(t *testing.T) {
-	p := NewPeer("10.26.104.52:8119")
+	p := NewPeer("10.26.104.52:8119", 0)
 	assert.Equal(t, Digest{
-		Addr:    "10.26.104.52:8119",
+		ID:      "10.26.104.52:8119",
 		Version: 0,
 	}, p.Digest())
 }
 
 // Tests deltas returns all entries with a greater version in sorted order.
 func TestPeer_Deltas(t *testing.T) {
-	p := NewPeer("10.26.104.52:8119")
+	p := NewPeer("10.26.104.52:8119", 0)
 
 	p.UpdateLocal("a", "b")
 	p.UpdateRemote("c", "d", 3)
@@ -118,17 +118,17 @@ func TestPeer_Deltas(t *testing.T) {
 
 	// Expect a version of 0 to include all entries.
 	expectedSince0 := []Delta{
-		{Addr: "10.26.104.52:8119", Key: "a", Value: "b", Version: 1},
-		{Addr: "10.26.104.52:8119", Key: "c", Value: "d", Version: 3},
-		{Addr: "10.26.104.52:8119", Key: "e", Value: "f", Version: 7},
-		{Addr: "10.26.104.52:8119", Key: "g", Value: "h", Version: 9},
+		{ID: "10.26.104.52:8119", Key: "a", Value: "b", Version: 1},
+		{ID: "10.26.104.52:8119", Key: "c", Value: "d", Version: 3},
+		{ID: "10.26.104.52:8119", Key: "e", Value: "f", Version: 7},
+		{ID: "10.26.104.52:8119", Key: "g", Value: "h", Version: 9},
 	}
 	assert.Equal(t, expectedSince0, p.Deltas(0))
 
 	// A version of 3 should only returns entries with greater versions.
 	expectedSince3 := []Delta{
-		{Addr: "10.26.104.52:8119", Key: "e", Value: "f", Version: 7},
-		{Addr: "10.26.104.52:8119", Key: "g", Value: "h", Version: 9},
+		{ID: "10.26.104.52:8119", Key: "e", Value: "f", Version: 7},
+		{ID: "10.26.104.52:8119", Key: "g", Value: "h", Version: 9},
 	}
 	assert.Equal(t, expectedSince3, p.Deltas(3))
 
@@ -137,3 +137,114 @@ func TestPeer_Deltas(t *testing.T) {
 	expectedSince10 := []Delta{}
 	assert.Equal(t, expectedSince10, p.Deltas(10))
 }
+
+func TestPeer_DeleteLocal(t *testing.T) {
+	p := NewPeer("", 0)
+
+	p.UpdateLocal("foo", "bar")
+	p.DeleteLocal("foo")
+
+	// The deleted entry should not be found and the version incremented.
+	_, ok := p.Lookup("foo")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(2), p.Version())
+
+	// Deleting again or deleting an unknown key should not change the version.
+	p.DeleteLocal("foo")
+	p.DeleteLocal("car")
+	assert.Equal(t, uint64(2), p.Version())
+
+	// Updating the deleted key should add it back.
+	p.UpdateLocal("foo", "bar")
+	e, ok := p.Lookup("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "bar", e.Value)
+	assert.Equal(t, uint64(3), p.Version())
+}
+
+func TestPeer_DeleteRemote(t *testing.T) {
+	p := NewPeer("", 0)
+
+	p.UpdateRemote("foo", "bar", 10)
+
+	// Deletes with an old version should be ignored.
+	assert.False(t, p.DeleteRemote("foo", 5))
+	_, ok := p.Lookup("foo")
+	assert.True(t, ok)
+
+	assert.True(t, p.DeleteRemote("foo", 15))
+	_, ok = p.Lookup("foo")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(15), p.Version())
+
+	// Updates older than the tombstone should be ignored.
+	p.UpdateRemote("foo", "car", 12)
+	_, ok = p.Lookup("foo")
+	assert.False(t, ok)
+
+	// Deleting an unknown key should store the tombstone but not report a
+	// delete.
+	assert.False(t, p.DeleteRemote("boo", 20))
+	assert.Equal(t, []Delta{
+		{ID: "", Key: "boo", Version: 20, Deleted: true},
+	}, p.Deltas(15))
+}
+
+func TestPeer_RemoveTombstones(t *testing.T) {
+	p := NewPeer("", 0)
+
+	p.UpdateLocal("a", "b")
+	p.UpdateLocal("c", "d")
+	p.DeleteLocal("a")
+	p.DeleteLocal("c")
+
+	assert.Equal(t, 1, p.RemoveTombstones(3))
+	assert.Equal(t, []Delta{
+		{ID: "", Key: "c", Version: 4, Deleted: true},
+	}, p.Deltas(0))
+
+	// Removing tombstones should not change the peer version.
+	assert.Equal(t, uint64(4), p.Version())
+
+	// Stale updates and deletes of the removed entry should be discarded.
+	assert.False(t, p.UpdateRemote("a", "b", 1))
+	assert.False(t, p.DeleteRemote("a", 3))
+	_, ok := p.Lookup("a")
+	assert.False(t, ok)
+
+	// Newer updates should still be applied.
+	assert.True(t, p.UpdateRemote("a", "e", 5))
+}
+
+func TestPeer_Claim(t *testing.T) {
+	p := NewPeer("", 0)
+
+	_, ok := p.Claim("10.26.104.11:8119")
+	assert.False(t, ok)
+
+	claim := statusClaim{
+		Status:      PeerStatusSuspect,
+		Generation:  0x1234,
+		Incarnation: 5,
+	}
+	p.UpdateLocal(claimKey("10.26.104.11:8119"), claim.encode())
+
+	c, ok := p.Claim("10.26.104.11:8119")
+	assert.True(t, ok)
+	assert.Equal(t, claim, c)
+
+	// Invalid claims are ignored.
+	for _, value := range []string{"", "alive:1:2", "dead:1", "dead:a:2", "dead:1:-2"} {
+		p.UpdateLocal(claimKey("10.26.104.11:8119"), value)
+		_, ok := p.Claim("10.26.104.11:8119")
+		assert.False(t, ok, value)
+	}
+}
+
+func TestPeer_Incarnation(t *testing.T) {
+	p := NewPeer("", 0)
+	assert.Equal(t, uint64(0), p.Incarnation())
+
+	p.UpdateRemote(incarnationKey, "3", 10)
+	assert.Equal(t, uint64(3), p.Incarnation())
+}
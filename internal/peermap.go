@@ -1,102 +1,208 @@
 package internal
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// removedPeer is a tombstone for a peer removed from the cluster, which
+// prevents the peer being gossiped back by nodes that still know about it.
+type removedPeer struct {
+	// Generation is the generation of the peer that was removed. Only
+	// generations up to and including this generation are discarded, so the
+	// peer can rejoin after restarting.
+	Generation uint64
+	// Expiry is the time the tombstone is discarded.
+	Expiry time.Time
+}
+
 // PeerMap contains this nodes view of all known peers in the cluster.
 //
 // Note this is thread safe.
 type PeerMap struct {
-	// localAddr is the address of the local node.
+	// localID is the ID of the local node.
+	localID string
+	// localAddr is the advertised address of the local node.
 	localAddr string
-	// peers contains the set of known peers indexed by address.
+	// peers contains the set of known peers indexed by ID.
 	peers map[string]*Peer
+	// removed contains tombstones for peers removed from the cluster indexed
+	// by ID, either by the local node or other nodes.
+	removed map[string]removedPeer
+	// pending contains events waiting to be emitted once mu is released.
+	pending []Event
 	// mu protects all above fields. Using a RWMutex since expect the workload to be
 	// quite read heavy (calculating deltas and digests).
 	mu sync.RWMutex
 
+	// reapTimeout is how long to keep peers that are dead or have left before
+	// removing them, and how long to keep the tombstones of removed peers.
+	reapTimeout time.Duration
+
+	clock  Clock
 	logger *zap.Logger
 
-	// Note must not hold mu when invoking callback as it may call back to
+	// Note must not hold mu when invoking onEvent as it may call back to
 	// peerMap.
-	onJoin   func(addr string)
-	onLeave  func(addr string)
-	onUpdate func(addr string, key string, value string)
+	onEvent func(e Event)
 }
 
+// NewPeerMap returns a peer map containing only the local peer with the given
+// ID, address and generation. Peers that are dead or have left are removed
+// after reapTimeout.
 func NewPeerMap(
+	localID string,
 	localAddr string,
-	onJoin func(addr string),
-	onLeave func(addr string),
-	onUpdate func(addr string, key string, value string),
+	localGeneration uint64,
+	reapTimeout time.Duration,
+	onEvent func(e Event),
+	clock Clock,
 	logger *zap.Logger,
 ) *PeerMap {
+	local := NewPeer(localID, localGeneration)
+	// Advertise the local address so other nodes can reach the local node.
+	local.UpdateLocal(addrKey, localAddr)
 	peers := map[string]*Peer{
-		localAddr: NewPeer(localAddr),
+		localID: local,
 	}
 	return &PeerMap{
-		localAddr: localAddr,
-		peers:     peers,
-		mu:        sync.RWMutex{},
-		onJoin:    onJoin,
-		onLeave:   onLeave,
-		onUpdate:  onUpdate,
-		logger:    logger,
+		localID:     localID,
+		localAddr:   localAddr,
+		peers:       peers,
+		removed:     make(map[string]removedPeer),
+		mu:          sync.RWMutex{},
+		reapTimeout: reapTimeout,
+		onEvent:     onEvent,
+		clock:       clock,
+		logger:      logger,
 	}
 }
 
-// Addrs returns the addresses of the up peers known by this node. If
-// includeLocal is true the local node is included, otherwise it isn't.
-func (m *PeerMap) Addrs(includeLocal bool) []string {
+// IDs returns the IDs of the up (alive or suspect) peers known by this
+// node. If includeLocal is true the local node is included, otherwise it
+// isn't.
+//
+// The IDs are sorted so peer selection is deterministic given the
+// random source.
+func (m *PeerMap) IDs(includeLocal bool) []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	peers := make([]string, 0, len(m.peers))
-	for addr, peer := range m.peers {
-		if peer.Status() != PeerStatusUp {
+	for id, peer := range m.peers {
+		if !peer.Status().Up() {
 			continue
 		}
 
-		if includeLocal || addr != m.localAddr {
-			peers = append(peers, addr)
+		if includeLocal || id != m.localID {
+			peers = append(peers, id)
 		}
 	}
+	sort.Strings(peers)
 	return peers
 }
 
+// DownPeers returns the sorted IDs of the peers considered dead.
 func (m *PeerMap) DownPeers() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	peers := make([]string, 0, len(m.peers))
-	for addr, peer := range m.peers {
-		if peer.Status() != PeerStatusDown {
+	for id, peer := range m.peers {
+		if peer.Status() != PeerStatusDead {
 			continue
 		}
-		peers = append(peers, addr)
+		peers = append(peers, id)
 	}
+	sort.Strings(peers)
 	return peers
 }
 
-func (m *PeerMap) Lookup(addr string, key string) (PeerEntry, bool) {
+// Status returns the status of the peer with the given ID, or false if
+// the peer is unknown.
+func (m *PeerMap) Status(id string) (PeerStatus, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if peer, ok := m.peers[addr]; ok {
+	peer, ok := m.peers[id]
+	if !ok {
+		return 0, false
+	}
+	return peer.Status(), true
+}
+
+func (m *PeerMap) Lookup(id string, key string) (PeerEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if peer, ok := m.peers[id]; ok {
 		return peer.Lookup(key)
 	}
 	return PeerEntry{}, false
 }
 
-func (m *PeerMap) Version(addr string) uint64 {
+// LocalID returns the ID of the local peer.
+func (m *PeerMap) LocalID() string {
+	return m.localID
+}
+
+// LocalAddr returns the advertised address of the local peer.
+func (m *PeerMap) LocalAddr() string {
+	return m.localAddr
+}
+
+// Addr returns the address of the peer with the given ID, or false if the peer
+// is unknown or its address isn't known yet.
+func (m *PeerMap) Addr(id string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	peer, ok := m.peers[id]
+	if !ok || peer.Addr() == "" {
+		return "", false
+	}
+	return peer.Addr(), true
+}
+
+// IDByAddr returns the ID of the peer with the given address, or false if no
+// known peer has the address. If multiple peers have the address, such as a
+// node that restarted with a new ID, an up peer is preferred.
+func (m *PeerMap) IDByAddr(addr string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found := ""
+	for id, peer := range m.peers {
+		if peer.Addr() != addr {
+			continue
+		}
+		if peer.Status().Up() {
+			return id, true
+		}
+		found = id
+	}
+	return found, found != ""
+}
+
+// LocalStateSize returns the size of the local peers application state.
+func (m *PeerMap) LocalStateSize() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	peer, ok := m.peers[addr]
+	return m.peers[m.localID].StateSize()
+}
+
+func (m *PeerMap) Version(id string) uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	peer, ok := m.peers[id]
 	if !ok {
 		// If we haven't see the peer the version is always 0.
 		return 0
@@ -127,156 +233,729 @@ func (m *PeerMap) UpdateLocal(key string, value string) {
 
 	m.logger.Debug("update local", zap.String("key", key), zap.String("value", value))
 
-	m.peers[m.localAddr].UpdateLocal(key, value)
+	m.peers[m.localID].UpdateLocal(key, value)
 }
 
-func (m *PeerMap) SetStatusUp(addr string) {
+// DeleteLocal deletes an entry in this nodes local peer.
+func (m *PeerMap) DeleteLocal(key string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	peer, ok := m.peers[addr]
-	if !ok {
-		return
-	}
+	m.logger.Debug("delete local", zap.String("key", key))
 
-	// Check if the status has changed to avoid sending duplicate notifications.
-	if peer.Status() == PeerStatusUp {
-		return
-	}
+	m.peers[m.localID].DeleteLocal(key)
+}
 
-	peer.SetStatusUp()
+// Heartbeat increments the local peers heartbeat, which is propagated to the
+// other nodes in the cluster to show the local node is alive.
+func (m *PeerMap) Heartbeat() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	local := m.peers[m.localID]
 
-	if m.onJoin != nil {
-		m.onJoin(addr)
+	heartbeat := uint64(0)
+	if entry, ok := local.Lookup(heartbeatKey); ok {
+		// The heartbeat is only ever written by the local node so is always
+		// valid.
+		heartbeat, _ = strconv.ParseUint(entry.Value, 10, 64)
 	}
+	local.UpdateLocal(heartbeatKey, strconv.FormatUint(heartbeat+1, 10))
 }
 
-func (m *PeerMap) SetStatusDown(addr string, expiry time.Time) {
+// Leave marks the local peer as having left the cluster, which will be
+// propagated to the other nodes in the cluster. Returns the local peers
+// version containing the leave.
+func (m *PeerMap) Leave() uint64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// The local peers state is always active.
-	if addr == m.localAddr {
-		return
-	}
+	m.logger.Debug("leave")
 
-	peer, ok := m.peers[addr]
-	if !ok {
-		return
-	}
+	local := m.peers[m.localID]
+	local.UpdateLocal(statusKey, statusLeft)
+	return local.Version()
+}
 
-	// Check if the status has changed to avoid sending duplicate notifications.
-	if peer.Status() == PeerStatusDown {
-		return
+// LocalVersionAcks returns the IDs of up peers that have acknowledged
+// receiving the local peer at the given version (or greater), and those
+// that haven't.
+func (m *PeerMap) LocalVersionAcks(version uint64) ([]string, []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	local := m.peers[m.localID]
+
+	acked := []string{}
+	unacked := []string{}
+	for id, peer := range m.peers {
+		if id == m.localID || !peer.Status().Up() {
+			continue
+		}
+		if local.KnownVersion(id) >= version {
+			acked = append(acked, id)
+		} else {
+			unacked = append(unacked, id)
+		}
 	}
+	return acked, unacked
+}
 
-	peer.SetStatusDown(expiry)
+// Suspect claims the peer with the given ID is suspect. The claim is
+// added to the local peers state so it is propagated to the other nodes in the
+// cluster, and to the suspected peer so it can refute the claim.
+func (m *PeerMap) Suspect(id string) {
+	m.claim(id, PeerStatusSuspect)
+}
+
+// Convict claims the peer with the given ID is dead. Like Suspect the
+// claim is propagated around the cluster.
+func (m *PeerMap) Convict(id string) {
+	m.claim(id, PeerStatusDead)
+}
+
+// ClearClaim removes the local nodes claim about the peer with the given ID,
+// such as if the local node has since heard from the peer. Note the
+// peer remains suspect or dead if other nodes also have claims about the peer.
+func (m *PeerMap) ClearClaim(id string) {
+	m.mu.Lock()
+	defer m.unlock()
 
-	if m.onLeave != nil {
-		m.onLeave(addr)
+	local := m.peers[m.localID]
+	if _, ok := local.Claim(id); !ok {
+		return
 	}
+	local.DeleteLocal(claimKey(id))
+	m.refreshStatus(id)
 }
 
-func (m *PeerMap) Digest(addr string) Digest {
+func (m *PeerMap) Digest(id string) Digest {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	peer, ok := m.peers[addr]
+	peer, ok := m.peers[id]
 	if !ok {
 		return Digest{}
 	}
 	return peer.Digest()
 }
 
-func (m *PeerMap) Deltas(addr string, version uint64) []Delta {
+func (m *PeerMap) Deltas(id string, version uint64) []Delta {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	peer, ok := m.peers[addr]
+	peer, ok := m.peers[id]
 	if !ok {
 		return []Delta{}
 	}
 	return peer.Deltas(version)
 }
 
-func (m *PeerMap) ApplyDigest(digest Digest) {
+// ApplyDigest applies the digest, adding the peer if it isn't known. Returns
+// true if the digest is from a newer generation of the peer so the peer
+// rejoined.
+func (m *PeerMap) ApplyDigest(digest Digest) bool {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlock()
 
 	m.logger.Debug(
 		"apply digest",
 		zap.Object("digest", digest),
 	)
 
-	peer, ok := m.peers[digest.Addr]
+	// Discard digests about removed peers so the peer isn't added back.
+	if m.isRemoved(digest.ID, digest.Generation) {
+		return false
+	}
+
+	peer, ok := m.peers[digest.ID]
 	if !ok {
-		m.logger.Info("node joined", zap.String("joined", digest.Addr))
+		m.logger.Info("node joined", zap.String("joined", digest.ID))
 
-		if m.onJoin != nil {
-			m.mu.Unlock()
-			m.onJoin(digest.Addr)
-			m.mu.Lock()
-		}
+		m.emit(Event{
+			Type: EventJoin,
+			ID:   digest.ID,
+			Addr: digest.Addr,
+		})
 
 		// Add the peer with a version of 0 given we don't have any state
 		// for the peer yet.
-		peer = NewPeer(digest.Addr)
-		m.peers[digest.Addr] = peer
+		peer = NewPeer(digest.ID, digest.Generation)
+		peer.SetDigestAddr(digest.Addr)
+		m.peers[digest.ID] = peer
+		// Other nodes may have already claimed the peer is suspect or dead.
+		m.refreshStatus(digest.ID)
+		return false
+	}
+
+	rejoined := false
+	if digest.Generation > peer.Generation() {
+		peer = m.rejoin(digest.ID, digest.Generation, digest.Addr)
+		rejoined = peer.Generation() == digest.Generation
+	}
+	if digest.Generation == peer.Generation() {
+		peer.SetDigestAddr(digest.Addr)
 	}
+	return rejoined
 }
 
-func (m *PeerMap) ApplyDelta(delta Delta) {
+// ApplyDelta applies the delta to the peers state. Returns true if the delta
+// was applied, or false if it was discarded such as if its older than the
+// known state, and whether the delta was from a newer generation of the peer
+// so the peer rejoined.
+func (m *PeerMap) ApplyDelta(delta Delta) (bool, bool) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlock()
 
-	if delta.Addr == m.localAddr {
+	if delta.ID == m.localID {
 		m.logger.Error("received delta update about local peer")
-		return
+		return false, false
 	}
 
-	peer, ok := m.peers[delta.Addr]
+	peer, ok := m.peers[delta.ID]
 	if !ok {
 		// This should never happen. We only receive digest entries for
 		// the peers we requested.
-		return
+		return false, false
+	}
+	if m.isRemoved(delta.ID, delta.Generation) {
+		return false, false
+	}
+
+	// If the delta is from an old generation of the peer discard it, and if
+	// its from a newer generation we must discard our stale state.
+	if delta.Generation < peer.Generation() {
+		return false, false
+	}
+	rejoined := false
+	if delta.Generation > peer.Generation() {
+		peer = m.rejoin(delta.ID, delta.Generation, "")
+		rejoined = peer.Generation() == delta.Generation
 	}
 
 	m.logger.Debug(
 		"apply delta",
-		zap.String("addr", delta.Addr),
-		zap.String("key", delta.Key),
-		zap.String("value", delta.Value),
-		zap.Uint64("version", delta.Version),
+		zap.Object("delta", delta),
 	)
 
-	peer.UpdateRemote(delta.Key, delta.Value, delta.Version)
+	if delta.Deleted {
+		if !peer.DeleteRemote(delta.Key, delta.Version) {
+			return false, rejoined
+		}
+		if IsInternalKey(delta.Key) {
+			m.applyInternal(peer, delta.Key)
+			return true, rejoined
+		}
+		m.emit(Event{
+			Type: EventDelete,
+			ID:   delta.ID,
+			Addr: peer.Addr(),
+			Key:  delta.Key,
+		})
+		return true, rejoined
+	}
+
+	// Only notify about updates that were applied, since the same delta
+	// may be received multiple times (such as from push-pull).
+	if !peer.UpdateRemote(delta.Key, delta.Value, delta.Version) {
+		return false, rejoined
+	}
 
-	if m.onUpdate != nil {
-		m.mu.Unlock()
-		m.onUpdate(delta.Addr, delta.Key, delta.Value)
-		m.mu.Lock()
+	if IsInternalKey(delta.Key) {
+		m.applyInternal(peer, delta.Key)
+		return true, rejoined
 	}
+
+	m.emit(Event{
+		Type:  EventUpdate,
+		ID:    delta.ID,
+		Addr:  peer.Addr(),
+		Key:   delta.Key,
+		Value: delta.Value,
+	})
+	return true, rejoined
 }
 
-func (m *PeerMap) RemoveExpiredPeers() []string {
+// UpdateKnownVersion records the version of the peer in the digest as known
+// by the node with ID fromID. Digests from unknown nodes are ignored.
+func (m *PeerMap) UpdateKnownVersion(fromID string, digest Digest) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if _, ok := m.peers[fromID]; !ok {
+		return
+	}
+
+	peer, ok := m.peers[digest.ID]
+	if !ok {
+		return
+	}
+	// Versions from another generation of the peer aren't comparable.
+	if digest.Generation != peer.Generation() {
+		return
+	}
+	peer.SetKnownVersion(fromID, digest.Version)
+}
+
+// RemoveConvergedTombstones removes the tombstones for all peers that are
+// known to have been seen by every other known peer (including down peers,
+// since they may come back up with stale state).
+func (m *PeerMap) RemoveConvergedTombstones() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, peer := range m.peers {
+		converged := peer.Version()
+		for nodeID := range m.peers {
+			if nodeID == m.localID || nodeID == id {
+				continue
+			}
+			if v := peer.KnownVersion(nodeID); v < converged {
+				converged = v
+			}
+		}
+
+		if n := peer.RemoveTombstones(converged); n > 0 {
+			m.logger.Debug(
+				"removed converged tombstones",
+				zap.String("id", id),
+				zap.Int("removed", n),
+				zap.Uint64("version", converged),
+			)
+		}
+	}
+}
+
+// ForceRemove removes the peer with the given ID from the cluster, such
+// as if the node has been decommissioned. A tombstone for the peer is added to
+// the local peers state, so the removal is propagated to the other nodes in
+// the cluster and they don't gossip the peer back. The peer may only rejoin by
+// restarting with a new generation.
+func (m *PeerMap) ForceRemove(id string) error {
+	m.mu.Lock()
+	defer m.unlock()
+
+	if id == m.localID {
+		return fmt.Errorf("cannot remove local peer")
+	}
+	peer, ok := m.peers[id]
+	if !ok {
+		return ErrUnknownPeer
+	}
+
+	m.logger.Info(
+		"force remove peer",
+		zap.String("id", id),
+		zap.Uint64("generation", peer.Generation()),
+	)
+
+	m.remove(peer)
+	m.peers[m.localID].UpdateLocal(removedKey(id), strconv.FormatUint(peer.Generation(), 10))
+	return nil
+}
+
+// RemoveExpiredPeers removes the peers that have been dead or have left for
+// longer than the reap timeout, and adds a tombstone for each removed peer to
+// the local peers state so the removal is propagated to the other nodes in the
+// cluster. Also discards expired tombstones. Returns the sorted IDs of
+// the removed peers.
+func (m *PeerMap) RemoveExpiredPeers() []string {
+	m.mu.Lock()
+	defer m.unlock()
+
+	now := m.clock.Now()
+
 	expired := []string{}
-	for addr, peer := range m.peers {
-		if peer.Status() == PeerStatusDown && time.Now().After(peer.Expiry()) {
+	for id, peer := range m.peers {
+		if !peer.Status().Up() && now.After(peer.Expiry()) {
 			m.logger.Info(
 				"remove expired peer",
-				zap.String("addr", addr),
+				zap.String("id", id),
 				zap.Int64("expiry", peer.Expiry().UnixMilli()),
 			)
-			expired = append(expired, addr)
+			expired = append(expired, id)
 		}
 	}
+	sort.Strings(expired)
 
-	for _, addr := range expired {
-		delete(m.peers, addr)
+	local := m.peers[m.localID]
+	for _, id := range expired {
+		peer := m.peers[id]
+		m.remove(peer)
+		local.UpdateLocal(removedKey(id), strconv.FormatUint(peer.Generation(), 10))
+	}
+
+	for id, removed := range m.removed {
+		if !now.After(removed.Expiry) {
+			continue
+		}
+		m.logger.Debug("remove expired tombstone", zap.String("id", id))
+		delete(m.removed, id)
+		if _, ok := local.Lookup(removedKey(id)); ok {
+			local.DeleteLocal(removedKey(id))
+		}
 	}
 
 	return expired
 }
+
+// remove removes the peer and adds a tombstone for the peers generation. If
+// the peer was up, a leave event is emitted since the peer was removed
+// without first being considered down.
+//
+// Note must hold mu.
+func (m *PeerMap) remove(peer *Peer) {
+	id := peer.ID()
+	delete(m.peers, id)
+
+	m.removed[id] = removedPeer{
+		Generation: peer.Generation(),
+		Expiry:     m.clock.Now().Add(m.reapTimeout),
+	}
+
+	// Remove any claim about the peer from the local state as it is no
+	// longer needed.
+	local := m.peers[m.localID]
+	if _, ok := local.Claim(id); ok {
+		local.DeleteLocal(claimKey(id))
+	}
+
+	if peer.Status().Up() {
+		m.emit(Event{
+			Type:        EventLeave,
+			ID:          id,
+			Addr:        peer.Addr(),
+			LeaveReason: LeaveReasonRemoved,
+		})
+	}
+
+	// The removed peers claims about other peers no longer apply.
+	for id := range m.peers {
+		m.refreshStatus(id)
+	}
+}
+
+// isRemoved returns whether the given generation of the peer with the given ID
+// has been removed.
+//
+// Note must hold mu.
+func (m *PeerMap) isRemoved(id string, generation uint64) bool {
+	removed, ok := m.removed[id]
+	return ok && generation <= removed.Generation
+}
+
+// applyRemoved handles a tombstone from another node for the removed peer with
+// the given ID, removing the peer if the tombstone applies to its
+// generation.
+//
+// Note must hold mu.
+func (m *PeerMap) applyRemoved(claimer *Peer, id string) {
+	entry, ok := claimer.Lookup(removedKey(id))
+	if !ok || entry.Deleted {
+		return
+	}
+	generation, err := strconv.ParseUint(entry.Value, 10, 64)
+	if err != nil {
+		m.logger.Warn(
+			"invalid removed peer generation",
+			zap.String("id", id),
+			zap.String("value", entry.Value),
+		)
+		return
+	}
+
+	if id == m.localID {
+		// The local node can't remove itself, though other nodes will
+		// discard its state until the tombstone expires.
+		m.logger.Warn(
+			"local peer removed by another node",
+			zap.String("claimer", claimer.ID()),
+			zap.Uint64("generation", generation),
+		)
+		return
+	}
+
+	if removed, ok := m.removed[id]; !ok || generation > removed.Generation {
+		m.removed[id] = removedPeer{
+			Generation: generation,
+			Expiry:     m.clock.Now().Add(m.reapTimeout),
+		}
+	}
+
+	peer, ok := m.peers[id]
+	if !ok || peer.Generation() > generation {
+		return
+	}
+	m.logger.Info(
+		"peer removed by another node",
+		zap.String("id", id),
+		zap.String("claimer", claimer.ID()),
+		zap.Uint64("generation", generation),
+	)
+	m.remove(peer)
+}
+
+// rejoin replaces the peer with the given ID with a new generation of
+// the peer, discarding all state from the old generation. addr is the peers
+// address used in the join event if the old generation was down, or empty to
+// use the address of the old generation.
+//
+// Note must hold mu.
+func (m *PeerMap) rejoin(id string, generation uint64, addr string) *Peer {
+	// The local peers generation can't change. If another node claims a newer
+	// generation it may be misconfigured with the same ID.
+	if id == m.localID {
+		m.logger.Warn(
+			"received newer generation of the local peer",
+			zap.Uint64("generation", generation),
+		)
+		return m.peers[id]
+	}
+
+	m.logger.Info(
+		"node rejoined",
+		zap.String("id", id),
+		zap.Uint64("generation", generation),
+	)
+
+	prev := m.peers[id]
+	if addr == "" {
+		addr = prev.Addr()
+	}
+
+	peer := NewPeer(id, generation)
+	m.peers[id] = peer
+
+	m.emit(Event{
+		Type: EventRejoin,
+		ID:   id,
+	})
+
+	// If the old generation was down, such as if it left before
+	// restarting, the peer has joined again.
+	if !prev.Status().Up() {
+		m.emit(Event{
+			Type:       EventStatusChange,
+			ID:         id,
+			Addr:       addr,
+			Status:     PeerStatusAlive,
+			PrevStatus: prev.Status(),
+		})
+		m.emit(Event{
+			Type: EventJoin,
+			ID:   id,
+			Addr: addr,
+		})
+	}
+
+	return peer
+}
+
+// applyInternal handles an update to one of the peers internal keys.
+//
+// Note must hold mu.
+func (m *PeerMap) applyInternal(peer *Peer, key string) {
+	switch {
+	case key == statusKey:
+		entry, ok := peer.Lookup(statusKey)
+		if !ok || entry.Value != statusLeft {
+			return
+		}
+		m.logger.Info("node left", zap.String("id", peer.ID()))
+		m.setStatus(peer, PeerStatusLeft)
+	case key == addrKey:
+		m.logger.Info(
+			"peer address updated",
+			zap.String("id", peer.ID()),
+			zap.String("addr", peer.Addr()),
+		)
+	case key == incarnationKey:
+		// The peer may have refuted claims about it.
+		m.refreshStatus(peer.ID())
+	case strings.HasPrefix(key, claimKeyPrefix):
+		id := strings.TrimPrefix(key, claimKeyPrefix)
+		if id == m.localID {
+			m.refute(peer)
+			return
+		}
+		m.refreshStatus(id)
+	case strings.HasPrefix(key, removedKeyPrefix):
+		m.applyRemoved(peer, strings.TrimPrefix(key, removedKeyPrefix))
+	}
+}
+
+// claim adds a claim with the given status about the peer with the given ID
+// to the local peers state.
+func (m *PeerMap) claim(id string, status PeerStatus) {
+	m.mu.Lock()
+	defer m.unlock()
+
+	// The local peer is always alive.
+	if id == m.localID {
+		return
+	}
+
+	peer, ok := m.peers[id]
+	if !ok {
+		return
+	}
+
+	claim := statusClaim{
+		Status:      status,
+		Generation:  peer.Generation(),
+		Incarnation: peer.Incarnation(),
+	}
+	m.logger.Debug(
+		"claim peer status",
+		zap.String("id", id),
+		zap.String("status", status.String()),
+		zap.Uint64("incarnation", claim.Incarnation),
+	)
+	m.peers[m.localID].UpdateLocal(claimKey(id), claim.encode())
+	m.refreshStatus(id)
+}
+
+// refute handles a claim by the given peer about the local node. If the claim
+// applies to the local nodes current incarnation, the incarnation is
+// incremented so the other nodes discard the claim.
+//
+// Note must hold mu.
+func (m *PeerMap) refute(claimer *Peer) {
+	local := m.peers[m.localID]
+
+	claim, ok := claimer.Claim(m.localID)
+	if !ok || claim.Generation != local.Generation() || claim.Incarnation < local.Incarnation() {
+		return
+	}
+
+	m.logger.Info(
+		"refuting claim",
+		zap.String("claimer", claimer.ID()),
+		zap.String("status", claim.Status.String()),
+		zap.Uint64("incarnation", claim.Incarnation),
+	)
+	local.UpdateLocal(incarnationKey, strconv.FormatUint(claim.Incarnation+1, 10))
+}
+
+// refreshStatus updates the status of the peer with the given ID from
+// the claims about the peer from all known nodes (including the local node).
+// Claims about an older generation or incarnation of the peer are ignored,
+// then the peer is dead if any node claims it is dead, suspect if any node
+// claims it is suspect, otherwise it is alive.
+//
+// Note must hold mu.
+func (m *PeerMap) refreshStatus(id string) {
+	// The local peer is always alive.
+	if id == m.localID {
+		return
+	}
+
+	peer, ok := m.peers[id]
+	if !ok {
+		return
+	}
+	// Peers that have left the cluster can't come back without restarting
+	// with a new generation.
+	if peer.Status() == PeerStatusLeft {
+		return
+	}
+
+	status := PeerStatusAlive
+	for _, claimer := range m.peers {
+		claim, ok := claimer.Claim(id)
+		if !ok {
+			continue
+		}
+		if claim.Generation != peer.Generation() || claim.Incarnation < peer.Incarnation() {
+			continue
+		}
+		if claim.Status == PeerStatusDead {
+			status = PeerStatusDead
+			break
+		}
+		status = PeerStatusSuspect
+	}
+	m.setStatus(peer, status)
+}
+
+// setStatus updates the status of the peer and emits events about the
+// transition.
+//
+// Note must hold mu.
+func (m *PeerMap) setStatus(peer *Peer, status PeerStatus) {
+	prev := peer.Status()
+	if prev == status {
+		return
+	}
+
+	m.logger.Info(
+		"peer status updated",
+		zap.String("id", peer.ID()),
+		zap.String("from", prev.String()),
+		zap.String("to", status.String()),
+	)
+
+	switch status {
+	case PeerStatusAlive:
+		peer.SetStatusAlive()
+	case PeerStatusSuspect:
+		peer.SetStatusSuspect()
+	case PeerStatusDead:
+		peer.SetStatusDead(m.clock.Now().Add(m.reapTimeout))
+	case PeerStatusLeft:
+		peer.SetStatusLeft(m.clock.Now().Add(m.reapTimeout))
+	}
+
+	m.emit(Event{
+		Type:       EventStatusChange,
+		ID:         peer.ID(),
+		Addr:       peer.Addr(),
+		Status:     status,
+		PrevStatus: prev,
+	})
+
+	switch {
+	case status == PeerStatusDead:
+		m.emit(Event{
+			Type:        EventLeave,
+			ID:          peer.ID(),
+			Addr:        peer.Addr(),
+			LeaveReason: LeaveReasonFailed,
+		})
+	case status == PeerStatusLeft && prev.Up():
+		m.emit(Event{
+			Type:        EventLeave,
+			ID:          peer.ID(),
+			Addr:        peer.Addr(),
+			LeaveReason: LeaveReasonLeft,
+		})
+	case status.Up() && !prev.Up():
+		m.emit(Event{
+			Type: EventJoin,
+			ID:   peer.ID(),
+			Addr: peer.Addr(),
+		})
+	}
+}
+
+// emit queues the event to be emitted once mu is released.
+//
+// Note must hold mu.
+func (m *PeerMap) emit(e Event) {
+	m.pending = append(m.pending, e)
+}
+
+// unlock releases mu then emits any pending events. Events are emitted without
+// holding mu so the handler may call back into the peer map.
+func (m *PeerMap) unlock() {
+	events := m.pending
+	m.pending = nil
+	m.mu.Unlock()
+
+	if m.onEvent == nil {
+		return
+	}
+	for _, e := range events {
+		m.onEvent(e)
+	}
+}
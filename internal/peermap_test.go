@@ -10,39 +10,40 @@ import (
 )
 
 func TestPeerMap_UpdateLocal(t *testing.T) {
-	pm := NewPeerMap("local:123", nil, nil, nil, zap.NewNop())
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
 
 	pm.UpdateLocal("foo", "bar")
 	e, ok := pm.Lookup("local:123", "foo")
 	assert.True(t, ok)
 	assert.Equal(t, "bar", e.Value)
-	assert.Equal(t, uint64(1), e.Version)
+	// Version 1 is the local address.
+	assert.Equal(t, uint64(2), e.Version)
 }
 
-func TestPeerMap_PeerAddrs(t *testing.T) {
-	pm := NewPeerMap("local:123", nil, nil, nil, zap.NewNop())
+func TestPeerMap_PeerIDs(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
 
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.11:8119",
+		ID:      "10.26.104.11:8119",
 		Version: 12,
 	})
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.12:8119",
+		ID:      "10.26.104.12:8119",
 		Version: 15,
 	})
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.13:8119",
+		ID:      "10.26.104.13:8119",
 		Version: 2,
 	})
 
 	// Add another peer but set its status to dead so it should not be included.
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.81:4431",
+		ID:      "10.26.104.81:4431",
 		Version: 6,
 	})
-	pm.SetStatusDown("10.26.104.81:4431", time.Now())
+	pm.Convict("10.26.104.81:4431")
 
-	allPeers := pm.Addrs(true)
+	allPeers := pm.IDs(true)
 	// Sort to make comparison easier.
 	sort.Strings(allPeers)
 	// Should include the local peer.
@@ -50,7 +51,7 @@ func TestPeerMap_PeerAddrs(t *testing.T) {
 		"10.26.104.11:8119", "10.26.104.12:8119", "10.26.104.13:8119", "local:123",
 	}, allPeers)
 
-	remotePeers := pm.Addrs(false)
+	remotePeers := pm.IDs(false)
 	// Sort to make comparison easier.
 	sort.Strings(remotePeers)
 	// Should not include the local peer.
@@ -61,27 +62,64 @@ func TestPeerMap_PeerAddrs(t *testing.T) {
 
 // Tests two random peer maps that exchange digests and deltas should have the
 // same peer state.
+// Tests the peers address is carried in its state, so may be unknown until
+// the peers state is received and may change.
+func TestPeerMap_Addr(t *testing.T) {
+	pm := NewPeerMap("local", "10.26.104.10:8119", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	addr, ok := pm.Addr("local")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.10:8119", addr)
+
+	pm.ApplyDigest(Digest{ID: "node-1", Version: 2})
+	_, ok = pm.Addr("node-1")
+	assert.False(t, ok)
+
+	pm.ApplyDelta(Delta{ID: "node-1", Key: addrKey, Value: "10.26.104.11:8119", Version: 1})
+	addr, ok = pm.Addr("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.11:8119", addr)
+	id, ok := pm.IDByAddr("10.26.104.11:8119")
+	assert.True(t, ok)
+	assert.Equal(t, "node-1", id)
+
+	pm.ApplyDelta(Delta{ID: "node-1", Key: addrKey, Value: "10.26.104.21:8119", Version: 2})
+	addr, ok = pm.Addr("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.21:8119", addr)
+	_, ok = pm.IDByAddr("10.26.104.11:8119")
+	assert.False(t, ok)
+
+	// Peers that only support protocol versions before 5 are identified by
+	// address.
+	pm.ApplyDigest(Digest{ID: "10.26.104.13:8119", Version: 1})
+	pm.ApplyDelta(Delta{ID: "10.26.104.13:8119", Key: protocolMaxKey, Value: "4", Version: 1})
+	addr, ok = pm.Addr("10.26.104.13:8119")
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.13:8119", addr)
+}
+
 func TestPeerMap_SyncState(t *testing.T) {
 	map1 := randomPeerMap(5, 3)
 	map2 := randomPeerMap(5, 3)
 
 	assert.False(t, map1.PeersEqual(map2))
 
-	for _, peerAddr := range map1.Addrs(true) {
+	for _, peerAddr := range map1.IDs(true) {
 		map2.ApplyDigest(map1.Digest(peerAddr))
 	}
-	for _, peerAddr := range map2.Addrs(true) {
+	for _, peerAddr := range map2.IDs(true) {
 		map1.ApplyDigest(map2.Digest(peerAddr))
 	}
 
-	for _, peerAddr := range map1.Addrs(true) {
+	for _, peerAddr := range map1.IDs(true) {
 		deltas := map1.Deltas(peerAddr, map2.Version(peerAddr))
 		for _, delta := range deltas {
 			map2.ApplyDelta(delta)
 		}
 	}
 
-	for _, peerAddr := range map2.Addrs(true) {
+	for _, peerAddr := range map2.IDs(true) {
 		deltas := map2.Deltas(peerAddr, map1.Version(peerAddr))
 		for _, delta := range deltas {
 			map1.ApplyDelta(delta)
@@ -93,50 +131,641 @@ func TestPeerMap_SyncState(t *testing.T) {
 
 func TestPeerMap_SetStatus(t *testing.T) {
 	left := []string{}
-	onLeave := func(addr string) {
-		left = append(left, addr)
-	}
-
 	joined := []string{}
-	onJoin := func(addr string) {
-		joined = append(joined, addr)
+	onEvent := func(e Event) {
+		switch e.Type {
+		case EventJoin:
+			joined = append(joined, e.ID)
+		case EventLeave:
+			assert.Equal(t, LeaveReasonFailed, e.LeaveReason)
+			left = append(left, e.ID)
+		}
 	}
 
-	pm := NewPeerMap("local:123", onJoin, onLeave, nil, zap.NewNop())
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
 
 	// Add a peer and check notified about it joining.
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.11:8119",
+		ID:      "10.26.104.11:8119",
 		Version: 12,
 	})
 	assert.Equal(t, []string{"10.26.104.11:8119"}, joined)
 
 	// Mark the peer as dead and check notified about it leaving.
-	pm.SetStatusDown("10.26.104.11:8119", time.Now())
+	pm.Convict("10.26.104.11:8119")
 	assert.Equal(t, []string{"10.26.104.11:8119"}, left)
 
 	// Mark the peer as alive and check notified about it re-joining.
-	pm.SetStatusUp("10.26.104.11:8119")
+	pm.ClearClaim("10.26.104.11:8119")
 	assert.Equal(t, []string{"10.26.104.11:8119", "10.26.104.11:8119"}, joined)
 }
 
+// Tests claims from other nodes about a peer update the peers status, and the
+// peer can refute the claims by incrementing its incarnation.
+func TestPeerMap_ApplyClaim(t *testing.T) {
+	events := []Event{}
+	onEvent := func(e Event) {
+		if e.Type != EventUpdate {
+			events = append(events, e)
+		}
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 1})
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:8119", Generation: 2})
+	events = events[:0]
+
+	// Claim the first peer is suspect.
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.12:8119",
+		Generation: 2,
+		Key:        claimKey("10.26.104.11:8119"),
+		Value:      statusClaim{Status: PeerStatusSuspect, Generation: 1}.encode(),
+		Version:    1,
+	})
+	status, ok := pm.Status("10.26.104.11:8119")
+	assert.True(t, ok)
+	assert.Equal(t, PeerStatusSuspect, status)
+	// Suspect peers are still considered up.
+	assert.Equal(t, []string{"10.26.104.11:8119", "10.26.104.12:8119"}, pm.IDs(false))
+
+	// Claim the first peer is dead.
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.12:8119",
+		Generation: 2,
+		Key:        claimKey("10.26.104.11:8119"),
+		Value:      statusClaim{Status: PeerStatusDead, Generation: 1}.encode(),
+		Version:    2,
+	})
+	status, _ = pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusDead, status)
+	assert.Equal(t, []string{"10.26.104.11:8119"}, pm.DownPeers())
+
+	// Refute the claim by incrementing the peers incarnation.
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        incarnationKey,
+		Value:      "1",
+		Version:    1,
+	})
+	status, _ = pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusAlive, status)
+
+	assert.Equal(t, []Event{
+		{Type: EventStatusChange, ID: "10.26.104.11:8119", Status: PeerStatusSuspect, PrevStatus: PeerStatusAlive},
+		{Type: EventStatusChange, ID: "10.26.104.11:8119", Status: PeerStatusDead, PrevStatus: PeerStatusSuspect},
+		{Type: EventLeave, ID: "10.26.104.11:8119", LeaveReason: LeaveReasonFailed},
+		{Type: EventStatusChange, ID: "10.26.104.11:8119", Status: PeerStatusAlive, PrevStatus: PeerStatusDead},
+		{Type: EventJoin, ID: "10.26.104.11:8119"},
+	}, events)
+}
+
+// Tests claims about an old generation of a peer are ignored.
+func TestPeerMap_ApplyClaimOldGeneration(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 2})
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:8119", Generation: 1})
+
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.12:8119",
+		Generation: 1,
+		Key:        claimKey("10.26.104.11:8119"),
+		Value:      statusClaim{Status: PeerStatusDead, Generation: 1}.encode(),
+		Version:    1,
+	})
+	status, _ := pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusAlive, status)
+}
+
+// Tests the local node refutes claims about itself.
+func TestPeerMap_RefuteClaim(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 5, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 1})
+
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        claimKey("local:123"),
+		Value:      statusClaim{Status: PeerStatusSuspect, Generation: 5}.encode(),
+		Version:    1,
+	})
+	e, ok := pm.Lookup("local:123", incarnationKey)
+	assert.True(t, ok)
+	assert.Equal(t, "1", e.Value)
+
+	// A claim about the previous incarnation is already refuted.
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        claimKey("local:123"),
+		Value:      statusClaim{Status: PeerStatusDead, Generation: 5}.encode(),
+		Version:    2,
+	})
+	e, _ = pm.Lookup("local:123", incarnationKey)
+	assert.Equal(t, "1", e.Value)
+
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        claimKey("local:123"),
+		Value:      statusClaim{Status: PeerStatusDead, Generation: 5, Incarnation: 1}.encode(),
+		Version:    3,
+	})
+	e, _ = pm.Lookup("local:123", incarnationKey)
+	assert.Equal(t, "2", e.Value)
+
+	// The local peer is always alive.
+	status, _ := pm.Status("local:123")
+	assert.Equal(t, PeerStatusAlive, status)
+}
+
+// Tests the local nodes claims are added to its state and cleared.
+func TestPeerMap_LocalClaim(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 1})
+
+	pm.Suspect("10.26.104.11:8119")
+	status, _ := pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusSuspect, status)
+	e, ok := pm.Lookup("local:123", claimKey("10.26.104.11:8119"))
+	assert.True(t, ok)
+	assert.Equal(t, "suspect:1:0", e.Value)
+
+	pm.Convict("10.26.104.11:8119")
+	status, _ = pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusDead, status)
+
+	pm.ClearClaim("10.26.104.11:8119")
+	status, _ = pm.Status("10.26.104.11:8119")
+	assert.Equal(t, PeerStatusAlive, status)
+	_, ok = pm.Lookup("local:123", claimKey("10.26.104.11:8119"))
+	assert.False(t, ok)
+}
+
 func TestPeerMap_RemoveExpiredPeers(t *testing.T) {
-	pm := NewPeerMap("local:123", nil, nil, nil, zap.NewNop())
+	clock := NewManualClock(time.Unix(0, 0))
+	pm := NewPeerMap("local:123", "local:123", 0, time.Minute*10, nil, clock, zap.NewNop())
 
-	// Add a down peer who has expired.
+	// Add a dead peer who has expired.
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.11:8119",
-		Version: 12,
+		ID:         "10.26.104.12:6823",
+		Generation: 3,
+		Version:    21,
 	})
-	pm.SetStatusDown("10.26.104.11:8119", time.Now().Add(time.Minute))
+	pm.Convict("10.26.104.12:6823")
 
-	// Add a down peer who has not expired.
+	clock.Advance(time.Minute * 9)
+
+	// Add a dead peer who has not expired.
 	pm.ApplyDigest(Digest{
-		Addr:    "10.26.104.12:6823",
-		Version: 21,
+		ID:      "10.26.104.11:8119",
+		Version: 12,
 	})
-	pm.SetStatusDown("10.26.104.12:6823", time.Now().Add(-time.Minute))
+	pm.Convict("10.26.104.11:8119")
+
+	clock.Advance(time.Minute * 2)
 
 	assert.Equal(t, []string{"10.26.104.12:6823"}, pm.RemoveExpiredPeers())
 	assert.Equal(t, []string{"10.26.104.11:8119"}, pm.DownPeers())
+
+	// The claim about the removed peer is replaced by a tombstone.
+	_, ok := pm.Lookup("local:123", claimKey("10.26.104.12:6823"))
+	assert.False(t, ok)
+	e, ok := pm.Lookup("local:123", removedKey("10.26.104.12:6823"))
+	assert.True(t, ok)
+	assert.Equal(t, "3", e.Value)
+	_, ok = pm.Lookup("local:123", claimKey("10.26.104.11:8119"))
+	assert.True(t, ok)
+
+	// The removed peer isn't added back by stale digests, though can rejoin
+	// with a new generation.
+	pm.ApplyDigest(Digest{
+		ID:         "10.26.104.12:6823",
+		Generation: 3,
+		Version:    21,
+	})
+	_, ok = pm.Status("10.26.104.12:6823")
+	assert.False(t, ok)
+
+	pm.ApplyDigest(Digest{
+		ID:         "10.26.104.12:6823",
+		Generation: 4,
+		Version:    2,
+	})
+	status, ok := pm.Status("10.26.104.12:6823")
+	assert.True(t, ok)
+	assert.Equal(t, PeerStatusAlive, status)
+}
+
+// Tests the tombstone of a removed peer is discarded once it expires.
+func TestPeerMap_RemoveExpiredTombstones(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	pm := NewPeerMap("local:123", "local:123", 0, time.Minute*10, nil, clock, zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:6823", Generation: 3})
+	assert.Nil(t, pm.ForceRemove("10.26.104.12:6823"))
+
+	clock.Advance(time.Minute * 11)
+	assert.Equal(t, []string{}, pm.RemoveExpiredPeers())
+
+	_, ok := pm.Lookup("local:123", removedKey("10.26.104.12:6823"))
+	assert.False(t, ok)
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:6823", Generation: 3})
+	_, ok = pm.Status("10.26.104.12:6823")
+	assert.True(t, ok)
+}
+
+// Tests a peer removed by another node is removed, and isn't added back.
+func TestPeerMap_ApplyRemoved(t *testing.T) {
+	left := []Event{}
+	onEvent := func(e Event) {
+		if e.Type == EventLeave {
+			left = append(left, e)
+		}
+	}
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 1})
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:8119", Generation: 3})
+
+	applied, _ := pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        removedKey("10.26.104.12:8119"),
+		Value:      "3",
+		Version:    1,
+	})
+	assert.True(t, applied)
+
+	_, ok := pm.Status("10.26.104.12:8119")
+	assert.False(t, ok)
+	assert.Equal(t, []Event{{
+		Type:        EventLeave,
+		ID:          "10.26.104.12:8119",
+		LeaveReason: LeaveReasonRemoved,
+	}}, left)
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:8119", Generation: 3})
+	_, ok = pm.Status("10.26.104.12:8119")
+	assert.False(t, ok)
+
+	// Tombstones about the local peer are ignored.
+	applied, _ = pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        removedKey("local:123"),
+		Value:      "0",
+		Version:    2,
+	})
+	assert.True(t, applied)
+	_, ok = pm.Status("local:123")
+	assert.True(t, ok)
+}
+
+func TestPeerMap_ForceRemove(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119", Generation: 2})
+	assert.Nil(t, pm.ForceRemove("10.26.104.11:8119"))
+
+	_, ok := pm.Status("10.26.104.11:8119")
+	assert.False(t, ok)
+	e, ok := pm.Lookup("local:123", removedKey("10.26.104.11:8119"))
+	assert.True(t, ok)
+	assert.Equal(t, "2", e.Value)
+
+	assert.Equal(t, ErrUnknownPeer, pm.ForceRemove("10.26.104.11:8119"))
+	assert.NotNil(t, pm.ForceRemove("local:123"))
+}
+
+func TestPeerMap_DeleteRemote(t *testing.T) {
+	deleted := []string{}
+	onEvent := func(e Event) {
+		if e.Type == EventDelete {
+			deleted = append(deleted, e.Key)
+		}
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.11:8119",
+		Version: 12,
+	})
+	pm.ApplyDelta(Delta{
+		ID:      "10.26.104.11:8119",
+		Key:     "foo",
+		Value:   "bar",
+		Version: 5,
+	})
+	pm.ApplyDelta(Delta{
+		ID:      "10.26.104.11:8119",
+		Key:     "foo",
+		Version: 12,
+		Deleted: true,
+	})
+
+	_, ok := pm.Lookup("10.26.104.11:8119", "foo")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"foo"}, deleted)
+}
+
+// Tests tombstones are only removed once all known peers have reported a
+// version including the tombstone.
+func TestPeerMap_RemoveConvergedTombstones(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.UpdateLocal("foo", "bar")
+	pm.DeleteLocal("foo")
+
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.11:8119",
+		Version: 0,
+	})
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.12:8119",
+		Version: 0,
+	})
+
+	// Only one peer has seen the delete so the tombstone must be kept. Note
+	// version 1 is the local address.
+	pm.UpdateKnownVersion("10.26.104.11:8119", Digest{
+		ID:      "local:123",
+		Version: 3,
+	})
+	pm.UpdateKnownVersion("10.26.104.12:8119", Digest{
+		ID:      "local:123",
+		Version: 2,
+	})
+	pm.RemoveConvergedTombstones()
+	assert.Equal(t, 2, len(pm.Deltas("local:123", 0)))
+
+	pm.UpdateKnownVersion("10.26.104.12:8119", Digest{
+		ID:      "local:123",
+		Version: 3,
+	})
+	pm.RemoveConvergedTombstones()
+	assert.Equal(t, 1, len(pm.Deltas("local:123", 0)))
+	assert.Equal(t, uint64(3), pm.Version("local:123"))
+}
+
+// Tests a digest with a newer generation discards the stale peer state and
+// notifies about the peer rejoining.
+func TestPeerMap_ApplyDigestNewGeneration(t *testing.T) {
+	rejoined := []string{}
+	onEvent := func(e Event) {
+		if e.Type == EventRejoin {
+			rejoined = append(rejoined, e.ID)
+		}
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Version:    12,
+	})
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        "foo",
+		Value:      "bar",
+		Version:    12,
+	})
+
+	// Digests with an old generation should be ignored.
+	pm.ApplyDigest(Digest{
+		ID:         "10.26.104.11:8119",
+		Generation: 0,
+		Version:    2,
+	})
+	assert.Equal(t, Digest{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Version:    12,
+	}, pm.Digest("10.26.104.11:8119"))
+	assert.Equal(t, []string{}, rejoined)
+
+	pm.ApplyDigest(Digest{
+		ID:         "10.26.104.11:8119",
+		Generation: 2,
+		Version:    3,
+	})
+	assert.Equal(t, Digest{
+		ID:         "10.26.104.11:8119",
+		Generation: 2,
+		Version:    0,
+	}, pm.Digest("10.26.104.11:8119"))
+	_, ok := pm.Lookup("10.26.104.11:8119", "foo")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"10.26.104.11:8119"}, rejoined)
+
+	// Deltas from the old generation should be discarded.
+	pm.ApplyDelta(Delta{
+		ID:         "10.26.104.11:8119",
+		Generation: 1,
+		Key:        "foo",
+		Value:      "bar",
+		Version:    14,
+	})
+	_, ok = pm.Lookup("10.26.104.11:8119", "foo")
+	assert.False(t, ok)
+}
+
+// Tests when a peer leaves the cluster it is notified about leaving with
+// LeaveReasonLeft and is no longer considered up.
+func TestPeerMap_ApplyLeave(t *testing.T) {
+	left := []LeaveReason{}
+	updated := []string{}
+	onEvent := func(e Event) {
+		switch e.Type {
+		case EventLeave:
+			left = append(left, e.LeaveReason)
+		case EventUpdate:
+			updated = append(updated, e.Key)
+		}
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.11:8119",
+		Version: 12,
+	})
+	pm.ApplyDelta(Delta{
+		ID:      "10.26.104.11:8119",
+		Key:     statusKey,
+		Value:   statusLeft,
+		Version: 12,
+	})
+
+	assert.Equal(t, []LeaveReason{LeaveReasonLeft}, left)
+	// Internal keys should not be notified as updates.
+	assert.Equal(t, []string{}, updated)
+	assert.Equal(t, []string{}, pm.IDs(false))
+
+	// Once the peer has left it can't be marked as up or down.
+	pm.Convict("10.26.104.11:8119")
+	pm.ClearClaim("10.26.104.11:8119")
+	assert.Equal(t, []LeaveReason{LeaveReasonLeft}, left)
+	assert.Equal(t, []string{}, pm.IDs(false))
+}
+
+// Tests when a peer that left restarts with a newer generation it is notified
+// about joining again and is considered up.
+func TestPeerMap_RejoinAfterLeave(t *testing.T) {
+	events := []Event{}
+	onEvent := func(e Event) {
+		events = append(events, e)
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:         "node-1",
+		Addr:       "10.26.104.11:8119",
+		Generation: 1,
+		Version:    12,
+	})
+	pm.ApplyDelta(Delta{
+		ID:         "node-1",
+		Generation: 1,
+		Key:        statusKey,
+		Value:      statusLeft,
+		Version:    12,
+	})
+	assert.Equal(t, []string{}, pm.IDs(false))
+
+	events = []Event{}
+	assert.True(t, pm.ApplyDigest(Digest{
+		ID:         "node-1",
+		Addr:       "10.26.104.12:8119",
+		Generation: 2,
+		Version:    3,
+	}))
+	assert.Equal(t, []Event{
+		{Type: EventRejoin, ID: "node-1"},
+		{
+			Type:       EventStatusChange,
+			ID:         "node-1",
+			Addr:       "10.26.104.12:8119",
+			Status:     PeerStatusAlive,
+			PrevStatus: PeerStatusLeft,
+		},
+		{Type: EventJoin, ID: "node-1", Addr: "10.26.104.12:8119"},
+	}, events)
+
+	status, ok := pm.Status("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, PeerStatusAlive, status)
+	assert.Equal(t, []string{"node-1"}, pm.IDs(false))
+
+	// Rejoining when the old generation was up only notifies about the
+	// rejoin.
+	events = []Event{}
+	_, rejoined := pm.ApplyDelta(Delta{
+		ID:         "node-1",
+		Generation: 3,
+		Key:        "foo",
+		Value:      "bar",
+		Version:    1,
+	})
+	assert.True(t, rejoined)
+	assert.Equal(t, EventRejoin, events[0].Type)
+	for _, e := range events {
+		assert.NotEqual(t, EventJoin, e.Type)
+	}
+}
+
+func TestPeerMap_Heartbeat(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.Heartbeat()
+	pm.Heartbeat()
+
+	e, ok := pm.Lookup("local:123", heartbeatKey)
+	assert.True(t, ok)
+	assert.Equal(t, "2", e.Value)
+	// Version 1 is the local address.
+	assert.Equal(t, uint64(3), pm.Version("local:123"))
+}
+
+func TestPeerMap_LocalVersionAcks(t *testing.T) {
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, nil, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{ID: "10.26.104.11:8119"})
+	pm.ApplyDigest(Digest{ID: "10.26.104.12:8119"})
+
+	version := pm.Leave()
+
+	pm.UpdateKnownVersion("10.26.104.11:8119", Digest{
+		ID:      "local:123",
+		Version: version,
+	})
+
+	acked, unacked := pm.LocalVersionAcks(version)
+	assert.Equal(t, []string{"10.26.104.11:8119"}, acked)
+	assert.Equal(t, []string{"10.26.104.12:8119"}, unacked)
+}
+
+// Tests events are emitted without holding the lock so the handler can call
+// back into the peer map.
+func TestPeerMap_EventHandlerCallsPeerMap(t *testing.T) {
+	var pm *PeerMap
+	statuses := []bool{}
+	onEvent := func(e Event) {
+		_, ok := pm.Lookup(e.ID, "foo")
+		statuses = append(statuses, ok)
+	}
+
+	pm = NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.11:8119",
+		Version: 12,
+	})
+	pm.ApplyDelta(Delta{
+		ID:      "10.26.104.11:8119",
+		Key:     "foo",
+		Value:   "bar",
+		Version: 12,
+	})
+	pm.Convict("10.26.104.11:8119")
+	pm.ClearClaim("10.26.104.11:8119")
+
+	assert.Equal(t, []bool{false, true, true, true, true, true}, statuses)
+}
+
+// Tests receiving the same delta multiple times only notifies once.
+func TestPeerMap_ApplyDuplicateDelta(t *testing.T) {
+	updated := []string{}
+	onEvent := func(e Event) {
+		if e.Type == EventUpdate {
+			updated = append(updated, e.Value)
+		}
+	}
+
+	pm := NewPeerMap("local:123", "local:123", 0, time.Hour, onEvent, NewRealClock(), zap.NewNop())
+
+	pm.ApplyDigest(Digest{
+		ID:      "10.26.104.11:8119",
+		Version: 12,
+	})
+	delta := Delta{
+		ID:      "10.26.104.11:8119",
+		Key:     "foo",
+		Value:   "bar",
+		Version: 12,
+	}
+	pm.ApplyDelta(delta)
+	pm.ApplyDelta(delta)
+
+	assert.Equal(t, []string{"bar"}, updated)
 }
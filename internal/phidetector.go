@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type phiAccrualPeer struct {
+	lastTimestamp time.Time
+	intervals     *ArrivalIntervals
+}
+
+// PhiAccrualDetector is a phi accrual failure detector that assumes the
+// intervals between heartbeats follow a normal distribution, as described in
+// "The Phi Accrual Failure Detector" and implemented by Akka.
+type PhiAccrualDetector struct {
+	threshold                float64
+	maxSampleSize            int
+	minStdDeviation          time.Duration
+	acceptableHeartbeatPause time.Duration
+	firstHeartbeatEstimate   time.Duration
+
+	peers map[string]*phiAccrualPeer
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+// NewPhiAccrualDetector returns a phi accrual failure detector.
+//
+// threshold is the value of phi at which a peer is considered down.
+// maxSampleSize is the number of intervals between heartbeats used to
+// calculate the mean and standard deviation. minStdDeviation is the minimum
+// standard deviation used, since a very low standard deviation (such as with
+// very regular heartbeats) would make the detector too sensitive.
+// acceptableHeartbeatPause is the duration of missing heartbeats that is
+// tolerated, such as due to garbage collection pauses. firstHeartbeatEstimate
+// is the expected interval before any heartbeats are received.
+func NewPhiAccrualDetector(
+	threshold float64,
+	maxSampleSize int,
+	minStdDeviation time.Duration,
+	acceptableHeartbeatPause time.Duration,
+	firstHeartbeatEstimate time.Duration,
+) *PhiAccrualDetector {
+	return &PhiAccrualDetector{
+		threshold:                threshold,
+		maxSampleSize:            maxSampleSize,
+		minStdDeviation:          minStdDeviation,
+		acceptableHeartbeatPause: acceptableHeartbeatPause,
+		firstHeartbeatEstimate:   firstHeartbeatEstimate,
+		peers:                    make(map[string]*phiAccrualPeer),
+	}
+}
+
+func (d *PhiAccrualDetector) Report(id string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peer, ok := d.peers[id]
+	if !ok {
+		d.peers[id] = d.newPeer(now)
+		return
+	}
+
+	if now.After(peer.lastTimestamp) {
+		peer.intervals.Add(uint64(now.Sub(peer.lastTimestamp)))
+		peer.lastTimestamp = now
+	}
+}
+
+// Suspicion returns the phi of the peer.
+func (d *PhiAccrualDetector) Suspicion(id string, now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peer, ok := d.peers[id]
+	if !ok {
+		// If we have never received any heartbeats from the node, start by
+		// assuming it is alive so we can eventually detect the node as down
+		// if we never receive any heartbeats.
+		peer = d.newPeer(now)
+		d.peers[id] = peer
+	}
+
+	stdDeviation := peer.intervals.StdDeviation()
+	if stdDeviation < float64(d.minStdDeviation) {
+		stdDeviation = float64(d.minStdDeviation)
+	}
+	return normalPhi(
+		float64(now.Sub(peer.lastTimestamp)),
+		peer.intervals.Mean()+float64(d.acceptableHeartbeatPause),
+		stdDeviation,
+	)
+}
+
+func (d *PhiAccrualDetector) Available(id string, now time.Time) bool {
+	return d.Suspicion(id, now) < d.threshold
+}
+
+func (d *PhiAccrualDetector) Remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.peers, id)
+}
+
+// newPeer returns the state of a peer first heard from at the given time.
+// Like Akka, the intervals start with two samples around the first heartbeat
+// estimate, so the detector can be used before any heartbeats arrive.
+func (d *PhiAccrualDetector) newPeer(now time.Time) *phiAccrualPeer {
+	intervals := NewArrivalIntervals(d.maxSampleSize)
+	stdDeviation := d.firstHeartbeatEstimate / 4
+	intervals.Add(uint64(d.firstHeartbeatEstimate - stdDeviation))
+	intervals.Add(uint64(d.firstHeartbeatEstimate + stdDeviation))
+	return &phiAccrualPeer{
+		lastTimestamp: now,
+		intervals:     intervals,
+	}
+}
+
+// normalPhi returns phi for the time since the last heartbeat, given the mean
+// and standard deviation of the intervals between heartbeats. This uses a
+// logistic approximation of the cumulative normal distribution.
+func normalPhi(timeDiff float64, mean float64, stdDeviation float64) float64 {
+	y := (timeDiff - mean) / stdDeviation
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if timeDiff > mean {
+		return -math.Log10(e / (1.0 + e))
+	}
+	return -math.Log10(1.0 - 1.0/(1.0+e))
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhiAccrualDetector(t *testing.T) {
+	tests := []struct {
+		Name                     string
+		Available                bool
+		Intervals                []time.Duration
+		Elapsed                  time.Duration
+		AcceptableHeartbeatPause time.Duration
+	}{
+		{
+			Name:      "bootstrap status",
+			Available: true,
+			Elapsed:   time.Second,
+		},
+		{
+			Name:      "bootstrap peer down",
+			Available: false,
+			Elapsed:   time.Second * 5,
+		},
+		{
+			Name:      "peer up",
+			Available: true,
+			Intervals: []time.Duration{
+				time.Second, time.Second, time.Second, time.Second,
+			},
+			Elapsed: time.Second,
+		},
+		{
+			Name:      "peer down",
+			Available: false,
+			Intervals: []time.Duration{
+				time.Second, time.Second, time.Second, time.Second,
+			},
+			Elapsed: time.Second * 3,
+		},
+		{
+			Name:      "acceptable pause",
+			Available: true,
+			Intervals: []time.Duration{
+				time.Second, time.Second, time.Second, time.Second,
+			},
+			Elapsed:                  time.Second * 3,
+			AcceptableHeartbeatPause: time.Second * 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			fd := NewPhiAccrualDetector(
+				8.0, 10, time.Millisecond*100, test.AcceptableHeartbeatPause, time.Second,
+			)
+
+			now := time.Unix(1000, 0)
+			fd.Report("my-endpoint", now)
+			for _, interval := range test.Intervals {
+				now = now.Add(interval)
+				fd.Report("my-endpoint", now)
+			}
+
+			assert.Equal(
+				t,
+				test.Available,
+				fd.Available("my-endpoint", now.Add(test.Elapsed)),
+			)
+		})
+	}
+}
+
+func TestPhiAccrualDetector_SuspicionIncreases(t *testing.T) {
+	fd := NewPhiAccrualDetector(8.0, 10, time.Millisecond*100, 0, time.Second)
+
+	now := time.Unix(1000, 0)
+	fd.Report("my-endpoint", now)
+
+	prev := fd.Suspicion("my-endpoint", now)
+	for i := 1; i != 20; i++ {
+		phi := fd.Suspicion("my-endpoint", now.Add(time.Duration(i)*time.Millisecond*100))
+		assert.Greater(t, phi, prev)
+		prev = phi
+	}
+}
+
+func TestNormalPhi(t *testing.T) {
+	// At the mean the probability of a later heartbeat is 0.5.
+	assert.InEpsilon(t, 0.301, normalPhi(1000, 1000, 100), 0.01)
+	// At 3 standard deviations above the mean the probability is around
+	// 0.00135.
+	assert.InEpsilon(t, 2.87, normalPhi(1300, 1000, 100), 0.02)
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type probe struct {
+	// Target is the ID of the suspected peer.
+	Target string
+	Expiry time.Time
+}
+
+// relay is a ping sent on behalf of another peer, whose ack must be relayed
+// back to the requester.
+type relay struct {
+	// ID is the ID of the peer that requested the ping.
+	ID string
+	// Addr is the address of the peer that requested the ping.
+	Addr string
+	// Seq is the sequence number of the requesters ping-req, which is used
+	// for the relayed ack.
+	Seq    uint64
+	Expiry time.Time
+}
+
+// prober tracks the outstanding probes of suspected peers, and the pings sent
+// on behalf of other peers probing their own suspected peers.
+//
+// Probes and relays share a sequence number space so an ack identifies which
+// is being acknowledged.
+//
+// Note this is thread safe.
+type prober struct {
+	nextSeq uint64
+	// probes contains the outstanding probes indexed by sequence number.
+	probes map[uint64]probe
+	// suspects contains the sequence number of the probe of each suspected
+	// peer indexed by ID.
+	suspects map[string]uint64
+	// relays contains the outstanding relays indexed by sequence number.
+	relays map[uint64]relay
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+func newProber() *prober {
+	return &prober{
+		probes:   make(map[uint64]probe),
+		suspects: make(map[string]uint64),
+		relays:   make(map[uint64]relay),
+	}
+}
+
+// Start starts probing the target, which expires at the given time unless
+// acknowledged. Returns the sequence number of the probe and true, or false if
+// the target is already being probed.
+func (p *prober) Start(target string, expiry time.Time) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.suspects[target]; ok {
+		return 0, false
+	}
+
+	p.nextSeq++
+	seq := p.nextSeq
+	p.probes[seq] = probe{Target: target, Expiry: expiry}
+	p.suspects[target] = seq
+	return seq, true
+}
+
+// Cancel stops probing the target, such as if the target has since been heard
+// from.
+func (p *prober) Cancel(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seq, ok := p.suspects[target]
+	if !ok {
+		return
+	}
+	delete(p.probes, seq)
+	delete(p.suspects, target)
+}
+
+// AckProbe completes the probe with the given sequence number. Returns the
+// target of the probe, or false if there is no outstanding probe with the
+// sequence number.
+func (p *prober) AckProbe(seq uint64) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	probe, ok := p.probes[seq]
+	if !ok {
+		return "", false
+	}
+	delete(p.probes, seq)
+	delete(p.suspects, probe.Target)
+	return probe.Target, true
+}
+
+// AddRelay adds a ping sent on behalf of the requester, which expires at the
+// given time unless acknowledged. Returns the sequence number to use for the
+// ping.
+func (p *prober) AddRelay(requesterID string, requesterAddr string, requesterSeq uint64, expiry time.Time) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextSeq++
+	seq := p.nextSeq
+	p.relays[seq] = relay{
+		ID:     requesterID,
+		Addr:   requesterAddr,
+		Seq:    requesterSeq,
+		Expiry: expiry,
+	}
+	return seq
+}
+
+// AckRelay completes the relay with the given sequence number. Returns the
+// relay so the ack can be sent to the requester, or false if there is no
+// outstanding relay with the sequence number.
+func (p *prober) AckRelay(seq uint64) (relay, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.relays[seq]
+	if !ok {
+		return relay{}, false
+	}
+	delete(p.relays, seq)
+	return r, true
+}
+
+// Expired removes all probes and relays that have expired. Returns the sorted
+// targets of the expired probes.
+func (p *prober) Expired(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expired := []string{}
+	for seq, probe := range p.probes {
+		if now.After(probe.Expiry) {
+			expired = append(expired, probe.Target)
+			delete(p.probes, seq)
+			delete(p.suspects, probe.Target)
+		}
+	}
+	for seq, r := range p.relays {
+		if now.After(r.Expiry) {
+			delete(p.relays, seq)
+		}
+	}
+
+	sort.Strings(expired)
+	return expired
+}
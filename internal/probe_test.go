@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProber_AckProbe(t *testing.T) {
+	p := newProber()
+	now := time.Now()
+
+	seq, ok := p.Start("10.26.104.11:8119", now.Add(time.Second))
+	assert.True(t, ok)
+
+	// Only a single probe of each target is outstanding.
+	_, ok = p.Start("10.26.104.11:8119", now.Add(time.Second))
+	assert.False(t, ok)
+
+	target, ok := p.AckProbe(seq)
+	assert.True(t, ok)
+	assert.Equal(t, "10.26.104.11:8119", target)
+
+	// Duplicate acks are ignored.
+	_, ok = p.AckProbe(seq)
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{}, p.Expired(now.Add(time.Minute)))
+}
+
+func TestProber_Cancel(t *testing.T) {
+	p := newProber()
+	now := time.Now()
+
+	seq, ok := p.Start("10.26.104.11:8119", now.Add(time.Second))
+	assert.True(t, ok)
+	p.Cancel("10.26.104.11:8119")
+
+	_, ok = p.AckProbe(seq)
+	assert.False(t, ok)
+	assert.Equal(t, []string{}, p.Expired(now.Add(time.Minute)))
+
+	// Once cancelled the target can be probed again.
+	_, ok = p.Start("10.26.104.11:8119", now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func TestProber_Expired(t *testing.T) {
+	p := newProber()
+	now := time.Now()
+
+	p.Start("10.26.104.13:8119", now.Add(time.Second))
+	p.Start("10.26.104.12:8119", now.Add(time.Second))
+	p.Start("10.26.104.11:8119", now.Add(time.Minute))
+
+	assert.Equal(t, []string{}, p.Expired(now))
+	assert.Equal(t, []string{"10.26.104.12:8119", "10.26.104.13:8119"}, p.Expired(now.Add(time.Second*2)))
+	// Expired probes are removed.
+	assert.Equal(t, []string{}, p.Expired(now.Add(time.Second*2)))
+}
+
+func TestProber_Relay(t *testing.T) {
+	p := newProber()
+	now := time.Now()
+
+	probeSeq, ok := p.Start("10.26.104.11:8119", now.Add(time.Second))
+	assert.True(t, ok)
+	relaySeq := p.AddRelay("node-c", "10.26.104.12:8119", 5, now.Add(time.Second))
+	// Probes and relays share sequence numbers so acks are unambiguous.
+	assert.NotEqual(t, probeSeq, relaySeq)
+
+	_, ok = p.AckRelay(probeSeq)
+	assert.False(t, ok)
+
+	r, ok := p.AckRelay(relaySeq)
+	assert.True(t, ok)
+	assert.Equal(t, "node-c", r.ID)
+	assert.Equal(t, "10.26.104.12:8119", r.Addr)
+	assert.Equal(t, uint64(5), r.Seq)
+
+	_, ok = p.AckRelay(relaySeq)
+	assert.False(t, ok)
+
+	// Expired relays are removed.
+	relaySeq = p.AddRelay("node-c", "10.26.104.12:8119", 6, now.Add(time.Second))
+	p.Expired(now.Add(time.Minute))
+	_, ok = p.AckRelay(relaySeq)
+	assert.False(t, ok)
+}
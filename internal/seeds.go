@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// SeedProvider returns the addresses of the seed nodes used to join the
+// cluster. The provider is called each time the node re-seeds, so the seeds
+// may change over time.
+//
+// Note implementations must be thread safe.
+type SeedProvider interface {
+	// Seeds returns the seed addresses. If only some seeds could be found,
+	// such as when composing providers and one fails, the seeds that were
+	// found are returned along with the error.
+	Seeds(ctx context.Context) ([]string, error)
+}
+
+// SeedFunc adapts a function to a SeedProvider.
+type SeedFunc func(ctx context.Context) ([]string, error)
+
+func (f SeedFunc) Seeds(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// Resolver resolves the DNS records used to discover seeds. *net.Resolver
+// implements Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// StaticSeeds is a SeedProvider that returns a fixed list of seeds.
+type StaticSeeds struct {
+	addrs []string
+}
+
+// NewStaticSeeds returns a provider that returns the given seed addresses.
+func NewStaticSeeds(addrs ...string) *StaticSeeds {
+	return &StaticSeeds{
+		addrs: addrs,
+	}
+}
+
+func (s *StaticSeeds) Seeds(ctx context.Context) ([]string, error) {
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	return addrs, nil
+}
+
+// DNSSeeds is a SeedProvider that discovers seeds by resolving the A and AAAA
+// records of a hostname, using a default port for each address.
+type DNSSeeds struct {
+	host     string
+	port     int
+	resolver Resolver
+}
+
+// NewDNSSeeds returns a provider that resolves the A and AAAA records of host,
+// where each resolved IP is a seed with the given port. If resolver is nil
+// the default resolver is used.
+func NewDNSSeeds(host string, port int, resolver Resolver) *DNSSeeds {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSSeeds{
+		host:     host,
+		port:     port,
+		resolver: resolver,
+	}
+}
+
+func (s *DNSSeeds) Seeds(ctx context.Context) ([]string, error) {
+	ips, err := s.resolver.LookupIPAddr(ctx, s.host)
+	if err != nil {
+		return nil, fmt.Errorf("dns seeds: %s: %w", s.host, err)
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ipAddrPort(ip, s.port))
+	}
+	return addrs, nil
+}
+
+// SRVSeeds is a SeedProvider that discovers seeds by resolving SRV records,
+// where each record gives the host and port of a seed. The host of each
+// record is resolved to its IP addresses.
+type SRVSeeds struct {
+	service  string
+	proto    string
+	name     string
+	resolver Resolver
+}
+
+// NewSRVSeeds returns a provider that resolves the SRV records of
+// _service._proto.name, as in net.LookupSRV. If service and proto are empty
+// name is looked up directly. If resolver is nil the default resolver is used.
+func NewSRVSeeds(service string, proto string, name string, resolver Resolver) *SRVSeeds {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &SRVSeeds{
+		service:  service,
+		proto:    proto,
+		name:     name,
+		resolver: resolver,
+	}
+}
+
+func (s *SRVSeeds) Seeds(ctx context.Context) ([]string, error) {
+	_, records, err := s.resolver.LookupSRV(ctx, s.service, s.proto, s.name)
+	if err != nil {
+		return nil, fmt.Errorf("srv seeds: %s: %w", s.name, err)
+	}
+
+	addrs := []string{}
+	var errs error
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// Avoid a lookup if the target is already an IP.
+		if ip := net.ParseIP(target); ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(record.Port))))
+			continue
+		}
+
+		ips, err := s.resolver.LookupIPAddr(ctx, target)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("srv seeds: %s: %w", target, err))
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ipAddrPort(ip, int(record.Port)))
+		}
+	}
+	return addrs, errs
+}
+
+// MergedSeeds is a SeedProvider that combines the seeds of multiple
+// providers, removing duplicates.
+type MergedSeeds struct {
+	providers []SeedProvider
+}
+
+// NewMergedSeeds returns a provider that combines the seeds of the given
+// providers.
+func NewMergedSeeds(providers ...SeedProvider) *MergedSeeds {
+	return &MergedSeeds{
+		providers: providers,
+	}
+}
+
+// Seeds returns the seeds of each provider in order, with duplicates removed.
+// If any providers fail, the seeds from the other providers are returned along
+// with the errors.
+func (s *MergedSeeds) Seeds(ctx context.Context) ([]string, error) {
+	addrs := []string{}
+	seen := make(map[string]struct{})
+	var errs error
+	for _, provider := range s.providers {
+		seeds, err := provider.Seeds(ctx)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		for _, addr := range seeds {
+			addr = normalizeAddr(addr)
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, errs
+}
+
+// Close closes any of the providers that implement io.Closer.
+func (s *MergedSeeds) Close() error {
+	var errs error
+	for _, provider := range s.providers {
+		if closer, ok := provider.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// normalizeAddr returns the address with its host formatted in canonical form
+// if it is an IP, so the same address formatted differently (such as
+// [::1]:8229 and [0:0::1]:8229) is detected as a duplicate.
+func normalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func ipAddrPort(ip net.IPAddr, port int) string {
+	host := ip.IP.String()
+	if ip.Zone != "" {
+		host += "%" + ip.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
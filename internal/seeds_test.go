@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	srv map[string][]*net.SRV
+	ips map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := "_" + service + "._" + proto + "." + name
+	if service == "" && proto == "" {
+		cname = name
+	}
+	records, ok := r.srv[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestStaticSeeds(t *testing.T) {
+	provider := NewStaticSeeds("10.26.104.52:8229", "10.26.104.53:8229")
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "10.26.104.53:8229"}, seeds)
+
+	// Modifying the returned seeds must not modify the provider.
+	seeds[0] = "10.26.104.54:8229"
+	seeds, err = provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "10.26.104.53:8229"}, seeds)
+}
+
+func TestDNSSeeds(t *testing.T) {
+	resolver := &fakeResolver{
+		ips: map[string][]net.IPAddr{
+			"seeds.cluster.local": {
+				{IP: net.ParseIP("10.26.104.52")},
+				{IP: net.ParseIP("fd00::1")},
+			},
+		},
+	}
+
+	provider := NewDNSSeeds("seeds.cluster.local", 8229, resolver)
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "[fd00::1]:8229"}, seeds)
+
+	provider = NewDNSSeeds("unknown.cluster.local", 8229, resolver)
+	_, err = provider.Seeds(context.Background())
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr))
+}
+
+func TestSRVSeeds(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_gossip._udp.cluster.local": {
+				{Target: "node-1.cluster.local.", Port: 8229},
+				{Target: "node-2.cluster.local.", Port: 8230},
+				{Target: "10.26.104.54", Port: 8231},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"node-1.cluster.local": {{IP: net.ParseIP("10.26.104.52")}},
+			"node-2.cluster.local": {{IP: net.ParseIP("fd00::2")}},
+		},
+	}
+
+	provider := NewSRVSeeds("gossip", "udp", "cluster.local", resolver)
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.52:8229", "[fd00::2]:8230", "10.26.104.54:8231"}, seeds)
+}
+
+// Tests if a SRV target can't be resolved the other targets are still
+// returned.
+func TestSRVSeeds_UnresolvedTarget(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_gossip._udp.cluster.local": {
+				{Target: "node-1.cluster.local.", Port: 8229},
+				{Target: "node-2.cluster.local.", Port: 8229},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"node-2.cluster.local": {{IP: net.ParseIP("10.26.104.53")}},
+		},
+	}
+
+	provider := NewSRVSeeds("gossip", "udp", "cluster.local", resolver)
+	seeds, err := provider.Seeds(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"10.26.104.53:8229"}, seeds)
+}
+
+func TestMergedSeeds(t *testing.T) {
+	resolver := &fakeResolver{
+		ips: map[string][]net.IPAddr{
+			"seeds.cluster.local": {
+				{IP: net.ParseIP("10.26.104.52")},
+				{IP: net.ParseIP("fd00::1")},
+			},
+		},
+	}
+
+	provider := NewMergedSeeds(
+		NewStaticSeeds("10.26.104.53:8229", "[fd00:0::1]:8229"),
+		NewDNSSeeds("seeds.cluster.local", 8229, resolver),
+		NewStaticSeeds("10.26.104.53:8229"),
+	)
+	seeds, err := provider.Seeds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.26.104.53:8229", "[fd00::1]:8229", "10.26.104.52:8229"}, seeds)
+}
+
+// Tests if a provider fails the seeds of the other providers are still
+// returned.
+func TestMergedSeeds_ProviderFails(t *testing.T) {
+	provider := NewMergedSeeds(
+		NewDNSSeeds("seeds.cluster.local", 8229, &fakeResolver{}),
+		NewStaticSeeds("10.26.104.53:8229"),
+	)
+	seeds, err := provider.Seeds(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"10.26.104.53:8229"}, seeds)
+}
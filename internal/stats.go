@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"sync/atomic"
+)
+
+// Stats contains counters about the messages received by the gossiper.
+type Stats struct {
+	// ClusterNameMismatch is the number of messages dropped since they were
+	// from a different cluster.
+	ClusterNameMismatch uint64
+	// DecryptFailed is the number of messages dropped since they couldn't be
+	// decrypted.
+	DecryptFailed uint64
+	// Malformed is the number of messages dropped since they couldn't be
+	// decoded.
+	Malformed uint64
+	// UnknownMessageType is the number of messages dropped since they had an
+	// unsupported message type.
+	UnknownMessageType uint64
+	// UnsupportedVersion is the number of messages dropped since they were
+	// encoded with an unsupported protocol version.
+	UnsupportedVersion uint64
+	// FragmentDropped is the number of delta fragments dropped since they
+	// couldn't be reassembled.
+	FragmentDropped uint64
+}
+
+type stats struct {
+	clusterNameMismatch atomic.Uint64
+	decryptFailed       atomic.Uint64
+	malformed           atomic.Uint64
+	unknownMessageType  atomic.Uint64
+	unsupportedVersion  atomic.Uint64
+	fragmentDropped     atomic.Uint64
+}
+
+func (s *stats) Snapshot() Stats {
+	return Stats{
+		ClusterNameMismatch: s.clusterNameMismatch.Load(),
+		DecryptFailed:       s.decryptFailed.Load(),
+		Malformed:           s.malformed.Load(),
+		UnknownMessageType:  s.unknownMessageType.Load(),
+		UnsupportedVersion:  s.unsupportedVersion.Load(),
+		FragmentDropped:     s.fragmentDropped.Load(),
+	}
+}
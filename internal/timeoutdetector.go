@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeoutDetector is a failure detector that considers a peer down if no
+// heartbeats have been received within a fixed timeout.
+type TimeoutDetector struct {
+	timeout time.Duration
+
+	// lastTimestamps contains the time of the last heartbeat received from
+	// each peer.
+	lastTimestamps map[string]time.Time
+	// mu protects the above fields.
+	mu sync.Mutex
+}
+
+// NewTimeoutDetector returns a failure detector that considers a peer down if
+// no heartbeats have been received within the timeout.
+func NewTimeoutDetector(timeout time.Duration) *TimeoutDetector {
+	return &TimeoutDetector{
+		timeout:        timeout,
+		lastTimestamps: make(map[string]time.Time),
+	}
+}
+
+func (d *TimeoutDetector) Report(id string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.After(d.lastTimestamps[id]) {
+		d.lastTimestamps[id] = now
+	}
+}
+
+// Suspicion returns the time since the last heartbeat as a fraction of the
+// timeout, so the peer is considered down once the suspicion exceeds 1.
+func (d *TimeoutDetector) Suspicion(id string, now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, ok := d.lastTimestamps[id]
+	if !ok {
+		// If we have never received any heartbeats from the node, start by
+		// assuming it is alive so we can eventually detect the node as down
+		// if we never receive any heartbeats.
+		d.lastTimestamps[id] = now
+		return 0
+	}
+	return float64(now.Sub(last)) / float64(d.timeout)
+}
+
+func (d *TimeoutDetector) Available(id string, now time.Time) bool {
+	return d.Suspicion(id, now) <= 1
+}
+
+func (d *TimeoutDetector) Remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.lastTimestamps, id)
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutDetector(t *testing.T) {
+	fd := NewTimeoutDetector(time.Second)
+
+	now := time.Unix(1000, 0)
+	fd.Report("my-endpoint", now)
+
+	assert.InEpsilon(t, 0.5, fd.Suspicion("my-endpoint", now.Add(time.Millisecond*500)), 0.01)
+	assert.True(t, fd.Available("my-endpoint", now.Add(time.Second)))
+	assert.False(t, fd.Available("my-endpoint", now.Add(time.Millisecond*1001)))
+
+	fd.Report("my-endpoint", now.Add(time.Second))
+	assert.True(t, fd.Available("my-endpoint", now.Add(time.Millisecond*1500)))
+
+	// Ignores heartbeats older than the latest.
+	fd.Report("my-endpoint", now)
+	assert.True(t, fd.Available("my-endpoint", now.Add(time.Millisecond*1500)))
+}
+
+func TestTimeoutDetector_BootstrapUnknownPeer(t *testing.T) {
+	fd := NewTimeoutDetector(time.Second)
+
+	now := time.Unix(1000, 0)
+	assert.True(t, fd.Available("my-endpoint", now))
+	assert.False(t, fd.Available("my-endpoint", now.Add(time.Second*2)))
+
+	fd.Remove("my-endpoint")
+	assert.True(t, fd.Available("my-endpoint", now.Add(time.Second*2)))
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"net"
+	"time"
 )
 
 // Packet is used to provide some metadata about incoming packets from peers
@@ -15,18 +16,39 @@ type Packet struct {
 	From net.Addr
 }
 
-// Transport is an interface for a best-effort packet oriented transport.
+// Transport is an interface for a best-effort packet oriented transport, plus
+// a reliable stream oriented transport used for full state synchronization.
+//
+// Received packets and streams are delivered on PacketCh and StreamCh, which
+// are consumed from the moment the node is created until it shuts down, so a
+// transport may be created before the node that uses it.
 type Transport interface {
 	// WriteTo is a packet-oriented interface that fires off the given
 	// payload to the given address in a connectionless fashion.
 	WriteTo(b []byte, addr string) error
 
+	// PacketCh returns a channel that can be read to receive incoming
+	// packets from other peers.
+	PacketCh() <-chan *Packet
+
+	// DialTimeout is used to create a connection that allows us to perform
+	// two-way communication with a peer. This is generally more expensive
+	// than packet connections so is used for more infrequent operations
+	// such as push-pull state synchronization.
+	DialTimeout(addr string, timeout time.Duration) (net.Conn, error)
+
+	// StreamCh returns a channel that can be read to handle incoming stream
+	// connections from other peers. The receiver is responsible for closing
+	// the connection.
+	StreamCh() <-chan net.Conn
+
 	// BindAddr returns the address the transport listener is bound to. Note
 	// this may be different from the configured bind addr if the system chooses
 	// the addr (such as using a port of 0).
 	BindAddr() string
 
 	// Shutdown is called when gossip is shutting down; this gives the
-	// transport a chance to clean up any listeners.
+	// transport a chance to clean up any listeners. Once Shutdown returns
+	// no more packets or streams are delivered.
 	Shutdown() error
 }
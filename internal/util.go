@@ -2,11 +2,38 @@ package internal
 
 import (
 	"math/rand"
+	"sync"
 )
 
-func shuffle(arr []string) {
+func shuffle(rng *rand.Rand, arr []string) {
 	for i := range arr {
-		j := rand.Intn(i + 1)
+		j := rng.Intn(i + 1)
 		arr[i], arr[j] = arr[j], arr[i]
 	}
 }
+
+// lockedSource is a rand.Source that is safe for concurrent use.
+type lockedSource struct {
+	src rand.Source
+	mu  sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.src.Seed(seed)
+}
+
+// NewLockedRand returns a random number generator using the given source,
+// that is safe for concurrent use (unlike rand.New).
+func NewLockedRand(src rand.Source) *rand.Rand {
+	return rand.New(&lockedSource{src: src})
+}
@@ -1,48 +1,299 @@
 package scuttlebutt
 
 import (
+	"math/rand"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 const (
-	DefaultMaxMessageSize      = 512
-	DefaultConvictionThreshold = 8.0
-	DefaultInterval            = time.Millisecond * 500
+	DefaultMaxMessageSize       = 512
+	DefaultConvictionThreshold  = 8.0
+	DefaultInterval             = time.Millisecond * 500
+	DefaultPushPullInterval     = time.Second * 30
+	DefaultLeaveAckCount        = 3
+	DefaultReapTimeout          = time.Hour
+	DefaultSubscriberBufferSize = 64
+	DefaultMaxKeySize           = 256
+	DefaultMaxValueSize         = 64 * 1024
+	DefaultMaxStateSize         = 1024 * 1024
+	DefaultIndirectProbes       = 3
+	DefaultProbeTimeout         = time.Millisecond * 500
+	DefaultFlapPenalty          = 1000.0
+	DefaultFlapSuppressLimit    = 2000.0
+	DefaultFlapReuseLimit       = 750.0
+	DefaultFlapHalfLife         = time.Minute
+	DefaultFlapMaxSuppressTime  = time.Minute * 5
+	DefaultMulticastGroup       = "239.255.82.29:8229"
+	DefaultMulticastInterval    = time.Second * 5
 )
 
+// Options contains the node configuration.
+//
+// Note the OnJoin, OnLeave, OnUpdate, OnDelete, OnRejoin, OnStatusChange and
+// OnFlapping callbacks are invoked from the event dispatcher goroutine (see
+// Scuttlebutt.Subscribe), so a slow callback delays dispatching events to
+// subscribers though never blocks gossip.
 type Options struct {
 	// SeedCB is a callback that returns a list of seed addresses to use to
 	// join the cluster. This will be called whenever the node does not know
 	// about any other nodes in the cluster. If nil the node will not attempt
 	// to seed and must wait for the other nodes to contact it instead.
+	//
+	// IPv6 seed addresses must be enclosed in brackets, such as
+	// "[fd00::1]:8229".
 	SeedCB func() []string
 
-	// OnJoin is invoked when a peer joins the cluster.
-	OnJoin func(peerAddr string)
+	// SeedProvider returns the seed addresses to use to join the cluster,
+	// such as seeds discovered using DNS. Like SeedCB this is called
+	// whenever the node does not know about any other nodes in the cluster.
+	// If both SeedCB and SeedProvider are set the seeds from both are used.
+	//
+	// Seeds are requested from their own goroutine, so a slow provider (such
+	// as resolving DNS) doesn't delay gossip. The context passed to the
+	// provider is cancelled on Shutdown, which waits for the provider to
+	// return.
+	//
+	// The node takes ownership of the provider, so if it implements
+	// io.Closer (such as FileSeeds) it is closed on Shutdown.
+	SeedProvider SeedProvider
+
+	// MulticastDiscovery enables discovering the other nodes in the cluster
+	// on the local network using multicast, so nodes on the same LAN can
+	// join without configuring seeds. Each node announces its ID and
+	// AdvertiseAddr to MulticastGroup every MulticastInterval, and queries
+	// the group whenever it seeds. Discovered nodes are used as seeds along
+	// with any seeds from SeedCB and SeedProvider.
+	//
+	// Only nodes with the same ClusterName discover each other. Note
+	// announcements are sent using UDP directly rather than the Transport,
+	// and are not encrypted even if SecretKeys is set.
+	//
+	// Defaults to false.
+	MulticastDiscovery bool
+
+	// MulticastGroup is the multicast group address, including the port,
+	// used for discovery. Either an IPv4 or IPv6 group may be used. If not
+	// set defaults to 239.255.82.29:8229, an IPv4 organization-local scope
+	// address.
+	MulticastGroup string
+
+	// MulticastInterface is the name of the network interface used for
+	// discovery, such as "eth0". If not set the system default interface is
+	// used.
+	MulticastInterface string
+
+	// MulticastInterval is the time between announcing the node to the
+	// multicast group. Nodes that haven't been heard from for 3 intervals
+	// are no longer used as seeds. If not set defaults to 5s.
+	MulticastInterval time.Duration
+
+	// OnJoin is invoked when a peer joins the cluster. Each callback is
+	// passed the ID of the peer, whose address can be looked up with
+	// Scuttlebutt.Addr.
+	OnJoin func(peerID string)
 
 	// OnLeave is invoked when a peer leaves the cluster or is considered
-	// inactive.
-	OnLeave func(peerAddr string)
+	// inactive. The reason indicates whether the peer gracefully left
+	// (LeaveReasonLeft), was detected as down (LeaveReasonFailed), or was
+	// removed with ForceRemove while up (LeaveReasonRemoved).
+	OnLeave func(peerID string, reason LeaveReason)
 
 	// OnUpdate is invoked when a peers state is updated.
-	OnUpdate func(peerAddr string, key string, value string)
+	OnUpdate func(peerID string, key string, value string)
+
+	// OnDelete is invoked when a key is deleted from a peers state.
+	OnDelete func(peerID string, key string)
+
+	// OnRejoin is invoked when a peer restarts with a new generation, so its
+	// old state has been discarded.
+	OnRejoin func(peerID string)
+
+	// OnStatusChange is invoked when the status of a peer changes, such as
+	// when a peer is suspected of being down.
+	OnStatusChange func(peerID string, from PeerStatus, to PeerStatus)
+
+	// OnFlapping is invoked when a peer is repeatedly failing and recovering,
+	// so its join and leave events are suppressed until it stabilizes. Only
+	// used if FlapDamping is enabled.
+	OnFlapping func(peerID string)
 
 	// MaxMessageSize is the maximum allowed UDP payload for gossip messages.
 	// If the MTU is known this should be increased to the maximum size. If not
 	// set default to 512 bytes.
 	MaxMessageSize int
 
+	// MaxKeySize is the maximum size of a key in bytes. UpdateLocal returns
+	// ErrKeyTooLarge for larger keys. If not set defaults to 256 bytes.
+	MaxKeySize int
+
+	// MaxValueSize is the maximum size of a value in bytes. UpdateLocal
+	// returns ErrValueTooLarge for larger values. Values that don't fit in a
+	// single message are fragmented across multiple messages. If not set
+	// defaults to 64KB.
+	MaxValueSize int
+
+	// MaxStateSize is the maximum total size of the nodes keys and values in
+	// bytes. UpdateLocal returns ErrStateTooLarge if the update would exceed
+	// the limit. If not set defaults to 1MB.
+	MaxStateSize int
+
 	// ConvictionThreshold is the value if phi in the failure detector to
-	// consider a node down. If not set defaults to 8.0.
+	// suspect a node is down. Suspected nodes are probed (see
+	// IndirectProbes) before being considered down. If not set defaults to
+	// 8.0.
+	//
+	// This is only used by the default failure detector, so is ignored if
+	// FailureDetector is set.
 	ConvictionThreshold float64
 
+	// FailureDetector detects when peers are suspected to be down based on
+	// the heartbeats received from them. Note each node must have its own
+	// failure detector, so an instance must not be shared between nodes.
+	//
+	// If not set defaults to a PhiAccrualDetector using
+	// ConvictionThreshold, a minimum standard deviation of half the gossip
+	// interval, and a first heartbeat estimate of twice the gossip interval.
+	FailureDetector FailureDetector
+
+	// IndirectProbes is the number of other peers asked to probe a
+	// suspected peer on behalf of this node, so a bad link between this node
+	// and the suspected peer doesn't cause the peer to be considered down.
+	// The peer is only considered down if neither a direct or indirect probe
+	// is acknowledged within ProbeTimeout. If set to 0 suspected peers are
+	// considered down immediately. Defaults to 3.
+	IndirectProbes int
+
+	// ProbeTimeout is how long to wait for a suspected peer to acknowledge
+	// a probe before considering it down. If not set defaults to 500ms.
+	ProbeTimeout time.Duration
+
+	// FlapDamping enables damping join and leave events for peers that
+	// repeatedly fail and recover, such as peers on a marginal link, like BGP
+	// route flap damping.
+	//
+	// Each time a peer fails FlapPenalty is added to its penalty, which
+	// decays by half every FlapHalfLife. Once the penalty reaches
+	// FlapSuppressLimit an EventFlapping is emitted and the peers join and
+	// leave events are suppressed, until the penalty decays below
+	// FlapReuseLimit. If the peers status changed while suppressed a join or
+	// leave event is then emitted with its current status. Status change
+	// events are never suppressed.
+	//
+	// Defaults to false.
+	FlapDamping bool
+
+	// FlapPenalty is the penalty added each time a peer fails. If not set
+	// defaults to 1000.
+	FlapPenalty float64
+
+	// FlapSuppressLimit is the penalty at which a peers join and leave
+	// events are suppressed. If not set defaults to 2000.
+	FlapSuppressLimit float64
+
+	// FlapReuseLimit is the penalty below which a suppressed peers join and
+	// leave events are no longer suppressed. If not set defaults to 750.
+	FlapReuseLimit float64
+
+	// FlapHalfLife is the time for a peers penalty to decay by half. If not
+	// set defaults to 1 minute.
+	FlapHalfLife time.Duration
+
+	// FlapMaxSuppressTime is the maximum time a peer is suppressed after it
+	// last failed. If not set defaults to 5 minutes.
+	FlapMaxSuppressTime time.Duration
+
 	// Interval is the time between gossip rounds, when the node selects
 	// a random peer to sync with.
 	// If not set defaults to 500ms.
 	Interval time.Duration
 
+	// PushPullInterval is the time between push-pull exchanges, where the
+	// node exchanges its full known cluster state with a random peer over
+	// TCP. This repairs any state that gossip has been slow to propagate
+	// given the maximum message size. Nodes also push-pull with a seed when
+	// joining the cluster. If set to 0 periodic push-pull is disabled.
+	// Defaults to 30s.
+	PushPullInterval time.Duration
+
+	// LeaveAckCount is the number of peers that must acknowledge the node
+	// leaving before Leave returns. If fewer peers are known, all known
+	// peers must acknowledge. If not set defaults to 3.
+	LeaveAckCount int
+
+	// ReapTimeout is how long to keep peers that are dead or have left the
+	// cluster before removing them. Once removed, a tombstone for the peer is
+	// gossiped to the other nodes for another ReapTimeout, so nodes that still
+	// know about the peer don't gossip it back. If not set defaults to 1 hour.
+	ReapTimeout time.Duration
+
+	// ClusterName is the name of the cluster, which is included in every
+	// message. Messages from nodes with a different cluster name are dropped
+	// (and counted in Stats), so separate clusters sharing a network can't
+	// accidentally join. If not set defaults to an empty name.
+	ClusterName string
+
+	// SecretKeys contains the AES keys used to encrypt all messages. Each
+	// key must be either 16, 24 or 32 bytes to select AES-128, AES-192 or
+	// AES-256. The first key is the primary key used to encrypt messages,
+	// though messages are decrypted by trying all keys. Keys can be rotated
+	// at runtime with Scuttlebutt.InstallKey, UseKey and RemoveKey.
+	//
+	// If not set messages are not encrypted.
+	SecretKeys [][]byte
+
+	// SubscriberBufferSize is the number of events buffered for each
+	// subscriber, which must be at least 1. If not set defaults to 64.
+	SubscriberBufferSize int
+
+	// SlowConsumerPolicy describes how to handle events for a subscriber
+	// whose buffer is full, which must be one of the SlowConsumer policies.
+	// If not set defaults to SlowConsumerDropOldest.
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// NodeID is the ID that identifies the node in the cluster. Unlike the
+	// nodes address, the ID is expected to stay the same if the node restarts
+	// with a different address, so the node keeps its identity rather than
+	// joining as a new member. If not set defaults to a randomly generated
+	// ID.
+	//
+	// Nodes running a version before node IDs were introduced identify
+	// nodes by address, so when upgrading a cluster with such nodes the ID
+	// must be set to the nodes AdvertiseAddr.
+	NodeID string
+
+	// AdvertiseAddr is the address the node advertises to the other nodes
+	// in the cluster, which is used by other nodes to reach it. This must be
+	// set if the node binds to an unspecified address (such as 0.0.0.0 or
+	// [::]) or is behind NAT, such as in a container, where the bind address
+	// isn't reachable by the other nodes. Must include a
+	// non-zero port. If not set defaults to the transports bind address.
+	AdvertiseAddr string
+
+	// Transport is used to communicate with the other nodes in the cluster.
+	// The node takes ownership of the transport, so shuts it down on
+	// Shutdown. If set the address passed to Create is ignored and the node
+	// uses the transports BindAddr instead.
+	//
+	// If not set defaults to a transport using UDP and TCP listening on the
+	// address passed to Create. Binding to an IPv4 address (including
+	// 0.0.0.0) listens on IPv4 only and binding to an IPv6 address (such as
+	// [::1]:8229) listens on IPv6 only, while binding to [::] or an empty host
+	// listens on both IPv4 and IPv6 where the system supports it.
+	Transport Transport
+
+	// Clock is used to read the time and schedule gossip rounds, which can
+	// be replaced to control time in tests and simulations. If not set
+	// defaults to the system clock.
+	Clock Clock
+
+	// Rand is the source of randomness used to select peers, which can be
+	// replaced with a seeded source to make tests reproducible. Note this
+	// isn't used for encryption. If not set defaults to a source seeded
+	// with the current time.
+	Rand rand.Source
+
 	Logger *zap.Logger
 }
 
@@ -54,42 +305,240 @@ func WithSeedCB(seedCB func() []string) Option {
 	}
 }
 
-func WithOnJoin(cb func(peerAddr string)) Option {
+func WithSeedProvider(provider SeedProvider) Option {
+	return func(opts *Options) {
+		opts.SeedProvider = provider
+	}
+}
+
+func WithMulticastDiscovery(enabled bool) Option {
+	return func(opts *Options) {
+		opts.MulticastDiscovery = enabled
+	}
+}
+
+func WithMulticastGroup(group string) Option {
+	return func(opts *Options) {
+		opts.MulticastGroup = group
+	}
+}
+
+func WithMulticastInterface(name string) Option {
+	return func(opts *Options) {
+		opts.MulticastInterface = name
+	}
+}
+
+func WithMulticastInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.MulticastInterval = interval
+	}
+}
+
+func WithOnJoin(cb func(peerID string)) Option {
 	return func(opts *Options) {
 		opts.OnJoin = cb
 	}
 }
 
-func WithOnLeave(cb func(peerAddr string)) Option {
+func WithOnLeave(cb func(peerID string, reason LeaveReason)) Option {
 	return func(opts *Options) {
 		opts.OnLeave = cb
 	}
 }
 
-func WithOnUpdate(cb func(peerAddr string, key string, value string)) Option {
+func WithOnUpdate(cb func(peerID string, key string, value string)) Option {
 	return func(opts *Options) {
 		opts.OnUpdate = cb
 	}
 }
 
+func WithOnDelete(cb func(peerID string, key string)) Option {
+	return func(opts *Options) {
+		opts.OnDelete = cb
+	}
+}
+
+func WithOnRejoin(cb func(peerID string)) Option {
+	return func(opts *Options) {
+		opts.OnRejoin = cb
+	}
+}
+
+func WithOnStatusChange(cb func(peerID string, from PeerStatus, to PeerStatus)) Option {
+	return func(opts *Options) {
+		opts.OnStatusChange = cb
+	}
+}
+
+func WithOnFlapping(cb func(peerID string)) Option {
+	return func(opts *Options) {
+		opts.OnFlapping = cb
+	}
+}
+
 func WithMaxMessageSize(size int) Option {
 	return func(opts *Options) {
 		opts.MaxMessageSize = size
 	}
 }
 
+func WithMaxKeySize(size int) Option {
+	return func(opts *Options) {
+		opts.MaxKeySize = size
+	}
+}
+
+func WithMaxValueSize(size int) Option {
+	return func(opts *Options) {
+		opts.MaxValueSize = size
+	}
+}
+
+func WithMaxStateSize(size int) Option {
+	return func(opts *Options) {
+		opts.MaxStateSize = size
+	}
+}
+
 func WithConvictionThreshold(convictionThreshold float64) Option {
 	return func(opts *Options) {
 		opts.ConvictionThreshold = convictionThreshold
 	}
 }
 
+func WithFailureDetector(failureDetector FailureDetector) Option {
+	return func(opts *Options) {
+		opts.FailureDetector = failureDetector
+	}
+}
+
+func WithIndirectProbes(n int) Option {
+	return func(opts *Options) {
+		opts.IndirectProbes = n
+	}
+}
+
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.ProbeTimeout = timeout
+	}
+}
+
+func WithFlapDamping(enabled bool) Option {
+	return func(opts *Options) {
+		opts.FlapDamping = enabled
+	}
+}
+
+func WithFlapPenalty(penalty float64) Option {
+	return func(opts *Options) {
+		opts.FlapPenalty = penalty
+	}
+}
+
+func WithFlapSuppressLimit(limit float64) Option {
+	return func(opts *Options) {
+		opts.FlapSuppressLimit = limit
+	}
+}
+
+func WithFlapReuseLimit(limit float64) Option {
+	return func(opts *Options) {
+		opts.FlapReuseLimit = limit
+	}
+}
+
+func WithFlapHalfLife(halfLife time.Duration) Option {
+	return func(opts *Options) {
+		opts.FlapHalfLife = halfLife
+	}
+}
+
+func WithFlapMaxSuppressTime(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.FlapMaxSuppressTime = d
+	}
+}
+
 func WithInterval(interval time.Duration) Option {
 	return func(opts *Options) {
 		opts.Interval = interval
 	}
 }
 
+func WithPushPullInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.PushPullInterval = interval
+	}
+}
+
+func WithLeaveAckCount(count int) Option {
+	return func(opts *Options) {
+		opts.LeaveAckCount = count
+	}
+}
+
+func WithReapTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.ReapTimeout = timeout
+	}
+}
+
+func WithClusterName(name string) Option {
+	return func(opts *Options) {
+		opts.ClusterName = name
+	}
+}
+
+func WithSecretKeys(keys ...[]byte) Option {
+	return func(opts *Options) {
+		opts.SecretKeys = keys
+	}
+}
+
+func WithSubscriberBufferSize(size int) Option {
+	return func(opts *Options) {
+		opts.SubscriberBufferSize = size
+	}
+}
+
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(opts *Options) {
+		opts.SlowConsumerPolicy = policy
+	}
+}
+
+func WithNodeID(id string) Option {
+	return func(opts *Options) {
+		opts.NodeID = id
+	}
+}
+
+func WithAdvertiseAddr(addr string) Option {
+	return func(opts *Options) {
+		opts.AdvertiseAddr = addr
+	}
+}
+
+func WithTransport(transport Transport) Option {
+	return func(opts *Options) {
+		opts.Transport = transport
+	}
+}
+
+func WithClock(clock Clock) Option {
+	return func(opts *Options) {
+		opts.Clock = clock
+	}
+}
+
+func WithRand(source rand.Source) Option {
+	return func(opts *Options) {
+		opts.Rand = source
+	}
+}
+
 func WithLogger(logger *zap.Logger) Option {
 	return func(opts *Options) {
 		opts.Logger = logger
@@ -99,13 +548,44 @@ func WithLogger(logger *zap.Logger) Option {
 func defaultOptions() *Options {
 	l, _ := zap.NewDevelopment()
 	return &Options{
-		SeedCB:              nil,
-		OnJoin:              nil,
-		OnLeave:             nil,
-		OnUpdate:            nil,
-		MaxMessageSize:      DefaultMaxMessageSize,
-		ConvictionThreshold: DefaultConvictionThreshold,
-		Interval:            DefaultInterval,
-		Logger:              l,
+		SeedCB:               nil,
+		SeedProvider:         nil,
+		MulticastDiscovery:   false,
+		MulticastGroup:       DefaultMulticastGroup,
+		MulticastInterface:   "",
+		MulticastInterval:    DefaultMulticastInterval,
+		OnJoin:               nil,
+		OnLeave:              nil,
+		OnUpdate:             nil,
+		OnDelete:             nil,
+		OnRejoin:             nil,
+		OnStatusChange:       nil,
+		OnFlapping:           nil,
+		MaxMessageSize:       DefaultMaxMessageSize,
+		MaxKeySize:           DefaultMaxKeySize,
+		MaxValueSize:         DefaultMaxValueSize,
+		MaxStateSize:         DefaultMaxStateSize,
+		ConvictionThreshold:  DefaultConvictionThreshold,
+		FailureDetector:      nil,
+		IndirectProbes:       DefaultIndirectProbes,
+		ProbeTimeout:         DefaultProbeTimeout,
+		FlapDamping:          false,
+		FlapPenalty:          DefaultFlapPenalty,
+		FlapSuppressLimit:    DefaultFlapSuppressLimit,
+		FlapReuseLimit:       DefaultFlapReuseLimit,
+		FlapHalfLife:         DefaultFlapHalfLife,
+		FlapMaxSuppressTime:  DefaultFlapMaxSuppressTime,
+		Interval:             DefaultInterval,
+		PushPullInterval:     DefaultPushPullInterval,
+		LeaveAckCount:        DefaultLeaveAckCount,
+		ReapTimeout:          DefaultReapTimeout,
+		SubscriberBufferSize: DefaultSubscriberBufferSize,
+		SlowConsumerPolicy:   SlowConsumerDropOldest,
+		NodeID:               "",
+		AdvertiseAddr:        "",
+		Transport:            nil,
+		Clock:                nil,
+		Rand:                 nil,
+		Logger:               l,
 	}
 }
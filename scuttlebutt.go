@@ -1,6 +1,12 @@
 package scuttlebutt
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"sync"
 	"time"
 
@@ -10,18 +16,98 @@ import (
 
 const (
 	failureDetectorSampleSize = 1000
+
+	// maxConcurrentStreams is the maximum number of incoming push-pull
+	// streams handled at once. Since each stream may buffer the full cluster
+	// state, streams over the limit are closed.
+	maxConcurrentStreams = 16
+)
+
+var (
+	// ErrEncryptionDisabled is returned when modifying the keyring of a node
+	// that wasn't configured with secret keys.
+	ErrEncryptionDisabled = errors.New("encryption disabled")
+
+	// ErrKeyTooLarge is returned by UpdateLocal when the key exceeds
+	// MaxKeySize.
+	ErrKeyTooLarge = internal.ErrKeyTooLarge
+	// ErrValueTooLarge is returned by UpdateLocal when the value exceeds
+	// MaxValueSize.
+	ErrValueTooLarge = internal.ErrValueTooLarge
+	// ErrStateTooLarge is returned by UpdateLocal when the update would make
+	// the nodes state exceed MaxStateSize.
+	ErrStateTooLarge = internal.ErrStateTooLarge
+	// ErrUnknownPeer is returned by ForceRemove when the peer isn't known.
+	ErrUnknownPeer = internal.ErrUnknownPeer
+)
+
+// Stats contains counters about the messages received by the node.
+type Stats = internal.Stats
+
+// LeaveReason indicates why a peer left the cluster.
+type LeaveReason = internal.LeaveReason
+
+const (
+	// LeaveReasonFailed indicates the peer was detected as down by the failure
+	// detector.
+	LeaveReasonFailed = internal.LeaveReasonFailed
+	// LeaveReasonLeft indicates the peer gracefully left the cluster using
+	// Leave.
+	LeaveReasonLeft = internal.LeaveReasonLeft
+	// LeaveReasonRemoved indicates the peer was removed from the cluster with
+	// ForceRemove.
+	LeaveReasonRemoved = internal.LeaveReasonRemoved
+)
+
+// PeerStatus is the status of a peer as known by the local node.
+type PeerStatus = internal.PeerStatus
+
+const (
+	// PeerStatusAlive indicates the peer is considered up.
+	PeerStatusAlive = internal.PeerStatusAlive
+	// PeerStatusSuspect indicates a node suspects the peer is down, though it
+	// hasn't been confirmed. The peer is still considered up, and may refute
+	// the suspicion.
+	PeerStatusSuspect = internal.PeerStatusSuspect
+	// PeerStatusDead indicates the peer is considered down.
+	PeerStatusDead = internal.PeerStatusDead
+	// PeerStatusLeft indicates the peer gracefully left the cluster using
+	// Leave.
+	PeerStatusLeft = internal.PeerStatusLeft
 )
 
 // Scuttlebutt handles cluster membership using the scuttlebutt protocol.
 // This is thread safe.
 type Scuttlebutt struct {
-	gossiper       *internal.Gossiper
-	seedCB         func() []string
+	gossiper *internal.Gossiper
+	// seedProvider returns the seeds to join the cluster, or nil if the node
+	// doesn't seed.
+	seedProvider   SeedProvider
 	gossipInterval time.Duration
-	transport      internal.Transport
-	done           chan struct{}
-	wg             sync.WaitGroup
-	logger         *zap.Logger
+	// pushPullInterval is the time between push-pull exchanges with a random
+	// peer, or 0 if periodic push-pull is disabled.
+	pushPullInterval time.Duration
+	// seedPushPullCh receives seed addresses to push-pull with when joining
+	// the cluster.
+	seedPushPullCh chan []string
+	// seedCh receives requests to re-seed when the node doesn't know about
+	// any other nodes in the cluster.
+	seedCh chan struct{}
+	// streamSem limits the number of concurrent incoming streams.
+	streamSem     chan struct{}
+	leaveAckCount int
+	transport     Transport
+	keyring       *internal.Keyring
+	clock         Clock
+	rng           *rand.Rand
+	events        *internal.EventDispatcher
+	flapDamper    *internal.FlapDamper
+	// ctx is cancelled on shutdown, to cancel seeding.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+	logger *zap.Logger
 }
 
 // Create will create a new Scuttlebutt using the given configuration.
@@ -43,24 +129,133 @@ func Create(addr string, options ...Option) (*Scuttlebutt, error) {
 	return g, nil
 }
 
+// ID returns the ID that identifies this node in the cluster.
+func (s *Scuttlebutt) ID() string {
+	return s.gossiper.ID()
+}
+
+// IDs returns the IDs of the peers known by this node (including ourselves).
+func (s *Scuttlebutt) IDs() []string {
+	return s.gossiper.IDs(true)
+}
+
 // Addrs returns the addresses of the peers known by this node (including
-// ourselves).
+// ourselves). Peers whose address isn't known yet are excluded.
 func (s *Scuttlebutt) Addrs() []string {
-	return s.gossiper.Addrs(true)
+	addrs := []string{}
+	for _, id := range s.gossiper.IDs(true) {
+		if addr, ok := s.gossiper.Addr(id); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Addr returns the current address of the peer with the given ID, or false
+// if the peer is unknown or its address hasn't been received yet.
+func (s *Scuttlebutt) Addr(id string) (string, bool) {
+	return s.gossiper.Addr(id)
+}
+
+// Status returns the status of the peer with the given ID as known by this
+// node, or false if the peer is unknown.
+func (s *Scuttlebutt) Status(id string) (PeerStatus, bool) {
+	return s.gossiper.Status(id)
 }
 
-// Lookup looks up the given key in the known state of the peer with the
-// address. Since the cluster state is eventually consistent, this isn't
-// guaranteed to be up to date with the actual state of the peer, though should
-// converge quickly.
-func (s *Scuttlebutt) Lookup(addr string, key string) (string, bool) {
-	return s.gossiper.Lookup(addr, key)
+// Suspicion returns the failure detectors suspicion level of the peer with
+// the given ID, where a higher value means the peer is more likely to be
+// down. Returns false if the peer is unknown or is the local node.
+func (s *Scuttlebutt) Suspicion(id string) (float64, bool) {
+	return s.gossiper.Suspicion(id)
+}
+
+// Lookup looks up the given key in the known state of the peer with the ID.
+// Since the cluster state is eventually consistent, this isn't guaranteed to
+// be up to date with the actual state of the peer, though should converge
+// quickly.
+func (s *Scuttlebutt) Lookup(id string, key string) (string, bool) {
+	return s.gossiper.Lookup(id, key)
+}
+
+// Subscribe returns a channel that receives events about changes to the
+// cluster matching the filter (or all events if the filter is nil), and a
+// function to cancel the subscription, which closes the channel.
+//
+// Events are dispatched from a separate goroutine so a slow subscriber can't
+// stall gossip, and subscribers may call back into the node (such as Lookup).
+// Each subscriber has a buffer of SubscriberBufferSize events, and if the
+// buffer is full events are handled according to SlowConsumerPolicy.
+//
+// The channel is closed on Shutdown.
+func (s *Scuttlebutt) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	return s.events.Subscribe(filter)
 }
 
 // UpdateLocal updates this nodes state with the given key-value pair. This will
 // be propagated to the other nodes in the cluster.
-func (s *Scuttlebutt) UpdateLocal(key string, value string) {
-	s.gossiper.UpdateLocal(key, value)
+//
+// Returns ErrKeyTooLarge, ErrValueTooLarge or ErrStateTooLarge if the update
+// exceeds the configured size limits, or an error if the key is reserved.
+func (s *Scuttlebutt) UpdateLocal(key string, value string) error {
+	return s.gossiper.UpdateLocal(key, value)
+}
+
+// DeleteLocal deletes the key from this nodes state. The delete will be
+// propagated to the other nodes in the cluster.
+//
+// Returns an error if the key is reserved.
+func (s *Scuttlebutt) DeleteLocal(key string) error {
+	return s.gossiper.DeleteLocal(key)
+}
+
+// InstallKey adds the key to the keyring so it can be used to decrypt
+// messages. This is used to rotate keys across the cluster by installing the
+// new key on all nodes, then promoting it with UseKey on all nodes, then
+// removing the old key with RemoveKey.
+//
+// Returns ErrEncryptionDisabled if the node wasn't created with secret keys.
+func (s *Scuttlebutt) InstallKey(key []byte) error {
+	if s.keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	return s.keyring.AddKey(key)
+}
+
+// UseKey promotes an installed key to the primary key used to encrypt
+// messages.
+//
+// Returns ErrEncryptionDisabled if the node wasn't created with secret keys.
+func (s *Scuttlebutt) UseKey(key []byte) error {
+	if s.keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	return s.keyring.UseKey(key)
+}
+
+// RemoveKey removes an installed key from the keyring. The primary key cannot
+// be removed.
+//
+// Returns ErrEncryptionDisabled if the node wasn't created with secret keys.
+func (s *Scuttlebutt) RemoveKey(key []byte) error {
+	if s.keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	return s.keyring.RemoveKey(key)
+}
+
+// Keys returns the installed keys, where the first key is the primary key.
+func (s *Scuttlebutt) Keys() [][]byte {
+	if s.keyring == nil {
+		return nil
+	}
+	return s.keyring.Keys()
+}
+
+// Stats returns counters about the messages received by the node, such as
+// the number of messages dropped since they were from another cluster.
+func (s *Scuttlebutt) Stats() Stats {
+	return s.gossiper.Stats()
 }
 
 // BindAddr returns the address the transport listener is bound to. Note
@@ -70,54 +265,276 @@ func (s *Scuttlebutt) BindAddr() string {
 	return s.gossiper.BindAddr()
 }
 
+// AdvertiseAddr returns the address the node advertises to the other nodes
+// in the cluster, which they use to reach the node. This is the configured
+// AdvertiseAddr, or BindAddr if not configured.
+func (s *Scuttlebutt) AdvertiseAddr() string {
+	return s.gossiper.AdvertiseAddr()
+}
+
+// ForceRemove removes the peer with the given ID from the cluster, such
+// as a node that has been decommissioned, rather than waiting for it to be
+// removed ReapTimeout after it is considered down. The removal is gossiped to
+// the other nodes in the cluster, which will also remove the peer. If the peer
+// was up the nodes are notified with LeaveReasonRemoved.
+//
+// The peer can only rejoin the cluster by restarting.
+//
+// Returns ErrUnknownPeer if the peer isn't known.
+func (s *Scuttlebutt) ForceRemove(id string) error {
+	return s.gossiper.ForceRemove(id)
+}
+
+// Leave marks this node as leaving the cluster and gossips that status until
+// LeaveAckCount peers (or all known peers if there are fewer) have
+// acknowledged it, or the context expires. The other nodes will be notified
+// that this node has left with LeaveReasonLeft rather than waiting for the
+// failure detector to consider it down.
+//
+// Once Leave returns the node should be shutdown with Shutdown.
+func (s *Scuttlebutt) Leave(ctx context.Context) error {
+	s.logger.Debug("leave")
+
+	version := s.gossiper.Leave()
+
+	ticker := s.clock.NewTicker(s.gossipInterval)
+	defer ticker.Stop()
+
+	for {
+		acked, unacked := s.gossiper.LeaveAcks(version)
+		required := s.leaveAckCount
+		if known := len(acked) + len(unacked); known < required {
+			required = known
+		}
+		if len(acked) >= required {
+			s.logger.Debug("leave acknowledged", zap.Strings("acked", acked))
+			return nil
+		}
+
+		// Gossip with the peers that haven't acknowledged the leave yet in
+		// addition to the usual gossip rounds to propagate the leave
+		// quickly.
+		s.shuffleStrings(unacked)
+		for i := 0; i < len(unacked) && i < required-len(acked); i++ {
+			s.gossiper.SendDigestRequest(unacked[i])
+		}
+
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // Shutdown closes all background networking and stops gossiping its state to
 // the cluster.
 func (s *Scuttlebutt) Shutdown() error {
 	s.logger.Debug("shutdown")
 
 	// Note must close transport first or could block writing to packetCh.
+	// The packet and stream loops keep reading until done is closed.
 	err := s.gossiper.Close()
+	s.cancel()
 	close(s.done)
 	s.wg.Wait()
+	s.events.Close()
+	if closer, ok := s.seedProvider.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
 	return err
 }
 
 func newScuttlebutt(addr string, opts *Options) (*Scuttlebutt, error) {
+	if len(opts.ClusterName) > 0xff {
+		return nil, fmt.Errorf("cluster name cannot exceed 255 bytes")
+	}
+	if len(opts.NodeID) > 0xff {
+		return nil, fmt.Errorf("node id cannot exceed 255 bytes")
+	}
+	if opts.SubscriberBufferSize < 1 {
+		return nil, fmt.Errorf("subscriber buffer size must be at least 1")
+	}
+	switch opts.SlowConsumerPolicy {
+	case SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerBlock, SlowConsumerUnsubscribe:
+	default:
+		return nil, fmt.Errorf("unknown slow consumer policy: %d", opts.SlowConsumerPolicy)
+	}
+
+	if opts.AdvertiseAddr != "" {
+		if err := internal.ValidateAdvertiseAddr(opts.AdvertiseAddr); err != nil {
+			opts.Logger.Error("invalid advertise addr", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	var keyring *internal.Keyring
+	if len(opts.SecretKeys) > 0 {
+		var err error
+		keyring, err = internal.NewKeyring(opts.SecretKeys)
+		if err != nil {
+			opts.Logger.Error("invalid secret keys", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = internal.NewRealClock()
+	}
+	source := opts.Rand
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	rng := internal.NewLockedRand(source)
+
+	// Note the ID is generated from rng so simulations seeding Rand are
+	// reproducible.
+	nodeID := opts.NodeID
+	if nodeID == "" {
+		nodeID = fmt.Sprintf("%016x%016x", rng.Uint64(), rng.Uint64())
+	}
+
+	failureDetector := opts.FailureDetector
+	if failureDetector == nil {
+		failureDetector = internal.NewPhiAccrualDetector(
+			opts.ConvictionThreshold,
+			failureDetectorSampleSize,
+			opts.Interval/2,
+			0,
+			opts.Interval*2,
+		)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	gossip := &Scuttlebutt{
-		seedCB:         opts.SeedCB,
-		gossipInterval: opts.Interval,
-		done:           make(chan struct{}),
-		wg:             sync.WaitGroup{},
-		logger:         opts.Logger,
+		keyring:          keyring,
+		clock:            clock,
+		rng:              rng,
+		gossipInterval:   opts.Interval,
+		pushPullInterval: opts.PushPullInterval,
+		seedPushPullCh:   make(chan []string, 1),
+		seedCh:           make(chan struct{}, 1),
+		streamSem:        make(chan struct{}, maxConcurrentStreams),
+		leaveAckCount:    opts.LeaveAckCount,
+		ctx:              ctx,
+		cancel:           cancel,
+		done:             make(chan struct{}),
+		wg:               sync.WaitGroup{},
+		logger:           opts.Logger,
 	}
 
-	transport, err := internal.NewUDPTransport(addr, gossip.onPacket, opts.Logger)
-	if err != nil {
-		opts.Logger.Error("failed to start transport", zap.Error(err))
-		return nil, err
+	transport := opts.Transport
+	if transport == nil {
+		var err error
+		transport, err = internal.NewNetTransport(addr, opts.Logger)
+		if err != nil {
+			opts.Logger.Error("failed to start transport", zap.Error(err))
+			return nil, err
+		}
 	}
 	gossip.transport = transport
 
-	opts.Logger.Debug("transport started", zap.String("addr", transport.BindAddr()))
+	opts.Logger.Debug(
+		"transport started",
+		zap.String("id", nodeID),
+		zap.String("addr", transport.BindAddr()),
+	)
+
+	// Note use transport bind addr not configured bind addr as these may be
+	// different if the system assigns the port.
+	advertiseAddr := opts.AdvertiseAddr
+	if advertiseAddr == "" {
+		advertiseAddr = transport.BindAddr()
+	}
+	if internal.IsUnspecifiedAddr(advertiseAddr) {
+		opts.Logger.Warn(
+			"advertise addr is unspecified; other nodes won't be able to reach the local node; configure AdvertiseAddr",
+			zap.String("advertise-addr", advertiseAddr),
+		)
+	}
+
+	var discovery *internal.MulticastDiscovery
+	if opts.MulticastDiscovery {
+		var err error
+		discovery, err = internal.NewMulticastDiscovery(
+			internal.MulticastConfig{
+				Group:     opts.MulticastGroup,
+				Interface: opts.MulticastInterface,
+				Interval:  opts.MulticastInterval,
+			},
+			opts.ClusterName,
+			nodeID,
+			advertiseAddr,
+			clock,
+			opts.Logger,
+		)
+		if err != nil {
+			opts.Logger.Error("failed to start multicast discovery", zap.Error(err))
+			transport.Shutdown()
+			return nil, err
+		}
+	}
+	gossip.seedProvider = seedProvider(opts, discovery)
+
+	// The options callbacks are invoked by the dispatcher, so are also never
+	// invoked from the gossip path.
+	gossip.events = internal.NewEventDispatcher(
+		opts.handleEvent,
+		opts.SubscriberBufferSize,
+		opts.SlowConsumerPolicy,
+		opts.Logger,
+	)
+
+	// Disabled unless FlapDamping is enabled.
+	flapDampingConfig := internal.FlapDampingConfig{}
+	if opts.FlapDamping {
+		flapDampingConfig = internal.FlapDampingConfig{
+			Penalty:         opts.FlapPenalty,
+			SuppressLimit:   opts.FlapSuppressLimit,
+			ReuseLimit:      opts.FlapReuseLimit,
+			HalfLife:        opts.FlapHalfLife,
+			MaxSuppressTime: opts.FlapMaxSuppressTime,
+		}
+	}
+	gossip.flapDamper = internal.NewFlapDamper(
+		flapDampingConfig,
+		gossip.events.Emit,
+		clock,
+		opts.Logger,
+	)
 
 	peerMap := internal.NewPeerMap(
-		// Note use transport bind addr not configured bind addr as these
-		// may be different if the system assigns the port.
-		transport.BindAddr(),
-		opts.OnJoin,
-		opts.OnLeave,
-		opts.OnUpdate,
+		nodeID,
+		advertiseAddr,
+		// Use the start time as the generation so a restarted node replaces
+		// its stale state.
+		uint64(clock.Now().UnixNano()),
+		opts.ReapTimeout,
+		gossip.flapDamper.OnEvent,
+		clock,
 		opts.Logger,
 	)
 	gossip.gossiper = internal.NewGossiper(
 		peerMap,
 		transport,
-		internal.NewFailureDetector(
-			uint64(opts.Interval.Nanoseconds()),
-			failureDetectorSampleSize,
-			opts.ConvictionThreshold,
-		),
+		failureDetector,
+		keyring,
+		opts.ClusterName,
 		opts.MaxMessageSize,
+		internal.StateLimits{
+			MaxKeySize:   opts.MaxKeySize,
+			MaxValueSize: opts.MaxValueSize,
+			MaxStateSize: opts.MaxStateSize,
+		},
+		internal.ProbeConfig{
+			IndirectProbes: opts.IndirectProbes,
+			Timeout:        opts.ProbeTimeout,
+		},
+		clock,
+		rng,
 		opts.Logger,
 	)
 
@@ -125,19 +542,71 @@ func newScuttlebutt(addr string, opts *Options) (*Scuttlebutt, error) {
 }
 
 func (s *Scuttlebutt) schedule() {
-	s.wg.Add(1)
+	s.wg.Add(5)
+	go s.packetLoop()
+	go s.streamLoop()
 	go s.gossipLoop()
+	go s.pushPullLoop()
+	go s.seedLoop()
+}
+
+// packetLoop handles incoming packets from the transport. Since this is only
+// started once the gossiper has been created, packets received before then
+// are buffered by the transport.
+func (s *Scuttlebutt) packetLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case p := <-s.transport.PacketCh():
+			s.onPacket(p)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// streamLoop handles incoming streams from the transport, where each stream
+// is handled in its own goroutine.
+func (s *Scuttlebutt) streamLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case conn := <-s.transport.StreamCh():
+			select {
+			case s.streamSem <- struct{}{}:
+			default:
+				s.logger.Warn(
+					"too many concurrent streams; closing stream",
+					zap.String("addr", conn.RemoteAddr().String()),
+				)
+				conn.Close()
+				continue
+			}
+
+			// Note the stream handlers aren't waited on in Shutdown, since
+			// they may be blocked waiting on the remote node until their
+			// deadline.
+			go func() {
+				defer func() { <-s.streamSem }()
+				s.onStream(conn)
+			}()
+		case <-s.done:
+			return
+		}
+	}
 }
 
 func (s *Scuttlebutt) gossipLoop() {
 	defer s.wg.Done()
 
-	ticker := time.NewTicker(s.gossipInterval)
+	ticker := s.clock.NewTicker(s.gossipInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			s.round()
 		case <-s.done:
 			return
@@ -145,39 +614,170 @@ func (s *Scuttlebutt) gossipLoop() {
 	}
 }
 
+// pushPullLoop runs push-pull exchanges, both periodically with a random peer
+// and with a seed when joining the cluster. This runs in its own goroutine
+// since push-pull may block for much longer than a gossip round.
+func (s *Scuttlebutt) pushPullLoop() {
+	defer s.wg.Done()
+
+	var tickerCh <-chan time.Time
+	if s.pushPullInterval > 0 {
+		ticker := s.clock.NewTicker(s.pushPullInterval)
+		defer ticker.Stop()
+		tickerCh = ticker.C()
+	}
+
+	for {
+		select {
+		case <-tickerCh:
+			s.pushPullToUpPeer()
+		case seeds := <-s.seedPushPullCh:
+			s.pushPullToSeed(seeds)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// seedLoop re-seeds when requested by the gossip loop. This runs in its own
+// goroutine since the seed provider may block, such as when resolving DNS,
+// which would otherwise delay heartbeats and failure detection.
+func (s *Scuttlebutt) seedLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.seedCh:
+			s.seed()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Scuttlebutt) pushPullToUpPeer() {
+	id, ok := s.gossiper.RandomUpPeer()
+	if !ok {
+		return
+	}
+	if err := s.gossiper.PushPull(id); err != nil {
+		s.logger.Warn("push-pull failed", zap.String("id", id), zap.Error(err))
+	}
+}
+
+// pushPullToSeed push-pulls with the seeds in a random order until one
+// succeeds.
+func (s *Scuttlebutt) pushPullToSeed(seeds []string) {
+	seeds = append([]string{}, seeds...)
+	s.shuffleStrings(seeds)
+	for _, addr := range seeds {
+		// Ignore ourselves.
+		if s.gossiper.IsLocalAddr(addr) {
+			continue
+		}
+		err := s.gossiper.PushPullSeed(addr)
+		if err == nil {
+			return
+		}
+		s.logger.Debug("push-pull with seed failed", zap.String("addr", addr), zap.Error(err))
+	}
+}
+
 func (s *Scuttlebutt) round() {
+	s.gossiper.Heartbeat()
 	s.gossipToUpPeer()
 	s.gossiper.CheckLiveness()
+	s.flapDamper.Reuse()
 	s.gossipToDownPeer()
+	s.gossiper.RemoveConvergedTombstones()
 }
 
 func (s *Scuttlebutt) gossipToUpPeer() {
-	addr, ok := s.gossiper.RandomUpPeer()
+	id, ok := s.gossiper.RandomUpPeer()
 	if !ok {
 		// If we don't know about any other peers in the cluster re-seed.
-		s.seed()
+		// If the previous re-seed is still in progress skip this one.
+		select {
+		case s.seedCh <- struct{}{}:
+		default:
+		}
 		return
 	}
-	s.gossiper.SendDigestRequest(addr)
+	s.gossiper.SendDigestRequest(id)
 }
 
 func (s *Scuttlebutt) gossipToDownPeer() {
-	addr, ok := s.gossiper.RandomDownPeer()
+	id, ok := s.gossiper.RandomDownPeer()
 	if !ok {
 		return
 	}
-	s.gossiper.SendDigestRequest(addr)
+	s.gossiper.SendDigestRequest(id)
 }
 
 func (s *Scuttlebutt) seed() {
-	if s.seedCB == nil {
-		s.logger.Debug("no seed cb; skipping")
+	if s.seedProvider == nil {
+		s.logger.Debug("no seed provider; skipping")
 		return
 	}
 
-	s.gossiper.Seed(s.seedCB())
+	// If only some seeds could be found, still seed with the seeds that
+	// were found.
+	seeds, err := s.seedProvider.Seeds(s.ctx)
+	if err != nil {
+		s.logger.Warn("failed to get seeds", zap.Error(err))
+	}
+	s.gossiper.Seed(seeds)
+
+	// Also push-pull with a seed so we get the full cluster state in one
+	// round trip. If the previous seed push-pull is still in progress skip
+	// this one.
+	select {
+	case s.seedPushPullCh <- seeds:
+	default:
+	}
+}
+
+// seedProvider returns the provider of the seeds configured by SeedCB,
+// SeedProvider and multicast discovery, or nil if none are configured.
+func seedProvider(opts *Options, discovery *internal.MulticastDiscovery) SeedProvider {
+	providers := []SeedProvider{}
+	if opts.SeedProvider != nil {
+		providers = append(providers, opts.SeedProvider)
+	}
+	if opts.SeedCB != nil {
+		seedCB := opts.SeedCB
+		providers = append(providers, SeedFunc(func(ctx context.Context) ([]string, error) {
+			return seedCB(), nil
+		}))
+	}
+	// Note check discovery explicitly as a nil *MulticastDiscovery is a
+	// non-nil SeedProvider.
+	if discovery != nil {
+		providers = append(providers, discovery)
+	}
+
+	switch len(providers) {
+	case 0:
+		return nil
+	case 1:
+		return providers[0]
+	default:
+		return NewMergedSeeds(providers...)
+	}
 }
 
 func (s *Scuttlebutt) onPacket(p *internal.Packet) {
 	s.gossiper.OnMessage(p.Buf, p.From.String())
 }
+
+func (s *Scuttlebutt) onStream(conn net.Conn) {
+	if err := s.gossiper.OnStream(conn); err != nil {
+		s.logger.Debug("failed to handle stream", zap.Error(err))
+	}
+}
+
+func (s *Scuttlebutt) shuffleStrings(arr []string) {
+	s.rng.Shuffle(len(arr), func(i, j int) {
+		arr[i], arr[j] = arr[j], arr[i]
+	})
+}
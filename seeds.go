@@ -0,0 +1,87 @@
+package scuttlebutt
+
+import (
+	"time"
+
+	"github.com/andydunstall/scuttlebutt/internal"
+	"go.uber.org/zap"
+)
+
+// SeedProvider returns the addresses of the seed nodes used to join the
+// cluster. A seed provider is configured with WithSeedProvider, and is called
+// each time the node re-seeds, so the seeds may change over time.
+//
+// Note implementations must be thread safe.
+type SeedProvider = internal.SeedProvider
+
+// SeedFunc adapts a function to a SeedProvider.
+type SeedFunc = internal.SeedFunc
+
+// Resolver resolves the DNS records used to discover seeds. *net.Resolver
+// implements Resolver.
+type Resolver = internal.Resolver
+
+// StaticSeeds is a SeedProvider that returns a fixed list of seeds.
+type StaticSeeds = internal.StaticSeeds
+
+// FileSeeds is a SeedProvider that reads seed addresses from a file, which
+// can be watched for changes. Close stops watching the file.
+type FileSeeds = internal.FileSeeds
+
+// DNSSeeds is a SeedProvider that discovers seeds by resolving the A and AAAA
+// records of a hostname.
+type DNSSeeds = internal.DNSSeeds
+
+// SRVSeeds is a SeedProvider that discovers seeds by resolving SRV records.
+type SRVSeeds = internal.SRVSeeds
+
+// MergedSeeds is a SeedProvider that combines the seeds of multiple
+// providers, removing duplicates.
+type MergedSeeds = internal.MergedSeeds
+
+// NewStaticSeeds returns a provider that returns the given seed addresses.
+func NewStaticSeeds(addrs ...string) *StaticSeeds {
+	return internal.NewStaticSeeds(addrs...)
+}
+
+// NewFileSeeds returns a provider that reads seed addresses from the file at
+// the given path. The file either contains one address per line, where empty
+// lines and lines starting with # are ignored, or a JSON array of addresses.
+//
+// If reloadInterval is non-zero the file is watched for changes by re-reading
+// it every interval until the provider is closed, otherwise the file is
+// re-read each time the node re-seeds.
+//
+// If the file can't be read or contains an invalid address, the error is
+// logged and passed to onError (if not nil), and the seeds from the last
+// valid version of the file are still used. If logger is nil errors are only
+// passed to onError.
+func NewFileSeeds(path string, reloadInterval time.Duration, onError func(err error), logger *zap.Logger) *FileSeeds {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return internal.NewFileSeeds(path, reloadInterval, onError, internal.NewRealClock(), logger)
+}
+
+// NewDNSSeeds returns a provider that resolves the A and AAAA records of host,
+// where each resolved IP is a seed with the given port. The host is resolved
+// each time the node re-seeds. If resolver is nil net.DefaultResolver is used.
+func NewDNSSeeds(host string, port int, resolver Resolver) *DNSSeeds {
+	return internal.NewDNSSeeds(host, port, resolver)
+}
+
+// NewSRVSeeds returns a provider that resolves the SRV records of
+// _service._proto.name (as in net.LookupSRV), where each record gives the host
+// and port of a seed. The records are resolved each time the node re-seeds.
+// If resolver is nil net.DefaultResolver is used.
+func NewSRVSeeds(service string, proto string, name string, resolver Resolver) *SRVSeeds {
+	return internal.NewSRVSeeds(service, proto, name, resolver)
+}
+
+// NewMergedSeeds returns a provider that combines the seeds of the given
+// providers in order, removing duplicates. If some providers fail, the seeds
+// from the other providers are still used. Closing the provider closes any of
+// the given providers that implement io.Closer.
+func NewMergedSeeds(providers ...SeedProvider) *MergedSeeds {
+	return internal.NewMergedSeeds(providers...)
+}
@@ -0,0 +1,220 @@
+package scuttlebutt
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt/internal"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Simulation runs a cluster of nodes on an in-memory network with a virtual
+// clock. Rather than each node gossiping from its own goroutines, the
+// simulation steps the gossip rounds of all nodes from the calling goroutine,
+// so simulating hours of gossip takes milliseconds and a run is reproducible
+// from its seed.
+//
+// Since streams require concurrent goroutines, nodes don't push-pull in a
+// simulation, and Leave must not be called as it waits on the clock.
+//
+// Note this is not thread safe.
+type Simulation struct {
+	clock    *ManualClock
+	network  *MemoryNetwork
+	rng      *rand.Rand
+	interval time.Duration
+	options  []Option
+	// nodes contains the nodes in the order they were added, which is the
+	// order their rounds are run in each step.
+	nodes []*Scuttlebutt
+}
+
+// NewSimulation returns a simulation with no nodes. The options are applied to
+// every node added, and the gossip interval of the options is used as the
+// duration of each step.
+func NewSimulation(seed int64, options ...Option) *Simulation {
+	opts := defaultOptions()
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	// Start the clock at a fixed time so runs are reproducible.
+	clock := internal.NewManualClock(time.Unix(0, 0))
+	return &Simulation{
+		clock:    clock,
+		network:  internal.NewMemoryNetwork(clock, rand.New(rand.NewSource(rng.Int63()))),
+		rng:      rng,
+		interval: opts.Interval,
+		options:  options,
+	}
+}
+
+// AddNode adds a node to the simulation bound to the given address on the
+// simulated network. If the port is 0 the network assigns an unused port.
+//
+// By default the node seeds using the addresses of the other nodes in the
+// simulation, which can be overridden with WithSeedCB.
+func (s *Simulation) AddNode(addr string, options ...Option) (*Scuttlebutt, error) {
+	transport, err := s.network.NewTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := defaultOptions()
+	opts.SeedCB = s.Addrs
+	for _, opt := range s.options {
+		opt(opts)
+	}
+	for _, opt := range options {
+		opt(opts)
+	}
+	opts.Transport = transport
+	opts.Clock = s.clock
+	opts.Rand = rand.NewSource(s.rng.Int63())
+
+	node, err := newScuttlebutt(transport.BindAddr(), opts)
+	if err != nil {
+		transport.Shutdown()
+		return nil, err
+	}
+	s.nodes = append(s.nodes, node)
+	return node, nil
+}
+
+// RemoveNode shuts down the node with the given address, such as to simulate
+// the node crashing. The other nodes will detect the node as failed.
+func (s *Simulation) RemoveNode(addr string) error {
+	for i, node := range s.nodes {
+		if node.BindAddr() == addr {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			return node.Shutdown()
+		}
+	}
+	return nil
+}
+
+// Node returns the node with the given address, or nil if no node has the
+// address.
+func (s *Simulation) Node(addr string) *Scuttlebutt {
+	for _, node := range s.nodes {
+		if node.BindAddr() == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the nodes in the simulation.
+func (s *Simulation) Addrs() []string {
+	addrs := make([]string, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		addrs = append(addrs, node.BindAddr())
+	}
+	return addrs
+}
+
+// IDs returns the IDs of the nodes in the simulation, in the same order as
+// Addrs.
+func (s *Simulation) IDs() []string {
+	ids := make([]string, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		ids = append(ids, node.ID())
+	}
+	return ids
+}
+
+// Network returns the simulated network, used to inject faults.
+func (s *Simulation) Network() *MemoryNetwork {
+	return s.network
+}
+
+// Now returns the current time of the simulations virtual clock.
+func (s *Simulation) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Step advances the clock by the gossip interval then runs a gossip round on
+// each node, delivering all packets sent by the round before running the
+// next nodes round.
+//
+// Once Step returns, the events emitted during the step have been dispatched
+// to the event callbacks and subscribers. So with SlowConsumerBlock, Step
+// blocks until subscribers read their events.
+func (s *Simulation) Step() {
+	// Advancing the clock delivers any delayed packets that are due.
+	s.clock.Advance(s.interval)
+	s.deliver()
+
+	for _, node := range s.nodes {
+		node.round()
+		// Nodes normally re-seed from their own goroutine, so run any
+		// requested re-seed as part of the nodes round.
+		select {
+		case <-node.seedCh:
+			node.seed()
+		default:
+		}
+		s.deliver()
+	}
+
+	// Events are dispatched from each nodes own goroutine, so wait for them
+	// to be dispatched so callers see the events from this step.
+	for _, node := range s.nodes {
+		node.events.Flush()
+	}
+}
+
+// Run steps the simulation until the duration has elapsed on the virtual
+// clock.
+func (s *Simulation) Run(d time.Duration) {
+	end := s.clock.Now().Add(d)
+	for s.clock.Now().Before(end) {
+		s.Step()
+	}
+}
+
+// RunUntil steps the simulation until the condition is true or the timeout
+// elapses on the virtual clock. Returns whether the condition was met.
+func (s *Simulation) RunUntil(condition func() bool, timeout time.Duration) bool {
+	end := s.clock.Now().Add(timeout)
+	for !condition() {
+		if !s.clock.Now().Before(end) {
+			return false
+		}
+		s.Step()
+	}
+	return true
+}
+
+// Shutdown shuts down all nodes in the simulation.
+func (s *Simulation) Shutdown() error {
+	var errs error
+	for _, node := range s.nodes {
+		if err := node.Shutdown(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	s.nodes = nil
+	return errs
+}
+
+// deliver delivers all pending packets to the nodes until there are no more
+// pending packets. Nodes are delivered a packet at a time in turn so the
+// order is deterministic.
+func (s *Simulation) deliver() {
+	for {
+		delivered := false
+		for _, node := range s.nodes {
+			select {
+			case p := <-node.transport.PacketCh():
+				node.onPacket(p)
+				delivered = true
+			default:
+			}
+		}
+		if !delivered {
+			return
+		}
+	}
+}
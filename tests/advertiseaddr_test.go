@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests a node bound to an unspecified address is reached by its advertise
+// address.
+func TestAdvertiseAddr_BindUnspecified(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	// Find a free port to bind to since the advertise address must include
+	// the port.
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	assert.Nil(t, ln.Close())
+
+	advertiseAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	node1, err := cluster.AddNodeWithAddr(
+		fmt.Sprintf("0.0.0.0:%d", port),
+		nil,
+		scuttlebutt.WithAdvertiseAddr(advertiseAddr),
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, advertiseAddr, node1.AdvertiseAddr())
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	nodeSub := NewNodeSubscriber()
+	node2, err := cluster.AddNode(nodeSub)
+	assert.Nil(t, err)
+	assert.Equal(t, node2.BindAddr(), node2.AdvertiseAddr())
+
+	id, ok := nodeSub.WaitPeerJoinedWithTimeout(time.Second * 5)
+	assert.True(t, ok)
+	assert.Equal(t, node1.ID(), id)
+
+	assert.Eventually(t, func() bool {
+		v, ok := node2.Lookup(node1.ID(), "foo")
+		return ok && v == "bar"
+	}, time.Second*5, time.Millisecond*10)
+	addr, ok := node2.Addr(node1.ID())
+	assert.True(t, ok)
+	assert.Equal(t, advertiseAddr, addr)
+	assert.ElementsMatch(t, []string{advertiseAddr, node2.AdvertiseAddr()}, node2.Addrs())
+	assert.Eventually(t, func() bool {
+		return len(node1.Addrs()) == 2
+	}, time.Second*5, time.Millisecond*10)
+	assert.ElementsMatch(t, []string{advertiseAddr, node2.AdvertiseAddr()}, node1.Addrs())
+}
+
+func TestAdvertiseAddr_Invalid(t *testing.T) {
+	for _, addr := range []string{"10.26.104.52", ":8229", "10.26.104.52:0", "10.26.104.52:foo"} {
+		_, err := scuttlebutt.Create("127.0.0.1:0", scuttlebutt.WithAdvertiseAddr(addr))
+		assert.NotNil(t, err, addr)
+	}
+}
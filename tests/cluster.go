@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"sync"
 	"time"
 
 	"github.com/andydunstall/scuttlebutt"
@@ -8,41 +9,69 @@ import (
 )
 
 type peerUpdate struct {
-	Addr  string
+	ID    string
 	Key   string
 	Value string
 }
 
+type peerLeave struct {
+	ID     string
+	Reason scuttlebutt.LeaveReason
+}
+
+type peerDelete struct {
+	ID  string
+	Key string
+}
+
 type NodeSubscriber struct {
-	PeerJoinedCh  chan string
-	PeerLeftCh    chan string
-	PeerUpdatedCh chan peerUpdate
+	PeerJoinedCh   chan string
+	PeerRejoinedCh chan string
+	PeerLeftCh     chan peerLeave
+	PeerUpdatedCh  chan peerUpdate
+	PeerDeletedCh  chan peerDelete
 }
 
 func NewNodeSubscriber() *NodeSubscriber {
 	return &NodeSubscriber{
-		PeerJoinedCh:  make(chan string, 64),
-		PeerLeftCh:    make(chan string, 64),
-		PeerUpdatedCh: make(chan peerUpdate, 64),
+		PeerJoinedCh:   make(chan string, 64),
+		PeerRejoinedCh: make(chan string, 64),
+		PeerLeftCh:     make(chan peerLeave, 64),
+		PeerUpdatedCh:  make(chan peerUpdate, 64),
+		PeerDeletedCh:  make(chan peerDelete, 64),
 	}
 }
 
-func (e *NodeSubscriber) OnJoin(addr string) {
-	e.PeerJoinedCh <- addr
+func (e *NodeSubscriber) OnJoin(id string) {
+	e.PeerJoinedCh <- id
 }
 
-func (e *NodeSubscriber) OnLeave(addr string) {
-	e.PeerLeftCh <- addr
+func (e *NodeSubscriber) OnRejoin(id string) {
+	e.PeerRejoinedCh <- id
 }
 
-func (e *NodeSubscriber) OnUpdate(addr string, key string, value string) {
+func (e *NodeSubscriber) OnLeave(id string, reason scuttlebutt.LeaveReason) {
+	e.PeerLeftCh <- peerLeave{
+		ID:     id,
+		Reason: reason,
+	}
+}
+
+func (e *NodeSubscriber) OnUpdate(id string, key string, value string) {
 	e.PeerUpdatedCh <- peerUpdate{
-		Addr:  addr,
+		ID:    id,
 		Key:   key,
 		Value: value,
 	}
 }
 
+func (e *NodeSubscriber) OnDelete(id string, key string) {
+	e.PeerDeletedCh <- peerDelete{
+		ID:  id,
+		Key: key,
+	}
+}
+
 func (s *NodeSubscriber) WaitPeerUpdatedWithTimeout(t time.Duration) (peerUpdate, bool) {
 	select {
 	case update := <-s.PeerUpdatedCh:
@@ -52,26 +81,50 @@ func (s *NodeSubscriber) WaitPeerUpdatedWithTimeout(t time.Duration) (peerUpdate
 	}
 }
 
+func (s *NodeSubscriber) WaitPeerDeletedWithTimeout(t time.Duration) (peerDelete, bool) {
+	select {
+	case del := <-s.PeerDeletedCh:
+		return del, true
+	case <-time.After(t):
+		return peerDelete{}, false
+	}
+}
+
 func (s *NodeSubscriber) WaitPeerJoinedWithTimeout(t time.Duration) (string, bool) {
 	select {
-	case addr := <-s.PeerJoinedCh:
-		return addr, true
+	case id := <-s.PeerJoinedCh:
+		return id, true
 	case <-time.After(t):
 		return "", false
 	}
 }
 
-func (s *NodeSubscriber) WaitPeerLeftWithTimeout(t time.Duration) (string, bool) {
+func (s *NodeSubscriber) WaitPeerRejoinedWithTimeout(t time.Duration) (string, bool) {
 	select {
-	case addr := <-s.PeerLeftCh:
-		return addr, true
+	case id := <-s.PeerRejoinedCh:
+		return id, true
 	case <-time.After(t):
 		return "", false
 	}
 }
 
+func (s *NodeSubscriber) WaitPeerLeftWithTimeout(t time.Duration) (peerLeave, bool) {
+	select {
+	case leave := <-s.PeerLeftCh:
+		return leave, true
+	case <-time.After(t):
+		return peerLeave{}, false
+	}
+}
+
 type Cluster struct {
+	// nodes contains the nodes in the cluster indexed by ID.
 	nodes map[string]*scuttlebutt.Scuttlebutt
+	// network is the in-memory network nodes are added to, or nil if nodes
+	// use the default UDP and TCP transport.
+	network *scuttlebutt.MemoryNetwork
+	// mu protects nodes since it's read by the nodes seed callbacks.
+	mu sync.Mutex
 }
 
 func NewCluster() *Cluster {
@@ -80,34 +133,86 @@ func NewCluster() *Cluster {
 	}
 }
 
-func (c *Cluster) AddNode(nodeSub *NodeSubscriber) (*scuttlebutt.Scuttlebutt, error) {
+// NewMemoryCluster returns a cluster whose nodes communicate over an
+// in-memory network rather than real sockets.
+func NewMemoryCluster() *Cluster {
+	return &Cluster{
+		nodes:   make(map[string]*scuttlebutt.Scuttlebutt),
+		network: scuttlebutt.NewMemoryNetwork(),
+	}
+}
+
+// Network returns the in-memory network the nodes communicate over, used to
+// inject faults, or nil if the cluster uses real sockets.
+func (c *Cluster) Network() *scuttlebutt.MemoryNetwork {
+	return c.network
+}
+
+func (c *Cluster) AddNode(nodeSub *NodeSubscriber, opts ...scuttlebutt.Option) (*scuttlebutt.Scuttlebutt, error) {
+	return c.AddNodeWithAddr("127.0.0.1:0", nodeSub, opts...)
+}
+
+func (c *Cluster) AddNodeWithAddr(addr string, nodeSub *NodeSubscriber, extraOpts ...scuttlebutt.Option) (*scuttlebutt.Scuttlebutt, error) {
 	opts := []scuttlebutt.Option{
 		scuttlebutt.WithSeedCB(func() []string {
 			return c.Seeds()
 		}),
 		scuttlebutt.WithInterval(time.Millisecond * 100),
 	}
+	opts = append(opts, extraOpts...)
 	if nodeSub != nil {
 		opts = append(opts, scuttlebutt.WithOnJoin(nodeSub.OnJoin))
 		opts = append(opts, scuttlebutt.WithOnLeave(nodeSub.OnLeave))
 		opts = append(opts, scuttlebutt.WithOnUpdate(nodeSub.OnUpdate))
+		opts = append(opts, scuttlebutt.WithOnDelete(nodeSub.OnDelete))
+		opts = append(opts, scuttlebutt.WithOnRejoin(nodeSub.OnRejoin))
+	}
+	if c.network != nil {
+		transport, err := c.network.NewTransport(addr)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, scuttlebutt.WithTransport(transport))
 	}
 
-	node, err := scuttlebutt.Create("127.0.0.1:0", opts...)
+	node, err := scuttlebutt.Create(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
-	c.nodes[node.BindAddr()] = node
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodes[node.ID()] = node
 	return node, nil
 }
 
-func (c *Cluster) RemoveNode(addr string) {
-	delete(c.nodes, addr)
+func (c *Cluster) Node(id string) *scuttlebutt.Scuttlebutt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nodes[id]
+}
+
+func (c *Cluster) RemoveNode(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.nodes, id)
 }
 
 func (c *Cluster) Shutdown() error {
-	var errs error
+	// Note don't hold mu while shutting down the nodes, as shutdown waits
+	// for the nodes seed callbacks to return.
+	c.mu.Lock()
+	nodes := make([]*scuttlebutt.Scuttlebutt, 0, len(c.nodes))
 	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.Unlock()
+
+	var errs error
+	for _, node := range nodes {
 		if err := node.Shutdown(); err != nil {
 			errs = multierror.Append(errs, err)
 		}
@@ -116,9 +221,12 @@ func (c *Cluster) Shutdown() error {
 }
 
 func (c *Cluster) Seeds() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	seeds := []string{}
 	for _, node := range c.nodes {
-		seeds = append(seeds, node.BindAddr())
+		seeds = append(seeds, node.AdvertiseAddr())
 	}
 	return seeds
 }
@@ -0,0 +1,40 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests nodes in clusters with different names sharing a network can't join
+// each other.
+func TestClusterName_Isolation(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	stagingSub := NewNodeSubscriber()
+	devSub := NewNodeSubscriber()
+
+	staging1, err := cluster.AddNode(stagingSub, scuttlebutt.WithClusterName("staging"))
+	assert.Nil(t, err)
+	staging2, err := cluster.AddNode(nil, scuttlebutt.WithClusterName("staging"))
+	assert.Nil(t, err)
+	dev, err := cluster.AddNode(devSub, scuttlebutt.WithClusterName("dev"))
+	assert.Nil(t, err)
+
+	id, ok := stagingSub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, staging2.ID(), id)
+
+	_, ok = devSub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.False(t, ok)
+	_, ok = stagingSub.WaitPeerJoinedWithTimeout(time.Millisecond * 100)
+	assert.False(t, ok)
+
+	assert.ElementsMatch(t, []string{staging1.ID(), staging2.ID()}, staging1.IDs())
+	assert.Equal(t, []string{dev.ID()}, dev.IDs())
+	// The dev node keeps re-seeding with the staging nodes.
+	assert.True(t, staging1.Stats().ClusterNameMismatch > 0)
+}
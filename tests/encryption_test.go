@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption_PropagateUpdate(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	_, err := cluster.AddNode(sub, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+
+	node2.UpdateLocal("foo", "bar")
+
+	update, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, node2.ID(), update.ID)
+	assert.Equal(t, "bar", update.Value)
+}
+
+// Tests nodes with different keys can't join each other.
+func TestEncryption_MismatchedKeys(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	_, err := cluster.AddNode(sub, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+	_, err = cluster.AddNode(nil, scuttlebutt.WithSecretKeys(testKey(2)))
+	assert.Nil(t, err)
+
+	_, ok := sub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.False(t, ok)
+}
+
+// Tests nodes with and without encryption can't join each other, and the
+// node without encryption drops the encrypted messages it can't decode.
+func TestEncryption_PlaintextNode(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	_, err := cluster.AddNode(sub, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+	plaintext, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	_, ok := sub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, []string{plaintext.ID()}, plaintext.IDs())
+}
+
+// Tests rotating the key across a live cluster.
+func TestEncryption_RotateKeys(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil, scuttlebutt.WithSecretKeys(testKey(1)))
+	assert.Nil(t, err)
+
+	_, ok := sub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+
+	nodes := []*scuttlebutt.Scuttlebutt{node1, node2}
+	for _, node := range nodes {
+		assert.Nil(t, node.InstallKey(testKey(2)))
+	}
+	for _, node := range nodes {
+		assert.Nil(t, node.UseKey(testKey(2)))
+	}
+	for _, node := range nodes {
+		assert.Nil(t, node.RemoveKey(testKey(1)))
+		assert.Equal(t, [][]byte{testKey(2)}, node.Keys())
+	}
+
+	node2.UpdateLocal("foo", "bar")
+
+	update, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, "bar", update.Value)
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
@@ -0,0 +1,22 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents_InvalidSubscriberBufferSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		_, err := scuttlebutt.Create("127.0.0.1:0", scuttlebutt.WithSubscriberBufferSize(size))
+		assert.NotNil(t, err, size)
+	}
+}
+
+func TestEvents_UnknownSlowConsumerPolicy(t *testing.T) {
+	for _, policy := range []scuttlebutt.SlowConsumerPolicy{0, 5, -1} {
+		_, err := scuttlebutt.Create("127.0.0.1:0", scuttlebutt.WithSlowConsumerPolicy(policy))
+		assert.NotNil(t, err, policy)
+	}
+}
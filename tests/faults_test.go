@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// Tests the cluster converges when the network drops, delays, reorders and
+// duplicates packets.
+func TestFaults_ConvergeUnreliableNetwork(t *testing.T) {
+	cluster := NewMemoryCluster()
+	defer cluster.Shutdown()
+
+	cluster.Network().SetDefaultLink(scuttlebutt.LinkConfig{
+		Loss:      0.2,
+		Latency:   time.Millisecond * 5,
+		Jitter:    time.Millisecond * 5,
+		Reorder:   0.1,
+		Duplicate: 0.1,
+	})
+
+	nodes := []*scuttlebutt.Scuttlebutt{}
+	for i := 0; i != 10; i++ {
+		node, err := cluster.AddNode(nil, scuttlebutt.WithLogger(zap.NewNop()))
+		assert.Nil(t, err)
+		nodes = append(nodes, node)
+	}
+
+	// Update the nodes after they've joined so the updates must be
+	// propagated by gossip rather than push-pull when joining.
+	for i, node := range nodes {
+		assert.Nil(t, node.UpdateLocal("id", fmt.Sprintf("node-%d", i)))
+	}
+
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool {
+			for i, peer := range nodes {
+				val, ok := node.Lookup(peer.ID(), "id")
+				if !ok || val != fmt.Sprintf("node-%d", i) {
+					return false
+				}
+			}
+			return true
+		}, time.Second*10, time.Millisecond*10)
+	}
+}
+
+// Tests a partitioned node is detected as failed, then rejoins when the
+// partition heals.
+func TestFaults_PartitionAndHeal(t *testing.T) {
+	cluster := NewMemoryCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub, scuttlebutt.WithLogger(zap.NewNop()))
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil, scuttlebutt.WithLogger(zap.NewNop()))
+	assert.Nil(t, err)
+	node3, err := cluster.AddNode(nil, scuttlebutt.WithLogger(zap.NewNop()))
+	assert.Nil(t, err)
+
+	// Wait to discovery the other nodes.
+	_, ok := sub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+	_, ok = sub.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+
+	majority := []string{node1.BindAddr(), node2.BindAddr()}
+	minority := []string{node3.BindAddr()}
+	cluster.Network().Partition(majority, minority)
+	cluster.Network().Partition(minority, majority)
+
+	leave, ok := sub.WaitPeerLeftWithTimeout(time.Second * 10)
+	assert.True(t, ok)
+	assert.Equal(t, node3.ID(), leave.ID)
+	assert.Equal(t, scuttlebutt.LeaveReasonFailed, leave.Reason)
+
+	cluster.Network().Heal()
+
+	id, ok := sub.WaitPeerJoinedWithTimeout(time.Second * 10)
+	assert.True(t, ok)
+	assert.Equal(t, node3.ID(), id)
+}
+
+// Tests with an asymmetric partition, where a node can send to its peer but
+// not receive from it, only the node that stops receiving detects its peer
+// as failed.
+func TestFaults_AsymmetricPartition(t *testing.T) {
+	cluster := NewMemoryCluster()
+	defer cluster.Shutdown()
+
+	sub1 := NewNodeSubscriber()
+	sub2 := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub1, scuttlebutt.WithLogger(zap.NewNop()))
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(sub2, scuttlebutt.WithLogger(zap.NewNop()))
+	assert.Nil(t, err)
+
+	_, ok := sub1.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+	_, ok = sub2.WaitPeerJoinedWithTimeout(time.Second)
+	assert.True(t, ok)
+
+	// Drop all packets from node1 to node2.
+	cluster.Network().Partition([]string{node1.BindAddr()}, []string{node2.BindAddr()})
+
+	leave, ok := sub2.WaitPeerLeftWithTimeout(time.Second * 10)
+	assert.True(t, ok)
+	assert.Equal(t, node1.ID(), leave.ID)
+	assert.Equal(t, scuttlebutt.LeaveReasonFailed, leave.Reason)
+
+	// node1 still receives from node2 so considers it up.
+	_, ok = sub1.WaitPeerLeftWithTimeout(time.Millisecond * 500)
+	assert.False(t, ok)
+}
@@ -1,9 +1,15 @@
 package tests
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andydunstall/scuttlebutt"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,15 +28,122 @@ func TestGossip_PropagateUpdate(t *testing.T) {
 
 	update, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
 	assert.True(t, ok)
-	assert.Equal(t, node2.BindAddr(), update.Addr)
+	assert.Equal(t, node2.ID(), update.ID)
 	assert.Equal(t, "foo", update.Key)
 	assert.Equal(t, "bar", update.Value)
 
-	val, ok := node1.Lookup(node2.BindAddr(), "foo")
+	val, ok := node1.Lookup(node2.ID(), "foo")
 	assert.True(t, ok)
 	assert.Equal(t, "bar", val)
 }
 
+// Tests values larger than a single message are propagated.
+func TestGossip_PropagateLargeValue(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	_, err := cluster.AddNode(sub)
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	value := strings.Repeat("a", 10000)
+	assert.Nil(t, node2.UpdateLocal("foo", value))
+
+	update, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, "foo", update.Key)
+	assert.Equal(t, value, update.Value)
+}
+
+// Tests a joining node receives the full cluster state with push-pull, much
+// faster than gossip alone could given the maximum message size.
+func TestGossip_PushPullOnJoin(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	node1, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+	for i := 0; i != 200; i++ {
+		assert.Nil(t, node1.UpdateLocal(fmt.Sprintf("key-%d", i), strings.Repeat("a", 200)))
+	}
+
+	node2, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	// Since only a couple of entries fit in each message, gossip alone would
+	// take around 100 rounds.
+	assert.Eventually(t, func() bool {
+		for i := 0; i != 200; i++ {
+			if _, ok := node2.Lookup(node1.ID(), fmt.Sprintf("key-%d", i)); !ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestGossip_UpdateLocalLimits(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	node, err := cluster.AddNode(
+		nil,
+		scuttlebutt.WithMaxKeySize(10),
+		scuttlebutt.WithMaxValueSize(100),
+		scuttlebutt.WithMaxStateSize(150),
+	)
+	assert.Nil(t, err)
+
+	assert.ErrorIs(t, node.UpdateLocal(strings.Repeat("k", 11), "v"), scuttlebutt.ErrKeyTooLarge)
+	assert.ErrorIs(t, node.UpdateLocal("k", strings.Repeat("v", 101)), scuttlebutt.ErrValueTooLarge)
+	assert.Nil(t, node.UpdateLocal("k1", strings.Repeat("v", 100)))
+	assert.ErrorIs(t, node.UpdateLocal("k2", strings.Repeat("v", 100)), scuttlebutt.ErrStateTooLarge)
+}
+
+// Tests reserved keys can't be updated or deleted.
+func TestGossip_ReservedKey(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	node, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, node.UpdateLocal("__heartbeat", "1"))
+	assert.NotNil(t, node.DeleteLocal("__heartbeat"))
+	assert.NotNil(t, node.DeleteLocal("__addr"))
+	assert.Equal(t, []string{node.AdvertiseAddr()}, node.Addrs())
+}
+
+func TestGossip_PropagateDelete(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub)
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	node2.UpdateLocal("foo", "bar")
+
+	_, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+
+	assert.Nil(t, node2.DeleteLocal("foo"))
+
+	del, ok := sub.WaitPeerDeletedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, node2.ID(), del.ID)
+	assert.Equal(t, "foo", del.Key)
+
+	_, ok = node1.Lookup(node2.ID(), "foo")
+	assert.False(t, ok)
+}
+
 func TestGossip_PeerDiscovery(t *testing.T) {
 	cluster := NewCluster()
 	defer cluster.Shutdown()
@@ -71,8 +184,211 @@ func TestGossip_DetectFailedNode(t *testing.T) {
 	assert.True(t, ok)
 
 	node3.Shutdown()
-	cluster.RemoveNode(node3.BindAddr())
+	cluster.RemoveNode(node3.ID())
+
+	leave, ok := sub.WaitPeerLeftWithTimeout(time.Second * 10)
+	assert.True(t, ok)
+	assert.Equal(t, scuttlebutt.LeaveReasonFailed, leave.Reason)
+}
+
+func TestGossip_Leave(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+	leavingSub := NewNodeSubscriber()
+
+	_, err := cluster.AddNode(sub)
+	assert.Nil(t, err)
+	_, err = cluster.AddNode(nil)
+	assert.Nil(t, err)
+	node3, err := cluster.AddNode(leavingSub)
+	assert.Nil(t, err)
+
+	// Wait for both the leaving node and the subscribed node to discover the
+	// other nodes.
+	for _, s := range []*NodeSubscriber{sub, leavingSub} {
+		_, ok := s.WaitPeerJoinedWithTimeout(time.Second)
+		assert.True(t, ok)
+		_, ok = s.WaitPeerJoinedWithTimeout(time.Second)
+		assert.True(t, ok)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	assert.Nil(t, node3.Leave(ctx))
+
+	node3.Shutdown()
+	cluster.RemoveNode(node3.ID())
+
+	// The leave should be received well before the failure detector would
+	// detect the node as down.
+	leave, ok := sub.WaitPeerLeftWithTimeout(time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, node3.ID(), leave.ID)
+	assert.Equal(t, scuttlebutt.LeaveReasonLeft, leave.Reason)
+}
+
+// Tests a node that restarts with the same ID is detected as rejoining and its
+// new state replaces the old state, even though its version restarted.
+func TestGossip_RejoinRestartedNode(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	sub := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub)
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	node2.UpdateLocal("foo", "bar")
+	node2.UpdateLocal("boo", "baz")
+
+	_, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	_, ok = sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+
+	id := node2.ID()
+	addr := node2.BindAddr()
+	assert.Nil(t, node2.Shutdown())
+	cluster.RemoveNode(id)
+
+	node2, err = cluster.AddNodeWithAddr(addr, nil, scuttlebutt.WithNodeID(id))
+	assert.Nil(t, err)
+	node2.UpdateLocal("foo", "car")
+
+	rejoined, ok := sub.WaitPeerRejoinedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, id, rejoined)
+
+	update, ok := sub.WaitPeerUpdatedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, "car", update.Value)
+
+	// The state from the old generation should be discarded.
+	_, ok = node1.Lookup(id, "boo")
+	assert.False(t, ok)
+}
+
+// Tests a node that restarts with the same ID on a different address keeps
+// its identity, rather than joining as a new member while its old identity is
+// considered down.
+func TestGossip_RestartWithNewAddr(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
 
-	_, ok = sub.WaitPeerLeftWithTimeout(time.Second * 10)
+	sub := NewNodeSubscriber()
+
+	node1, err := cluster.AddNode(sub)
+	assert.Nil(t, err)
+	node2, err := cluster.AddNode(nil, scuttlebutt.WithNodeID("node-2"))
+	assert.Nil(t, err)
+
+	id, ok := sub.WaitPeerJoinedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, "node-2", id)
+
+	oldAddr := node2.BindAddr()
+	assert.Nil(t, node2.Shutdown())
+	cluster.RemoveNode("node-2")
+
+	node2, err = cluster.AddNode(nil, scuttlebutt.WithNodeID("node-2"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldAddr, node2.BindAddr())
+
+	rejoined, ok := sub.WaitPeerRejoinedWithTimeout(3 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, "node-2", rejoined)
+
+	assert.Eventually(t, func() bool {
+		addr, ok := node1.Addr("node-2")
+		return ok && addr == node2.BindAddr()
+	}, time.Second*3, time.Millisecond*10)
+	assert.ElementsMatch(t, []string{node1.ID(), "node-2"}, node1.IDs())
+	status, ok := node1.Status("node-2")
+	assert.True(t, ok)
+	assert.Equal(t, scuttlebutt.PeerStatusAlive, status)
+}
+
+func TestGossip_Subscribe(t *testing.T) {
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	node1, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+
+	eventCh, cancel := node1.Subscribe(scuttlebutt.EventTypes(
+		scuttlebutt.EventJoin, scuttlebutt.EventUpdate,
+	))
+	defer cancel()
+
+	node2, err := cluster.AddNode(nil)
+	assert.Nil(t, err)
+	node2.UpdateLocal("foo", "bar")
+
+	e := waitEvent(t, eventCh)
+	assert.Equal(t, scuttlebutt.EventJoin, e.Type)
+	assert.Equal(t, node2.ID(), e.ID)
+
+	e = waitEvent(t, eventCh)
+	assert.Equal(t, scuttlebutt.EventUpdate, e.Type)
+	assert.Equal(t, node2.ID(), e.ID)
+	assert.Equal(t, node2.BindAddr(), e.Addr)
+	assert.Equal(t, "foo", e.Key)
+	assert.Equal(t, "bar", e.Value)
+
+	// Subscribers can call back into the node when handling events.
+	val, ok := node1.Lookup(e.ID, e.Key)
 	assert.True(t, ok)
+	assert.Equal(t, "bar", val)
+}
+
+func waitEvent(t *testing.T, ch <-chan scuttlebutt.Event) scuttlebutt.Event {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return scuttlebutt.Event{}
+	}
+}
+
+// Tests incoming streams over the concurrent stream limit are closed, rather
+// than each buffering a push-pull request.
+func TestGossip_MaxConcurrentStreams(t *testing.T) {
+	node, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	// Open more idle streams than the limit of 16, which are held open until
+	// the push-pull timeout.
+	var conns []net.Conn
+	for i := 0; i != 20; i++ {
+		conn, err := net.Dial("tcp", node.AdvertiseAddr())
+		assert.Nil(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// Read from each stream concurrently to find those that were closed.
+	closedCh := make(chan bool, len(conns))
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500)); err != nil {
+				closedCh <- false
+				return
+			}
+			_, err := conn.Read(make([]byte, 1))
+			closedCh <- err == io.EOF
+		}(conn)
+	}
+	closed := 0
+	for range conns {
+		if <-closedCh {
+			closed++
+		}
+	}
+	assert.Equal(t, 4, closed)
 }
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+// skipIfNoIPv6 skips the test if the system doesn't support IPv6 loopback.
+func skipIfNoIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 not supported")
+	}
+	ln.Close()
+}
+
+// Tests a cluster of nodes bound to the IPv6 loopback address converges.
+func TestIPv6_ClusterConverges(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	nodes := []*scuttlebutt.Scuttlebutt{}
+	for i := 0; i != 3; i++ {
+		node, err := cluster.AddNodeWithAddr("[::1]:0", nil)
+		assert.Nil(t, err)
+		assert.Nil(t, node.UpdateLocal("id", fmt.Sprintf("node-%d", i)))
+
+		host, _, err := net.SplitHostPort(node.BindAddr())
+		assert.Nil(t, err)
+		assert.Equal(t, "::1", host)
+
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool {
+			for i, peer := range nodes {
+				val, ok := node.Lookup(peer.ID(), "id")
+				if !ok || val != fmt.Sprintf("node-%d", i) {
+					return false
+				}
+			}
+			return true
+		}, time.Second*5, time.Millisecond*10)
+
+		for _, peer := range nodes {
+			addr, ok := node.Addr(peer.ID())
+			assert.True(t, ok)
+			assert.Equal(t, peer.AdvertiseAddr(), addr)
+		}
+	}
+}
+
+// Tests a node bound to the IPv6 unspecified address is reached by its
+// advertised IPv6 address.
+func TestIPv6_BindUnspecified(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	ln, err := net.Listen("tcp6", "[::]:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	assert.Nil(t, ln.Close())
+
+	advertiseAddr := fmt.Sprintf("[::1]:%d", port)
+	node1, err := cluster.AddNodeWithAddr(
+		fmt.Sprintf("[::]:%d", port),
+		nil,
+		scuttlebutt.WithAdvertiseAddr(advertiseAddr),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	nodeSub := NewNodeSubscriber()
+	node2, err := cluster.AddNodeWithAddr("[::1]:0", nodeSub)
+	assert.Nil(t, err)
+
+	id, ok := nodeSub.WaitPeerJoinedWithTimeout(time.Second * 5)
+	assert.True(t, ok)
+	assert.Equal(t, node1.ID(), id)
+
+	assert.Eventually(t, func() bool {
+		v, ok := node2.Lookup(node1.ID(), "foo")
+		return ok && v == "bar"
+	}, time.Second*5, time.Millisecond*10)
+	assert.Eventually(t, func() bool {
+		addr, ok := node1.Addr(node2.ID())
+		return ok && addr == node2.AdvertiseAddr()
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests a node bound to both IPv4 and IPv6 can be seeded by nodes using
+// either.
+func TestIPv6_DualStackSeed(t *testing.T) {
+	skipIfNoIPv6(t)
+
+	cluster := NewCluster()
+	defer cluster.Shutdown()
+
+	ln, err := net.Listen("tcp", "[::]:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	assert.Nil(t, ln.Close())
+
+	node1, err := cluster.AddNodeWithAddr(
+		fmt.Sprintf("[::]:%d", port),
+		nil,
+		scuttlebutt.WithAdvertiseAddr(fmt.Sprintf("[::1]:%d", port)),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		seed := net.JoinHostPort(host, strconv.Itoa(port))
+		node, err := scuttlebutt.Create(
+			net.JoinHostPort(host, "0"),
+			scuttlebutt.WithSeedCB(func() []string {
+				return []string{seed}
+			}),
+			scuttlebutt.WithInterval(time.Millisecond*100),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, node.UpdateLocal("foo", host))
+
+		assert.Eventually(t, func() bool {
+			v, ok := node.Lookup(node1.ID(), "foo")
+			return ok && v == "bar"
+		}, time.Second*5, time.Millisecond*10, seed)
+		assert.Eventually(t, func() bool {
+			v, ok := node1.Lookup(node.ID(), "foo")
+			return ok && v == host
+		}, time.Second*5, time.Millisecond*10, seed)
+
+		assert.Nil(t, node.Shutdown())
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+// multicastGroup returns a multicast group using a free port, so concurrent
+// tests don't discover each others nodes.
+func multicastGroup(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	assert.Nil(t, err)
+	defer conn.Close()
+	return fmt.Sprintf("239.255.82.29:%d", conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Tests nodes on the same network join without any seeds using multicast
+// discovery.
+func TestMulticast_ClusterConverges(t *testing.T) {
+	group := multicastGroup(t)
+
+	var nodes []*scuttlebutt.Scuttlebutt
+	for i := 0; i != 3; i++ {
+		node, err := scuttlebutt.Create(
+			"127.0.0.1:0",
+			scuttlebutt.WithMulticastDiscovery(true),
+			scuttlebutt.WithMulticastGroup(group),
+			scuttlebutt.WithMulticastInterval(time.Millisecond*100),
+			scuttlebutt.WithInterval(time.Millisecond*100),
+		)
+		if err != nil {
+			t.Skipf("multicast not supported: %s", err)
+		}
+		defer node.Shutdown()
+		assert.Nil(t, node.UpdateLocal("foo", fmt.Sprintf("bar-%d", i)))
+		nodes = append(nodes, node)
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, node := range nodes {
+			for i, peer := range nodes {
+				v, ok := node.Lookup(peer.ID(), "foo")
+				if !ok || v != fmt.Sprintf("bar-%d", i) {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests nodes with different cluster names don't discover each other.
+func TestMulticast_ClusterName(t *testing.T) {
+	group := multicastGroup(t)
+
+	node1, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithClusterName("cluster-1"),
+		scuttlebutt.WithMulticastDiscovery(true),
+		scuttlebutt.WithMulticastGroup(group),
+		scuttlebutt.WithMulticastInterval(time.Millisecond*100),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	if err != nil {
+		t.Skipf("multicast not supported: %s", err)
+	}
+	defer node1.Shutdown()
+	node2, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithClusterName("cluster-2"),
+		scuttlebutt.WithMulticastDiscovery(true),
+		scuttlebutt.WithMulticastGroup(group),
+		scuttlebutt.WithMulticastInterval(time.Millisecond*100),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node2.Shutdown()
+
+	time.Sleep(time.Millisecond * 500)
+	assert.Equal(t, []string{node1.ID()}, node1.IDs())
+	assert.Equal(t, []string{node2.ID()}, node2.IDs())
+}
+
+// Tests an invalid multicast group fails to create the node.
+func TestMulticast_InvalidGroup(t *testing.T) {
+	_, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithMulticastDiscovery(true),
+		scuttlebutt.WithMulticastGroup("127.0.0.1:8229"),
+	)
+	assert.NotNil(t, err)
+}
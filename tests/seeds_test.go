@@ -0,0 +1,240 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver is a DNS resolver whose records can be updated while the
+// nodes are running.
+type fakeResolver struct {
+	srv map[string][]*net.SRV
+	ips map[string][]net.IPAddr
+	mu  sync.Mutex
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		srv: make(map[string][]*net.SRV),
+		ips: make(map[string][]net.IPAddr),
+	}
+}
+
+func (r *fakeResolver) SetSRV(name string, records []*net.SRV) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.srv[name] = records
+}
+
+func (r *fakeResolver) SetIPs(host string, ips []net.IPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips[host] = ips
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cname := "_" + service + "._" + proto + "." + name
+	records, ok := r.srv[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// Tests a node discovers seeds using SRV records.
+func TestSeeds_SRV(t *testing.T) {
+	node1, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node1.Shutdown()
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	_, port, err := net.SplitHostPort(node1.AdvertiseAddr())
+	assert.Nil(t, err)
+	portNum, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+
+	resolver := newFakeResolver()
+	resolver.SetSRV("_gossip._udp.cluster.local", []*net.SRV{
+		{Target: "node-1.cluster.local.", Port: uint16(portNum)},
+	})
+	resolver.SetIPs("node-1.cluster.local", []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}})
+
+	node2, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedProvider(scuttlebutt.NewSRVSeeds("gossip", "udp", "cluster.local", resolver)),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node2.Shutdown()
+
+	assert.Eventually(t, func() bool {
+		v, ok := node2.Lookup(node1.ID(), "foo")
+		return ok && v == "bar"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests DNS seeds are resolved again each time the node re-seeds, so a node
+// joins once its seeds are registered in DNS.
+func TestSeeds_DNSResolvedOnReseed(t *testing.T) {
+	node1, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node1.Shutdown()
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	_, port, err := net.SplitHostPort(node1.AdvertiseAddr())
+	assert.Nil(t, err)
+	portNum, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+
+	resolver := newFakeResolver()
+	node2, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedProvider(scuttlebutt.NewDNSSeeds("seeds.cluster.local", portNum, resolver)),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node2.Shutdown()
+
+	// Wait for a few re-seeds that fail to resolve.
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, []string{node2.ID()}, node2.IDs())
+
+	resolver.SetIPs("seeds.cluster.local", []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}})
+
+	assert.Eventually(t, func() bool {
+		v, ok := node2.Lookup(node1.ID(), "foo")
+		return ok && v == "bar"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests seeds from SeedCB and a seed provider are both used.
+func TestSeeds_SeedCBAndProvider(t *testing.T) {
+	node1, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node1.Shutdown()
+	node2, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node2.Shutdown()
+
+	node3, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedCB(func() []string {
+			return []string{node1.AdvertiseAddr()}
+		}),
+		scuttlebutt.WithSeedProvider(scuttlebutt.NewStaticSeeds(node2.AdvertiseAddr())),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node3.Shutdown()
+
+	// Since node1 and node2 have no seeds, they only discover each other
+	// through node3.
+	assert.Eventually(t, func() bool {
+		return len(node1.IDs()) == 3 && len(node2.IDs()) == 3
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests a node seeded from a watched file joins once the file is updated
+// with a seed, and invalid files are reported to the error callback.
+func TestSeeds_FileReload(t *testing.T) {
+	node1, err := scuttlebutt.Create("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer node1.Shutdown()
+	assert.Nil(t, node1.UpdateLocal("foo", "bar"))
+
+	path := filepath.Join(t.TempDir(), "seeds")
+	assert.Nil(t, os.WriteFile(path, []byte("not-an-address\n"), 0o644))
+
+	errCh := make(chan error, 1)
+	provider := scuttlebutt.NewFileSeeds(path, time.Millisecond*10, func(err error) {
+		// Don't block if the file is read while partially written.
+		select {
+		case errCh <- err:
+		default:
+		}
+	}, nil)
+
+	select {
+	case err := <-errCh:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("error not reported")
+	}
+
+	node2, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedProvider(provider),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node2.Shutdown()
+
+	assert.Nil(t, os.WriteFile(path, []byte(`["`+node1.AdvertiseAddr()+`"]`), 0o644))
+
+	assert.Eventually(t, func() bool {
+		v, ok := node2.Lookup(node1.ID(), "foo")
+		return ok && v == "bar"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// Tests a seed provider that blocks doesn't block the nodes gossip rounds, so
+// the node still detects failed peers.
+func TestSeeds_BlockedProvider(t *testing.T) {
+	node1, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedProvider(scuttlebutt.SeedFunc(func(ctx context.Context) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+	defer node1.Shutdown()
+
+	// Wait for node1 to re-seed, which blocks until shutdown.
+	time.Sleep(time.Millisecond * 300)
+
+	node2, err := scuttlebutt.Create(
+		"127.0.0.1:0",
+		scuttlebutt.WithSeedCB(func() []string {
+			return []string{node1.AdvertiseAddr()}
+		}),
+		scuttlebutt.WithInterval(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, ok := node1.Status(node2.ID())
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+
+	assert.Nil(t, node2.Shutdown())
+
+	assert.Eventually(t, func() bool {
+		status, _ := node1.Status(node2.ID())
+		return status == scuttlebutt.PeerStatusDead
+	}, time.Second*10, time.Millisecond*10)
+}
@@ -0,0 +1,521 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newSimulation(seed int64, numNodes int, interval time.Duration, options ...scuttlebutt.Option) (*scuttlebutt.Simulation, error) {
+	sim := scuttlebutt.NewSimulation(
+		seed,
+		append([]scuttlebutt.Option{
+			scuttlebutt.WithLogger(zap.NewNop()),
+			scuttlebutt.WithInterval(interval),
+		}, options...)...,
+	)
+	for i := 0; i != numNodes; i++ {
+		if _, err := addNode(sim); err != nil {
+			return nil, err
+		}
+	}
+	return sim, nil
+}
+
+// addNode adds a node to the simulation with an "id" of node-<index>.
+func addNode(sim *scuttlebutt.Simulation, options ...scuttlebutt.Option) (*scuttlebutt.Scuttlebutt, error) {
+	id := fmt.Sprintf("node-%d", len(sim.Addrs()))
+	node, err := sim.AddNode("127.0.0.1:0", options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := node.UpdateLocal("id", id); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// converged returns whether every node in the simulation knows the state of
+// every other node.
+func converged(sim *scuttlebutt.Simulation) bool {
+	ids := sim.IDs()
+	for _, addr := range sim.Addrs() {
+		node := sim.Node(addr)
+		for i, peerID := range ids {
+			val, ok := node.Lookup(peerID, "id")
+			if !ok || val != fmt.Sprintf("node-%d", i) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestSimulation_Converge(t *testing.T) {
+	sim, err := newSimulation(1, 50, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+}
+
+// Tests events emitted during a step are dispatched by the time Step returns,
+// so can be checked without waiting.
+func TestSimulation_EventsDispatchedOnStep(t *testing.T) {
+	sim, err := newSimulation(10, 0, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	var events []string
+	_, err = addNode(sim, scuttlebutt.WithOnJoin(func(peerID string) {
+		events = append(events, "join "+peerID)
+	}), scuttlebutt.WithOnLeave(func(peerID string, reason scuttlebutt.LeaveReason) {
+		events = append(events, "leave "+peerID+" "+reason.String())
+	}))
+	assert.Nil(t, err)
+	peer, err := addNode(sim)
+	assert.Nil(t, err)
+	node := sim.Node(sim.Addrs()[0])
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+	assert.Equal(t, []string{"join " + peer.ID()}, events)
+
+	assert.Nil(t, sim.RemoveNode(peer.BindAddr()))
+	assert.True(t, sim.RunUntil(func() bool {
+		status, _ := node.Status(peer.ID())
+		return status == scuttlebutt.PeerStatusDead
+	}, time.Minute))
+	assert.Equal(t, []string{
+		"join " + peer.ID(),
+		"leave " + peer.ID() + " " + scuttlebutt.LeaveReasonFailed.String(),
+	}, events)
+}
+
+// Tests a simulation is reproducible from its seed, even with an unreliable
+// network.
+func TestSimulation_Reproducible(t *testing.T) {
+	run := func() time.Time {
+		sim, err := newSimulation(4, 20, time.Millisecond*100)
+		assert.Nil(t, err)
+		defer sim.Shutdown()
+
+		sim.Network().SetDefaultLink(scuttlebutt.LinkConfig{
+			Loss:      0.3,
+			Latency:   time.Millisecond * 20,
+			Jitter:    time.Millisecond * 100,
+			Duplicate: 0.1,
+		})
+
+		assert.True(t, sim.RunUntil(func() bool {
+			return converged(sim)
+		}, time.Minute))
+		return sim.Now()
+	}
+
+	assert.Equal(t, run(), run())
+}
+
+// Tests a failed node is detected, then its state is removed once it expires
+// an hour later.
+func TestSimulation_DetectFailedNodeAndExpire(t *testing.T) {
+	// Use a longer interval to reduce the number of steps to simulate an
+	// hour.
+	sim, err := newSimulation(2, 5, time.Second)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	failed := sim.IDs()[4]
+	assert.Nil(t, sim.RemoveNode(addrs[4]))
+
+	node := sim.Node(addrs[0])
+	assert.True(t, sim.RunUntil(func() bool {
+		return len(node.IDs()) == 4
+	}, time.Minute))
+	assert.NotContains(t, node.IDs(), failed)
+
+	// The state of the down node is kept until it expires.
+	_, ok := node.Lookup(failed, "id")
+	assert.True(t, ok)
+
+	sim.Run(time.Hour + time.Minute)
+
+	_, ok = node.Lookup(failed, "id")
+	assert.False(t, ok)
+}
+
+// Tests a node that can't reach a peer directly doesn't consider the peer
+// down, since the other nodes can still reach the peer and acknowledge the
+// indirect probes.
+func TestSimulation_IndirectProbe(t *testing.T) {
+	sim, err := newSimulation(3, 0, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	// Since heartbeats are received indirectly through other nodes, use a
+	// low conviction threshold so the first node suspects its peers whenever
+	// a heartbeat is late.
+	_, err = addNode(sim, scuttlebutt.WithConvictionThreshold(0.1))
+	assert.Nil(t, err)
+	for i := 0; i != 3; i++ {
+		_, err = addNode(sim)
+		assert.Nil(t, err)
+	}
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	sim.Network().Partition(addrs[:1], addrs[1:2])
+	sim.Network().Partition(addrs[1:2], addrs[:1])
+
+	node := sim.Node(addrs[0])
+	assert.False(t, sim.RunUntil(func() bool {
+		return len(node.IDs()) != 4
+	}, time.Minute*5))
+}
+
+// Tests with indirect probes disabled, a node that can't reach a peer directly
+// considers the peer down.
+func TestSimulation_IndirectProbeDisabled(t *testing.T) {
+	sim, err := newSimulation(3, 0, time.Millisecond*100, scuttlebutt.WithIndirectProbes(0))
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	_, err = addNode(sim, scuttlebutt.WithConvictionThreshold(0.1))
+	assert.Nil(t, err)
+	for i := 0; i != 3; i++ {
+		_, err = addNode(sim)
+		assert.Nil(t, err)
+	}
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	sim.Network().Partition(addrs[:1], addrs[1:2])
+	sim.Network().Partition(addrs[1:2], addrs[:1])
+
+	node := sim.Node(addrs[0])
+	assert.True(t, sim.RunUntil(func() bool {
+		status, _ := node.Status(sim.IDs()[1])
+		return status == scuttlebutt.PeerStatusDead
+	}, time.Minute*5))
+}
+
+// Tests when one node convicts a failed peer, the conviction is gossiped to
+// the rest of the cluster, rather than each node waiting for its own failure
+// detector.
+func TestSimulation_ConvictionDisseminated(t *testing.T) {
+	sim, err := newSimulation(5, 1, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	// Only the first node can detect failed peers within the test.
+	for i := 1; i != 5; i++ {
+		_, err := addNode(
+			sim,
+			scuttlebutt.WithFailureDetector(scuttlebutt.NewTimeoutDetector(time.Hour)),
+		)
+		assert.Nil(t, err)
+	}
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	failed := sim.IDs()[4]
+	assert.Nil(t, sim.RemoveNode(addrs[4]))
+
+	assert.True(t, sim.RunUntil(func() bool {
+		for _, addr := range addrs[:4] {
+			status, _ := sim.Node(addr).Status(failed)
+			if status != scuttlebutt.PeerStatusDead {
+				return false
+			}
+		}
+		return true
+	}, time.Minute))
+}
+
+// Tests when a node suspects a peer that is still alive, the peer refutes the
+// suspicion so the other nodes never consider it dead.
+func TestSimulation_SuspicionRefuted(t *testing.T) {
+	sim, err := newSimulation(6, 0, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	_, err = addNode(sim, scuttlebutt.WithConvictionThreshold(0.1))
+	assert.Nil(t, err)
+	for i := 0; i != 3; i++ {
+		_, err = addNode(sim)
+		assert.Nil(t, err)
+	}
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	sim.Network().Partition(addrs[:1], addrs[1:2])
+	sim.Network().Partition(addrs[1:2], addrs[:1])
+
+	node := sim.Node(addrs[2])
+	suspected := sim.IDs()[1]
+	statuses := make(map[scuttlebutt.PeerStatus]bool)
+	sim.RunUntil(func() bool {
+		status, _ := node.Status(suspected)
+		statuses[status] = true
+		return false
+	}, time.Minute)
+
+	assert.True(t, statuses[scuttlebutt.PeerStatusSuspect])
+	assert.False(t, statuses[scuttlebutt.PeerStatusDead])
+}
+
+// Tests a node that can't reach a peer directly still receives the peers
+// heartbeats through the other nodes, so doesn't consider the peer down even
+// without probing.
+func TestSimulation_HeartbeatReceivedIndirectly(t *testing.T) {
+	// Use a high conviction threshold since without probing any false
+	// positive would cause a peer to be considered down.
+	sim, err := newSimulation(
+		8, 4, time.Millisecond*100,
+		scuttlebutt.WithIndirectProbes(0),
+		scuttlebutt.WithConvictionThreshold(20),
+	)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	sim.Network().Partition(addrs[:1], addrs[1:2])
+	sim.Network().Partition(addrs[1:2], addrs[:1])
+
+	node := sim.Node(addrs[0])
+	assert.False(t, sim.RunUntil(func() bool {
+		return len(node.IDs()) != 4
+	}, time.Minute*5))
+}
+
+// Tests a node with a custom failure detector uses it to detect failed peers,
+// and exposes the suspicion level of each peer.
+func TestSimulation_CustomFailureDetector(t *testing.T) {
+	sim, err := newSimulation(8, 0, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	// Only the last node can detect failed peers within the test.
+	for i := 0; i != 3; i++ {
+		_, err := addNode(
+			sim,
+			scuttlebutt.WithFailureDetector(scuttlebutt.NewTimeoutDetector(time.Hour)),
+		)
+		assert.Nil(t, err)
+	}
+	node, err := addNode(
+		sim,
+		scuttlebutt.WithFailureDetector(scuttlebutt.NewTimeoutDetector(time.Second*10)),
+	)
+	assert.Nil(t, err)
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	failed := sim.IDs()[0]
+	suspicion, ok := node.Suspicion(failed)
+	assert.True(t, ok)
+	assert.Less(t, suspicion, 1.0)
+	_, ok = node.Suspicion(node.ID())
+	assert.False(t, ok)
+
+	assert.Nil(t, sim.RemoveNode(sim.Addrs()[0]))
+
+	// The node doesn't consider the peer down until the timeout.
+	sim.Run(time.Second * 5)
+	status, _ := node.Status(failed)
+	assert.Equal(t, scuttlebutt.PeerStatusAlive, status)
+	suspicion, _ = node.Suspicion(failed)
+	assert.Greater(t, suspicion, 0.4)
+
+	assert.True(t, sim.RunUntil(func() bool {
+		status, _ := node.Status(failed)
+		return status == scuttlebutt.PeerStatusDead
+	}, time.Second*10))
+}
+
+// Tests with flap damping enabled, a peer that repeatedly fails and recovers
+// is reported as flapping and its join and leave events are suppressed.
+func TestSimulation_FlapDamping(t *testing.T) {
+	sim, err := newSimulation(
+		9, 4, time.Millisecond*100,
+		scuttlebutt.WithFlapDamping(true),
+		scuttlebutt.WithSubscriberBufferSize(1024),
+	)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	addrs := sim.Addrs()
+	flapping := sim.IDs()[3]
+	node := sim.Node(addrs[0])
+	eventCh, cancel := node.Subscribe(func(e scuttlebutt.Event) bool {
+		if e.ID != flapping {
+			return false
+		}
+		return e.Type == scuttlebutt.EventJoin ||
+			e.Type == scuttlebutt.EventLeave ||
+			e.Type == scuttlebutt.EventFlapping
+	})
+	defer cancel()
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	for i := 0; i != 5; i++ {
+		sim.Network().Partition(addrs[3:], addrs[:3])
+		sim.Network().Partition(addrs[:3], addrs[3:])
+		assert.True(t, sim.RunUntil(func() bool {
+			status, _ := node.Status(flapping)
+			return status == scuttlebutt.PeerStatusDead
+		}, time.Minute))
+
+		sim.Network().Heal()
+		assert.True(t, sim.RunUntil(func() bool {
+			status, _ := node.Status(flapping)
+			return status == scuttlebutt.PeerStatusAlive
+		}, time.Minute))
+	}
+
+	// The peer joining and its first two failures are reported, then the
+	// third failure is reported as flapping instead.
+	for _, eventType := range []scuttlebutt.EventType{
+		scuttlebutt.EventJoin,
+		scuttlebutt.EventLeave,
+		scuttlebutt.EventJoin,
+		scuttlebutt.EventLeave,
+		scuttlebutt.EventJoin,
+		scuttlebutt.EventFlapping,
+	} {
+		e := waitEvent(t, eventCh)
+		assert.Equal(t, eventType, e.Type)
+	}
+
+	// Once the peer stabilizes it is no longer suppressed, though since it
+	// was up when it started flapping theres no need to notify again.
+	sim.Run(time.Minute * 10)
+	select {
+	case e := <-eventCh:
+		t.Fatalf("unexpected event: %s", e.Type)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// Tests once a failed node is reaped it isn't gossiped back by nodes that
+// still think it is up.
+func TestSimulation_ReapedNodeNotResurrected(t *testing.T) {
+	sim, err := newSimulation(
+		10, 0, time.Millisecond*100,
+		scuttlebutt.WithReapTimeout(time.Minute),
+	)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	for i := 0; i != 3; i++ {
+		_, err = addNode(sim)
+		assert.Nil(t, err)
+	}
+	// Add a node that won't detect the failed node itself.
+	_, err = addNode(
+		sim,
+		scuttlebutt.WithFailureDetector(scuttlebutt.NewTimeoutDetector(time.Hour)),
+	)
+	assert.Nil(t, err)
+	_, err = addNode(sim)
+	assert.Nil(t, err)
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	failed := sim.IDs()[4]
+	assert.Nil(t, sim.RemoveNode(addrs[4]))
+
+	// Drop all packets to the fourth node, so it never learns the failed node
+	// is down and keeps gossiping it to the other nodes.
+	sim.Network().Partition(addrs[:3], addrs[3:4])
+
+	removed := func(addrs []string) bool {
+		for _, addr := range addrs {
+			if _, ok := sim.Node(addr).Status(failed); ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return removed(addrs[:3])
+	}, time.Minute*5))
+	assert.False(t, sim.RunUntil(func() bool {
+		return !removed(addrs[:3])
+	}, time.Second*30))
+
+	// Once healed the fourth node receives the tombstone so also removes the
+	// failed node.
+	sim.Network().Heal()
+	assert.True(t, sim.RunUntil(func() bool {
+		return removed(addrs[:4])
+	}, time.Second*30))
+	assert.False(t, sim.RunUntil(func() bool {
+		return !removed(addrs[:4])
+	}, time.Minute*5))
+}
+
+// Tests a node removed with ForceRemove is removed from every node in the
+// cluster.
+func TestSimulation_ForceRemove(t *testing.T) {
+	sim, err := newSimulation(11, 5, time.Millisecond*100)
+	assert.Nil(t, err)
+	defer sim.Shutdown()
+
+	assert.True(t, sim.RunUntil(func() bool {
+		return converged(sim)
+	}, time.Minute))
+
+	addrs := sim.Addrs()
+	removed := sim.IDs()[4]
+	assert.Nil(t, sim.RemoveNode(addrs[4]))
+	assert.Nil(t, sim.Node(addrs[0]).ForceRemove(removed))
+	assert.Equal(t, scuttlebutt.ErrUnknownPeer, sim.Node(addrs[0]).ForceRemove(removed))
+
+	// The node is removed well before it would be reaped.
+	assert.True(t, sim.RunUntil(func() bool {
+		for _, addr := range addrs[:4] {
+			if _, ok := sim.Node(addr).Status(removed); ok {
+				return false
+			}
+		}
+		return true
+	}, time.Minute))
+}
@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// Tests a large cluster running on an in-memory network converges, so every
+// node learns the state of every other node.
+func TestTransport_MemoryClusterConverges(t *testing.T) {
+	cluster := NewMemoryCluster()
+	defer cluster.Shutdown()
+
+	ids := []string{}
+	for i := 0; i != 50; i++ {
+		// Use a nop logger as logging from each node dominates the test
+		// duration.
+		node, err := cluster.AddNode(nil, scuttlebutt.WithLogger(zap.NewNop()))
+		assert.Nil(t, err)
+		assert.Nil(t, node.UpdateLocal("id", fmt.Sprintf("node-%d", i)))
+		ids = append(ids, node.ID())
+	}
+
+	for _, id := range ids {
+		node := cluster.Node(id)
+		assert.Eventually(t, func() bool {
+			for i, peerID := range ids {
+				val, ok := node.Lookup(peerID, "id")
+				if !ok || val != fmt.Sprintf("node-%d", i) {
+					return false
+				}
+			}
+			return true
+		}, time.Second*10, time.Millisecond*10)
+	}
+}
+
+// Tests the bind address passed to Create is ignored when a transport is
+// configured.
+func TestTransport_IgnoreBindAddr(t *testing.T) {
+	network := scuttlebutt.NewMemoryNetwork()
+	transport, err := network.NewTransport("10.26.104.11:8119")
+	assert.Nil(t, err)
+
+	node, err := scuttlebutt.Create("127.0.0.1:0", scuttlebutt.WithTransport(transport))
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	assert.Equal(t, "10.26.104.11:8119", node.BindAddr())
+}
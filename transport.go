@@ -0,0 +1,51 @@
+package scuttlebutt
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/andydunstall/scuttlebutt/internal"
+)
+
+// Transport is used to communicate with the other nodes in the cluster, using
+// best-effort packets for gossip and reliable streams for push-pull state
+// synchronization. By default nodes use UDP for packets and TCP for streams,
+// both listening on the bind address, though a custom transport can be set
+// with WithTransport.
+type Transport = internal.Transport
+
+// Packet is an incoming packet received by a Transport.
+type Packet = internal.Packet
+
+// MemoryNetwork is an in-memory network that MemoryTransports register on.
+// This is used to run many nodes in a single process without real sockets,
+// such as in tests and simulations.
+type MemoryNetwork = internal.MemoryNetwork
+
+// MemoryTransport is a Transport that communicates with the other transports
+// on the same MemoryNetwork. Create using MemoryNetwork.NewTransport.
+type MemoryTransport = internal.MemoryTransport
+
+// NewMemoryNetwork returns a new empty in-memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return internal.NewMemoryNetwork(
+		internal.NewRealClock(),
+		rand.New(rand.NewSource(time.Now().UnixNano())),
+	)
+}
+
+// LinkConfig describes the faults injected into packets sent over a link
+// between two transports on a MemoryNetwork.
+type LinkConfig = internal.LinkConfig
+
+// LatencyDistribution describes how the jitter of a link is distributed.
+type LatencyDistribution = internal.LatencyDistribution
+
+const (
+	// LatencyUniform adds a jitter uniformly distributed between 0 and
+	// Jitter to the links latency.
+	LatencyUniform = internal.LatencyUniform
+	// LatencyNormal uses a normal distribution with a mean of the links
+	// latency and a standard deviation of Jitter.
+	LatencyNormal = internal.LatencyNormal
+)